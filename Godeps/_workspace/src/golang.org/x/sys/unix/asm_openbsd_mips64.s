@@ -1,13 +1,13 @@
-// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2019 The Go Authors. All rights reserved.
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !gccgo
+//go:build gc
 
 #include "textflag.h"
 
 //
-// System call support for AMD64, Darwin
+// System call support for mips64, OpenBSD
 //
 
 // Just jump to package syscall's implementation for all these functions.
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net"
+	"strings"
 )
 
 var privateBlocks []*net.IPNet
@@ -12,6 +13,7 @@ func setupIPBlocks() {
 		"10.0.0.0/8",
 		"172.16.0.0/12",
 		"192.168.0.0/16",
+		"fc00::/7", // IPv6 unique local addresses
 	}
 
 	privateBlocks = make([]*net.IPNet, len(privateBlockStrs))
@@ -47,7 +49,7 @@ func findPrivateAddresses() ([]*net.IP, error) {
 
 	result := make([]*net.IP, 0, len(addresses))
 
-	// Find private IPv4 address
+	// Find private IPv4 and IPv6 addresses
 	for _, rawAddr := range addresses {
 		var ip net.IP
 		switch addr := rawAddr.(type) {
@@ -59,10 +61,6 @@ func findPrivateAddresses() ([]*net.IP, error) {
 			continue
 		}
 
-		if ip.To4() == nil {
-			continue
-		}
-
 		if isPrivateIP(ip.String()) {
 			result = append(result, &ip)
 		}
@@ -78,22 +76,83 @@ func findPrivateAddresses() ([]*net.IP, error) {
 	return result, err
 }
 
-func getPublishedIP(excluded []string, advertise *string) (string, error) {
-	if advertise != nil && *advertise != "" {
-		return *advertise, nil
+// Is this address excluded? Exclusions can be single addresses or CIDR
+// ranges, and either can be IPv4 or IPv6. Ranges that don't parse are
+// skipped, see invalidExclusions().
+func isExcludedIP(ip net.IP, excluded []string) bool {
+	for _, exclude := range excluded {
+		if strings.Contains(exclude, "/") {
+			_, block, err := net.ParseCIDR(exclude)
+			if err == nil && block.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		// Single addresses match however they're written
+		if ip.Equal(net.ParseIP(exclude)) {
+			return true
+		}
 	}
 
-	addresses, _ := findPrivateAddresses()
+	return false
+}
 
-OUTER:
-	for _, address := range addresses {
-		for _, excludeIP := range excluded {
-			if address.String() == excludeIP {
-				continue OUTER
+// Returns the exclusions that aren't valid addresses or CIDR ranges, so
+// we can warn about them at startup
+func invalidExclusions(excluded []string) []string {
+	var invalid []string
+	for _, exclude := range excluded {
+		if strings.Contains(exclude, "/") {
+			if _, _, err := net.ParseCIDR(exclude); err != nil {
+				invalid = append(invalid, exclude)
 			}
+			continue
+		}
+
+		if net.ParseIP(exclude) == nil {
+			invalid = append(invalid, exclude)
+		}
+	}
+
+	return invalid
+}
+
+// Pick the address to publish from the candidates, skipping any that are
+// excluded. We take the first of the preferred family, or failing that the
+// first of the other one.
+func selectAddress(addresses []*net.IP, excluded []string, preferIPv6 bool) (string, error) {
+	var fallback string
+
+	for _, address := range addresses {
+		if isExcludedIP(*address, excluded) {
+			continue
+		}
+
+		isIPv6 := address.To4() == nil
+		if isIPv6 == preferIPv6 {
+			return address.String(), nil
+		}
+
+		if fallback == "" {
+			fallback = address.String()
 		}
-		return address.String(), nil
+	}
+
+	if fallback != "" {
+		return fallback, nil
 	}
 
 	return "", errors.New("Can't find address!")
 }
+
+func getPublishedIP(excluded []string, advertise *string, preferIPv6 bool) (string, error) {
+	if advertise != nil && *advertise != "" {
+		// Memberlist wants a bare address, not a bracketed one
+		return strings.Trim(*advertise, "[]"), nil
+	}
+
+	addresses, _ := findPrivateAddresses()
+
+	return selectAddress(addresses, excluded, preferIPv6)
+}
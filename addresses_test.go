@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -10,7 +11,7 @@ func Test_Addresses(t *testing.T) {
 	Convey("setupIPBlocks()", t, func() {
 		Convey("Sets up the right number of blocks", func() {
 			setupIPBlocks()
-			So(len(privateBlocks), ShouldEqual, 3)
+			So(len(privateBlocks), ShouldEqual, 4)
 		})
 	})
 
@@ -18,6 +19,8 @@ func Test_Addresses(t *testing.T) {
 		Convey("Can tell whether an address is private", func() {
 			So(isPrivateIP("172.16.54.3"), ShouldBeTrue)
 			So(isPrivateIP("12.1.1.1"), ShouldBeFalse)
+			So(isPrivateIP("fd00:ec2::254"), ShouldBeTrue)
+			So(isPrivateIP("2001:db8::1"), ShouldBeFalse)
 		})
 	})
 
@@ -36,18 +39,124 @@ func Test_Addresses(t *testing.T) {
 		ip := "10.10.10.10"
 
 		Convey("Returns the advertised IP if supplied", func() {
-			result, err := getPublishedIP([]string{}, &ip)
+			result, err := getPublishedIP([]string{}, &ip, false)
 			So(err, ShouldBeNil)
 			So(result, ShouldEqual, ip)
 		})
 
+		Convey("Strips the brackets from an advertised IPv6 address", func() {
+			bracketed := "[fd00::10]"
+			result, err := getPublishedIP([]string{}, &bracketed, false)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, "fd00::10")
+		})
+
 		// See caveat for findPrivateAddresses() above
 		Convey("Returns an address", func() {
 			addresses, _ := findPrivateAddresses()
-			result, err := getPublishedIP([]string{}, nil)
+			result, err := getPublishedIP([]string{}, nil, false)
 
 			So(err, ShouldBeNil)
 			So(result, ShouldResemble, addresses[0].String())
 		})
 	})
 }
+
+func Test_isExcludedIP(t *testing.T) {
+	Convey("isExcludedIP()", t, func() {
+		Convey("Matches single addresses", func() {
+			So(isExcludedIP(net.ParseIP("192.168.168.168"), []string{"192.168.168.168"}), ShouldBeTrue)
+			So(isExcludedIP(net.ParseIP("192.168.168.169"), []string{"192.168.168.168"}), ShouldBeFalse)
+		})
+
+		Convey("Matches IPv6 addresses however they're written", func() {
+			So(isExcludedIP(net.ParseIP("fd00::1"), []string{"fd00:0:0:0:0:0:0:1"}), ShouldBeTrue)
+		})
+
+		Convey("Matches IPv4 CIDR ranges", func() {
+			excluded := []string{"172.17.0.0/16"}
+			So(isExcludedIP(net.ParseIP("172.17.0.1"), excluded), ShouldBeTrue)
+			So(isExcludedIP(net.ParseIP("172.18.0.1"), excluded), ShouldBeFalse)
+		})
+
+		Convey("Matches IPv6 CIDR ranges", func() {
+			excluded := []string{"fd00:dead::/32"}
+			So(isExcludedIP(net.ParseIP("fd00:dead:beef::1"), excluded), ShouldBeTrue)
+			So(isExcludedIP(net.ParseIP("fd00:beef::1"), excluded), ShouldBeFalse)
+		})
+
+		Convey("Matches overlapping ranges", func() {
+			excluded := []string{"172.16.0.0/12", "172.17.0.0/16", "172.17.0.5"}
+			So(isExcludedIP(net.ParseIP("172.17.0.5"), excluded), ShouldBeTrue)
+			So(isExcludedIP(net.ParseIP("172.20.0.5"), excluded), ShouldBeTrue)
+			So(isExcludedIP(net.ParseIP("172.32.0.5"), excluded), ShouldBeFalse)
+		})
+
+		Convey("Skips exclusions it can't parse", func() {
+			So(isExcludedIP(net.ParseIP("10.0.0.1"), []string{"10.0.0.0/99", "junk"}), ShouldBeFalse)
+		})
+
+		Convey("Still honors valid exclusions next to malformed ones", func() {
+			excluded := []string{"169.254.0.0/abc", "169.254.0.0/16", "10.0.0.0.0/8"}
+			So(isExcludedIP(net.ParseIP("169.254.1.1"), excluded), ShouldBeTrue)
+			So(isExcludedIP(net.ParseIP("10.0.0.1"), excluded), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_invalidExclusions(t *testing.T) {
+	Convey("invalidExclusions()", t, func() {
+		Convey("Returns nothing when everything is valid", func() {
+			So(invalidExclusions([]string{"10.0.0.1", "172.17.0.0/16", "fd00::/8"}), ShouldBeEmpty)
+		})
+
+		Convey("Returns the entries that don't parse", func() {
+			invalid := invalidExclusions([]string{"10.0.0.1", "10.0.0.0/33", "bogus", "172.17.0.0/16", "fd00::/129"})
+			So(invalid, ShouldResemble, []string{"10.0.0.0/33", "bogus", "fd00::/129"})
+		})
+	})
+}
+
+func Test_selectAddress(t *testing.T) {
+	Convey("selectAddress()", t, func() {
+		addrs := func(strs ...string) []*net.IP {
+			result := make([]*net.IP, 0, len(strs))
+			for _, str := range strs {
+				ip := net.ParseIP(str)
+				result = append(result, &ip)
+			}
+			return result
+		}
+
+		addresses := addrs("fd00::10", "10.0.0.5", "fd00::11", "10.0.0.6")
+
+		Convey("Prefers IPv4 by default", func() {
+			result, err := selectAddress(addresses, []string{}, false)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, "10.0.0.5")
+		})
+
+		Convey("Prefers IPv6 when asked", func() {
+			result, err := selectAddress(addresses, []string{}, true)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, "fd00::10")
+		})
+
+		Convey("Skips excluded ranges", func() {
+			result, err := selectAddress(addresses, []string{"10.0.0.5/32", "fd00::10/128"}, true)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, "fd00::11")
+		})
+
+		Convey("Falls back to the other family", func() {
+			result, err := selectAddress(addresses, []string{"10.0.0.0/8"}, false)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, "fd00::10")
+		})
+
+		Convey("Returns an error when everything is excluded", func() {
+			_, err := selectAddress(addresses, []string{"10.0.0.0/8", "fd00::/8"}, false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
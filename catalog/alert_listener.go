@@ -0,0 +1,199 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
+	"github.com/newrelic/sidecar/service"
+)
+
+const (
+	DEFAULT_ALERT_DEDUP = 5 * time.Minute // Don't alert about the same service more often than this
+	ALERT_QUEUE_LENGTH  = 50
+
+	ALERT_DOWN = "down"
+	ALERT_UP   = "up"
+)
+
+// What we post to the webhook. The text is what Slack shows, the rest is
+// for anything else that wants to read it.
+type Alert struct {
+	Text     string    `json:"text"`
+	Service  string    `json:"service"`
+	Hostname string    `json:"hostname"` // The node whose change set off the alert
+	Event    string    `json:"event"`    // ALERT_DOWN or ALERT_UP
+	Time     time.Time `json:"time"`
+}
+
+// An AlertListener posts to a webhook when a service loses its last healthy
+// instance, and again when one comes back. Unlike the UrlListener, it
+// doesn't send anything for the changes in between.
+type AlertListener struct {
+	Url         string
+	Retries     int           // How many times we retry a failed post
+	RetryDelay  time.Duration // The first backoff, which doubles on each retry
+	DedupWindow time.Duration // Only one outage per service is alerted in this window
+	Client      *http.Client
+
+	healthy      map[string]bool      // Did the service have a healthy instance last we looked?
+	alerted      map[string]bool      // Have we told them it's down, and not that it's back?
+	lastAlert    map[string]time.Time // When we last said it was down
+	eventChannel chan ChangeEvent
+	alerts       chan Alert
+	sync.Mutex
+}
+
+func NewAlertListener(url string) *AlertListener {
+	return &AlertListener{
+		Url:          url,
+		Retries:      DEFAULT_RETRIES,
+		RetryDelay:   DEFAULT_RETRY_DELAY,
+		DedupWindow:  DEFAULT_ALERT_DEDUP,
+		Client:       &http.Client{Timeout: CLIENT_TIMEOUT},
+		healthy:      make(map[string]bool),
+		alerted:      make(map[string]bool),
+		lastAlert:    make(map[string]time.Time),
+		eventChannel: make(chan ChangeEvent, 100),
+		alerts:       make(chan Alert, ALERT_QUEUE_LENGTH),
+	}
+}
+
+// How many healthy instances of the service are in the state
+func healthyCount(state *ServicesState, name string) int {
+	count := 0
+	state.EachService(func(hostname *string, id *string, svc *service.Service) {
+		if svc.IsAlive() && state.ServiceName(svc) == name {
+			count++
+		}
+	})
+	return count
+}
+
+// Work out whether a change in the state is an edge we alert on. Returns
+// nil when it isn't, or when it's been deduplicated.
+func (a *AlertListener) check(state *ServicesState, event ChangeEvent, now time.Time) *Alert {
+	name := state.ServiceName(&event.Service)
+	isHealthy := healthyCount(state, name) > 0
+
+	a.Lock()
+	defer a.Unlock()
+
+	wasHealthy, seen := a.healthy[name]
+	a.healthy[name] = isHealthy
+
+	switch {
+	case wasHealthy && !isHealthy:
+		if now.Sub(a.lastAlert[name]) < a.DedupWindow {
+			log.Debugf("Not alerting that %s is down again, it was already down at %s",
+				name, a.lastAlert[name])
+			metrics.IncrCounter([]string{"alert_listener", "deduplicated"}, 1)
+			return nil
+		}
+
+		a.alerted[name] = true
+		a.lastAlert[name] = now
+		return &Alert{
+			Text:     fmt.Sprintf(":red_circle: %s has no healthy instances, the last one went away on %s", name, event.Hostname),
+			Service:  name,
+			Hostname: event.Hostname,
+			Event:    ALERT_DOWN,
+			Time:     now,
+		}
+
+	case seen && !wasHealthy && isHealthy:
+		// Only say it's back if we said it was gone. New services start
+		// out unhealthy, and deduplicated outages were never reported.
+		if !a.alerted[name] {
+			return nil
+		}
+
+		a.alerted[name] = false
+		return &Alert{
+			Text:     fmt.Sprintf(":large_green_circle: %s is back, with a healthy instance on %s", name, event.Hostname),
+			Service:  name,
+			Hostname: event.Hostname,
+			Event:    ALERT_UP,
+			Time:     now,
+		}
+	}
+
+	return nil
+}
+
+// Post an alert to the Url
+func (a *AlertListener) post(alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.Client.Post(a.Url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return fmt.Errorf("Bad status code returned (%d)", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Watch for services changing and post alerts. Working out the alerts is
+// quick, so we don't miss events, and the posts are made one at a time in
+// another goroutine so they arrive in order.
+func (a *AlertListener) Watch(state *ServicesState) {
+	// Start from what's healthy now, so we don't alert on the first change
+	a.Lock()
+	for name, services := range state.ByService() {
+		for _, svc := range services {
+			if svc.IsAlive() {
+				a.healthy[name] = true
+			}
+		}
+	}
+	a.Unlock()
+
+	state.AddServiceListener(a.eventChannel)
+
+	go func() {
+		for event := range a.eventChannel {
+			alert := a.check(state, event, time.Now().UTC())
+			if alert == nil {
+				continue
+			}
+
+			select {
+			case a.alerts <- *alert:
+			default:
+				log.Warnf("Alert queue for '%s' is full, dropping alert: %s", a.Url, alert.Text)
+				metrics.IncrCounter([]string{"alert_listener", "failed"}, 1)
+			}
+		}
+	}()
+
+	go func() {
+		for alert := range a.alerts {
+			log.WithField("event", "alert").Warn(alert.Text)
+
+			err := withRetries(a.Retries, a.RetryDelay, func() error {
+				return a.post(&alert)
+			})
+
+			if err != nil {
+				log.Warnf("Failed posting alert to '%s', dropping it: %s", a.Url, err.Error())
+				metrics.IncrCounter([]string{"alert_listener", "failed"}, 1)
+				continue
+			}
+
+			metrics.IncrCounter([]string{"alert_listener", "delivered"}, 1)
+		}
+	}()
+}
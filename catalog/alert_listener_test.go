@@ -0,0 +1,128 @@
+package catalog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_AlertListener(t *testing.T) {
+	Convey("Alerting on the last healthy instance", t, func() {
+		state := NewServicesState()
+		state.Hostname = "grendel"
+		now := time.Now().UTC()
+
+		alerter := NewAlertListener("http://beowulf.example.com")
+
+		web1 := service.Service{ID: "deadbeef123", Image: "web", Hostname: "grendel", Status: service.ALIVE, Updated: now}
+		web2 := service.Service{ID: "deadbeef456", Image: "web", Hostname: "heorot", Status: service.ALIVE, Updated: now}
+		state.AddServiceEntry(web1)
+		state.AddServiceEntry(web2)
+		alerter.healthy["web"] = true
+
+		// Change a service's status and check for an alert the way Watch() would
+		change := func(svc service.Service, status int, at time.Time) *Alert {
+			svc.Status = status
+			svc.Updated = at
+			state.AddServiceEntry(svc)
+			return alerter.check(state, ChangeEvent{Hostname: svc.Hostname, Service: svc}, at)
+		}
+
+		Convey("NewAlertListener() configures the defaults", func() {
+			So(alerter.DedupWindow, ShouldEqual, DEFAULT_ALERT_DEDUP)
+			So(alerter.Retries, ShouldEqual, DEFAULT_RETRIES)
+			So(alerter.Client, ShouldNotBeNil)
+		})
+
+		Convey("Doesn't alert while an instance is still healthy", func() {
+			So(change(web1, service.UNHEALTHY, now.Add(time.Second)), ShouldBeNil)
+		})
+
+		Convey("Alerts when the last healthy instance goes", func() {
+			change(web1, service.UNHEALTHY, now.Add(time.Second))
+			alert := change(web2, service.UNHEALTHY, now.Add(2*time.Second))
+
+			So(alert, ShouldNotBeNil)
+			So(alert.Event, ShouldEqual, ALERT_DOWN)
+			So(alert.Service, ShouldEqual, "web")
+			So(alert.Hostname, ShouldEqual, "heorot")
+			So(alert.Text, ShouldContainSubstring, "web has no healthy instances")
+			So(alert.Text, ShouldContainSubstring, "heorot")
+
+			Convey("And when the first one comes back", func() {
+				alert := change(web1, service.ALIVE, now.Add(3*time.Second))
+
+				So(alert, ShouldNotBeNil)
+				So(alert.Event, ShouldEqual, ALERT_UP)
+				So(alert.Hostname, ShouldEqual, "grendel")
+				So(alert.Text, ShouldContainSubstring, "web is back")
+
+				So(change(web2, service.ALIVE, now.Add(4*time.Second)), ShouldBeNil)
+			})
+
+			Convey("Doesn't repeat itself when it flaps inside the window", func() {
+				So(change(web1, service.ALIVE, now.Add(3*time.Second)), ShouldNotBeNil)
+				So(change(web1, service.UNHEALTHY, now.Add(4*time.Second)), ShouldBeNil)
+				So(change(web1, service.ALIVE, now.Add(5*time.Second)), ShouldBeNil)
+			})
+
+			Convey("Alerts again once the window is over", func() {
+				later := now.Add(DEFAULT_ALERT_DEDUP + 3*time.Second)
+				change(web1, service.ALIVE, later)
+
+				alert := change(web1, service.UNHEALTHY, later.Add(time.Second))
+				So(alert, ShouldNotBeNil)
+				So(alert.Event, ShouldEqual, ALERT_DOWN)
+			})
+		})
+
+		Convey("Doesn't alert for new services coming up", func() {
+			api := service.Service{ID: "deadbeef789", Image: "api", Hostname: "grendel", Updated: now}
+			So(change(api, service.UNKNOWN, now.Add(time.Second)), ShouldBeNil)
+			So(change(api, service.ALIVE, now.Add(2*time.Second)), ShouldBeNil)
+		})
+	})
+}
+
+func Test_AlertDelivery(t *testing.T) {
+	Convey("Delivering alerts to a webhook", t, func() {
+		posts := make(chan Alert, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			var alert Alert
+			json.Unmarshal(body, &alert)
+			posts <- alert
+		}))
+		defer server.Close()
+
+		now := time.Now().UTC()
+		state := NewServicesState()
+		state.Hostname = "grendel"
+		svc := service.Service{ID: "deadbeef123", Image: "web", Hostname: "grendel", Status: service.ALIVE, Updated: now}
+		state.AddServiceEntry(svc)
+
+		alerter := NewAlertListener(server.URL)
+		alerter.Watch(state)
+
+		svc.Status = service.UNHEALTHY
+		svc.Updated = now.Add(time.Second)
+		state.AddServiceEntry(svc)
+
+		select {
+		case alert := <-posts:
+			So(alert.Event, ShouldEqual, ALERT_DOWN)
+			So(alert.Service, ShouldEqual, "web")
+			So(alert.Hostname, ShouldEqual, "grendel")
+			So(alert.Text, ShouldNotBeEmpty)
+		case <-time.After(time.Second):
+			So("the alert was never posted", ShouldBeEmpty)
+		}
+	})
+}
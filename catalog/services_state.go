@@ -4,16 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path"
 	"regexp"
+	"sort"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/armon/go-metrics"
-	"github.com/nitro/memberlist"
-	"github.com/relistan/go-director"
 	"github.com/newrelic/sidecar/output"
 	"github.com/newrelic/sidecar/service"
+	"github.com/nitro/memberlist"
+	"github.com/relistan/go-director"
 )
 
 // catalog handles all of the eventual-consistency mechanisms for
@@ -31,12 +33,29 @@ const (
 	ALIVE_BROADCAST_INTERVAL = 1 * time.Minute                // Broadcast Alive messages every minute
 )
 
+const (
+	NEW_SERVICE          = -1            // The PreviousStatus of a service we hadn't seen before
+	MAINTENANCE_METADATA = "maintenance" // Metadata that puts a service in maintenance when "true"
+)
+
+// What adding a service entry did to the state
+const (
+	ENTRY_UNCHANGED = iota
+	ENTRY_ADDED
+	ENTRY_UPDATED
+)
+
 // A ChangeEvent represents the time and hostname that was modified and signals a major
 // state change event. It is passed to listeners over the listeners channel in the
-// state object.
+// state object. Service listeners get one for each service that changes, which
+// also carries that service and its status before the change. Removed is set
+// when a service is dropped from the state entirely.
 type ChangeEvent struct {
-	Hostname string
-	Time     time.Time
+	Hostname       string
+	Time           time.Time
+	Service        service.Service
+	PreviousStatus int
+	Removed        bool
 }
 
 // Holds the state about one server in our cluster
@@ -65,10 +84,23 @@ type ServicesState struct {
 	Hostname            string
 	Broadcasts          chan [][]byte
 	ServiceNameMatch    *regexp.Regexp // How we match service names
+	ServiceNameRewrite  *regexp.Regexp // Optionally rewrites the matched names...
+	ServiceNameReplace  string         // ...using this replacement template
+	ServiceInclude      []string       // Only manage services with these names, if set
+	ServiceExclude      []string       // Never manage these, even if they're included
+	MaxTombstones       int            // Most tombstones per broadcast, zero for no limit
+	AliveLifespan       time.Duration  // Down if not heard from in this long
+	LeaveDrainGrace     time.Duration  // Drain the services of servers that leave for this long
 	LastChanged         time.Time
 	listeners           []chan ChangeEvent
+	serviceListeners    []chan ChangeEvent
 	listenerLock        sync.Mutex
+	serversLock         sync.RWMutex // Held while reading or changing Servers
 	tombstoneRetransmit time.Duration
+	draining            bool              // Held down by the embedded Mutex
+	maintenance         map[string]bool   // Local service IDs in maintenance, also held by the Mutex
+	pendingTombstones   []service.Service // Only used by BroadcastTombstones
+	lastDrainCheck      time.Time         // Only used by TombstoneOthersServices
 	sync.Mutex
 }
 
@@ -84,6 +116,8 @@ func NewServicesState() *ServicesState {
 		log.Errorf("Error getting hostname! %s", err.Error())
 	}
 	state.tombstoneRetransmit = TOMBSTONE_RETRANSMIT
+	state.AliveLifespan = ALIVE_LIFESPAN
+	state.maintenance = make(map[string]bool)
 	return &state
 }
 
@@ -96,7 +130,34 @@ func (server *Server) HasService(id string) bool {
 // Return a Marshaled/Encoded byte array that can be deocoded with
 // catalog.Decode()
 func (state *ServicesState) Encode() []byte {
+	state.serversLock.RLock()
 	jsonData, err := json.Marshal(state.Servers)
+	state.serversLock.RUnlock()
+	if err != nil {
+		log.Error("ERROR: Failed to Marshal state")
+		return []byte{}
+	}
+
+	return jsonData
+}
+
+// Like Encode(), but leaves out the local-only services, for sending the
+// state to the rest of the cluster
+func (state *ServicesState) EncodeShared() []byte {
+	state.serversLock.RLock()
+	servers := make(map[string]*Server, len(state.Servers))
+	for hostname, server := range state.Servers {
+		shared := *server
+		shared.Services = make(map[string]*service.Service, len(server.Services))
+		for id, svc := range server.Services {
+			if !svc.IsLocalOnly() {
+				shared.Services[id] = svc
+			}
+		}
+		servers[hostname] = &shared
+	}
+	jsonData, err := json.Marshal(servers)
+	state.serversLock.RUnlock()
 	if err != nil {
 		log.Error("ERROR: Failed to Marshal state")
 		return []byte{}
@@ -108,13 +169,23 @@ func (state *ServicesState) Encode() []byte {
 // Shortcut for checking if the Servers map has an entry for this
 // hostname.
 func (state *ServicesState) HasServer(hostname string) bool {
+	state.serversLock.RLock()
+	defer state.serversLock.RUnlock()
+	return state.hasServer(hostname)
+}
+
+// Same as HasServer(), for when the serversLock is already held
+func (state *ServicesState) hasServer(hostname string) bool {
 	_, ok := state.Servers[hostname]
 	return ok
 }
 
 // Looks up a service from *only this host* by ID
 func (state *ServicesState) GetLocalService(id string) *service.Service {
-	if !state.HasServer(state.Hostname) {
+	state.serversLock.RLock()
+	defer state.serversLock.RUnlock()
+
+	if !state.hasServer(state.Hostname) {
 		// This can happen a lot on startup, so we're not logging it
 		return nil
 	}
@@ -131,32 +202,103 @@ func (state *ServicesState) GetLocalService(id string) *service.Service {
 
 // A server has left the cluster, so tombstone all of its records
 func (state *ServicesState) ExpireServer(hostname string) {
-	if !state.HasServer(hostname) {
+	state.serversLock.Lock()
+	if !state.hasServer(hostname) {
+		state.serversLock.Unlock()
 		log.Infof("No records to expire for %s", hostname)
 		return
 	}
 
-	log.Infof("Expiring %s", hostname)
+	log.WithFields(log.Fields{"node": hostname, "event": "expire_server"}).
+		Infof("Expiring %s", hostname)
 
 	tombstones := make([]service.Service, 0, len(state.Servers[hostname].Services))
 
 	for _, svc := range state.Servers[hostname].Services {
+		previousStatus := svc.Status
 		svc.Tombstone()
+		state.addLeaveDrain(svc)
 		tombstones = append(tombstones, *svc)
+		state.ServiceChanged(svc, previousStatus)
 	}
+	state.serversLock.Unlock()
 
 	state.SendServices(
 		tombstones,
 		director.NewTimedLooper(TOMBSTONE_COUNT, state.tombstoneRetransmit, nil),
 	)
+
+	state.serversLock.Lock()
 	state.ServerChanged(hostname, time.Now().UTC())
+	state.serversLock.Unlock()
+}
+
+// Give a tombstone from a server that left the leave drain grace, unless the
+// service asked for a longer one itself. It goes in the metadata, so peers
+// that hear about the tombstone drain it for just as long.
+func (state *ServicesState) addLeaveDrain(svc *service.Service) {
+	if state.LeaveDrainGrace <= svc.DrainGrace() {
+		return
+	}
+
+	metadata := make(map[string]string, len(svc.Metadata)+1)
+	for key, value := range svc.Metadata {
+		metadata[key] = value
+	}
+	metadata[service.DRAIN_GRACE_METADATA] = state.LeaveDrainGrace.String()
+	svc.Metadata = metadata
+}
+
+// Tombstone a single service, wherever it runs, and tell the cluster. This
+// is for clearing out entries that are stuck because a tombstone got lost.
+// If the service is really still around, its host will announce it again.
+// Returns the tombstoned service, or nil if we don't know about it.
+func (state *ServicesState) ExpireService(id string) *service.Service {
+	state.serversLock.Lock()
+
+	var svc *service.Service
+	for _, server := range state.Servers {
+		if found, ok := server.Services[id]; ok {
+			svc = found
+			break
+		}
+	}
+
+	if svc == nil {
+		state.serversLock.Unlock()
+		return nil
+	}
+
+	log.WithFields(state.logFields(svc, "force_expire")).Warnf("Force expiring %s", svc.ID)
+
+	previousStatus := svc.Status
+	lastUpdated := svc.Updated
+	svc.Tombstone()
+	// It has to be newer than what we have, even if its host's clock is ahead
+	if !svc.Updated.After(lastUpdated) {
+		svc.Updated = lastUpdated.Add(time.Second)
+	}
+	state.ServiceChanged(svc, previousStatus)
+	tombstone := *svc
+	state.serversLock.Unlock()
+
+	state.SendServices(
+		[]service.Service{tombstone},
+		director.NewTimedLooper(TOMBSTONE_COUNT, state.tombstoneRetransmit, nil),
+	)
+
+	state.serversLock.Lock()
+	state.ServerChanged(tombstone.Hostname, time.Now().UTC())
+	state.serversLock.Unlock()
+
+	return &tombstone
 }
 
 // Tell the state that something changed on a particular server so that it
 // can keep the timestamps up to date. This is how we know something has
-// transitioned state.
+// transitioned state. Must be called with the serversLock held.
 func (state *ServicesState) ServerChanged(hostname string, updated time.Time) {
-	if !state.HasServer(hostname) {
+	if !state.hasServer(hostname) {
 		log.Errorf("Attempt to change a server we don't have! (%s)", hostname)
 		return
 	}
@@ -171,10 +313,25 @@ func (state *ServicesState) ServerChanged(hostname string, updated time.Time) {
 	state.NotifyListeners(hostname, state.LastChanged)
 }
 
+// Tell the service listeners that a single service changed, and what its
+// status was before. This doesn't touch any timestamps, that's still up to
+// ServerChanged().
+func (state *ServicesState) ServiceChanged(svc *service.Service, previousStatus int) {
+	state.notifyServiceListeners(ChangeEvent{
+		Hostname:       svc.Hostname,
+		Time:           svc.Updated,
+		Service:        *svc,
+		PreviousStatus: previousStatus,
+	})
+}
+
 // Tell all of our listeners that something changed for a host at
 // set timestamp. See AddListener() for information about how channels
 // must be configured.
 func (state *ServicesState) NotifyListeners(hostname string, changedTime time.Time) {
+	state.listenerLock.Lock()
+	defer state.listenerLock.Unlock()
+
 	if len(state.listeners) < 1 {
 		log.Debugf("Skipping listeners, there are none")
 		return
@@ -183,7 +340,6 @@ func (state *ServicesState) NotifyListeners(hostname string, changedTime time.Ti
 	log.Infof("Notifying listeners of change at %s", changedTime.String())
 
 	event := ChangeEvent{Hostname: hostname, Time: changedTime}
-	state.listenerLock.Lock()
 	for _, listener := range state.listeners {
 		select {
 		case listener <- event:
@@ -192,7 +348,20 @@ func (state *ServicesState) NotifyListeners(hostname string, changedTime time.Ti
 			log.Error("NotifyListeners(): Can't send to listener!")
 		}
 	}
-	state.listenerLock.Unlock()
+}
+
+func (state *ServicesState) notifyServiceListeners(event ChangeEvent) {
+	state.listenerLock.Lock()
+	defer state.listenerLock.Unlock()
+
+	for _, listener := range state.serviceListeners {
+		select {
+		case listener <- event:
+			continue
+		default:
+			log.Error("notifyServiceListeners(): Can't send to listener!")
+		}
+	}
 }
 
 // Add an event listener channel to the list that will be notified on
@@ -205,13 +374,49 @@ func (state *ServicesState) AddListener(listener chan ChangeEvent) {
 	log.Debugf("AddListener(): new count %d", len(state.listeners))
 }
 
+// Add a listener that gets an event for every service that changes, rather
+// than one per major state change. Same rules as AddListener().
+func (state *ServicesState) AddServiceListener(listener chan ChangeEvent) {
+	state.listenerLock.Lock()
+	state.serviceListeners = append(state.serviceListeners, listener)
+	state.listenerLock.Unlock()
+	log.Debugf("AddServiceListener(): new count %d", len(state.serviceListeners))
+}
+
+// Stop sending events to a listener added with AddServiceListener().
+func (state *ServicesState) RemoveServiceListener(listener chan ChangeEvent) {
+	state.listenerLock.Lock()
+	for i, existing := range state.serviceListeners {
+		if existing == listener {
+			state.serviceListeners = append(state.serviceListeners[:i], state.serviceListeners[i+1:]...)
+			break
+		}
+	}
+	state.listenerLock.Unlock()
+	log.Debugf("RemoveServiceListener(): new count %d", len(state.serviceListeners))
+}
+
 // Take a service and merge it into our state. Correctly handle
 // timestamps so we only add things newer than what we already
 // know about. Retransmits updates to cluster peers.
 func (state *ServicesState) AddServiceEntry(entry service.Service) {
+	state.addServiceEntry(entry)
+}
+
+// Does the work for AddServiceEntry(), and says what it did: whether the
+// entry was new, an update, or ignored, and the status it replaced.
+func (state *ServicesState) addServiceEntry(entry service.Service) (int, int) {
 	defer metrics.MeasureSince([]string{"services_state", "AddServiceEntry"}, time.Now())
 
-	if !state.HasServer(entry.Hostname) {
+	if !state.Manages(&entry) {
+		log.Debugf("Ignoring %s (id: %s), we don't manage it", state.ServiceName(&entry), entry.ID)
+		return ENTRY_UNCHANGED, NEW_SERVICE
+	}
+
+	state.serversLock.Lock()
+	defer state.serversLock.Unlock()
+
+	if !state.hasServer(entry.Hostname) {
 		state.Servers[entry.Hostname] = NewServer(entry.Hostname)
 	}
 
@@ -220,29 +425,55 @@ func (state *ServicesState) AddServiceEntry(entry service.Service) {
 	if !server.HasService(entry.ID) {
 		server.Services[entry.ID] = &entry
 		state.ServerChanged(entry.Hostname, entry.Updated)
+		state.ServiceChanged(&entry, NEW_SERVICE)
 		state.retransmit(entry)
+		return ENTRY_ADDED, NEW_SERVICE
 	} else if entry.Invalidates(server.Services[entry.ID]) {
 		server.LastUpdated = entry.Updated
-		if server.Services[entry.ID].Status != entry.Status {
+		previousStatus := server.Services[entry.ID].Status
+		server.Services[entry.ID] = &entry
+		if previousStatus != entry.Status {
 			state.ServerChanged(entry.Hostname, entry.Updated)
+			state.ServiceChanged(&entry, previousStatus)
 		}
-		server.Services[entry.ID] = &entry
 		// We tell our gossip peers about the updated service
 		// by sending them the record. We're saved from an endless
 		// retransmit loop by the Invalidates() call above.
 		state.retransmit(entry)
-		return
+		return ENTRY_UPDATED, previousStatus
 	}
+
+	return ENTRY_UNCHANGED, server.Services[entry.ID].Status
+}
+
+// What a Merge() changed in our state
+type MergeResult struct {
+	Added   int // Services we didn't know about
+	Updated int // Newer records for services we did know about
+	Removed int // Services that were tombstoned since we last heard
 }
 
 // Merge a complete state struct into this one. Usually used on
 // node startup and during anti-entropy operations.
-func (state *ServicesState) Merge(otherState *ServicesState) {
+func (state *ServicesState) Merge(otherState *ServicesState) MergeResult {
+	var result MergeResult
+
 	for _, server := range otherState.Servers {
-		for _, service := range server.Services {
-			state.AddServiceEntry(*service)
+		for _, svc := range server.Services {
+			change, previousStatus := state.addServiceEntry(*svc)
+
+			switch {
+			case change == ENTRY_ADDED && !svc.IsTombstone():
+				result.Added++
+			case change == ENTRY_UPDATED && svc.IsTombstone() && previousStatus != service.TOMBSTONE:
+				result.Removed++
+			case change == ENTRY_UPDATED:
+				result.Updated++
+			}
 		}
 	}
+
+	return result
 }
 
 // Take a service we already handled, and drop it back into the
@@ -272,6 +503,7 @@ func (state *ServicesState) Format(list *memberlist.Memberlist) string {
 	refTime := time.Now().UTC()
 
 	outStr += "Services ------------------------------\n"
+	state.serversLock.RLock()
 	for hostname, server := range state.Servers {
 		outStr += fmt.Sprintf("  %s: (%s)\n", hostname, output.TimeAgo(server.LastUpdated, refTime))
 		for _, service := range server.Services {
@@ -279,6 +511,7 @@ func (state *ServicesState) Format(list *memberlist.Memberlist) string {
 		}
 		outStr += "\n"
 	}
+	state.serversLock.RUnlock()
 
 	// Don't show member list
 	if list == nil {
@@ -311,11 +544,94 @@ func (state *ServicesState) TrackNewServices(fn func() []service.Service, looper
 	})
 }
 
+// Put this node into maintenance, or take it back out. While draining we
+// stay in the cluster, but all our services are announced as unhealthy so
+// everyone else routes around us.
+func (state *ServicesState) SetDraining(draining bool) {
+	state.Lock()
+	state.draining = draining
+	state.Unlock()
+}
+
+func (state *ServicesState) IsDraining() bool {
+	state.Lock()
+	defer state.Unlock()
+
+	return state.draining
+}
+
+// Wraps a function returning our local services so that they all come back
+// unhealthy while we're draining. This sits in front of the health checks
+// so a passing check can't undo the drain.
+func (state *ServicesState) DrainableServices(fn func() []service.Service) func() []service.Service {
+	return func() []service.Service {
+		services := fn()
+		if !state.IsDraining() {
+			return services
+		}
+
+		drained := make([]service.Service, 0, len(services))
+		for _, svc := range services {
+			if !svc.IsTombstone() {
+				svc.Status = service.UNHEALTHY
+			}
+			drained = append(drained, svc)
+		}
+		return drained
+	}
+}
+
+// Put one of our services into maintenance, or take it back out. While it's
+// in maintenance it's announced with the MAINTENANCE status, so it stays in
+// the catalog but isn't routed to, without looking like it's failing.
+func (state *ServicesState) SetMaintenance(id string, maintenance bool) {
+	state.Lock()
+	defer state.Unlock()
+
+	if maintenance {
+		state.maintenance[id] = true
+	} else {
+		delete(state.maintenance, id)
+	}
+}
+
+func (state *ServicesState) InMaintenance(id string) bool {
+	state.Lock()
+	defer state.Unlock()
+
+	return state.maintenance[id]
+}
+
+// Wraps a function returning our local services so that the ones in
+// maintenance come back that way, whatever their health checks say.
+// Services can be put in maintenance with SetMaintenance(), or by
+// discovery with "maintenance" metadata set to "true". This sits in front
+// of draining, so a drained node still shows which services were in
+// maintenance.
+func (state *ServicesState) MaintainableServices(fn func() []service.Service) func() []service.Service {
+	return func() []service.Service {
+		services := fn()
+
+		maintained := make([]service.Service, 0, len(services))
+		for _, svc := range services {
+			wanted := svc.Metadata[MAINTENANCE_METADATA] == "true" || state.InMaintenance(svc.ID)
+			if wanted && !svc.IsTombstone() {
+				svc.Status = service.MAINTENANCE
+			}
+			maintained = append(maintained, svc)
+		}
+		return maintained
+	}
+}
+
 // Do we know about this service already? If we do, is it a tombstone?
 func (state *ServicesState) IsNewService(svc *service.Service) bool {
 	var found *service.Service
 
-	if state.HasServer(svc.Hostname) {
+	state.serversLock.RLock()
+	defer state.serversLock.RUnlock()
+
+	if state.hasServer(svc.Hostname) {
 		found = state.Servers[svc.Hostname].Services[svc.ID]
 	}
 
@@ -336,7 +652,7 @@ func (state *ServicesState) BroadcastServices(fn func() []service.Service, loope
 		var services []service.Service
 		haveNewServices := false
 
-		servicesList := fn()
+		servicesList := sharedServices(fn())
 
 		for _, svc := range servicesList {
 			isNew := state.IsNewService(&svc)
@@ -346,7 +662,7 @@ func (state *ServicesState) BroadcastServices(fn func() []service.Service, loope
 				log.Debug("Found service changes in BroadcastServices()")
 				haveNewServices = true
 				services = append(services, svc)
-			// Check that refresh window... is it time?
+				// Check that refresh window... is it time?
 			} else if time.Now().UTC().Add(0 - ALIVE_BROADCAST_INTERVAL).After(lastTime) {
 				services = append(services, svc)
 			}
@@ -415,7 +731,7 @@ func (state *ServicesState) BroadcastTombstones(fn func() []service.Service, loo
 		otherTombstones := state.TombstoneOthersServices()
 		tombstones := state.TombstoneServices(state.Hostname, containerList)
 
-		tombstones = append(tombstones, otherTombstones...)
+		tombstones = state.nextTombstones(sharedServices(append(tombstones, otherTombstones...)))
 
 		if tombstones != nil && len(tombstones) > 0 {
 			state.SendServices(
@@ -432,30 +748,92 @@ func (state *ServicesState) BroadcastTombstones(fn func() []service.Service, loo
 	})
 }
 
+// Drops the local-only services, which are never broadcast
+func sharedServices(services []service.Service) []service.Service {
+	shared := make([]service.Service, 0, len(services))
+	for _, svc := range services {
+		if !svc.IsLocalOnly() {
+			shared = append(shared, svc)
+		}
+	}
+	return shared
+}
+
+// Queue up new tombstones behind the ones we haven't sent yet, and return
+// the ones to send now. When lots of services go away at once, this stops
+// the tombstones crowding everything else out of the gossip. The oldest go
+// first so nothing waits forever.
+func (state *ServicesState) nextTombstones(tombstones []service.Service) []service.Service {
+	pending := append(state.pendingTombstones, tombstones...)
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Updated.Before(pending[j].Updated)
+	})
+
+	state.pendingTombstones = nil
+	if state.MaxTombstones > 0 && len(pending) > state.MaxTombstones {
+		state.pendingTombstones = append([]service.Service{}, pending[state.MaxTombstones:]...)
+		pending = pending[:state.MaxTombstones]
+	}
+
+	metrics.SetGauge([]string{"services_state", "pending_tombstones"}, float32(len(state.pendingTombstones)))
+
+	return pending
+}
+
 func (state *ServicesState) TombstoneOthersServices() []service.Service {
 	metrics.MeasureSince([]string{"services_state", "TombstoneOthersServices"}, time.Now())
 
 	result := make([]service.Service, 0, 1)
+	now := time.Now().UTC()
+	drained := make(map[string]bool)
+
+	state.serversLock.Lock()
+	defer state.serversLock.Unlock()
 
 	// Manage tombstone life so we don't keep them forever. We have to do this
 	// even for hosts that aren't running services now, because they might have
 	// been. Make sure we don't keep alive services around for very much
 	// time at all.
-	state.EachService(func(hostname *string, id *string, svc *service.Service) {
+	state.eachService(func(hostname *string, id *string, svc *service.Service) {
+		// A drain grace longer than the lifespan keeps the tombstone, so
+		// the proxy still sees it
+		lifespan := TOMBSTONE_LIFESPAN
+		grace := svc.DrainGrace()
+		if grace > lifespan {
+			lifespan = grace
+		}
+
 		if svc.IsTombstone() &&
-			svc.Updated.Before(time.Now().UTC().Add(0-TOMBSTONE_LIFESPAN)) {
+			svc.Updated.Before(now.Add(0-lifespan)) {
 			delete(state.Servers[*hostname].Services, *id)
 			// If this is the last service, remove the server
 			if len(state.Servers[*hostname].Services) < 1 {
 				delete(state.Servers, *hostname)
 			}
+			state.notifyServiceListeners(ChangeEvent{
+				Hostname:       *hostname,
+				Time:           time.Now().UTC(),
+				Service:        *svc,
+				PreviousStatus: svc.Status,
+				Removed:        true,
+			})
+			return
+		}
+
+		// Nothing else changes when a drain grace runs out, so we have to
+		// tell the listeners, or the proxy would keep the service
+		if svc.IsTombstone() && grace > 0 {
+			drainEnd := svc.Updated.Add(grace)
+			if drainEnd.After(state.lastDrainCheck) && !drainEnd.After(now) {
+				drained[*hostname] = true
+			}
 		}
 
 		if svc.IsAlive() &&
-			svc.Updated.Before(time.Now().UTC().Add(0-ALIVE_LIFESPAN)) {
+			svc.Updated.Before(time.Now().UTC().Add(0-state.AliveLifespan)) {
 
-			log.Warnf("Found expired service %s from %s, tombstoning",
-				svc.Name, svc.Hostname,
+			log.WithFields(state.logFields(svc, "expired")).Warnf(
+				"Found expired service %s from %s, tombstoning", svc.Name, svc.Hostname,
 			)
 
 			// Because we don't know that other hosts haven't gotten a newer
@@ -464,20 +842,31 @@ func (state *ServicesState) TombstoneOthersServices() []service.Service {
 			// we didn't see. This might happen when any node is removed from
 			// cluster and re-joins, for example. So we can't use svc.Tombstone()
 			// which updates the timestamp to Now().UTC()
+			previousStatus := svc.Status
 			svc.Status = service.TOMBSTONE
 			svc.Updated = svc.Updated.Add(time.Second)
 			state.ServerChanged(svc.Hostname, svc.Updated)
+			state.ServiceChanged(svc, previousStatus)
 
 			result = append(result, *svc)
 		}
 	})
 
+	state.lastDrainCheck = now
+	for hostname := range drained {
+		log.WithFields(log.Fields{"node": hostname, "event": "drained"}).
+			Infof("Services on %s finished draining", hostname)
+		state.NotifyListeners(hostname, now)
+	}
+
 	return result
 }
 
 func (state *ServicesState) TombstoneServices(hostname string, containerList []service.Service) []service.Service {
+	state.serversLock.Lock()
+	defer state.serversLock.Unlock()
 
-	if !state.HasServer(hostname) {
+	if !state.hasServer(hostname) {
 		log.Debug("TombstoneServices(): New host or not running services, skipping.")
 		return nil
 	}
@@ -492,9 +881,11 @@ func (state *ServicesState) TombstoneServices(hostname string, containerList []s
 	// Tombstone our own services that went away
 	for id, svc := range services {
 		if _, ok := mapping[id]; !ok && !svc.IsTombstone() {
-			log.Warnf("Tombstoning %s", svc.ID)
+			log.WithFields(state.logFields(svc, "tombstone")).Warnf("Tombstoning %s", svc.ID)
+			previousStatus := svc.Status
 			svc.Tombstone()
 			state.ServerChanged(hostname, svc.Updated)
+			state.ServiceChanged(svc, previousStatus)
 
 			// Tombstone each record twice to help with receipt
 			for i := 0; i < 2; i++ {
@@ -506,14 +897,29 @@ func (state *ServicesState) TombstoneServices(hostname string, containerList []s
 	return result
 }
 
+// These hold the serversLock for reading while they run, so fn mustn't
+// change the state.
 func (state *ServicesState) EachServer(fn func(hostname *string, server *Server)) {
+	state.serversLock.RLock()
+	defer state.serversLock.RUnlock()
+	state.eachServer(fn)
+}
+
+func (state *ServicesState) EachService(fn func(hostname *string, serviceId *string, svc *service.Service)) {
+	state.serversLock.RLock()
+	defer state.serversLock.RUnlock()
+	state.eachService(fn)
+}
+
+// The same again, for when the serversLock is already held
+func (state *ServicesState) eachServer(fn func(hostname *string, server *Server)) {
 	for hostname, server := range state.Servers {
 		fn(&hostname, server)
 	}
 }
 
-func (state *ServicesState) EachService(fn func(hostname *string, serviceId *string, svc *service.Service)) {
-	state.EachServer(func(hostname *string, server *Server) {
+func (state *ServicesState) eachService(fn func(hostname *string, serviceId *string, svc *service.Service)) {
+	state.eachServer(func(hostname *string, server *Server) {
 		for id, svc := range server.Services {
 			fn(hostname, &id, svc)
 		}
@@ -522,6 +928,8 @@ func (state *ServicesState) EachService(fn func(hostname *string, serviceId *str
 
 // Return a properly regex-matched name for the service, or failing that,
 // the Image ID which we use to stand in for the name of the service.
+// Services in an environment get it as a prefix, so the same service in
+// two environments doesn't end up in one backend.
 func (state *ServicesState) ServiceName(svc *service.Service) string {
 	var svcName string
 
@@ -537,9 +945,51 @@ func (state *ServicesState) ServiceName(svc *service.Service) string {
 		svcName = svc.Image
 	}
 
+	if state.ServiceNameRewrite != nil {
+		svcName = state.ServiceNameRewrite.ReplaceAllString(svcName, state.ServiceNameReplace)
+	}
+
+	if env := svc.Environment(); env != "" {
+		svcName = env + "-" + svcName
+	}
+
 	return svcName
 }
 
+// Do we manage this service at all? With an include list, only the services
+// named in it are, and the exclude list always wins. The names are matched
+// after the regexp and the rewrite, and can be globs like "api-*".
+func (state *ServicesState) Manages(svc *service.Service) bool {
+	if len(state.ServiceInclude) == 0 && len(state.ServiceExclude) == 0 {
+		return true
+	}
+
+	name := state.ServiceName(svc)
+	if matchesAny(state.ServiceExclude, name) {
+		return false
+	}
+
+	return len(state.ServiceInclude) == 0 || matchesAny(state.ServiceInclude, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Log fields for an event about a service
+func (state *ServicesState) logFields(svc *service.Service, event string) log.Fields {
+	return log.Fields{
+		"service": state.ServiceName(svc),
+		"node":    svc.Hostname,
+		"event":   event,
+	}
+}
+
 // Group the services into a map by service name rather than by the
 // hosts they run on.
 func (state *ServicesState) ByService() map[string][]*service.Service {
@@ -55,6 +55,11 @@ func Test_NewServicesState(t *testing.T) {
 			So(state.LastChanged, ShouldBeTheSameTimeAs, time.Unix(0, 0))
 		})
 
+		Convey("Defaults the AliveLifespan", func() {
+			state := NewServicesState()
+			So(state.AliveLifespan, ShouldEqual, ALIVE_LIFESPAN)
+		})
+
 	})
 }
 
@@ -230,6 +235,24 @@ func Test_ServicesStateWithData(t *testing.T) {
 			So(secondState.Servers[svcId], ShouldEqual, firstState.Servers[svcId])
 		})
 
+		Convey("Merge() says what it changed", func() {
+			other := NewServicesState()
+			other.AddServiceEntry(svc)
+			So(state.Merge(other), ShouldResemble, MergeResult{Added: 1})
+
+			// Nothing new the second time
+			So(state.Merge(other), ShouldResemble, MergeResult{})
+
+			svc.Updated = svc.Updated.Add(time.Second)
+			other.AddServiceEntry(svc)
+			So(state.Merge(other), ShouldResemble, MergeResult{Updated: 1})
+
+			svc.Updated = svc.Updated.Add(time.Second)
+			svc.Status = service.TOMBSTONE
+			other.AddServiceEntry(svc)
+			So(state.Merge(other), ShouldResemble, MergeResult{Removed: 1})
+		})
+
 		Convey("Format() pretty-prints the state even without a Memberlist", func() {
 			formatted := state.Format(nil)
 
@@ -243,6 +266,38 @@ func Test_ServicesStateWithData(t *testing.T) {
 	})
 }
 
+// Mostly useful with -race
+func Test_ConcurrentReads(t *testing.T) {
+	Convey("Reading the state while it's being changed", t, func() {
+		state := NewServicesState()
+		state.Hostname = hostname
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				state.AddServiceEntry(service.Service{
+					ID: fmt.Sprintf("deadbeef%03d", i), Hostname: hostname, Updated: baseTime,
+				})
+			}
+		}()
+
+		svc := service.Service{ID: "deadbeef050", Hostname: hostname, Updated: baseTime}
+		for i := 0; i < 100; i++ {
+			state.HasServer(hostname)
+			state.IsNewService(&svc)
+			state.GetLocalService(svc.ID)
+			state.ByService()
+		}
+		wg.Wait()
+
+		So(state.IsNewService(&svc), ShouldBeFalse)
+		So(len(state.ByService()), ShouldEqual, 1)
+	})
+}
+
 func Test_TrackingAndBroadcasting(t *testing.T) {
 
 	Convey("When Tracking and Broadcasting services", t, func() {
@@ -306,6 +361,51 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 			So(broadcast, ShouldBeNil)
 		})
 
+		Convey("Local-only services are never broadcast", func() {
+			localOnly := service.Service{
+				ID: "deadbeef999", Hostname: hostname, Updated: baseTime,
+				Metadata: map[string]string{service.LOCAL_ONLY_METADATA: "true"},
+			}
+			services = append(services, localOnly)
+			go state.BroadcastServices(containerFn, looper)
+
+			readBroadcasts := <-state.Broadcasts
+			So(len(readBroadcasts), ShouldEqual, 2)
+			for _, broadcast := range readBroadcasts {
+				So(service.Decode(broadcast).ID, ShouldNotEqual, localOnly.ID)
+			}
+		})
+
+		Convey("Local-only tombstones are never broadcast", func() {
+			localOnly := service.Service{
+				ID: "deadbeef999", Hostname: hostname, Updated: baseTime,
+				Metadata: map[string]string{service.LOCAL_ONLY_METADATA: "true"},
+			}
+			state.AddServiceEntry(localOnly)
+			go state.BroadcastTombstones(containerFn, looper)
+
+			broadcast := <-state.Broadcasts
+			So(broadcast, ShouldBeNil)
+			So(state.Servers[hostname].Services[localOnly.ID].IsTombstone(), ShouldBeTrue)
+		})
+
+		Convey("EncodeShared() leaves out local-only services", func() {
+			localOnly := service.Service{
+				ID: "deadbeef999", Hostname: hostname, Updated: baseTime,
+				Metadata: map[string]string{service.LOCAL_ONLY_METADATA: "true"},
+			}
+			state.AddServiceEntry(service1)
+			state.AddServiceEntry(localOnly)
+
+			decoded, err := Decode(state.EncodeShared())
+			So(err, ShouldBeNil)
+			So(decoded.Servers[hostname].Services[svcId1], ShouldNotBeNil)
+			So(decoded.Servers[hostname].Services[localOnly.ID], ShouldBeNil)
+
+			// It's still in our own state
+			So(state.Servers[hostname].Services[localOnly.ID], ShouldNotBeNil)
+		})
+
 		Convey("All of the tombstones are serialized into the channel", func() {
 			junk := service.Service{ID: "runs", Hostname: hostname, Updated: baseTime}
 			state.AddServiceEntry(junk)
@@ -320,6 +420,55 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 			So(readBroadcasts[1], ShouldMatch, "^{\"ID\":\"runs\".*\"Status\":1}$")
 		})
 
+		Convey("Tombstones beyond the limit wait for the next broadcast", func() {
+			// Our own tombstones are sent twice each, so this is one service
+			state.MaxTombstones = 2
+			state.AddServiceEntry(service1)
+			state.AddServiceEntry(service2)
+			looper := director.NewFreeLooper(2, make(chan error))
+			go state.BroadcastTombstones(func() []service.Service { return []service.Service{} }, looper)
+
+			// Each run's retransmits can arrive in any order
+			seen := make(map[string]int)
+			for i := 0; i < 2*TOMBSTONE_COUNT; i++ {
+				broadcast := <-state.Broadcasts
+				So(len(broadcast), ShouldEqual, 2)
+
+				decoded := service.Decode(broadcast[0])
+				So(service.Decode(broadcast[1]).ID, ShouldEqual, decoded.ID)
+				seen[decoded.ID]++
+			}
+
+			So(seen[svcId1], ShouldEqual, TOMBSTONE_COUNT)
+			So(seen[svcId2], ShouldEqual, TOMBSTONE_COUNT)
+		})
+
+		Convey("nextTombstones() sends the oldest tombstones first", func() {
+			state.MaxTombstones = 2
+			service1.Updated = baseTime.Add(2 * time.Second)
+			service2.Updated = baseTime.Add(time.Second)
+			service3 := service.Service{ID: "deadbeef105", Hostname: hostname, Updated: baseTime}
+
+			next := state.nextTombstones([]service.Service{service1, service2, service3})
+			So(len(next), ShouldEqual, 2)
+			So(next[0].ID, ShouldEqual, service3.ID)
+			So(next[1].ID, ShouldEqual, service2.ID)
+
+			// Older tombstones jump the queue ahead of the pending one
+			service4 := service.Service{ID: "deadbeef999", Hostname: hostname, Updated: baseTime.Add(-time.Second)}
+			next = state.nextTombstones([]service.Service{service4})
+			So(len(next), ShouldEqual, 2)
+			So(next[0].ID, ShouldEqual, service4.ID)
+			So(next[1].ID, ShouldEqual, service1.ID)
+			So(state.pendingTombstones, ShouldBeEmpty)
+		})
+
+		Convey("nextTombstones() sends everything without a limit", func() {
+			next := state.nextTombstones([]service.Service{service1, service2})
+			So(len(next), ShouldEqual, 2)
+			So(state.pendingTombstones, ShouldBeEmpty)
+		})
+
 		Convey("The timestamp is incremented on each subsequent service broadcast background run", func() {
 			state.Broadcasts = make(chan [][]byte, 4)
 			looper := director.NewFreeLooper(2, make(chan error))
@@ -410,6 +559,66 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 			So(state.Servers[hostname].LastChanged.After(lastChanged), ShouldBeTrue)
 		})
 
+		Convey("The alive lifespan can be changed", func() {
+			state.AliveLifespan = 5 * time.Minute
+			state.AddServiceEntry(service1)
+			svc := state.Servers[hostname].Services[service1.ID]
+			svc.Updated = service1.Updated.Add(0 - ALIVE_LIFESPAN - 5*time.Second)
+
+			state.TombstoneOthersServices()
+			So(svc.Status, ShouldEqual, service.ALIVE)
+
+			svc.Updated = service1.Updated.Add(-6 * time.Minute)
+			state.TombstoneOthersServices()
+			So(svc.Status, ShouldEqual, service.TOMBSTONE)
+		})
+
+		Convey("Services with a drain grace go from alive to draining to removed", func() {
+			events := make(chan ChangeEvent, 10)
+			service1.Metadata = map[string]string{service.DRAIN_GRACE_METADATA: "1m"}
+			state.AddServiceEntry(service1)
+			svc := state.Servers[hostname].Services[service1.ID]
+			So(svc.IsDraining(time.Now().UTC()), ShouldBeFalse)
+
+			// Discovery stopped seeing it
+			state.TombstoneServices(hostname, []service.Service{})
+			So(svc.IsTombstone(), ShouldBeTrue)
+			So(svc.IsDraining(time.Now().UTC()), ShouldBeTrue)
+
+			state.AddListener(events)
+			state.TombstoneOthersServices()
+			So(len(events), ShouldEqual, 0)
+
+			// The grace ran out since we last checked, so the proxy has to
+			// hear about it
+			svc.Updated = time.Now().UTC().Add(-61 * time.Second)
+			state.lastDrainCheck = svc.Updated
+			state.TombstoneOthersServices()
+			So(svc.IsDraining(time.Now().UTC()), ShouldBeFalse)
+			So(len(events), ShouldEqual, 1)
+			So((<-events).Hostname, ShouldEqual, hostname)
+
+			// Only once
+			state.TombstoneOthersServices()
+			So(len(events), ShouldEqual, 0)
+			So(state.Servers[hostname].Services[service1.ID], ShouldNotBeNil)
+
+			svc.Updated = time.Now().UTC().Add(0 - TOMBSTONE_LIFESPAN - time.Minute)
+			state.TombstoneOthersServices()
+			So(state.Servers[hostname], ShouldBeNil)
+		})
+
+		Convey("A drain grace longer than the tombstone lifespan keeps the tombstone", func() {
+			service1.Metadata = map[string]string{service.DRAIN_GRACE_METADATA: "4h"}
+			service1.Status = service.TOMBSTONE
+			service1.Updated = time.Now().UTC().Add(0 - TOMBSTONE_LIFESPAN - time.Minute)
+			state.AddServiceEntry(service1)
+
+			state.TombstoneOthersServices()
+			So(state.Servers[hostname].Services[service1.ID], ShouldNotBeNil)
+			So(state.Servers[hostname].Services[service1.ID].IsDraining(time.Now().UTC()), ShouldBeTrue)
+		})
+
 		Convey("Can detect new services or newly changed services", func() {
 			// service1 and services[0] are copies of the same service
 			service1.Status = service.UNHEALTHY
@@ -419,6 +628,56 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 			So(state.IsNewService(&services[0]), ShouldBeTrue)
 		})
 
+		Convey("Draining marks our services unhealthy until we stop", func() {
+			services[1].Status = service.TOMBSTONE
+			drainableFn := state.DrainableServices(containerFn)
+
+			state.SetDraining(true)
+			So(state.IsDraining(), ShouldBeTrue)
+			drained := drainableFn()
+			So(drained[0].Status, ShouldEqual, service.UNHEALTHY)
+			So(drained[1].Status, ShouldEqual, service.TOMBSTONE)
+			So(services[0].Status, ShouldEqual, service.ALIVE)
+
+			state.SetDraining(false)
+			So(drainableFn()[0].Status, ShouldEqual, service.ALIVE)
+		})
+
+		Convey("Services in maintenance are marked that way until they come out", func() {
+			services[1].Status = service.TOMBSTONE
+			maintainableFn := state.MaintainableServices(containerFn)
+
+			state.SetMaintenance(services[0].ID, true)
+			state.SetMaintenance(services[1].ID, true)
+			So(state.InMaintenance(services[0].ID), ShouldBeTrue)
+
+			maintained := maintainableFn()
+			So(maintained[0].Status, ShouldEqual, service.MAINTENANCE)
+			So(maintained[1].Status, ShouldEqual, service.TOMBSTONE)
+			So(services[0].Status, ShouldEqual, service.ALIVE)
+
+			state.SetMaintenance(services[0].ID, false)
+			So(state.InMaintenance(services[0].ID), ShouldBeFalse)
+			So(maintainableFn()[0].Status, ShouldEqual, service.ALIVE)
+		})
+
+		Convey("Maintenance metadata puts a service in maintenance", func() {
+			services[0].Metadata = map[string]string{"maintenance": "true"}
+			So(state.MaintainableServices(containerFn)()[0].Status, ShouldEqual, service.MAINTENANCE)
+
+			services[0].Metadata = map[string]string{"maintenance": "false"}
+			So(state.MaintainableServices(containerFn)()[0].Status, ShouldEqual, service.ALIVE)
+		})
+
+		Convey("Maintenance wins over draining", func() {
+			state.SetDraining(true)
+			state.SetMaintenance(services[0].ID, true)
+
+			serviceFn := state.MaintainableServices(state.DrainableServices(containerFn))
+			So(serviceFn()[0].Status, ShouldEqual, service.MAINTENANCE)
+			So(serviceFn()[1].Status, ShouldEqual, service.UNHEALTHY)
+		})
+
 		Convey("Doesn't call tombstones new services", func() {
 			// service1 and services[0] are copies of the same service
 			service1.Status = service.UNHEALTHY
@@ -465,6 +724,53 @@ func Test_Listeners(t *testing.T) {
 			So(result2.Hostname, ShouldEqual, hostname)
 		})
 
+		Convey("Removed service listeners aren't notified any more", func() {
+			state.AddServiceListener(listener)
+			state.AddServiceListener(listener2)
+			state.RemoveServiceListener(listener)
+
+			So(len(state.serviceListeners), ShouldEqual, 1)
+
+			state.AddServiceEntry(svc1)
+			So(len(listener), ShouldEqual, 0)
+			So(len(listener2), ShouldEqual, 1)
+		})
+
+		Convey("Service events carry the service that changed", func() {
+			events := make(chan ChangeEvent, 10)
+			state.AddServiceListener(events)
+
+			state.AddServiceEntry(svc1)
+			event := <-events
+			So(event.Service.ID, ShouldEqual, svcId1)
+			So(event.PreviousStatus, ShouldEqual, NEW_SERVICE)
+
+			svc1.Status = service.UNHEALTHY
+			svc1.Updated = svc1.Updated.Add(1 * time.Second)
+			state.AddServiceEntry(svc1)
+			event = <-events
+			So(event.Service.Status, ShouldEqual, service.UNHEALTHY)
+			So(event.PreviousStatus, ShouldEqual, service.ALIVE)
+			So(event.Removed, ShouldBeFalse)
+		})
+
+		Convey("Expired tombstones send a removal event", func() {
+			events := make(chan ChangeEvent, 10)
+			svc1.Status = service.TOMBSTONE
+			svc1.Updated = baseTime.Add(0 - TOMBSTONE_LIFESPAN - time.Minute)
+			state.AddServiceEntry(svc1)
+			state.AddServiceListener(events)
+			state.AddListener(listener)
+
+			state.TombstoneOthersServices()
+			event := <-events
+			So(event.Service.ID, ShouldEqual, svcId1)
+			So(event.Removed, ShouldBeTrue)
+
+			// Regular listeners aren't told about removals
+			So(len(listener), ShouldEqual, 0)
+		})
+
 		Reset(func() {
 			state = NewServicesState()
 		})
@@ -499,6 +805,44 @@ func Test_ClusterMembershipManagement(t *testing.T) {
 			So(expired[1], ShouldMatch, "^{\"ID\":\"deadbeef.*\"Status\":1}$")
 		})
 
+		Convey("ExpireServer() drains the services for the leave drain grace", func() {
+			events := make(chan ChangeEvent, 10)
+			state.LeaveDrainGrace = time.Minute
+			service2.Metadata = map[string]string{service.DRAIN_GRACE_METADATA: "1h"}
+			state.AddServiceEntry(service1)
+			state.AddServiceEntry(service2)
+
+			go state.ExpireServer(hostname)
+			<-state.Broadcasts
+
+			svc := state.Servers[hostname].Services[svcId1]
+			So(svc.IsDraining(time.Now().UTC()), ShouldBeTrue)
+			So(svc.Metadata[service.DRAIN_GRACE_METADATA], ShouldEqual, "1m0s")
+			So(service1.Metadata, ShouldBeNil)
+
+			// Its own longer grace wins
+			So(state.Servers[hostname].Services[svcId2].DrainGrace(), ShouldEqual, time.Hour)
+
+			// Then it's removed once the grace runs out
+			state.AddListener(events)
+			svc.Updated = time.Now().UTC().Add(-61 * time.Second)
+			state.lastDrainCheck = svc.Updated
+			state.TombstoneOthersServices()
+			So(svc.IsDraining(time.Now().UTC()), ShouldBeFalse)
+			So(len(events), ShouldEqual, 1)
+		})
+
+		Convey("ExpireServer() leaves the metadata alone without a leave drain grace", func() {
+			state.AddServiceEntry(service1)
+
+			go state.ExpireServer(hostname)
+			<-state.Broadcasts
+
+			svc := state.Servers[hostname].Services[svcId1]
+			So(svc.IsDraining(time.Now().UTC()), ShouldBeFalse)
+			So(svc.Metadata, ShouldBeNil)
+		})
+
 		Convey("The state LastChanged is updated", func() {
 			lastChanged := state.LastChanged
 			state.AddServiceEntry(service1)
@@ -509,6 +853,34 @@ func Test_ClusterMembershipManagement(t *testing.T) {
 			So(lastChanged.Before(state.LastChanged), ShouldBeTrue)
 		})
 
+		Convey("ExpireService() tombstones just the one service", func() {
+			state.AddServiceEntry(service1)
+			state.AddServiceEntry(service2)
+
+			expired := state.ExpireService(svcId1)
+
+			So(expired, ShouldNotBeNil)
+			So(expired.IsTombstone(), ShouldBeTrue)
+			So(state.Servers[hostname].Services[svcId1].IsTombstone(), ShouldBeTrue)
+			So(state.Servers[hostname].Services[svcId2].IsTombstone(), ShouldBeFalse)
+
+			broadcast := <-state.Broadcasts
+			So(len(broadcast), ShouldEqual, 1)
+			So(string(broadcast[0]), ShouldContainSubstring, svcId1)
+		})
+
+		Convey("ExpireService() makes the tombstone newer than the service", func() {
+			service1.Updated = time.Now().UTC().Add(time.Hour)
+			state.AddServiceEntry(service1)
+
+			expired := state.ExpireService(svcId1)
+			So(expired.Updated.After(service1.Updated), ShouldBeTrue)
+		})
+
+		Convey("ExpireService() returns nil for unknown services", func() {
+			So(state.ExpireService("missing"), ShouldBeNil)
+		})
+
 	})
 }
 
@@ -609,3 +981,155 @@ func ShouldMatch(actual interface{}, expected ...interface{}) string {
 
 	return ""
 }
+
+func Test_Manages(t *testing.T) {
+	Convey("Managing only some services", t, func() {
+		state := NewServicesState()
+		now := time.Now().UTC()
+
+		named := func(id, name string) service.Service {
+			return service.Service{ID: id, Name: name, Image: name, Hostname: "indomitable", Updated: now}
+		}
+		api := named("deadbeef001", "api")
+		apiAdmin := named("deadbeef002", "api-admin")
+		worker := named("deadbeef003", "worker")
+
+		Convey("manages everything by default", func() {
+			So(state.Manages(&api), ShouldBeTrue)
+			So(state.Manages(&worker), ShouldBeTrue)
+		})
+
+		Convey("only manages what's included, whatever was discovered", func() {
+			state.ServiceInclude = []string{"api*"}
+
+			So(state.Manages(&api), ShouldBeTrue)
+			So(state.Manages(&apiAdmin), ShouldBeTrue)
+			So(state.Manages(&worker), ShouldBeFalse)
+		})
+
+		Convey("lets the exclude list win over the include list", func() {
+			state.ServiceInclude = []string{"api*"}
+			state.ServiceExclude = []string{"api-admin"}
+
+			So(state.Manages(&api), ShouldBeTrue)
+			So(state.Manages(&apiAdmin), ShouldBeFalse)
+		})
+
+		Convey("manages everything but what's excluded without an include list", func() {
+			state.ServiceExclude = []string{"worker"}
+
+			So(state.Manages(&api), ShouldBeTrue)
+			So(state.Manages(&worker), ShouldBeFalse)
+		})
+
+		Convey("matches the names after they're rewritten", func() {
+			state.ServiceNameRewrite = regexp.MustCompile("^api$")
+			state.ServiceNameReplace = "web"
+			state.ServiceInclude = []string{"web"}
+
+			So(state.Manages(&api), ShouldBeTrue)
+		})
+
+		Convey("keeps services it doesn't manage out of the catalog", func() {
+			state.ServiceInclude = []string{"api"}
+			state.ServiceExclude = []string{"worker"}
+
+			state.AddServiceEntry(api)
+			state.AddServiceEntry(apiAdmin)
+			state.AddServiceEntry(worker)
+
+			byService := state.ByService()
+			So(len(byService), ShouldEqual, 1)
+			So(byService["api"][0].ID, ShouldEqual, "deadbeef001")
+		})
+	})
+}
+
+func Test_ServiceNameEnvironment(t *testing.T) {
+	Convey("Services in an environment", t, func() {
+		state := NewServicesState()
+		now := time.Now().UTC()
+
+		inEnv := func(id, env string) service.Service {
+			return service.Service{
+				ID: id, Name: "api", Image: "api", Hostname: "indomitable", Updated: now, Status: service.ALIVE,
+				Metadata: map[string]string{service.ENVIRONMENT_METADATA: env},
+			}
+		}
+
+		Convey("are named with the environment as a prefix", func() {
+			svc := inEnv("deadbeef123", "staging")
+			So(state.ServiceName(&svc), ShouldEqual, "staging-api")
+		})
+
+		Convey("are prefixed after the name is rewritten", func() {
+			state.ServiceNameRewrite = regexp.MustCompile("^api$")
+			state.ServiceNameReplace = "web"
+
+			svc := inEnv("deadbeef123", "staging")
+			So(state.ServiceName(&svc), ShouldEqual, "staging-web")
+		})
+
+		Convey("keep their names without one", func() {
+			svc := service.Service{Name: "api", Image: "api"}
+			So(state.ServiceName(&svc), ShouldEqual, "api")
+		})
+
+		Convey("don't merge with the same service in another environment", func() {
+			state.AddServiceEntry(inEnv("deadbeef123", "a"))
+			state.AddServiceEntry(inEnv("deadbeef456", "b"))
+
+			byService := state.ByService()
+			So(len(byService), ShouldEqual, 2)
+			So(byService["a-api"][0].ID, ShouldEqual, "deadbeef123")
+			So(byService["b-api"][0].ID, ShouldEqual, "deadbeef456")
+		})
+	})
+}
+
+func Test_ServiceName(t *testing.T) {
+	Convey("ServiceName()", t, func() {
+		state := NewServicesState()
+		state.ServiceNameMatch = regexp.MustCompile("^(.+)(-[0-9a-z]{7,14})$")
+
+		prod := service.Service{ID: "deadbeef123", Name: "prod-web-v2-deadabba999", Image: "img1", Hostname: "indomitable"}
+		plain := service.Service{ID: "deadbeef101", Name: "web-abba1231234", Image: "img1", Hostname: "indefatigable"}
+
+		Convey("Leaves the matched name alone without a rewrite", func() {
+			So(state.ServiceName(&prod), ShouldEqual, "prod-web-v2")
+			So(state.ServiceName(&plain), ShouldEqual, "web")
+		})
+
+		Convey("Falls back to the image when the name doesn't match", func() {
+			svc := service.Service{Name: "nope", Image: "img1"}
+			So(state.ServiceName(&svc), ShouldEqual, "img1")
+		})
+
+		Convey("Rewrites the matched name using capture groups", func() {
+			state.ServiceNameRewrite = regexp.MustCompile("^(?:prod-)?(.+?)(?:-v([0-9]+))?$")
+			state.ServiceNameReplace = "$1"
+
+			So(state.ServiceName(&prod), ShouldEqual, "web")
+			So(state.ServiceName(&plain), ShouldEqual, "web")
+		})
+
+		Convey("Supports named and multiple groups in the replacement", func() {
+			state.ServiceNameRewrite = regexp.MustCompile("^(?:prod-)?(?P<name>.+?)-v(?P<version>[0-9]+)$")
+			state.ServiceNameReplace = "${name}-api-${version}"
+
+			So(state.ServiceName(&prod), ShouldEqual, "web-api-2")
+			So(state.ServiceName(&plain), ShouldEqual, "web")
+		})
+
+		Convey("Groups rewritten services together in ByService()", func() {
+			state.ServiceNameRewrite = regexp.MustCompile("^(?:prod-)?(.+?)(?:-v([0-9]+))?$")
+			state.ServiceNameReplace = "$1"
+			state.AddServiceEntry(prod)
+			state.AddServiceEntry(plain)
+
+			services := state.ByService()
+			So(len(services), ShouldEqual, 1)
+			So(len(services["web"]), ShouldEqual, 2)
+		})
+	})
+}
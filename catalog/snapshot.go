@@ -0,0 +1,108 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
+	"github.com/newrelic/sidecar/service"
+	"github.com/relistan/go-director"
+)
+
+const (
+	SNAPSHOT_INTERVAL = 30 * time.Second         // How often we write a snapshot
+	SNAPSHOT_GRACE    = ALIVE_BROADCAST_INTERVAL // How long restored services live without gossip
+)
+
+// Write the current services and tombstones to a file, so we can pick up
+// where we left off after a restart. The file is replaced atomically.
+func (state *ServicesState) Snapshot(path string) error {
+	defer metrics.MeasureSince([]string{"services_state", "Snapshot"}, time.Now())
+
+	data := state.Encode()
+	if len(data) == 0 {
+		return errors.New("Unable to encode the state")
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".sidecar-snapshot")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// Load a snapshot written by Snapshot(). Meant to be called on startup,
+// before joining the cluster, so that we don't start out empty. Our own
+// services are skipped because discovery will find them again. Everyone
+// else's are backdated so that they expire within SNAPSHOT_GRACE unless
+// gossip tells us about them again. If the file is bad, we start empty.
+func (state *ServicesState) LoadSnapshot(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var servers map[string]*Server
+	err = json.Unmarshal(data, &servers)
+	if err != nil {
+		log.Errorf("Snapshot %s is corrupt, starting empty! (%s)", path, err.Error())
+		return err
+	}
+
+	// Backdated so that it expires at the end of the grace period
+	staleTime := time.Now().UTC().Add(SNAPSHOT_GRACE - state.AliveLifespan)
+	count := 0
+
+	state.serversLock.Lock()
+	defer state.serversLock.Unlock()
+
+	for hostname, server := range servers {
+		if hostname == state.Hostname || server == nil {
+			continue
+		}
+
+		for id, svc := range server.Services {
+			if svc == nil {
+				continue
+			}
+
+			if svc.Status == service.ALIVE && svc.Updated.After(staleTime) {
+				svc.Updated = staleTime
+			}
+
+			if !state.hasServer(hostname) {
+				state.Servers[hostname] = NewServer(hostname)
+			}
+			state.Servers[hostname].Services[id] = svc
+			count++
+		}
+	}
+
+	log.Infof("Restored %d services from snapshot %s", count, path)
+
+	return nil
+}
+
+// Write a snapshot on every iteration of the looper
+func (state *ServicesState) SaveSnapshots(path string, looper director.Looper) {
+	looper.Loop(func() error {
+		err := state.Snapshot(path)
+		if err != nil {
+			log.Errorf("Unable to write snapshot %s! (%s)", path, err.Error())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+package catalog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Snapshots(t *testing.T) {
+	Convey("Snapshotting the state", t, func() {
+		tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+		defer os.RemoveAll(tmpDir)
+		snapshotFile := path.Join(tmpDir, "snapshot.json")
+
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		state := NewServicesState()
+		state.Hostname = hostname
+
+		ours := service.Service{ID: "deadbeef123", Hostname: hostname, Updated: baseTime, Status: service.ALIVE}
+		theirs := service.Service{ID: "deadbeef101", Hostname: anotherHostname, Updated: baseTime, Status: service.ALIVE}
+		oldTombstone := service.Service{ID: "deadbeef105", Hostname: anotherHostname, Updated: baseTime.Add(-5 * time.Minute), Status: service.TOMBSTONE}
+
+		state.AddServiceEntry(ours)
+		state.AddServiceEntry(theirs)
+		state.AddServiceEntry(oldTombstone)
+
+		Convey("Snapshot() writes a file that LoadSnapshot() can read", func() {
+			So(state.Snapshot(snapshotFile), ShouldBeNil)
+
+			newState := NewServicesState()
+			newState.Hostname = hostname
+			So(newState.LoadSnapshot(snapshotFile), ShouldBeNil)
+
+			So(newState.HasServer(anotherHostname), ShouldBeTrue)
+			So(len(newState.Servers[anotherHostname].Services), ShouldEqual, 2)
+		})
+
+		Convey("Snapshot() can run while the state is changing", func() {
+			done := make(chan struct{})
+			go func() {
+				for i := 0; i < 50; i++ {
+					svc := theirs
+					svc.ID = fmt.Sprintf("deadbeef2%02d", i)
+					state.AddServiceEntry(svc)
+				}
+				close(done)
+			}()
+
+			for i := 0; i < 10; i++ {
+				So(state.Snapshot(snapshotFile), ShouldBeNil)
+			}
+			<-done
+		})
+
+		Convey("LoadSnapshot() skips our own services", func() {
+			state.Snapshot(snapshotFile)
+
+			newState := NewServicesState()
+			newState.Hostname = hostname
+			newState.LoadSnapshot(snapshotFile)
+
+			So(newState.HasServer(hostname), ShouldBeFalse)
+		})
+
+		Convey("LoadSnapshot() marks restored services as stale", func() {
+			state.Snapshot(snapshotFile)
+
+			newState := NewServicesState()
+			newState.Hostname = hostname
+			newState.LoadSnapshot(snapshotFile)
+
+			restored := newState.Servers[anotherHostname].Services[theirs.ID]
+			So(restored.IsAlive(), ShouldBeTrue)
+			So(restored.Updated.Before(baseTime), ShouldBeTrue)
+
+			// They expire by the end of the grace period
+			expiry := restored.Updated.Add(ALIVE_LIFESPAN)
+			So(expiry.Before(time.Now().UTC().Add(SNAPSHOT_GRACE+time.Second)), ShouldBeTrue)
+
+			// Tombstones are restored as they were
+			tombstone := newState.Servers[anotherHostname].Services[oldTombstone.ID]
+			So(tombstone.Updated, ShouldBeTheSameTimeAs, oldTombstone.Updated)
+		})
+
+		Convey("Restored services are replaced by newer gossip", func() {
+			state.Snapshot(snapshotFile)
+
+			newState := NewServicesState()
+			newState.Hostname = hostname
+			newState.LoadSnapshot(snapshotFile)
+
+			theirs.Updated = time.Now().UTC()
+			newState.AddServiceEntry(theirs)
+
+			restored := newState.Servers[anotherHostname].Services[theirs.ID]
+			So(restored.Updated, ShouldBeTheSameTimeAs, theirs.Updated)
+		})
+
+		Convey("LoadSnapshot() starts empty when the file is corrupt", func() {
+			ioutil.WriteFile(snapshotFile, []byte(`{"chaucer": {"Services": `), 0644)
+
+			newState := NewServicesState()
+			So(newState.LoadSnapshot(snapshotFile), ShouldNotBeNil)
+			So(len(newState.Servers), ShouldEqual, 0)
+		})
+
+		Convey("LoadSnapshot() returns an error when there's no file", func() {
+			newState := NewServicesState()
+			So(newState.LoadSnapshot(snapshotFile), ShouldNotBeNil)
+			So(len(newState.Servers), ShouldEqual, 0)
+		})
+	})
+}
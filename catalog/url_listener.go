@@ -2,22 +2,31 @@ package catalog
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
 	"github.com/relistan/go-director"
 )
 
 const (
-	CLIENT_TIMEOUT = 3 * time.Second
-	DEFAULT_RETRIES = 5
+	CLIENT_TIMEOUT      = 3 * time.Second
+	DEFAULT_RETRIES     = 5
+	DEFAULT_RETRY_DELAY = 100 * time.Millisecond
+	MAX_RETRY_DELAY     = 30 * time.Second
+	SIGNATURE_HEADER    = "X-Sidecar-Signature"
 )
 
 type UrlListener struct {
 	Url          string
-	Retries      int
+	Retries      int           // How many times we retry a failed post
+	RetryDelay   time.Duration // The first backoff, which doubles on each retry
+	Secret       string        // If set, posts are signed with HMAC-SHA256
 	Client       *http.Client
 	looper       director.Looper
 	eventChannel chan ChangeEvent
@@ -32,10 +41,13 @@ func NewUrlListener(url string) *UrlListener {
 		Client:       &http.Client{Timeout: CLIENT_TIMEOUT},
 		eventChannel: make(chan ChangeEvent, 20),
 		Retries:      DEFAULT_RETRIES,
+		RetryDelay:   DEFAULT_RETRY_DELAY,
 	}
 }
 
-func withRetries(count int, fn func() error) error {
+// Call fn, and retry it up to count times if it fails. The delay
+// between attempts doubles each time, up to MAX_RETRY_DELAY.
+func withRetries(count int, delay time.Duration, fn func() error) error {
 	var result error
 
 	for i := -1; i < count; i++ {
@@ -43,21 +55,75 @@ func withRetries(count int, fn func() error) error {
 		if result == nil {
 			return nil
 		}
-		time.Sleep(100*time.Duration(i)*time.Millisecond)
+
+		if i < count-1 {
+			time.Sleep(delay)
+			delay = delay * 2
+			if delay > MAX_RETRY_DELAY {
+				delay = MAX_RETRY_DELAY
+			}
+		}
 	}
 
 	log.Warnf("Failed after %d retries", count)
 	return result
 }
 
+// The hex encoded HMAC-SHA256 of the body, which receivers can compute
+// with the shared secret to check that the post came from us.
+func signature(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Post the state to the Url, signing it if we have a secret
+func (u *UrlListener) post(data []byte) error {
+	req, err := http.NewRequest("POST", u.Url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if u.Secret != "" {
+		req.Header.Set(SIGNATURE_HEADER, signature(u.Secret, data))
+	}
+
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return fmt.Errorf("Bad status code returned (%d)", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Drain any events that queued up while we were busy. We post the
+// whole state, so one post covers all of them.
+func (u *UrlListener) drainEvents() {
+	for {
+		select {
+		case <-u.eventChannel:
+		default:
+			return
+		}
+	}
+}
+
 func (u *UrlListener) Watch(state *ServicesState) {
 	state.AddListener(u.eventChannel)
 
 	go func() {
 		// We don't care what the change was, we post them all, so
-		// just listen for any event.
+		// just listen for any event. Posts happen one at a time, in
+		// this goroutine, so the endpoint never sees them out of order.
 		u.looper.Loop(func() error {
 			<-u.eventChannel
+			u.drainEvents()
 			data := state.Encode()
 
 			// Check for some kind of junk JSON being generated by state.Encode()
@@ -66,26 +132,18 @@ func (u *UrlListener) Watch(state *ServicesState) {
 				return nil
 			}
 
-			buf := bytes.NewBuffer(data)
-
-			err := withRetries(u.Retries, func() error {
-				resp, err := u.Client.Post(u.Url, "application/json", buf)
-
-				if err != nil {
-					return err
-				}
-
-				if resp.StatusCode > 299 || resp.StatusCode < 200 {
-					return fmt.Errorf("Bad status code returned (%d)", resp.StatusCode)
-				}
-
-				return nil
+			err := withRetries(u.Retries, u.RetryDelay, func() error {
+				return u.post(data)
 			})
 
 			if err != nil {
-				log.Warnf("Failed posting state to '%s': %s", u.Url, err.Error())
+				log.Warnf("Failed posting state to '%s', dropping it: %s", u.Url, err.Error())
+				metrics.IncrCounter([]string{"url_listener", "failed"}, 1)
+				return nil
 			}
 
+			metrics.IncrCounter([]string{"url_listener", "delivered"}, 1)
+
 			return nil
 		})
 	}()
@@ -1,8 +1,16 @@
 package catalog
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/newrelic/sidecar/mockhttp"
 	"github.com/newrelic/sidecar/service"
@@ -18,6 +26,148 @@ func Test_NewUrlListener(t *testing.T) {
 		So(listener.Client, ShouldNotBeNil)
 		So(listener.Url, ShouldEqual, url)
 		So(listener.looper, ShouldNotBeNil)
+		So(listener.Retries, ShouldEqual, DEFAULT_RETRIES)
+		So(listener.RetryDelay, ShouldEqual, DEFAULT_RETRY_DELAY)
+	})
+}
+
+func Test_withRetries(t *testing.T) {
+	Convey("withRetries()", t, func() {
+		var calls []time.Time
+		failing := func() error {
+			calls = append(calls, time.Now())
+			return errors.New("OMG!")
+		}
+
+		Convey("gives up after the last retry", func() {
+			err := withRetries(2, time.Millisecond, failing)
+			So(err, ShouldNotBeNil)
+			So(len(calls), ShouldEqual, 3)
+		})
+
+		Convey("stops as soon as it succeeds", func() {
+			err := withRetries(2, time.Millisecond, func() error {
+				calls = append(calls, time.Now())
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(len(calls), ShouldEqual, 1)
+		})
+
+		Convey("backs off exponentially", func() {
+			withRetries(2, 10*time.Millisecond, failing)
+			So(calls[1].Sub(calls[0]), ShouldBeGreaterThanOrEqualTo, 10*time.Millisecond)
+			So(calls[2].Sub(calls[1]), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+		})
+	})
+}
+
+func Test_Delivery(t *testing.T) {
+	Convey("Delivering state to a listener", t, func() {
+		var lock sync.Mutex
+		var bodies []string
+		var signatures []string
+		failures := 0
+		posts := make(chan struct{}, 10)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			lock.Lock()
+			if failures > 0 {
+				failures--
+				http.Error(w, "OMG!", http.StatusInternalServerError)
+			} else {
+				bodies = append(bodies, string(body))
+				signatures = append(signatures, r.Header.Get(SIGNATURE_HEADER))
+			}
+			lock.Unlock()
+
+			posts <- struct{}{}
+		}))
+		defer server.Close()
+
+		// Wait for the listener to have posted count times
+		waitForPosts := func(count int) {
+			for i := 0; i < count; i++ {
+				<-posts
+			}
+		}
+
+		delivered := func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return bodies
+		}
+
+		hostname := "grendel"
+		state := NewServicesState()
+		state.Hostname = hostname
+
+		listener := NewUrlListener(server.URL)
+		listener.Retries = 2
+		listener.RetryDelay = time.Millisecond
+		listener.looper = director.NewFreeLooper(1, make(chan error, 1))
+
+		Convey("retries failed posts with the whole body", func() {
+			failures = 2
+			listener.Watch(state)
+			state.AddServiceEntry(service.Service{ID: "deadbeef123", Hostname: hostname})
+			listener.looper.Wait()
+
+			So(len(delivered()), ShouldEqual, 1)
+			So(delivered()[0], ShouldContainSubstring, "deadbeef123")
+		})
+
+		Convey("drops the change when all retries fail", func() {
+			failures = 3
+			listener.Watch(state)
+			state.AddServiceEntry(service.Service{ID: "deadbeef123", Hostname: hostname})
+			listener.looper.Wait()
+
+			So(len(delivered()), ShouldEqual, 0)
+		})
+
+		Convey("keeps delivering after a failure", func() {
+			failures = 3
+			listener.looper = director.NewFreeLooper(2, make(chan error, 1))
+			listener.Watch(state)
+
+			state.AddServiceEntry(service.Service{ID: "deadbeef123", Hostname: hostname})
+			waitForPosts(3)
+			state.AddServiceEntry(service.Service{ID: "deadbeef101", Hostname: hostname})
+			listener.looper.Wait()
+
+			So(len(delivered()), ShouldEqual, 1)
+			So(delivered()[0], ShouldContainSubstring, "deadbeef101")
+		})
+
+		Convey("signs the body when there is a secret", func() {
+			listener.Secret = "beowulf"
+			listener.Watch(state)
+			state.AddServiceEntry(service.Service{ID: "deadbeef123", Hostname: hostname})
+			listener.looper.Wait()
+
+			// What the receiver would compute
+			mac := hmac.New(sha256.New, []byte("beowulf"))
+			mac.Write([]byte(delivered()[0]))
+			expected := hex.EncodeToString(mac.Sum(nil))
+
+			lock.Lock()
+			defer lock.Unlock()
+			So(signatures[0], ShouldEqual, expected)
+		})
+
+		Convey("doesn't sign the body without a secret", func() {
+			listener.Watch(state)
+			state.AddServiceEntry(service.Service{ID: "deadbeef123", Hostname: hostname})
+			listener.looper.Wait()
+
+			lock.Lock()
+			defer lock.Unlock()
+			So(len(signatures), ShouldEqual, 1)
+			So(signatures[0], ShouldBeEmpty)
+		})
 	})
 }
 
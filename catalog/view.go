@@ -2,6 +2,7 @@ package catalog
 
 import (
 	"sort"
+	"strings"
 
 	"github.com/newrelic/sidecar/service"
 )
@@ -31,6 +32,52 @@ func (state *ServicesState) EachLocalService(fn func(hostname *string, serviceId
 	})
 }
 
+// Picks out part of the state. Empty fields match everything.
+type StateQuery struct {
+	ServicePrefix string // The start of the service name, as in ServiceName()
+	Node          string // Just this server
+	HealthyOnly   bool   // Only services that are Alive
+}
+
+// Copies of the servers and services that match the query, so they're
+// safe to use without holding any locks. When it's picking services,
+// servers that are left with none aren't included.
+func (state *ServicesState) Query(query StateQuery) map[string]*Server {
+	state.serversLock.RLock()
+	defer state.serversLock.RUnlock()
+
+	pickingServices := query.ServicePrefix != "" || query.HealthyOnly
+
+	servers := make(map[string]*Server)
+	for hostname, server := range state.Servers {
+		if query.Node != "" && hostname != query.Node {
+			continue
+		}
+
+		found := *server
+		found.Services = make(map[string]*service.Service, len(server.Services))
+		for id, svc := range server.Services {
+			if query.HealthyOnly && !svc.IsAlive() {
+				continue
+			}
+
+			if !strings.HasPrefix(state.ServiceName(svc), query.ServicePrefix) {
+				continue
+			}
+
+			svcCopy := *svc
+			found.Services[id] = &svcCopy
+		}
+
+		if pickingServices && len(found.Services) < 1 {
+			continue
+		}
+		servers[hostname] = &found
+	}
+
+	return servers
+}
+
 // Services -------------------------------
 type ServicesByAge []*service.Service
 
@@ -42,8 +89,16 @@ func (s ServicesByAge) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
+// Ties are broken by hostname and ID so the order is always the same,
+// otherwise the HAproxy config would change between identical states.
 func (s ServicesByAge) Less(i, j int) bool {
-	return s[i].Updated.Before(s[j].Updated)
+	if !s[i].Updated.Equal(s[j].Updated) {
+		return s[i].Updated.Before(s[j].Updated)
+	}
+	if s[i].Hostname != s[j].Hostname {
+		return s[i].Hostname < s[j].Hostname
+	}
+	return s[i].ID < s[j].ID
 }
 
 func (s *Server) SortedServices() []*service.Service {
@@ -74,11 +129,13 @@ func (s ServerByName) Less(i, j int) bool {
 }
 
 func (state *ServicesState) SortedServers() []*Server {
+	state.serversLock.RLock()
 	serversList := make([]*Server, 0, len(state.Servers))
 
 	for _, server := range state.Servers {
 		serversList = append(serversList, server)
 	}
+	state.serversLock.RUnlock()
 
 	sort.Sort(ServerByName(serversList))
 
@@ -1,6 +1,7 @@
 package catalog
 
 import (
+	"sort"
 	"testing"
 	"time"
 
@@ -68,6 +69,18 @@ func Test_ServerSorting(t *testing.T) {
 			So(ids[2], ShouldEqual, svcId3)
 		})
 
+		Convey("Sorts Services with the same Updated time by ID", func() {
+			for _, id := range []string{"cafe03", "cafe01", "cafe02"} {
+				state.AddServiceEntry(service.Service{ID: id, Hostname: hostname1, Updated: baseTime})
+			}
+
+			sortedServices := state.Servers[hostname1].SortedServices()
+
+			So(sortedServices[0].ID, ShouldEqual, "cafe01")
+			So(sortedServices[1].ID, ShouldEqual, "cafe02")
+			So(sortedServices[2].ID, ShouldEqual, "cafe03")
+		})
+
 		Convey("Returs a list of Services sorted on sorted Servers", func() {
 			service4 := service.Service{ID: svcId1, Hostname: hostname3, Updated: baseTime.Add(5 * time.Second)}
 			service5 := service.Service{ID: svcId2, Hostname: hostname3, Updated: baseTime}
@@ -92,3 +105,57 @@ func Test_ServerSorting(t *testing.T) {
 	})
 
 }
+
+func Test_Query(t *testing.T) {
+	Convey("Query()", t, func() {
+		state := NewServicesState()
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		state.AddServiceEntry(service.Service{ID: "deadbeef123", Name: "web-1", Image: "web", Hostname: hostname1, Updated: baseTime})
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef101", Name: "web-2", Image: "web", Hostname: hostname2, Updated: baseTime, Status: service.UNHEALTHY,
+		})
+		state.AddServiceEntry(service.Service{ID: "deadbeef105", Name: "api-1", Image: "api", Hostname: hostname2, Updated: baseTime})
+
+		ids := func(servers map[string]*Server) []string {
+			var found []string
+			for _, server := range servers {
+				for id := range server.Services {
+					found = append(found, id)
+				}
+			}
+			sort.Strings(found)
+			return found
+		}
+
+		Convey("Returns everything for an empty query", func() {
+			So(ids(state.Query(StateQuery{})), ShouldResemble, []string{"deadbeef101", "deadbeef105", "deadbeef123"})
+		})
+
+		Convey("Filters by service name prefix", func() {
+			servers := state.Query(StateQuery{ServicePrefix: "we"})
+			So(ids(servers), ShouldResemble, []string{"deadbeef101", "deadbeef123"})
+		})
+
+		Convey("Filters by node", func() {
+			servers := state.Query(StateQuery{Node: hostname2})
+			So(len(servers), ShouldEqual, 1)
+			So(ids(servers), ShouldResemble, []string{"deadbeef101", "deadbeef105"})
+		})
+
+		Convey("Leaves out unhealthy services, and servers with none left", func() {
+			servers := state.Query(StateQuery{ServicePrefix: "web", HealthyOnly: true})
+			So(ids(servers), ShouldResemble, []string{"deadbeef123"})
+			So(servers[hostname2], ShouldBeNil)
+		})
+
+		Convey("Returns copies", func() {
+			servers := state.Query(StateQuery{})
+			servers[hostname1].Services["deadbeef123"].Status = service.TOMBSTONE
+			delete(servers[hostname2].Services, "deadbeef105")
+
+			So(state.Servers[hostname1].Services["deadbeef123"].Status, ShouldEqual, service.ALIVE)
+			So(state.Servers[hostname2].Services["deadbeef105"], ShouldNotBeNil)
+		})
+	})
+}
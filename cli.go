@@ -11,6 +11,10 @@ type CliOpts struct {
 	ConfigFile  *string
 	ClusterName *string
 	CpuProfile  *bool
+	Validate    *bool
+	StrictEnv   *bool
+	DiffHAproxy *bool
+	HAproxyName *string
 }
 
 func exitWithError(err error, message string) {
@@ -23,11 +27,20 @@ func parseCommandLine() *CliOpts {
 	var opts CliOpts
 
 	opts.AdvertiseIP = kingpin.Flag("advertise-ip", "The address to advertise to the cluster").Short('a').String()
-	opts.ClusterIPs = kingpin.Flag("cluster-ip", "The cluster seed addresses").Required().Short('c').Strings()
+	opts.ClusterIPs = kingpin.Flag("cluster-ip", "The cluster seed addresses, or dnssrv:<name> to look them up").Short('c').Strings()
 	opts.ConfigFile = kingpin.Flag("config-file", "The config file to use").Short('f').Default("sidecar.toml").String()
 	opts.ClusterName = kingpin.Flag("cluster-name", "The cluster we're part of").Short('n').Default("default").String()
 	opts.CpuProfile = kingpin.Flag("cpuprofile", "Enable CPU profiling").Short('p').Bool()
+	opts.Validate = kingpin.Flag("validate", "Check the config and discovery backends, then exit").Bool()
+	opts.StrictEnv = kingpin.Flag("strict-env", "Fail if the config file uses undefined environment variables").Bool()
+	opts.DiffHAproxy = kingpin.Flag("haproxy-diff", "Show how the running Sidecar would change the HAproxy config, then exit").Bool()
+	opts.HAproxyName = kingpin.Flag("haproxy-name", "Which HAproxy to diff, when there's more than one").String()
 	kingpin.Parse()
 
+	// We don't need a cluster to validate the config, or to diff it
+	if len(*opts.ClusterIPs) == 0 && !*opts.Validate && !*opts.DiffHAproxy {
+		kingpin.UsageErrorf("required flag --cluster-ip not provided")
+	}
+
 	return &opts
 }
@@ -1,64 +1,244 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/envoy"
+)
+
+const (
+	REDACTED = "[redacted]" // Shown instead of secrets in /config
+
+	MODE_NORMAL   = "normal"
+	MODE_OBSERVER = "observer" // Follows the cluster without any services of its own
+)
+
+// $$, ${VAR} or $VAR in the config file. Anything else, like the $1 in a
+// name_replacement, isn't a variable.
+var envVarRegexp = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// What has to be escaped in a TOML basic string
+var tomlEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`,
 )
 
 type ListenerUrlsConfig struct {
-	Urls []string `toml:"urls"`
+	Urls       []string          `toml:"urls"`
+	Retries    int               `toml:"retries"`
+	RetryDelay duration          `toml:"retry_delay"`
+	Secrets    map[string]string `toml:"secrets"`
+}
+
+// Webhooks, e.g. Slack, to post to when a service loses its last healthy
+// instance and when it gets one back
+type AlertsConfig struct {
+	Urls        []string `toml:"urls"`
+	DedupWindow duration `toml:"dedup_window"`
 }
 
 type HAproxyConfig struct {
-	ReloadCmd    string `toml:"reload_command"`
-	VerifyCmd    string `toml:"verify_command"`
-	BindIP       string `toml:"bind_ip"`
-	TemplateFile string `toml:"template_file"`
-	ConfigFile   string `toml:"config_file"`
-	PidFile      string `toml:"pid_file"`
-	Disable      bool   `toml:"disable"`
-	User         string `toml:"user"`
-	Group        string `toml:"group"`
+	ReloadCmd      string            `toml:"reload_command"`
+	VerifyCmd      string            `toml:"verify_command"`
+	BindIP         string            `toml:"bind_ip"`
+	TemplateFile   string            `toml:"template_file"`
+	ConfigFile     string            `toml:"config_file"`
+	PidFile        string            `toml:"pid_file"`
+	Disable        bool              `toml:"disable"`
+	User           string            `toml:"user"`
+	Group          string            `toml:"group"`
+	StatsSocket    string            `toml:"stats_socket"`
+	RouteTag       string            `toml:"route_tag"`
+	RouteHeader    string            `toml:"route_header"`
+	CanaryHeader   string            `toml:"canary_header"`
+	CanaryValue    string            `toml:"canary_value"`
+	ReloadDebounce duration          `toml:"reload_debounce"`
+	TLSCerts       map[string]string `toml:"tls_certs"`
+	BindAddresses  map[string]string `toml:"bind_addresses"`
+	Balance        string            `toml:"balance"`
+	PanicMode      bool              `toml:"panic_mode"`
+	SocketReload   bool              `toml:"socket_reload"`
+	Name           string            `toml:"name"`
+	Include        []string          `toml:"include"`
+	Exclude        []string          `toml:"exclude"`
+
+	// Merged into the template's global and defaults sections
+	GlobalSettings   map[string]string `toml:"global_settings"`
+	DefaultsSettings map[string]string `toml:"defaults_settings"`
+
+	// Hold off after this many failed reloads in a row
+	FailureThreshold int      `toml:"failure_threshold"`
+	FailureBackoff   duration `toml:"failure_backoff"`
+
+	// Have HAproxy look the servers up in DNS
+	Resolvers ResolversConfig `toml:"resolvers"`
+
+	// To run more than one HAproxy, each [[haproxy.proxies]] entry starts
+	// with the [haproxy] settings and overrides what it needs to. They end
+	// up in Instances.
+	Proxies   []toml.Primitive `toml:"proxies" json:"-"`
+	Instances []HAproxyConfig  `toml:"-"`
+}
+
+type ResolversConfig struct {
+	Name            string   `toml:"name"`
+	Nameservers     []string `toml:"nameservers"`
+	HostnamePattern string   `toml:"hostname_pattern"`
+	HoldValid       duration `toml:"hold_valid"`
+	ResolveRetries  int      `toml:"resolve_retries"`
+	TimeoutRetry    duration `toml:"timeout_retry"`
+}
+
+type EnvoyConfig struct {
+	ConfigDir      string   `toml:"config_dir"`
+	BindIP         string   `toml:"bind_ip"`
+	AdminPort      int      `toml:"admin_port"`
+	ReloadDebounce duration `toml:"reload_debounce"`
 }
 
 type ServicesConfig struct {
-	NameMatch  string `toml:"name_match"`
-	NameRegexp *regexp.Regexp
+	NameMatch       string         `toml:"name_match"`
+	NameRegexp      *regexp.Regexp `json:"-"`
+	NameRewrite     string         `toml:"name_rewrite"`
+	NameReplacement string         `toml:"name_replacement"`
+	RewriteRegexp   *regexp.Regexp `json:"-"`
+	Include         []string       `toml:"include"`
+	Exclude         []string       `toml:"exclude"`
 }
 
 type SidecarConfig struct {
-	ExcludeIPs           []string `toml:"exclude_ips"`
-	Discovery            []string `toml:"discovery"`
-	StatsAddr            string   `toml:"stats_addr"`
-	PushPullInterval     duration `toml:"push_pull_interval"`
-	GossipMessages       int      `toml:"gossip_messages"`
-	LoggingFormat        string   `toml:"logging_format"`
-	LoggingLevel         string   `toml:"logging_level"`
-	DefaultCheckEndpoint string   `toml:"default_check_endpoint"`
+	ExcludeIPs             []string          `toml:"exclude_ips"`
+	PreferIPv6             bool              `toml:"prefer_ipv6"`
+	Discovery              []string          `toml:"discovery"`
+	StatsAddr              string            `toml:"stats_addr"`
+	StatsFormat            string            `toml:"stats_format"`
+	Mode                   string            `toml:"mode"`
+	PushPullInterval       duration          `toml:"push_pull_interval"`
+	GossipMessages         int               `toml:"gossip_messages"`
+	LoggingFormat          string            `toml:"logging_format"`
+	LoggingLevel           string            `toml:"logging_level"`
+	DefaultCheckEndpoint   string            `toml:"default_check_endpoint"`
+	HealthyThreshold       int               `toml:"healthy_threshold"`
+	UnhealthyThreshold     int               `toml:"unhealthy_threshold"`
+	ProxyBackend           string            `toml:"proxy_backend"`
+	SnapshotFile           string            `toml:"snapshot_file"`
+	SnapshotInterval       duration          `toml:"snapshot_interval"`
+	DrainTimeout           duration          `toml:"drain_timeout"`
+	FailureGrace           duration          `toml:"failure_grace"`
+	LeaveDrainGrace        duration          `toml:"leave_drain_grace"`
+	DiscoveryGrace         duration          `toml:"discovery_grace"`
+	StallTimeout           duration          `toml:"stall_timeout"`
+	JoinRetryTimeout       duration          `toml:"join_retry_timeout"`
+	PrometheusEnabled      bool              `toml:"prometheus_enabled"`
+	EncryptionKey          stringList        `toml:"encryption_key"`
+	NetworkMode            string            `toml:"network_mode"`
+	MaxTombstones          int               `toml:"max_tombstones"`
+	AliveLifespan          duration          `toml:"alive_lifespan"`
+	AliveSleepInterval     duration          `toml:"alive_sleep_interval"`
+	TombstoneSleepInterval duration          `toml:"tombstone_sleep_interval"`
+	NodeTags               map[string]string `toml:"node_tags"`
+	LooperJitter           float64           `toml:"looper_jitter"`
+	IgnoreForeignClusters  bool              `toml:"ignore_foreign_clusters"`
+	TracingEndpoint        string            `toml:"tracing_endpoint"`
+	MaxConcurrentChecks    int               `toml:"max_concurrent_checks"`
+	HealthCheckTimeout     duration          `toml:"health_check_timeout"`
+	BindAddr               string            `toml:"bind_addr"`
+	ApiPort                int               `toml:"api_port"`
+	GossipPort             int               `toml:"gossip_port"`
+	GossipBindPort         int               `toml:"gossip_bind_port"`
+	BindIP                 string            `toml:"bind_ip"`
+	PauseGossip            bool              `toml:"pause_gossip"`
+	Environment            string            `toml:"environment"`
+	ApiAuth                ApiAuthConfig     `toml:"api_auth"`
+}
+
+// Credentials for the HTTP API, either for basic auth or a bearer token.
+// When neither is set, the API is open.
+type ApiAuthConfig struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Token    string `toml:"token"`
 }
 
 type DockerConfig struct {
-	DockerURL string `toml:"docker_url"`
+	DockerURL         stringList        `toml:"docker_url"`
+	CertFile          string            `toml:"cert_file"`
+	KeyFile           string            `toml:"key_file"`
+	CAFile            string            `toml:"ca_file"`
+	MatchLabels       map[string]string `toml:"match_labels"`
+	ExcludeLabels     map[string]string `toml:"exclude_labels"`
+	EventMode         bool              `toml:"event_mode"`
+	ResyncInterval    duration          `toml:"resync_interval"`
+	TrustDockerHealth bool              `toml:"trust_docker_health"`
+	ServicePortEnv    string            `toml:"service_port_env"`
+}
+
+type KubernetesConfig struct {
+	KubeConfig string `toml:"kube_config"`
+	Namespace  string `toml:"namespace"`
+}
+
+type ConsulConfig struct {
+	ConsulURL  string `toml:"consul_url"`
+	Datacenter string `toml:"datacenter"`
+}
+
+type NomadConfig struct {
+	NomadURL  string `toml:"nomad_url"`
+	Region    string `toml:"region"`
+	Namespace string `toml:"namespace"`
+}
+
+type EcsConfig struct {
+	MetadataURL string `toml:"metadata_url"`
 }
 
 type StaticConfig struct {
-	ConfigFile string `toml:"config_file"`
+	ConfigFile stringList `toml:"config_file"`
 }
 
 type Config struct {
-	Sidecar         SidecarConfig      `toml:"sidecar"`
-	DockerDiscovery DockerConfig       `toml:"docker_discovery"`
-	StaticDiscovery StaticConfig       `toml:"static_discovery"`
-	Services        ServicesConfig     `toml:"services"`
-	HAproxy         HAproxyConfig      `toml:"haproxy"`
-	Listeners       ListenerUrlsConfig `toml:"listeners"`
+	Sidecar             SidecarConfig      `toml:"sidecar"`
+	DockerDiscovery     DockerConfig       `toml:"docker_discovery"`
+	StaticDiscovery     StaticConfig       `toml:"static_discovery"`
+	KubernetesDiscovery KubernetesConfig   `toml:"kubernetes_discovery"`
+	ConsulDiscovery     ConsulConfig       `toml:"consul_discovery"`
+	NomadDiscovery      NomadConfig        `toml:"nomad_discovery"`
+	EcsDiscovery        EcsConfig          `toml:"ecs_discovery"`
+	Services            ServicesConfig     `toml:"services"`
+	HAproxy             HAproxyConfig      `toml:"haproxy"`
+	Envoy               EnvoyConfig        `toml:"envoy"`
+	Listeners           ListenerUrlsConfig `toml:"listeners"`
+	Alerts              AlertsConfig       `toml:"alerts"`
 }
 
 func setDefaults(config *Config) {
-	config.DockerDiscovery.DockerURL = "tcp://localhost:2375"
-	config.StaticDiscovery.ConfigFile = "static.json"
+	config.DockerDiscovery.DockerURL = stringList{"tcp://localhost:2375"}
+	config.StaticDiscovery.ConfigFile = stringList{"static.json"}
+	config.ConsulDiscovery.ConsulURL = "http://localhost:8500"
+	config.NomadDiscovery.NomadURL = "http://localhost:4646"
+	config.Sidecar.ProxyBackend = "haproxy"
+	config.Sidecar.NetworkMode = "lan"
+	config.Sidecar.Mode = MODE_NORMAL
+	config.Sidecar.AliveLifespan = duration{catalog.ALIVE_LIFESPAN}
+	config.Sidecar.AliveSleepInterval = duration{catalog.ALIVE_SLEEP_INTERVAL}
+	config.Sidecar.TombstoneSleepInterval = duration{catalog.TOMBSTONE_SLEEP_INTERVAL}
+	config.Sidecar.LooperJitter = DEFAULT_LOOPER_JITTER
+	config.Sidecar.StallTimeout = duration{DEFAULT_STALL_TIMEOUT}
+	config.Sidecar.JoinRetryTimeout = duration{DEFAULT_JOIN_RETRY_TIMEOUT}
+	config.Sidecar.BindAddr = DEFAULT_BIND_ADDR
+	config.Sidecar.ApiPort = DEFAULT_API_PORT
+	config.Envoy.ConfigDir = envoy.DEFAULT_CONFIG_DIR
+	config.Envoy.BindIP = "0.0.0.0"
 }
 
 type duration struct {
@@ -71,18 +251,303 @@ func (d *duration) UnmarshalText(text []byte) error {
 	return err
 }
 
-func parseConfig(path string) Config {
+// So that durations read like they do in the config file, e.g. in /config
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// A stringList can be configured either as a single string or as a list
+// of strings, for backward compatibility with single-valued settings.
+type stringList []string
+
+func (s *stringList) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*s = stringList{value}
+	case []interface{}:
+		list := make(stringList, 0, len(value))
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("Expected a list of strings, got %v", value)
+			}
+			list = append(list, str)
+		}
+		*s = list
+	default:
+		return fmt.Errorf("Expected a string or a list of strings, got %v", value)
+	}
+
+	return nil
+}
+
+// A copy of the config that's safe to show, with the secrets replaced.
+// Ones that aren't set are left empty, so you can still tell.
+func (config Config) redacted() Config {
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return REDACTED
+	}
+
+	keys := make(stringList, len(config.Sidecar.EncryptionKey))
+	for i, key := range config.Sidecar.EncryptionKey {
+		keys[i] = redact(key)
+	}
+	config.Sidecar.EncryptionKey = keys
+
+	config.Sidecar.ApiAuth.Password = redact(config.Sidecar.ApiAuth.Password)
+	config.Sidecar.ApiAuth.Token = redact(config.Sidecar.ApiAuth.Token)
+
+	// Webhook URLs are secrets in themselves
+	alerts := make([]string, len(config.Alerts.Urls))
+	for i, alertUrl := range config.Alerts.Urls {
+		alerts[i] = redact(alertUrl)
+	}
+	config.Alerts.Urls = alerts
+
+	listeners := make([]string, len(config.Listeners.Urls))
+	for i, listenerUrl := range config.Listeners.Urls {
+		listeners[i] = redactUrl(listenerUrl)
+	}
+	config.Listeners.Urls = listeners
+
+	if config.Listeners.Secrets != nil {
+		secrets := make(map[string]string, len(config.Listeners.Secrets))
+		for listenerUrl, secret := range config.Listeners.Secrets {
+			secrets[redactUrl(listenerUrl)] = redact(secret)
+		}
+		config.Listeners.Secrets = secrets
+	}
+
+	return config
+}
+
+// Strips any credentials or tokens from a URL, leaving where it goes.
+// One we can't parse is redacted entirely.
+func redactUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return REDACTED
+	}
+
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.ForceQuery = false
+	parsed.Fragment = ""
+	return parsed.String()
+}
+
+// Decode the [[haproxy.proxies]] entries on top of the [haproxy] settings.
+// Each one needs its own name, config file and pid file, or they'd trip
+// over each other.
+func haproxyInstances(md toml.MetaData, defaults HAproxyConfig) ([]HAproxyConfig, error) {
+	proxies := defaults.Proxies
+	defaults.Proxies = nil
+	defaults.Name = ""
+
+	var instances []HAproxyConfig
+	names := make(map[string]bool)
+	files := make(map[string]bool)
+
+	for i, primitive := range proxies {
+		instance := defaults
+
+		// Decoding adds to a map rather than replacing it, so each
+		// instance needs its own
+		instance.TLSCerts = make(map[string]string, len(defaults.TLSCerts))
+		for port, cert := range defaults.TLSCerts {
+			instance.TLSCerts[port] = cert
+		}
+		instance.BindAddresses = make(map[string]string, len(defaults.BindAddresses))
+		for name, address := range defaults.BindAddresses {
+			instance.BindAddresses[name] = address
+		}
+
+		instance.GlobalSettings = make(map[string]string, len(defaults.GlobalSettings))
+		for key, value := range defaults.GlobalSettings {
+			instance.GlobalSettings[key] = value
+		}
+		instance.DefaultsSettings = make(map[string]string, len(defaults.DefaultsSettings))
+		for key, value := range defaults.DefaultsSettings {
+			instance.DefaultsSettings[key] = value
+		}
+
+		err := md.PrimitiveDecode(primitive, &instance)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse haproxy.proxies[%d]: %s", i, err.Error())
+		}
+
+		if instance.Name == "" {
+			return nil, fmt.Errorf("Invalid haproxy.proxies[%d]: it needs a name", i)
+		}
+
+		if names[instance.Name] {
+			return nil, fmt.Errorf("Invalid haproxy.proxies: '%s' is used more than once", instance.Name)
+		}
+		names[instance.Name] = true
+
+		if files[instance.ConfigFile] || files[instance.PidFile] {
+			return nil, fmt.Errorf("Invalid haproxy.proxies: '%s' needs its own config_file and pid_file", instance.Name)
+		}
+		files[instance.ConfigFile] = true
+		files[instance.PidFile] = true
+
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
+
+func parseConfig(path string, strictEnv bool) Config {
+	config, err := loadConfig(path, strictEnv)
+	exitWithError(err, "Invalid config file")
+
+	return config
+}
+
+// Expand environment variables in the config file text. $$ is a literal $.
+// Undefined variables are left as they are, because capture groups in a
+// name_replacement look just the same, unless strict is set. Comment lines
+// are skipped. Values in "double quoted" strings are escaped, so a quote or
+// backslash in one can't break the TOML.
+func expandEnv(text string, strict bool) (string, error) {
+	var undefined []string
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		var expanded bytes.Buffer
+		last := 0
+		for _, match := range envVarRegexp.FindAllStringIndex(line, -1) {
+			ref := line[match[0]:match[1]]
+			expanded.WriteString(line[last:match[0]])
+			last = match[1]
+
+			if ref == "$$" {
+				expanded.WriteString("$")
+				continue
+			}
+
+			name := strings.Trim(ref, "${}")
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				undefined = append(undefined, name)
+				expanded.WriteString(ref)
+				continue
+			}
+
+			if inBasicString(line[:match[0]]) {
+				value = tomlEscaper.Replace(value)
+			}
+			expanded.WriteString(value)
+		}
+		expanded.WriteString(line[last:])
+		lines[i] = expanded.String()
+	}
+
+	if strict && len(undefined) > 0 {
+		return "", fmt.Errorf("Undefined environment variables: %s", strings.Join(undefined, ", "))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// Does this start of a line leave us inside a "double quoted" string?
+// Single quoted strings can't have escapes, so they don't count.
+func inBasicString(prefix string) bool {
+	var quote rune
+	escaped := false
+	for _, char := range prefix {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && char == '\\':
+			escaped = true
+		case quote == 0 && (char == '"' || char == '\''):
+			quote = char
+		case char == quote:
+			quote = 0
+		}
+	}
+	return quote == '"'
+}
+
+// Load and check the config file, without exiting on errors, so that
+// --validate can report them
+func loadConfig(path string, strictEnv bool) (Config, error) {
 	var config Config
 
 	setDefaults(&config)
 
-	_, err := toml.DecodeFile(path, &config)
+	contents, err := ioutil.ReadFile(path)
 	if err != nil {
-		exitWithError(err, "Failed to parse config file")
+		return config, fmt.Errorf("Failed to read config file: %s", err.Error())
+	}
+
+	text, err := expandEnv(string(contents), strictEnv)
+	if err != nil {
+		return config, err
+	}
+
+	md, err := toml.Decode(text, &config)
+	if err != nil {
+		return config, fmt.Errorf("Failed to parse config file: %s", err.Error())
+	}
+
+	config.HAproxy.Instances, err = haproxyInstances(md, config.HAproxy)
+	if err != nil {
+		return config, err
 	}
 
 	config.Services.NameRegexp, err = regexp.Compile(config.Services.NameMatch)
-	exitWithError(err, "Cant compile name_match regex")
+	if err != nil {
+		return config, fmt.Errorf("Cant compile name_match regex: %s", err.Error())
+	}
 
-	return config
+	if len(config.Services.NameRewrite) > 0 {
+		config.Services.RewriteRegexp, err = regexp.Compile(config.Services.NameRewrite)
+		if err != nil {
+			return config, fmt.Errorf("Cant compile name_rewrite regex: %s", err.Error())
+		}
+	}
+
+	var patterns []string
+	patterns = append(patterns, config.Services.Include...)
+	patterns = append(patterns, config.Services.Exclude...)
+	patterns = append(patterns, config.HAproxy.Include...)
+	patterns = append(patterns, config.HAproxy.Exclude...)
+	for _, instance := range config.HAproxy.Instances {
+		patterns = append(patterns, instance.Include...)
+		patterns = append(patterns, instance.Exclude...)
+	}
+
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return config, fmt.Errorf("Invalid service name pattern '%s': %s", pattern, err.Error())
+		}
+	}
+
+	switch config.Sidecar.StatsFormat {
+	case "", "statsd", "dogstatsd":
+	default:
+		return config, fmt.Errorf("Unknown stats_format '%s'", config.Sidecar.StatsFormat)
+	}
+
+	switch config.Sidecar.Mode {
+	case "", MODE_NORMAL, MODE_OBSERVER:
+	default:
+		return config, fmt.Errorf("Unknown mode '%s'", config.Sidecar.Mode)
+	}
+
+	auth := config.Sidecar.ApiAuth
+	if (auth.Username == "") != (auth.Password == "") {
+		return config, fmt.Errorf("Invalid api_auth: both a username and a password are needed")
+	}
+
+	return config, nil
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_expandEnv(t *testing.T) {
+	Convey("expandEnv()", t, func() {
+		os.Setenv("SIDECAR_TEST_CLUSTER", "staging")
+		defer os.Unsetenv("SIDECAR_TEST_CLUSTER")
+
+		Convey("Expands defined variables in both forms", func() {
+			text, err := expandEnv(`name = "${SIDECAR_TEST_CLUSTER}-$SIDECAR_TEST_CLUSTER"`, true)
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, `name = "staging-staging"`)
+		})
+
+		Convey("Leaves undefined variables alone", func() {
+			text, err := expandEnv(`name_replacement = "${name}-$SIDECAR_TEST_MISSING"`, false)
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, `name_replacement = "${name}-$SIDECAR_TEST_MISSING"`)
+		})
+
+		Convey("Fails on undefined variables when strict", func() {
+			_, err := expandEnv(`name = "${SIDECAR_TEST_CLUSTER}-$SIDECAR_TEST_MISSING"`, true)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "SIDECAR_TEST_MISSING")
+		})
+
+		Convey("Turns $$ into a literal $", func() {
+			text, err := expandEnv(`name_replacement = "$${name}" # costs $$5`, true)
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, `name_replacement = "${name}" # costs $5`)
+		})
+
+		Convey("Doesn't treat capture groups or a lone $ as variables", func() {
+			text, err := expandEnv(`name_match = "^/(.+)$"
+name_replacement = "$1"`, true)
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, `name_match = "^/(.+)$"
+name_replacement = "$1"`)
+		})
+
+		Convey("Skips comment lines, even when strict", func() {
+			text, err := expandEnv(`  # environment = "${SIDECAR_TEST_MISSING}"
+name = "$SIDECAR_TEST_CLUSTER"`, true)
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, `  # environment = "${SIDECAR_TEST_MISSING}"
+name = "staging"`)
+		})
+
+		Convey("Escapes values in double quoted strings", func() {
+			os.Setenv("SIDECAR_TEST_PASSWORD", `s3"cr\3t`)
+			defer os.Unsetenv("SIDECAR_TEST_PASSWORD")
+
+			text, err := expandEnv(`password = "$SIDECAR_TEST_PASSWORD" # "$SIDECAR_TEST_PASSWORD"`, true)
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, `password = "s3\"cr\\3t" # "s3\"cr\\3t"`)
+
+			text, err = expandEnv(`password = 's3"cr\3t' # $SIDECAR_TEST_PASSWORD`, true)
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, `password = 's3"cr\3t' # s3"cr\3t`)
+		})
+	})
+}
+
+func Test_loadConfig(t *testing.T) {
+	Convey("loadConfig()", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "sidecar-config")
+		defer os.RemoveAll(tmpDir)
+
+		configFile := filepath.Join(tmpDir, "sidecar.toml")
+		ioutil.WriteFile(configFile, []byte(`
+[sidecar]
+environment = "${SIDECAR_TEST_CLUSTER}"
+`), 0644)
+
+		Convey("Expands environment variables before parsing", func() {
+			os.Setenv("SIDECAR_TEST_CLUSTER", "staging")
+			defer os.Unsetenv("SIDECAR_TEST_CLUSTER")
+
+			config, err := loadConfig(configFile, true)
+			So(err, ShouldBeNil)
+			So(config.Sidecar.Environment, ShouldEqual, "staging")
+		})
+
+		Convey("Keeps quotes and backslashes in the values", func() {
+			os.Setenv("SIDECAR_TEST_CLUSTER", `stag"ing\`)
+			defer os.Unsetenv("SIDECAR_TEST_CLUSTER")
+
+			config, err := loadConfig(configFile, true)
+			So(err, ShouldBeNil)
+			So(config.Sidecar.Environment, ShouldEqual, `stag"ing\`)
+		})
+
+		Convey("Fails on undefined variables when strict", func() {
+			_, err := loadConfig(configFile, true)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DIFF_TIMEOUT = 10 * time.Second // How long we wait for the running Sidecar
+)
+
+// Ask the Sidecar running on this host how its HAproxy config would change
+// and print the diff, without reloading anything. Like diff, it returns 0
+// when nothing would change, 1 when something would, and 2 when we
+// couldn't find out.
+func haproxyDiff(configFile string, strictEnv bool, proxyName string, out io.Writer) int {
+	config, err := loadConfig(configFile, strictEnv)
+	if err != nil {
+		fmt.Fprintf(out, "Invalid config file %s: %s\n", configFile, err.Error())
+		return 2
+	}
+
+	// It listens everywhere by default, but we only need to get to it here
+	host := config.Sidecar.BindAddr
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	diffURL := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, strconv.Itoa(config.Sidecar.ApiPort)),
+		Path:   "/backends/diff",
+	}
+	if proxyName != "" {
+		diffURL.RawQuery = url.Values{"proxy": {proxyName}}.Encode()
+	}
+
+	req, _ := http.NewRequest("GET", diffURL.String(), nil)
+	auth := config.Sidecar.ApiAuth
+	if auth.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+	} else if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	client := &http.Client{Timeout: DIFF_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(out, "Can't reach Sidecar: %s\n", err.Error())
+		return 2
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(out, "Can't read the diff from Sidecar: %s\n", err.Error())
+		return 2
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(out, "Sidecar returned %s: %s", resp.Status, body)
+		return 2
+	}
+
+	if len(body) == 0 {
+		return 0
+	}
+
+	out.Write(body)
+	return 1
+}
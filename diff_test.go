@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_haproxyDiff(t *testing.T) {
+	Convey("haproxyDiff()", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "sidecar-diff")
+		defer os.RemoveAll(tmpDir)
+
+		var diff string
+		var requested *http.Request
+		server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, req *http.Request) {
+			requested = req
+			if req.URL.Query().Get("proxy") == "missing" {
+				http.Error(response, "No such HAproxy: missing", http.StatusNotFound)
+				return
+			}
+			response.Write([]byte(diff))
+		}))
+		defer server.Close()
+
+		_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		configFile := filepath.Join(tmpDir, "sidecar.toml")
+		ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`
+[sidecar]
+api_port = %s
+
+[sidecar.api_auth]
+token = "sekrit"
+`, port)), 0644)
+
+		var out bytes.Buffer
+
+		Convey("Returns 0 when nothing would change", func() {
+			So(haproxyDiff(configFile, false, "", &out), ShouldEqual, 0)
+			So(out.String(), ShouldBeEmpty)
+			So(requested.URL.Path, ShouldEqual, "/backends/diff")
+			So(requested.Header.Get("Authorization"), ShouldEqual, "Bearer sekrit")
+		})
+
+		Convey("Prints the diff and returns 1 when something would", func() {
+			diff = "--- /etc/haproxy.cfg\n+++ /etc/haproxy.cfg (new)\n"
+
+			So(haproxyDiff(configFile, false, "internal", &out), ShouldEqual, 1)
+			So(out.String(), ShouldEqual, diff)
+			So(requested.URL.Query().Get("proxy"), ShouldEqual, "internal")
+		})
+
+		Convey("Returns 2 when it can't find out", func() {
+			So(haproxyDiff(configFile, false, "missing", &out), ShouldEqual, 2)
+			So(out.String(), ShouldContainSubstring, "No such HAproxy")
+
+			server.Close()
+			So(haproxyDiff(configFile, false, "", &out), ShouldEqual, 2)
+			So(out.String(), ShouldContainSubstring, "Can't reach Sidecar")
+		})
+	})
+}
@@ -0,0 +1,257 @@
+package discovery
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/service"
+	"github.com/relistan/go-director"
+)
+
+const (
+	CONSUL_CLIENT_TIMEOUT = 3 * time.Second
+)
+
+// The parts of a Consul health API entry that we care about
+type ConsulHealthEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Tags    []string
+		Address string
+		Port    int64
+	}
+	Checks []struct {
+		CheckID string
+		Status  string
+	}
+}
+
+type ConsulDiscovery struct {
+	ConsulURL  string            // The Consul agent/server to talk to
+	Datacenter string            // Optional datacenter to query
+	Hostname   string            // The Consul node name we announce services for
+	Client     *http.Client      // The HTTP client used to talk to Consul
+	services   []service.Service // The list of services we know about
+	labels     map[string]map[string]string
+	sync.RWMutex
+}
+
+func NewConsulDiscovery(consulURL string) *ConsulDiscovery {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Errorf("Error getting hostname! %s", err.Error())
+	}
+
+	return &ConsulDiscovery{
+		ConsulURL: strings.TrimRight(consulURL, "/"),
+		Hostname:  hostname,
+		Client:    &http.Client{Timeout: CONSUL_CLIENT_TIMEOUT},
+		labels:    make(map[string]map[string]string),
+	}
+}
+
+// HealthCheck uses the Consul service tags in the form "key=value" in the
+// same way that the DockerDiscovery uses container labels.
+func (d *ConsulDiscovery) HealthCheck(svc *service.Service) (string, string) {
+	d.RLock()
+	defer d.RUnlock()
+
+	labels, ok := d.labels[svc.ID]
+	if !ok {
+		return "", ""
+	}
+
+	return labels["HealthCheck"], labels["HealthCheckArgs"]
+}
+
+func (d *ConsulDiscovery) CheckConfig(svc *service.Service) CheckConfig {
+	d.RLock()
+	defer d.RUnlock()
+
+	return CheckConfigFromLabels(d.labels[svc.ID])
+}
+
+func (d *ConsulDiscovery) Services() []service.Service {
+	d.RLock()
+	defer d.RUnlock()
+
+	svcList := make([]service.Service, len(d.services))
+	copy(svcList, d.services)
+
+	return svcList
+}
+
+// The main loop, poll the Consul catalog continuously.
+func (d *ConsulDiscovery) Run(looper director.Looper) {
+	go looper.Loop(func() error {
+		d.getServices()
+		return nil
+	})
+}
+
+func (d *ConsulDiscovery) getServices() {
+	var catalog map[string][]string
+	err := d.get("/v1/catalog/services", &catalog)
+	if err != nil {
+		log.WithField("event", "discovery_failed").Errorf("Error listing Consul services: %s", err.Error())
+		return
+	}
+
+	// Iterate in a stable order so the service list doesn't shuffle
+	names := make([]string, 0, len(catalog))
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	services := make([]service.Service, 0, len(names))
+	labels := make(map[string]map[string]string, len(names))
+
+	for _, name := range names {
+		var entries []ConsulHealthEntry
+		err := d.get("/v1/health/service/"+url.QueryEscape(name), &entries)
+		if err != nil {
+			log.Errorf("Error fetching health for Consul service %s: %s", name, err.Error())
+			// Don't half-update: keep what we had until the next poll
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.Node.Node != d.Hostname || entry.isCritical() {
+				continue
+			}
+
+			svc, svcLabels := consulToService(&entry, d.Hostname)
+
+			// Skip services that are purposely excluded from discovery.
+			if svcLabels["SidecarDiscover"] == "false" {
+				continue
+			}
+
+			services = append(services, svc)
+			labels[svc.ID] = svcLabels
+		}
+	}
+
+	d.Lock()
+	d.services = services
+	d.labels = labels
+	d.Unlock()
+}
+
+// Validate checks that we can read the Consul catalog
+func (d *ConsulDiscovery) Validate() error {
+	var catalog map[string][]string
+	err := d.get("/v1/catalog/services", &catalog)
+	if err != nil {
+		return fmt.Errorf("Can't list Consul services: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (d *ConsulDiscovery) get(path string, result interface{}) error {
+	reqUrl := d.ConsulURL + path
+	if d.Datacenter != "" {
+		reqUrl = reqUrl + "?dc=" + url.QueryEscape(d.Datacenter)
+	}
+
+	resp, err := d.Client.Get(reqUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Bad status code from Consul (%d)", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Any critical check means Consul considers the instance down
+func (e *ConsulHealthEntry) isCritical() bool {
+	for _, check := range e.Checks {
+		if check.Status == "critical" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Format a Consul health entry into a service. Tags in the form "key=value"
+// are treated like Docker labels, so "ProxyMode", "ProxyWeight",
+// "ProxySticky", "ServicePort_xxx", "Metadata_xxx" and "Tag_xxx" work as expected.
+func consulToService(entry *ConsulHealthEntry, hostname string) (service.Service, map[string]string) {
+	var svc service.Service
+
+	labels := make(map[string]string, len(entry.Service.Tags))
+	for _, tag := range entry.Service.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+
+	svc.ID = consulServiceID(entry.Node.Node, entry.Service.ID)
+	svc.Name = entry.Service.Service
+	svc.Image = entry.Service.Service
+	svc.Created = time.Unix(0, 0).UTC()
+	svc.Updated = time.Now().UTC()
+	svc.Hostname = hostname
+	svc.Status = service.ALIVE
+
+	if mode, ok := labels["ProxyMode"]; ok {
+		svc.ProxyMode = mode
+	} else {
+		svc.ProxyMode = "http"
+	}
+
+	svc.Metadata = service.MetadataFromLabels(labels)
+	svc.Tags = service.TagsFromLabels(labels)
+	svc.Weight = service.WeightFromLabels(labels)
+	svc.Sticky, svc.StickyCookie = service.StickyFromLabels(labels)
+
+	port := service.Port{Type: "tcp", Port: entry.Service.Port}
+
+	svcPortLabel := fmt.Sprintf("ServicePort_%d", entry.Service.Port)
+	if value, ok := labels[svcPortLabel]; ok {
+		svcPortInt, err := strconv.Atoi(value)
+		if err != nil {
+			log.Errorf("Error converting tag value for %s to integer: %s",
+				svcPortLabel,
+				err.Error(),
+			)
+		} else {
+			port.ServicePort = int64(svcPortInt)
+		}
+	}
+
+	svc.Ports = []service.Port{port}
+
+	return svc, labels
+}
+
+// Consul service IDs are arbitrary strings, so we hash them down to the
+// same short hex format as Docker IDs. They must be stable across polls.
+func consulServiceID(node string, serviceID string) string {
+	sum := sha1.Sum([]byte(node + "/" + serviceID))
+	return hex.EncodeToString(sum[:])[:12]
+}
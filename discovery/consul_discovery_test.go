@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/mockhttp"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	consulCatalog = `{"consul": [], "web": ["ServicePort_8080=10100"]}`
+	consulHealth  = `[
+		{
+			"Node": {"Node": "shakespeare", "Address": "10.0.0.1"},
+			"Service": {"ID": "web-1", "Service": "web", "Tags": ["ServicePort_8080=10100", "HealthCheck=HttpGet", "HealthCheckArgs=http://:8080/", "HealthCheckInterval=10s", "Metadata_canary=true"], "Port": 8080},
+			"Checks": [{"CheckID": "serfHealth", "Status": "passing"}]
+		},
+		{
+			"Node": {"Node": "shakespeare", "Address": "10.0.0.1"},
+			"Service": {"ID": "web-2", "Service": "web", "Tags": [], "Port": 8081},
+			"Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "web", "Status": "critical"}]
+		},
+		{
+			"Node": {"Node": "marlowe", "Address": "10.0.0.2"},
+			"Service": {"ID": "web-3", "Service": "web", "Tags": [], "Port": 8080},
+			"Checks": [{"CheckID": "serfHealth", "Status": "passing"}]
+		}
+	]`
+)
+
+func Test_ConsulDiscovery(t *testing.T) {
+	Convey("Working with Consul services", t, func() {
+		expectations := []mockhttp.HttpExpectation{
+			{Expect: "/v1/catalog/services", Send: consulCatalog, Content: "application/json"},
+			{Expect: "/v1/health/service/web", Send: consulHealth, Content: "application/json"},
+			{Expect: "/v1/health/service/consul", Send: "[]", Content: "application/json"},
+		}
+
+		disco := NewConsulDiscovery("http://consul.example.com:8500/")
+		disco.Hostname = hostname
+		disco.Client = mockhttp.ClientWithExpectations(expectations)
+
+		Convey("New() configures the URL without a trailing slash", func() {
+			So(disco.ConsulURL, ShouldEqual, "http://consul.example.com:8500")
+		})
+
+		Convey("getServices() finds healthy instances on this node", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(len(services), ShouldEqual, 1)
+			So(services[0].Name, ShouldEqual, "web")
+			So(services[0].Hostname, ShouldEqual, hostname)
+			So(services[0].Ports[0].Port, ShouldEqual, 8080)
+			So(services[0].Ports[0].ServicePort, ShouldEqual, 10100)
+		})
+
+		Convey("getServices() keeps IDs stable across polls", func() {
+			disco.getServices()
+			first := disco.Services()
+			disco.getServices()
+			second := disco.Services()
+
+			So(len(first[0].ID), ShouldEqual, 12)
+			So(first[0].ID, ShouldEqual, second[0].ID)
+		})
+
+		Convey("getServices() leaves the services alone on errors", func() {
+			disco.getServices()
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/v1/catalog/services", Err: errors.New("Oh no!")},
+			})
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 1)
+		})
+
+		Convey("HealthCheck() uses the service tags", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			check, args := disco.HealthCheck(&services[0])
+			So(check, ShouldEqual, "HttpGet")
+			So(args, ShouldEqual, "http://:8080/")
+		})
+
+		Convey("CheckConfig() uses the service tags", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(disco.CheckConfig(&services[0]).Interval, ShouldEqual, 10*time.Second)
+		})
+
+		Convey("getServices() picks up metadata tags", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(services[0].Metadata["canary"], ShouldEqual, "true")
+		})
+
+		Convey("Validate() checks that we can read the catalog", func() {
+			So(disco.Validate(), ShouldBeNil)
+
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/v1/catalog/services", Err: errors.New("Oh no!")},
+			})
+			So(disco.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Run() polls the catalog", func() {
+			looper := director.NewFreeLooper(director.ONCE, make(chan error))
+			disco.Run(looper)
+			looper.Wait()
+
+			So(len(disco.Services()), ShouldEqual, 1)
+		})
+	})
+}
@@ -1,14 +1,22 @@
 package discovery
 
 import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/relistan/go-director"
+	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
 	"github.com/newrelic/sidecar/service"
+	"github.com/newrelic/sidecar/tracing"
+	"github.com/relistan/go-director"
 )
 
 const (
-	SLEEP_INTERVAL = 1 * time.Second
+	SLEEP_INTERVAL      = 1 * time.Second
+	CHECK_HEADER_PREFIX = "HealthCheckHeader_" // Labels like "HealthCheckHeader_X-Token=abc" are sent with HTTP checks
 )
 
 // A Discoverer is responsible for findind services that we care
@@ -20,15 +28,132 @@ type Discoverer interface {
 	Services() []service.Service
 	// Get the health check and health check args for a service
 	HealthCheck(svc *service.Service) (string, string)
+	// Get the settings for how the health check is run
+	CheckConfig(svc *service.Service) CheckConfig
 	// A non-blocking method that runs a discovery loop.
 	// The controlling process kicks it off to start discovery.
 	Run(director.Looper)
 }
 
+// Discoverers that can check their settings, and that they can reach
+// whatever they discover services from. Used by --validate.
+type Validator interface {
+	Validate() error
+}
+
+// Optional settings for how a service's health check is run. These are
+// only used by the local health checks, they're not part of the Service
+// and so are never gossiped. Zero values mean the Monitor's defaults.
+type CheckConfig struct {
+	Interval           time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	ExpectedStatus     string
+	ExpectedBody       string
+	Timeout            time.Duration
+	Host               string            // Host header for HTTP checks
+	Path               string            // Path for the default HTTP check
+	Headers            map[string]string // Extra headers for HTTP checks
+	Scheme             string            // "http" or "https" for the default check
+	TLSSkipVerify      bool              // Don't verify the certificate on HTTPS checks
+	CAFile             string            // Verify HTTPS checks against this CA instead
+	CertFile           string            // Client certificate for mTLS...
+	KeyFile            string            // ...and its key
+	Port               string            // Name of the port for the default check
+}
+
+// Does this have any settings at all?
+func (c CheckConfig) isEmpty() bool {
+	return reflect.DeepEqual(c, CheckConfig{})
+}
+
+// Build a CheckConfig from Docker labels, Kubernetes annotations, or
+// Consul tags, which all use the same names.
+func CheckConfigFromLabels(labels map[string]string) CheckConfig {
+	return CheckConfig{
+		Interval:           parseCheckDuration(labels["HealthCheckInterval"]),
+		HealthyThreshold:   parseThreshold(labels["HealthyThreshold"]),
+		UnhealthyThreshold: parseThreshold(labels["UnhealthyThreshold"]),
+		ExpectedStatus:     labels["HealthCheckExpectedStatus"],
+		ExpectedBody:       labels["HealthCheckExpectedBody"],
+		Timeout:            parseCheckDuration(labels["HealthCheckTimeout"]),
+		Host:               labels["HealthCheckHost"],
+		Path:               labels["HealthCheckPath"],
+		Headers:            checkHeadersFromLabels(labels),
+		Scheme:             labels["HealthCheckScheme"],
+		TLSSkipVerify:      labels["HealthCheckTLSSkipVerify"] == "true",
+		CAFile:             labels["HealthCheckCAFile"],
+		CertFile:           labels["HealthCheckCertFile"],
+		KeyFile:            labels["HealthCheckKeyFile"],
+		Port:               labels["HealthCheckPort"],
+	}
+}
+
+// Pick out the HTTP check headers from the labels. Returns nil when
+// there aren't any.
+func checkHeadersFromLabels(labels map[string]string) map[string]string {
+	var headers map[string]string
+	for key, value := range labels {
+		if !strings.HasPrefix(key, CHECK_HEADER_PREFIX) || len(key) == len(CHECK_HEADER_PREFIX) {
+			continue
+		}
+
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.TrimPrefix(key, CHECK_HEADER_PREFIX)] = value
+	}
+
+	return headers
+}
+
+// Parse a health check interval or timeout like "30s". Returns zero,
+// meaning the default, when it's missing or invalid.
+func parseCheckDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		log.Errorf("Invalid health check duration '%s', using the default", value)
+		return 0
+	}
+
+	return interval
+}
+
+// Parse a healthy/unhealthy threshold count. Returns zero, meaning the
+// Monitor's default, when it's missing or invalid.
+func parseThreshold(value string) int {
+	if value == "" {
+		return 0
+	}
+
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 1 {
+		log.Errorf("Invalid health check threshold '%s', using the default", value)
+		return 0
+	}
+
+	return threshold
+}
+
 // A MultiDiscovery is a wrapper around zero or more Discoverers.
 // It allows the use of potentially multiple Discoverers in place of one.
 type MultiDiscovery struct {
 	Discoverers []Discoverer
+	// When a discoverer suddenly finds fewer services, keep its last result
+	// until the smaller one has lasted this long. Zero turns it off.
+	ShrinkGrace time.Duration
+	results     map[Discoverer]*lastResult
+	sync.Mutex
+}
+
+// A discoverer's last good result, and when it first came back smaller
+type lastResult struct {
+	services    []service.Service
+	shrunkSince time.Time // Zero unless it's smaller now
 }
 
 // Get the health check and health check args for a service
@@ -42,12 +167,26 @@ func (d *MultiDiscovery) HealthCheck(svc *service.Service) (string, string) {
 	return "", ""
 }
 
+// Get the check settings for a service from the first discoverer that has any
+func (d *MultiDiscovery) CheckConfig(svc *service.Service) CheckConfig {
+	for _, disco := range d.Discoverers {
+		if config := disco.CheckConfig(svc); !config.isEmpty() {
+			return config
+		}
+	}
+	return CheckConfig{}
+}
+
 // Aggregates all the service slices from the discoverers
 func (d *MultiDiscovery) Services() []service.Service {
 	var aggregate []service.Service
 
 	for _, disco := range d.Discoverers {
 		services := disco.Services()
+		if d.ShrinkGrace > 0 {
+			services = d.steadyServices(disco, services, time.Now().UTC())
+		}
+
 		if len(services) > 0 {
 			aggregate = append(aggregate, services...)
 		}
@@ -56,6 +195,60 @@ func (d *MultiDiscovery) Services() []service.Service {
 	return aggregate
 }
 
+// Smooth over a discoverer that briefly finds fewer services than it really
+// has, like Docker sometimes does under load, so that one bad poll doesn't
+// tombstone everything. A smaller result only counts once it has lasted for
+// the ShrinkGrace. Until then we stick with the last good one.
+func (d *MultiDiscovery) steadyServices(disco Discoverer, services []service.Service, now time.Time) []service.Service {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.results == nil {
+		d.results = make(map[Discoverer]*lastResult)
+	}
+
+	last, ok := d.results[disco]
+	if !ok || len(services) >= len(last.services) {
+		d.results[disco] = &lastResult{services: services}
+		return services
+	}
+
+	if last.shrunkSince.IsZero() {
+		last.shrunkSince = now
+	}
+
+	if now.Sub(last.shrunkSince) >= d.ShrinkGrace {
+		d.results[disco] = &lastResult{services: services}
+		return services
+	}
+
+	metrics.IncrCounter([]string{"discovery", "suppressed"}, 1)
+	log.Warnf("Discovery %s found %d services, down from %d, keeping the old list for now",
+		Name(disco), len(services), len(last.services))
+
+	return last.services
+}
+
+// A FilteredDiscovery passes on only the services that Keep says to, so
+// the rest are never health checked or announced.
+type FilteredDiscovery struct {
+	Discoverer
+	Keep func(svc *service.Service) bool
+}
+
+func (d *FilteredDiscovery) Services() []service.Service {
+	services := d.Discoverer.Services()
+
+	kept := make([]service.Service, 0, len(services))
+	for _, svc := range services {
+		if d.Keep(&svc) {
+			kept = append(kept, svc)
+		}
+	}
+
+	return kept
+}
+
 // Kicks off the Run() method for all the discoverers.
 func (d *MultiDiscovery) Run(looper director.Looper) {
 	var loopers []director.Looper
@@ -63,7 +256,7 @@ func (d *MultiDiscovery) Run(looper director.Looper) {
 	for _, disco := range d.Discoverers {
 		l := director.NewTimedLooper(director.FOREVER, SLEEP_INTERVAL, make(chan error))
 		loopers = append(loopers, l)
-		disco.Run(l)
+		disco.Run(&tracedLooper{Looper: l, disco: disco})
 	}
 
 	looper.Loop(func() error {
@@ -74,3 +267,35 @@ func (d *MultiDiscovery) Run(looper director.Looper) {
 		l.Quit()
 	}
 }
+
+// Wraps a discoverer's looper so that each poll gets a tracing span
+type tracedLooper struct {
+	director.Looper
+	disco Discoverer
+}
+
+func (l *tracedLooper) Loop(fn func() error) {
+	l.Looper.Loop(func() error {
+		span := tracing.Start("discovery.poll")
+		err := fn()
+
+		if span != nil {
+			span.SetAttribute("discoverer", Name(l.disco))
+			span.SetAttribute("services", len(l.disco.Services()))
+			span.SetError(err)
+			span.Finish()
+		}
+
+		return err
+	})
+}
+
+// Name returns "docker" for the DockerDiscovery, and so on
+func Name(disco Discoverer) string {
+	discoType := reflect.TypeOf(disco)
+	if discoType.Kind() == reflect.Ptr {
+		discoType = discoType.Elem()
+	}
+
+	return strings.ToLower(strings.TrimSuffix(discoType.Name(), "Discovery"))
+}
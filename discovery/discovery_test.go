@@ -1,11 +1,14 @@
 package discovery
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/newrelic/sidecar/service"
+	"github.com/newrelic/sidecar/tracing"
 )
 
 type mockDiscoverer struct {
@@ -14,6 +17,7 @@ type mockDiscoverer struct {
 	ServicesInvoked bool
 	Done            chan error
 	CheckName       string
+	Config          CheckConfig
 }
 
 func (m *mockDiscoverer) Services() []service.Service {
@@ -35,6 +39,16 @@ func (m *mockDiscoverer) HealthCheck(svc *service.Service) (string, string) {
 	return "", ""
 }
 
+func (m *mockDiscoverer) CheckConfig(svc *service.Service) CheckConfig {
+	for _, aSvc := range m.ServicesList {
+		if svc.Name == aSvc.Name {
+			return m.Config
+		}
+	}
+
+	return CheckConfig{}
+}
+
 func Test_MultiDiscovery(t *testing.T) {
 	Convey("MultiDiscovery", t, func() {
 		looper := director.NewFreeLooper(director.ONCE, nil)
@@ -45,10 +59,12 @@ func Test_MultiDiscovery(t *testing.T) {
 		svc1 := service.Service{Name: "svc1"}
 		svc2 := service.Service{Name: "svc2"}
 
-		disco1 := &mockDiscoverer{ []service.Service{ svc1 }, false, false, done1, "one" }
-		disco2 := &mockDiscoverer{ []service.Service{ svc2 }, false, false, done2, "two" }
+		disco1 := &mockDiscoverer{ []service.Service{ svc1 }, false, false, done1, "one", CheckConfig{} }
+		disco2 := &mockDiscoverer{
+			[]service.Service{svc2}, false, false, done2, "two", CheckConfig{HealthyThreshold: 2},
+		}
 
-		multi := &MultiDiscovery{[]Discoverer{disco1, disco2}}
+		multi := &MultiDiscovery{Discoverers: []Discoverer{disco1, disco2}}
 
 		Convey("Run() invokes the Run() method for all the discoverers", func() {
 			multi.Run(looper)
@@ -81,6 +97,41 @@ func Test_MultiDiscovery(t *testing.T) {
 			So(services[1].Name, ShouldEqual, "svc2")
 		})
 
+		Convey("Services() keeps the last result while a discoverer finds fewer", func() {
+			multi.ShrinkGrace = time.Minute
+			now := time.Now().UTC()
+
+			So(len(multi.Services()), ShouldEqual, 2)
+
+			disco1.ServicesList = nil
+			So(len(multi.Services()), ShouldEqual, 2)
+			So(multi.results[disco1].shrunkSince.IsZero(), ShouldBeFalse)
+
+			// Still empty once the grace is over, so now we believe it
+			So(multi.steadyServices(disco1, nil, now.Add(2*time.Minute)), ShouldBeEmpty)
+			So(len(multi.Services()), ShouldEqual, 1)
+		})
+
+		Convey("Services() forgets a shrink when the services come back", func() {
+			multi.ShrinkGrace = time.Minute
+			now := time.Now().UTC()
+
+			So(multi.steadyServices(disco1, []service.Service{svc1}, now), ShouldHaveLength, 1)
+			So(multi.steadyServices(disco1, nil, now.Add(30*time.Second)), ShouldHaveLength, 1)
+			So(multi.steadyServices(disco1, []service.Service{svc1}, now.Add(40*time.Second)), ShouldHaveLength, 1)
+
+			// The clock starts again on the next shrink
+			So(multi.steadyServices(disco1, nil, now.Add(80*time.Second)), ShouldHaveLength, 1)
+			So(multi.steadyServices(disco1, nil, now.Add(141*time.Second)), ShouldBeEmpty)
+		})
+
+		Convey("Services() takes smaller results right away without a grace", func() {
+			multi.Services()
+			disco1.ServicesList = nil
+			So(len(multi.Services()), ShouldEqual, 1)
+			So(multi.results, ShouldBeNil)
+		})
+
 		Convey("HealthCheck() aggregates all the health checks", func() {
 			check1, _ := multi.HealthCheck(&svc1)
 			check2, _ := multi.HealthCheck(&svc2)
@@ -96,5 +147,128 @@ func Test_MultiDiscovery(t *testing.T) {
 			So(check, ShouldEqual, "")
 			So(args, ShouldEqual, "")
 		})
+
+		Convey("CheckConfig() finds the discoverer with settings", func() {
+			So(multi.CheckConfig(&svc2).HealthyThreshold, ShouldEqual, 2)
+			So(multi.CheckConfig(&svc1), ShouldResemble, CheckConfig{})
+		})
+
+		Convey("CheckConfig() counts headers alone as settings", func() {
+			disco2.Config = CheckConfig{Headers: map[string]string{"X-Token": "abc"}}
+			So(multi.CheckConfig(&svc2).Headers["X-Token"], ShouldEqual, "abc")
+		})
+	})
+}
+
+func Test_FilteredDiscovery(t *testing.T) {
+	Convey("FilteredDiscovery", t, func() {
+		disco := &mockDiscoverer{
+			ServicesList: []service.Service{{ID: "deadbeef123", Name: "api"}, {ID: "deadbeef456", Name: "worker"}},
+			CheckName:    "HttpGet",
+		}
+		filtered := &FilteredDiscovery{disco, func(svc *service.Service) bool {
+			return svc.Name == "api"
+		}}
+
+		Convey("Only passes on the services it keeps", func() {
+			services := filtered.Services()
+			So(len(services), ShouldEqual, 1)
+			So(services[0].ID, ShouldEqual, "deadbeef123")
+			So(len(disco.ServicesList), ShouldEqual, 2)
+		})
+
+		Convey("Leaves everything else to the discoverer", func() {
+			check, _ := filtered.HealthCheck(&service.Service{Name: "api"})
+			So(check, ShouldEqual, "HttpGet")
+		})
+	})
+}
+
+func Test_CheckConfigFromLabels(t *testing.T) {
+	Convey("Tracing discovery polls", t, func() {
+		Convey("Names the discoverers", func() {
+			So(Name(&DockerDiscovery{}), ShouldEqual, "docker")
+			So(Name(&StaticDiscovery{}), ShouldEqual, "static")
+			So(Name(&mockDiscoverer{}), ShouldEqual, "mockdiscoverer")
+		})
+
+		Convey("Runs each poll and passes on its errors", func() {
+			tracing.Enable(tracing.NewExporter("http://localhost:4318", nil))
+			defer tracing.Enable(nil)
+
+			disco := &mockDiscoverer{ServicesList: []service.Service{{Name: "svc1"}}}
+			looper := &tracedLooper{
+				Looper: director.NewFreeLooper(director.ONCE, make(chan error, 1)),
+				disco:  disco,
+			}
+
+			runs := 0
+			looper.Loop(func() error {
+				runs++
+				return errors.New("Oh no!")
+			})
+
+			So(runs, ShouldEqual, 1)
+			So(disco.ServicesInvoked, ShouldBeTrue)
+			So(looper.Wait(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("CheckConfigFromLabels()", t, func() {
+		Convey("Parses all the settings", func() {
+			config := CheckConfigFromLabels(map[string]string{
+				"HealthCheckInterval":       "10s",
+				"HealthyThreshold":          "2",
+				"UnhealthyThreshold":        "3",
+				"HealthCheckExpectedStatus": "200-399",
+				"HealthCheckExpectedBody":   "OK",
+				"HealthCheckTimeout":        "5s",
+				"HealthCheckHost":           "web.example.com",
+				"HealthCheckPath":           "/healthz",
+				"HealthCheckHeader_X-Token": "abc",
+				"HealthCheckHeader_":        "ignored",
+				"HealthCheckScheme":         "https",
+				"HealthCheckTLSSkipVerify":  "true",
+				"HealthCheckCAFile":         "/etc/ssl/ca.pem",
+				"HealthCheckCertFile":       "/etc/ssl/client.pem",
+				"HealthCheckKeyFile":        "/etc/ssl/client.key",
+				"HealthCheckPort":           "metrics",
+			})
+
+			So(config, ShouldResemble, CheckConfig{
+				Interval:           10 * time.Second,
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 3,
+				ExpectedStatus:     "200-399",
+				ExpectedBody:       "OK",
+				Timeout:            5 * time.Second,
+				Host:               "web.example.com",
+				Path:               "/healthz",
+				Headers:            map[string]string{"X-Token": "abc"},
+				Scheme:             "https",
+				TLSSkipVerify:      true,
+				CAFile:             "/etc/ssl/ca.pem",
+				CertFile:           "/etc/ssl/client.pem",
+				KeyFile:            "/etc/ssl/client.key",
+				Port:               "metrics",
+			})
+		})
+
+		Convey("Uses zero values for missing or invalid settings", func() {
+			config := CheckConfigFromLabels(map[string]string{
+				"HealthCheckInterval": "often",
+				"HealthyThreshold":    "lots",
+				"UnhealthyThreshold":  "0",
+				"HealthCheckTimeout":  "soon",
+			})
+			So(config, ShouldResemble, CheckConfig{})
+
+			So(CheckConfigFromLabels(nil), ShouldResemble, CheckConfig{})
+		})
+
+		Convey("Doesn't accept negative intervals", func() {
+			config := CheckConfigFromLabels(map[string]string{"HealthCheckInterval": "-5s"})
+			So(config.Interval, ShouldEqual, 0)
+		})
 	})
 }
@@ -1,6 +1,12 @@
 package discovery
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +19,7 @@ import (
 
 const (
 	CACHE_DRAIN_INTERVAL = 10 * time.Minute // Drain the cache every 10 mins
+	RESYNC_INTERVAL      = 30 * time.Second // Full resyncs in event mode
 )
 
 type DockerClient interface {
@@ -24,19 +31,33 @@ type DockerClient interface {
 }
 
 type DockerDiscovery struct {
-	events         chan *docker.APIEvents       // Where events are announced to us
-	endpoint       string                       // The Docker endpoint to talk to
-	services       []*service.Service           // The list of services we know about
-	ClientProvider func() (DockerClient, error) // Return the client we'll use to connect
-	containerCache map[string]*docker.Container // Cache of inspected containers
-	sync.RWMutex                                // Reader/Writer lock
+	events            chan *docker.APIEvents                      // Where events are announced to us
+	endpoints         []string                                    // The Docker endpoints to talk to
+	services          []*service.Service                          // The list of services we know about
+	serviceEndpoints  map[string]string                           // Which endpoint reported each service
+	ClientProvider    func(endpoint string) (DockerClient, error) // Return the client we'll use to connect
+	MatchLabels       map[string]string                           // Only discover containers with all of these
+	ExcludeLabels     map[string]string                           // Never discover containers with any of these
+	containerCache    map[string]*docker.Container                // Cache of inspected containers
+	tlsCert           []byte                                      // PEM client certificate for TLS
+	tlsKey            []byte                                      // PEM client key for TLS
+	tlsCA             []byte                                      // PEM CA certificate for TLS
+	EventMode         bool                                        // Discover from Docker events, and only resync now and then
+	TrustDockerHealth bool                                        // Use Docker's HEALTHCHECK status instead of our default check
+	ResyncInterval    time.Duration                               // How often to resync in event mode
+	ServicePortEnv    string                                      // Env var with the service port, e.g. "SERVICE_PORT"
+	lastSync          time.Time                                   // When we last listed the containers
+	syncLock          sync.Mutex                                  // Only one container listing at a time
+	sync.RWMutex                                                  // Reader/Writer lock
 }
 
-func NewDockerDiscovery(endpoint string) *DockerDiscovery {
+func NewDockerDiscovery(endpoints []string) *DockerDiscovery {
 	discovery := DockerDiscovery{
-		endpoint:       endpoint,
-		events:         make(chan *docker.APIEvents),
-		containerCache: make(map[string]*docker.Container),
+		endpoints:        endpoints,
+		events:           make(chan *docker.APIEvents),
+		serviceEndpoints: make(map[string]string),
+		containerCache:   make(map[string]*docker.Container),
+		ResyncInterval:   RESYNC_INTERVAL,
 	}
 
 	// Default to our own method for returning this
@@ -45,9 +66,61 @@ func NewDockerDiscovery(endpoint string) *DockerDiscovery {
 	return &discovery
 }
 
-func (d *DockerDiscovery) getDockerClient() (DockerClient, error) {
-	if d.endpoint != "" {
-		client, err := docker.NewClient(d.endpoint)
+// ConfigureTLS loads the client certificate, key, and (optional) CA
+// certificate used to talk to Docker over TCP. They are loaded and checked
+// once, up front, so that bad files are found at startup. Unix socket
+// endpoints don't use TLS.
+func (d *DockerDiscovery) ConfigureTLS(certFile string, keyFile string, caFile string) error {
+	cert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = tls.X509KeyPair(cert, key)
+	if err != nil {
+		return err
+	}
+
+	var ca []byte
+	if caFile != "" {
+		ca, err = ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return fmt.Errorf("Unable to parse CA certificate from '%s'", caFile)
+		}
+	} else {
+		log.Warn("No Docker CA file configured, server certificate will not be verified")
+	}
+
+	d.tlsCert, d.tlsKey, d.tlsCA = cert, key, ca
+
+	return nil
+}
+
+func (d *DockerDiscovery) usesTLS(endpoint string) bool {
+	return d.tlsCert != nil && !strings.HasPrefix(endpoint, "unix://")
+}
+
+func (d *DockerDiscovery) getDockerClient(endpoint string) (DockerClient, error) {
+	if d.usesTLS(endpoint) {
+		client, err := docker.NewTLSClientFromBytes(endpoint, d.tlsCert, d.tlsKey, d.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+
+		return client, nil
+	}
+
+	if endpoint != "" {
+		client, err := docker.NewClient(endpoint)
 		if err != nil {
 			return nil, err
 		}
@@ -62,61 +135,187 @@ func (d *DockerDiscovery) getDockerClient() (DockerClient, error) {
 	return client, nil
 }
 
+// Validate checks that we can reach every Docker endpoint
+func (d *DockerDiscovery) Validate() error {
+	for _, endpoint := range d.endpoints {
+		client, err := d.ClientProvider(endpoint)
+		if err != nil {
+			return fmt.Errorf("Can't create Docker client for '%s': %s", endpoint, err.Error())
+		}
+
+		err = client.Ping()
+		if err != nil {
+			return fmt.Errorf("Can't reach Docker on '%s': %s", endpoint, err.Error())
+		}
+	}
+
+	return nil
+}
+
 // HealthCheck looks up a health check using Docker container labels to
-// pass the type of check and the arguments to pass to it.
+// pass the type of check and the arguments to pass to it. Without one, and
+// if we trust it, we use the health Docker reports for containers with a
+// HEALTHCHECK rather than probing them again.
 func (d *DockerDiscovery) HealthCheck(svc *service.Service) (string, string) {
+	container, err := d.inspectContainer(svc)
+	if err == nil && container.Config.Labels["HealthCheck"] != "" {
+		return container.Config.Labels["HealthCheck"], container.Config.Labels["HealthCheckArgs"]
+	}
+
+	if d.TrustDockerHealth && svc.DockerHealth != "" {
+		return "DockerHealth", svc.ID
+	}
+
+	return "", ""
+}
+
+func (d *DockerDiscovery) CheckConfig(svc *service.Service) CheckConfig {
 	container, err := d.inspectContainer(svc)
 	if err != nil {
-		return "", ""
+		return CheckConfig{}
 	}
 
-	return container.Config.Labels["HealthCheck"], container.Config.Labels["HealthCheckArgs"]
+	return CheckConfigFromLabels(container.Config.Labels)
 }
 
 func (d *DockerDiscovery) inspectContainer(svc *service.Service) (*docker.Container, error) {
+	// Talk to the Docker that reported this service
+	d.RLock()
+	endpoint := d.serviceEndpoints[svc.ID]
+	d.RUnlock()
+
+	return d.inspectContainerAt(svc.ID, endpoint)
+}
+
+// Like inspectContainer(), but for when we already know which Docker to ask.
+// Takes the lock itself, so it can't be called with it held.
+func (d *DockerDiscovery) inspectContainerAt(id string, endpoint string) (*docker.Container, error) {
 	// If we have it cached, return it!
-	if container, ok := d.containerCache[svc.ID]; ok {
+	d.RLock()
+	container, ok := d.containerCache[id]
+	d.RUnlock()
+	if ok {
 		return container, nil
 	}
 
 	// New connection every time
-	client, err := d.ClientProvider()
+	client, err := d.ClientProvider(endpoint)
 	if err != nil {
 		log.Errorf("Error when creating Docker client: %s\n", err.Error())
 		return nil, err
 	}
 
-	container, err := client.InspectContainer(svc.ID)
+	container, err = client.InspectContainer(id)
 	if err != nil {
-		log.Errorf("Error inspecting container : %v\n", svc.ID)
+		log.Errorf("Error inspecting container : %v\n", id)
 		return nil, err
 	}
 
 	// Cache it for next time
-	d.containerCache[svc.ID] = container
+	d.Lock()
+	d.containerCache[id] = container
+	d.Unlock()
 
 	return container, nil
 }
 
+// Some containers say what their service port is in an environment
+// variable, rather than with a ServicePort_xxx label. Host networking
+// containers have no port mappings at all, so they get the port from the
+// variable for both. Otherwise it's the service port for the one mapping
+// without a service port, or when there's more than one, the mapping for
+// the same port inside the container. Without the variable, the ports are
+// left as they were.
+func (d *DockerDiscovery) servicePortFromEnv(svc *service.Service, container *docker.APIContainers, endpoint string) {
+	if d.ServicePortEnv == "" {
+		return
+	}
+
+	inspected, err := d.inspectContainerAt(svc.ID, endpoint)
+	if err != nil || inspected.Config == nil {
+		return
+	}
+
+	value, ok := envValue(inspected.Config.Env, d.ServicePortEnv)
+	if !ok {
+		return
+	}
+
+	port, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		log.Warnf("Ignoring bad %s '%s' for container %s", d.ServicePortEnv, value, svc.ID)
+		return
+	}
+
+	if len(svc.Ports) == 0 {
+		svc.Ports = append(svc.Ports, service.Port{Type: "tcp", Port: port, ServicePort: port})
+		return
+	}
+
+	// Ports are built from the published mappings, in the same order
+	var published []docker.APIPort
+	for _, mapping := range container.Ports {
+		if mapping.PublicPort != 0 {
+			published = append(published, mapping)
+		}
+	}
+
+	var unset []int
+	for i := range svc.Ports {
+		if svc.Ports[i].ServicePort == 0 {
+			unset = append(unset, i)
+		}
+	}
+
+	switch {
+	case len(unset) == 1:
+		svc.Ports[unset[0]].ServicePort = port
+	case len(unset) > 1:
+		for _, i := range unset {
+			if i < len(published) && published[i].PrivatePort == port {
+				svc.Ports[i].ServicePort = port
+				return
+			}
+		}
+		log.Warnf("Can't tell which port %s=%d is for on container %s", d.ServicePortEnv, port, svc.ID)
+	}
+}
+
+// Look up a variable in a container's environment, like "SERVICE_PORT=80"
+func envValue(env []string, name string) (string, bool) {
+	for _, variable := range env {
+		if strings.HasPrefix(variable, name+"=") {
+			return strings.TrimPrefix(variable, name+"="), true
+		}
+	}
+	return "", false
+}
+
 // The main loop, poll for containers continuously.
 func (d *DockerDiscovery) Run(looper director.Looper) {
 	watchEventsQuit := make(chan bool)
 	processEventsQuit := make(chan bool)
 	drainCacheQuit := make(chan bool)
 
-	go d.watchEvents(watchEventsQuit)
+	for _, endpoint := range d.endpoints {
+		go d.watchEvents(endpoint, watchEventsQuit)
+	}
 	go d.processEvents(processEventsQuit)
 	go d.drainCache(drainCacheQuit)
 
 	go func() {
-		// Loop around fetching the whole container list
+		// Loop around fetching the whole container list. In event mode the
+		// events keep us up to date, and this just catches anything missed.
 		looper.Loop(func() error {
+			if d.EventMode && !d.resyncDue() {
+				return nil
+			}
 			d.getContainers()
 			return nil
 		})
 
 		// Propagate quit channel message
-		go func() { watchEventsQuit <- true }()
+		go func() { close(watchEventsQuit) }()
 		go func() { processEventsQuit <- true }()
 		go func() { drainCacheQuit <- true }()
 	}()
@@ -135,41 +334,156 @@ func (d *DockerDiscovery) Services() []service.Service {
 	return svcList
 }
 
-func (d *DockerDiscovery) getContainers() {
+// The result of listing containers on one Docker endpoint
+type endpointContainers struct {
+	endpoint   string
+	containers []docker.APIContainers
+	err        error
+}
+
+func (d *DockerDiscovery) listContainers(endpoint string) ([]docker.APIContainers, error) {
 	// New connection every time
-	client, err := d.ClientProvider()
+	client, err := d.ClientProvider(endpoint)
 	if err != nil {
 		log.Errorf("Error when creating Docker client: %s\n", err.Error())
-		return
+		return nil, err
 	}
 
 	containers, err := client.ListContainers(docker.ListContainersOptions{All: false})
 	if err != nil {
+		log.WithField("event", "discovery_failed").
+			Errorf("Error listing containers on Docker '%s': %s", endpoint, err.Error())
+		return nil, err
+	}
+
+	return containers, nil
+}
+
+// Is it time for a full resync in event mode?
+func (d *DockerDiscovery) resyncDue() bool {
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+	return time.Since(d.lastSync) >= d.ResyncInterval
+}
+
+// We might have missed some events, so resync on the next loop
+func (d *DockerDiscovery) forceResync() {
+	d.syncLock.Lock()
+	d.lastSync = time.Time{}
+	d.syncLock.Unlock()
+}
+
+// Query all the Docker endpoints concurrently and merge the results. If we
+// can't talk to one of them, we keep the services we last saw from it.
+func (d *DockerDiscovery) getContainers() {
+	// Events and the looper can both get here, and an older listing
+	// mustn't overwrite a newer one
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+	d.lastSync = time.Now()
+
+	results := make(chan endpointContainers, len(d.endpoints))
+
+	for _, endpoint := range d.endpoints {
+		go func(endpoint string) {
+			containers, err := d.listContainers(endpoint)
+			results <- endpointContainers{endpoint, containers, err}
+		}(endpoint)
+	}
+
+	failed := make(map[string]bool)
+	var listed []endpointContainers
+	for i := 0; i < len(d.endpoints); i++ {
+		result := <-results
+		if result.err != nil {
+			failed[result.endpoint] = true
+			continue
+		}
+		listed = append(listed, result)
+	}
+
+	// Nothing was reachable, leave everything as it was
+	if len(listed) < 1 {
+		d.lastSync = time.Time{}
 		return
 	}
 
+	if len(failed) > 0 {
+		d.lastSync = time.Time{}
+	}
+
+	// Build up the new services before taking the lock, since getting the
+	// service port can mean inspecting containers
+	var discovered []*service.Service
+	discoveredEndpoints := make(map[string]string)
+	for _, result := range listed {
+		for _, container := range result.containers {
+			// Skip services that are purposely excluded from discovery.
+			if container.Labels["SidecarDiscover"] == "false" {
+				continue
+			}
+
+			if !d.matchesLabels(container.Labels) {
+				continue
+			}
+
+			svc := service.ToService(&container)
+			d.servicePortFromEnv(&svc, &container, result.endpoint)
+			discovered = append(discovered, &svc)
+			discoveredEndpoints[svc.ID] = result.endpoint
+		}
+	}
+
 	d.Lock()
 	defer d.Unlock()
 
 	// Temporary set to track if we have seen a container (for cache pruning)
 	containerMap := make(map[string]interface{})
 
-	// Build up the service list, and prepare to prune the containerCache
-	d.services = make([]*service.Service, 0, len(containers))
-	for _, container := range containers {
-		// Skip services that are purposely excluded from discovery.
-		if container.Labels["SidecarDiscover"] == "false" {
-			continue
+	services := make([]*service.Service, 0, len(d.services))
+	serviceEndpoints := make(map[string]string, len(d.serviceEndpoints))
+
+	// Hang on to what the unreachable endpoints told us last time
+	for _, svc := range d.services {
+		endpoint := d.serviceEndpoints[svc.ID]
+		if failed[endpoint] {
+			services = append(services, svc)
+			serviceEndpoints[svc.ID] = endpoint
+			containerMap[svc.ID] = true
 		}
+	}
 
-		svc := service.ToService(&container)
-		d.services = append(d.services, &svc)
+	// Swap in the new ones, and prepare to prune the containerCache
+	for _, svc := range discovered {
+		services = append(services, svc)
+		serviceEndpoints[svc.ID] = discoveredEndpoints[svc.ID]
 		containerMap[svc.ID] = true
 	}
 
+	d.services = services
+	d.serviceEndpoints = serviceEndpoints
+
 	d.pruneContainerCache(containerMap)
 }
 
+// A container must carry all of the MatchLabels and none of the
+// ExcludeLabels to be discovered. Empty maps match everything.
+func (d *DockerDiscovery) matchesLabels(labels map[string]string) bool {
+	for key, value := range d.MatchLabels {
+		if labels[key] != value {
+			return false
+		}
+	}
+
+	for key, value := range d.ExcludeLabels {
+		if found, ok := labels[key]; ok && found == value {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Loop through the current cache and remove anything that has disappeared
 func (d *DockerDiscovery) pruneContainerCache(liveContainers map[string]interface{}) {
 	for id, _ := range d.containerCache {
@@ -179,28 +493,33 @@ func (d *DockerDiscovery) pruneContainerCache(liveContainers map[string]interfac
 	}
 }
 
-func (d *DockerDiscovery) watchEvents(quit chan bool) {
-	client, err := d.ClientProvider()
+// Watch the events from one Docker endpoint, and pass them on to the
+// events channel that processEvents() is reading.
+func (d *DockerDiscovery) watchEvents(endpoint string, quit chan bool) {
+	client, err := d.ClientProvider(endpoint)
 	if err != nil {
 		log.Errorf("Error when creating Docker client: %s\n", err.Error())
 		return
 	}
-	client.AddEventListener(d.events)
+	listener := d.forwardEvents()
+	client.AddEventListener(listener)
 
 	// Health check the connection and set it back up when it goes away.
 	for {
 
 		err := client.Ping()
 		if err != nil {
-			log.Warn("Lost connection to Docker, re-connecting")
-			client.RemoveEventListener(d.events)
-			d.events = make(chan *docker.APIEvents) // RemoveEventListener closes it
+			log.Warnf("Lost connection to Docker '%s', re-connecting", endpoint)
+			client.RemoveEventListener(listener)
+			listener = d.forwardEvents() // RemoveEventListener closes it
 
-			client, err = docker.NewClient(d.endpoint)
+			client, err = d.ClientProvider(endpoint)
 			if err == nil {
-				client.AddEventListener(d.events)
+				client.AddEventListener(listener)
+				// Catch up on anything that happened while we were gone
+				d.forceResync()
 			} else {
-				log.Error("Can't reconnect to Docker!")
+				log.Errorf("Can't reconnect to Docker '%s'!", endpoint)
 			}
 		}
 
@@ -214,8 +533,30 @@ func (d *DockerDiscovery) watchEvents(quit chan bool) {
 	}
 }
 
+// Return a new listener channel that feeds the events channel until
+// it is closed.
+func (d *DockerDiscovery) forwardEvents() chan *docker.APIEvents {
+	listener := make(chan *docker.APIEvents)
+
+	go func() {
+		for event := range listener {
+			d.events <- event
+		}
+	}()
+
+	return listener
+}
+
 func (d *DockerDiscovery) handleEvent(event docker.APIEvents) {
-	// We're only worried about stopping containers
+	// In event mode, pick up new and newly healthy containers right away
+	if d.EventMode && (event.Status == "start" || strings.HasPrefix(event.Status, "health_status")) {
+		log.WithField("event", "docker_"+event.Status).
+			Debugf("Resyncing based on Docker '%s' event for %s", event.Status, event.ID)
+		d.getContainers()
+		return
+	}
+
+	// Otherwise we're only worried about stopping containers
 	if event.Status == "die" || event.Status == "stop" {
 		d.Lock()
 		defer d.Unlock()
@@ -225,7 +566,11 @@ func (d *DockerDiscovery) handleEvent(event docker.APIEvents) {
 				continue
 			}
 			if event.ID[:12] == service.ID {
-				log.Printf("Deleting %s based on Docker '%s' event\n", event.Status, service.ID)
+				log.WithFields(log.Fields{
+					"service": service.Name,
+					"node":    service.Hostname,
+					"event":   "docker_" + event.Status,
+				}).Printf("Deleting %s based on Docker '%s' event", service.ID, event.Status)
 				// Delete the entry in the slice
 				d.services[i] = nil
 				d.services = append(d.services[:i], d.services[i+1:]...)
@@ -248,6 +593,7 @@ func (d *DockerDiscovery) processEvents(quit chan bool) {
 		if event == nil {
 			// This usually happens because of a Docker restart.
 			// Sleep, let us reconnect in the background, then loop.
+			d.forceResync()
 			time.Sleep(SLEEP_INTERVAL)
 			continue
 		}
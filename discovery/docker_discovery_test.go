@@ -15,13 +15,25 @@ var hostname = "shakespeare"
 // Define a stubDockerClient that we can use to test the discovery
 type stubDockerClient struct {
 	ErrorOnInspectContainer bool
+	ErrorOnListContainers   bool
+	Containers              []docker.APIContainers
+	Inspected               map[string]*docker.Container // By ID, for containers that need more than labels
+	OnInspect               func()                       // Called on every inspect, if set
 }
 
 func (s *stubDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	if s.OnInspect != nil {
+		s.OnInspect()
+	}
+
 	if s.ErrorOnInspectContainer {
 		return nil, errors.New("Oh no!")
 	}
 
+	if container, ok := s.Inspected[id]; ok {
+		return container, nil
+	}
+
 	// If we match this ID, return a real setup
 	if id == "deadbeef1231" { // svcId1
 		return &docker.Container{
@@ -43,7 +55,10 @@ func (s *stubDockerClient) InspectContainer(id string) (*docker.Container, error
 }
 
 func (s *stubDockerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
-	return nil, nil
+	if s.ErrorOnListContainers {
+		return nil, errors.New("Oh no!")
+	}
+	return s.Containers, nil
 }
 
 func (s *stubDockerClient) AddEventListener(listener chan<- *docker.APIEvents) error {
@@ -67,17 +82,17 @@ func Test_DockerDiscovery(t *testing.T) {
 		service2 := service.Service{ID: svcId2, Hostname: hostname, Updated: baseTime}
 		services := []*service.Service{&service1, &service2}
 
-		stubClientProvider := func() (DockerClient, error) {
+		stubClientProvider := func(endpoint string) (DockerClient, error) {
 			return &stubDockerClient{
 				ErrorOnInspectContainer: false,
 			}, nil
 		}
 
-		disco := NewDockerDiscovery(endpoint)
+		disco := NewDockerDiscovery([]string{endpoint})
 		disco.ClientProvider = stubClientProvider
 
-		Convey("New() configures an endpoint and events channel", func() {
-			So(disco.endpoint, ShouldEqual, endpoint)
+		Convey("New() configures the endpoints and events channel", func() {
+			So(disco.endpoints, ShouldResemble, []string{endpoint})
 			So(disco.events, ShouldNotBeNil)
 		})
 
@@ -111,8 +126,35 @@ func Test_DockerDiscovery(t *testing.T) {
 				So(args, ShouldEqual, "")
 			})
 
+			Convey("uses the Docker health when we trust it", func() {
+				service2.DockerHealth = service.DOCKER_HEALTHY
+
+				check, _ := disco.HealthCheck(&service2)
+				So(check, ShouldEqual, "")
+
+				disco.TrustDockerHealth = true
+				check, args := disco.HealthCheck(&service2)
+				So(check, ShouldEqual, "DockerHealth")
+				So(args, ShouldEqual, svcId2)
+			})
+
+			Convey("prefers the HealthCheck label over the Docker health", func() {
+				service1.DockerHealth = service.DOCKER_HEALTHY
+				disco.TrustDockerHealth = true
+
+				check, _ := disco.HealthCheck(&service1)
+				So(check, ShouldEqual, "HttpGet")
+			})
+
+			Convey("leaves containers without a HEALTHCHECK to our own checks", func() {
+				disco.TrustDockerHealth = true
+
+				check, _ := disco.HealthCheck(&service2)
+				So(check, ShouldEqual, "")
+			})
+
 			Convey("handles errors from the Docker client", func() {
-				disco.ClientProvider = func() (DockerClient, error) {
+				disco.ClientProvider = func(endpoint string) (DockerClient, error) {
 					return &stubDockerClient{
 						ErrorOnInspectContainer: true,
 					}, nil
@@ -124,6 +166,271 @@ func Test_DockerDiscovery(t *testing.T) {
 			})
 		})
 
+		Convey("Validate() checks each endpoint", func() {
+			So(disco.Validate(), ShouldBeNil)
+
+			disco.ClientProvider = func(endpoint string) (DockerClient, error) {
+				return nil, errors.New("Oh no!")
+			}
+			So(disco.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("getContainers()", func() {
+			endpoint2 := "http://example.com:2376"
+			clients := map[string]*stubDockerClient{
+				endpoint: &stubDockerClient{
+					Containers: []docker.APIContainers{
+						{ID: svcId1 + "abcdef", Names: []string{"/one"}},
+					},
+				},
+				endpoint2: &stubDockerClient{
+					Containers: []docker.APIContainers{
+						{ID: svcId2 + "abcdef", Names: []string{"/two"}},
+					},
+				},
+			}
+
+			disco = NewDockerDiscovery([]string{endpoint, endpoint2})
+			disco.ClientProvider = func(endpoint string) (DockerClient, error) {
+				return clients[endpoint], nil
+			}
+
+			Convey("merges the containers from all the endpoints", func() {
+				disco.getContainers()
+
+				So(len(disco.Services()), ShouldEqual, 2)
+				So(disco.serviceEndpoints[svcId1], ShouldEqual, endpoint)
+				So(disco.serviceEndpoints[svcId2], ShouldEqual, endpoint2)
+			})
+
+			Convey("keeps the last services from an unreachable endpoint", func() {
+				disco.getContainers()
+				clients[endpoint2].ErrorOnListContainers = true
+				clients[endpoint].Containers = nil
+				disco.getContainers()
+
+				result := disco.Services()
+				So(len(result), ShouldEqual, 1)
+				So(result[0].ID, ShouldEqual, svcId2)
+			})
+
+			Convey("reads the service port from the environment", func() {
+				disco.ServicePortEnv = "SERVICE_PORT"
+				withEnv := func(env ...string) *docker.Container {
+					return &docker.Container{Config: &docker.Config{Env: env}}
+				}
+
+				Convey("for the one port without a service port", func() {
+					clients[endpoint].Containers[0].Ports = []docker.APIPort{
+						{PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+					}
+					clients[endpoint].Inspected = map[string]*docker.Container{
+						svcId1: withEnv("PATH=/bin", "SERVICE_PORT=8080"),
+					}
+					disco.getContainers()
+
+					svc := servicesByID(disco.Services())[svcId1]
+					So(svc.Ports, ShouldResemble, []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080}})
+				})
+
+				Convey("for the matching port when there are several", func() {
+					clients[endpoint].Containers[0].Ports = []docker.APIPort{
+						{PrivatePort: 9102, PublicPort: 32768, Type: "tcp"},
+						{PrivatePort: 8080, PublicPort: 32769, Type: "tcp"},
+					}
+					clients[endpoint].Inspected = map[string]*docker.Container{
+						svcId1: withEnv("SERVICE_PORT=8080"),
+					}
+					disco.getContainers()
+
+					svc := servicesByID(disco.Services())[svcId1]
+					So(svc.Ports[0].ServicePort, ShouldEqual, 0)
+					So(svc.Ports[1].ServicePort, ShouldEqual, 8080)
+				})
+
+				Convey("for host networking containers without any ports", func() {
+					clients[endpoint].Inspected = map[string]*docker.Container{
+						svcId1: withEnv("SERVICE_PORT=8080"),
+					}
+					disco.getContainers()
+
+					svc := servicesByID(disco.Services())[svcId1]
+					So(svc.Ports, ShouldResemble, []service.Port{{Type: "tcp", Port: 8080, ServicePort: 8080}})
+				})
+
+				Convey("but falls back to the published ports without it", func() {
+					clients[endpoint].Containers[0].Ports = []docker.APIPort{
+						{PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+					}
+					clients[endpoint].Containers[0].Labels = map[string]string{"ServicePort_80": "8000"}
+					clients[endpoint].Inspected = map[string]*docker.Container{
+						svcId1: withEnv("SERVICE_PORT=8080"),
+					}
+					clients[endpoint2].Containers[0].Ports = []docker.APIPort{
+						{PrivatePort: 80, PublicPort: 32770, Type: "tcp"},
+					}
+					disco.getContainers()
+
+					services := servicesByID(disco.Services())
+					So(services[svcId1].Ports[0].ServicePort, ShouldEqual, 8000)
+					So(services[svcId2].Ports, ShouldResemble, []service.Port{{Type: "tcp", Port: 32770}})
+				})
+
+				Convey("without holding the lock while it inspects", func() {
+					var readable bool
+					clients[endpoint].OnInspect = func() {
+						done := make(chan struct{})
+						go func() {
+							disco.Services()
+							close(done)
+						}()
+
+						select {
+						case <-done:
+							readable = true
+						case <-time.After(time.Second):
+						}
+					}
+					disco.getContainers()
+
+					So(readable, ShouldBeTrue)
+				})
+
+				Convey("and ignores values that aren't ports", func() {
+					clients[endpoint].Inspected = map[string]*docker.Container{
+						svcId1: withEnv("SERVICE_PORT=http"),
+					}
+					disco.getContainers()
+
+					So(servicesByID(disco.Services())[svcId1].Ports, ShouldBeEmpty)
+				})
+			})
+
+			Convey("only discovers containers with the MatchLabels", func() {
+				clients[endpoint].Containers[0].Labels = map[string]string{"Team": "a", "Env": "prod"}
+				clients[endpoint2].Containers[0].Labels = map[string]string{"Team": "b", "Env": "prod"}
+				disco.MatchLabels = map[string]string{"Team": "a", "Env": "prod"}
+				disco.getContainers()
+
+				result := disco.Services()
+				So(len(result), ShouldEqual, 1)
+				So(result[0].ID, ShouldEqual, svcId1)
+			})
+
+			Convey("drops containers with the ExcludeLabels even if they matched", func() {
+				clients[endpoint].Containers[0].Labels = map[string]string{"Env": "prod", "Role": "logs"}
+				clients[endpoint2].Containers[0].Labels = map[string]string{"Env": "prod"}
+				disco.MatchLabels = map[string]string{"Env": "prod"}
+				disco.ExcludeLabels = map[string]string{"Role": "logs"}
+				disco.getContainers()
+
+				result := disco.Services()
+				So(len(result), ShouldEqual, 1)
+				So(result[0].ID, ShouldEqual, svcId2)
+			})
+
+			Convey("carries on with the others when an endpoint fails", func() {
+				clients[endpoint2].ErrorOnListContainers = true
+				disco.getContainers()
+
+				result := disco.Services()
+				So(len(result), ShouldEqual, 1)
+				So(result[0].ID, ShouldEqual, svcId1)
+			})
+
+			Convey("in event mode", func() {
+				disco.EventMode = true
+				disco.getContainers()
+				clients[endpoint].Containers = append(clients[endpoint].Containers,
+					docker.APIContainers{ID: "cafebabe1231abcdef", Names: []string{"/three"}},
+				)
+
+				Convey("picks up started containers right away", func() {
+					disco.handleEvent(docker.APIEvents{ID: "cafebabe1231abcdef", Status: "start"})
+					So(len(disco.Services()), ShouldEqual, 3)
+				})
+
+				Convey("picks up health changes right away", func() {
+					disco.handleEvent(docker.APIEvents{ID: "cafebabe1231abcdef", Status: "health_status: healthy"})
+					So(len(disco.Services()), ShouldEqual, 3)
+				})
+
+				Convey("still prunes dead containers", func() {
+					disco.handleEvent(docker.APIEvents{ID: svcId1 + "abcdef", Status: "die"})
+					So(len(disco.Services()), ShouldEqual, 1)
+				})
+
+				Convey("only resyncs when it's due", func() {
+					So(disco.resyncDue(), ShouldBeFalse)
+
+					disco.ResyncInterval = 0
+					So(disco.resyncDue(), ShouldBeTrue)
+				})
+
+				Convey("resyncs right away when it might have missed events", func() {
+					disco.forceResync()
+					So(disco.resyncDue(), ShouldBeTrue)
+				})
+
+				Convey("retries when an endpoint couldn't be listed", func() {
+					clients[endpoint2].ErrorOnListContainers = true
+					disco.getContainers()
+					So(disco.resyncDue(), ShouldBeTrue)
+				})
+			})
+
+			Convey("ignores started containers when not in event mode", func() {
+				disco.getContainers()
+				clients[endpoint].Containers = append(clients[endpoint].Containers,
+					docker.APIContainers{ID: "cafebabe1231abcdef", Names: []string{"/three"}},
+				)
+
+				disco.handleEvent(docker.APIEvents{ID: "cafebabe1231abcdef", Status: "start"})
+				So(len(disco.Services()), ShouldEqual, 2)
+			})
+		})
+
+		Convey("ConfigureTLS()", func() {
+			certFile := "../fixtures/docker-cert.pem"
+			keyFile := "../fixtures/docker-key.pem"
+
+			Convey("loads the certificates", func() {
+				err := disco.ConfigureTLS(certFile, keyFile, certFile)
+
+				So(err, ShouldBeNil)
+				So(disco.tlsCert, ShouldNotBeNil)
+				So(disco.tlsCA, ShouldNotBeNil)
+			})
+
+			Convey("only applies to TCP endpoints", func() {
+				disco.ConfigureTLS(certFile, keyFile, certFile)
+
+				So(disco.usesTLS("tcp://example.com:2376"), ShouldBeTrue)
+				So(disco.usesTLS("unix:///var/run/docker.sock"), ShouldBeFalse)
+			})
+
+			Convey("errors when a file is missing", func() {
+				err := disco.ConfigureTLS("!!!!", keyFile, certFile)
+
+				So(err, ShouldNotBeNil)
+				So(disco.tlsCert, ShouldBeNil)
+			})
+
+			Convey("errors when the key doesn't match the cert", func() {
+				err := disco.ConfigureTLS(certFile, certFile, certFile)
+
+				So(err, ShouldNotBeNil)
+				So(disco.tlsCert, ShouldBeNil)
+			})
+
+			Convey("errors when the CA can't be parsed", func() {
+				err := disco.ConfigureTLS(certFile, keyFile, "../fixtures/static.json")
+
+				So(err, ShouldNotBeNil)
+				So(disco.tlsCert, ShouldBeNil)
+			})
+		})
+
 		Convey("inspectContainer()", func() {
 			Convey("looks in the cache first", func() {
 				disco.containerCache[svcId1] = &docker.Container{Path: "cached"}
@@ -141,7 +448,7 @@ func Test_DockerDiscovery(t *testing.T) {
 			})
 
 			Convey("bubbles up errors from the Docker client", func() {
-				disco.ClientProvider = func() (DockerClient, error) {
+				disco.ClientProvider = func(endpoint string) (DockerClient, error) {
 					return &stubDockerClient{
 						ErrorOnInspectContainer: true,
 					}, nil
@@ -172,3 +479,11 @@ func Test_DockerDiscovery(t *testing.T) {
 		})
 	})
 }
+
+func servicesByID(services []service.Service) map[string]service.Service {
+	byID := make(map[string]service.Service, len(services))
+	for _, svc := range services {
+		byID[svc.ID] = svc
+	}
+	return byID
+}
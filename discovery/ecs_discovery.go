@@ -0,0 +1,279 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/service"
+	"github.com/relistan/go-director"
+)
+
+const (
+	ECS_CLIENT_TIMEOUT = 3 * time.Second
+	ECS_METADATA_ENV   = "ECS_CONTAINER_METADATA_URI_V4"
+)
+
+type EcsPort struct {
+	ContainerPort int64
+	HostPort      int64
+	Protocol      string
+}
+
+// The parts of a container in the ECS task metadata that we care about
+type EcsContainer struct {
+	DockerId    string
+	Name        string
+	Image       string
+	Labels      map[string]string
+	KnownStatus string
+	Type        string
+	CreatedAt   time.Time
+	Ports       []EcsPort
+	Health      *struct {
+		Status string
+	}
+}
+
+// The parts of the ECS task metadata that we care about
+type EcsTask struct {
+	TaskARN     string
+	Family      string
+	KnownStatus string
+	Containers  []EcsContainer
+	TaskTags    map[string]string
+}
+
+type EcsDiscovery struct {
+	MetadataURL string            // The ECS task metadata endpoint
+	Hostname    string            // The hostname we announce services for
+	Client      *http.Client      // The HTTP client used to talk to ECS
+	services    []service.Service // The list of services we know about
+	labels      map[string]map[string]string
+	sync.RWMutex
+}
+
+// NewEcsDiscovery polls the task metadata endpoint. If metadataURL is
+// empty, it uses the one ECS gives every container in the environment.
+func NewEcsDiscovery(metadataURL string) *EcsDiscovery {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Errorf("Error getting hostname! %s", err.Error())
+	}
+
+	if metadataURL == "" {
+		metadataURL = os.Getenv(ECS_METADATA_ENV)
+	}
+
+	return &EcsDiscovery{
+		MetadataURL: strings.TrimRight(metadataURL, "/"),
+		Hostname:    hostname,
+		Client:      &http.Client{Timeout: ECS_CLIENT_TIMEOUT},
+		labels:      make(map[string]map[string]string),
+	}
+}
+
+// HealthCheck uses the Docker labels on the container in the task
+// definition, in the same way that the DockerDiscovery does.
+func (d *EcsDiscovery) HealthCheck(svc *service.Service) (string, string) {
+	d.RLock()
+	defer d.RUnlock()
+
+	labels, ok := d.labels[svc.ID]
+	if !ok {
+		return "", ""
+	}
+
+	return labels["HealthCheck"], labels["HealthCheckArgs"]
+}
+
+func (d *EcsDiscovery) CheckConfig(svc *service.Service) CheckConfig {
+	d.RLock()
+	defer d.RUnlock()
+
+	return CheckConfigFromLabels(d.labels[svc.ID])
+}
+
+func (d *EcsDiscovery) Services() []service.Service {
+	d.RLock()
+	defer d.RUnlock()
+
+	svcList := make([]service.Service, len(d.services))
+	copy(svcList, d.services)
+
+	return svcList
+}
+
+// The main loop, poll the task metadata continuously.
+func (d *EcsDiscovery) Run(looper director.Looper) {
+	go looper.Loop(func() error {
+		d.getServices()
+		return nil
+	})
+}
+
+func (d *EcsDiscovery) getServices() {
+	task, err := d.getTask()
+	if err != nil {
+		log.WithField("event", "discovery_failed").Errorf("Error fetching ECS task metadata: %s", err.Error())
+		return
+	}
+
+	services := make([]service.Service, 0, len(task.Containers))
+	labels := make(map[string]map[string]string, len(task.Containers))
+
+	if task.KnownStatus == "RUNNING" {
+		// Iterate in a stable order so the service list doesn't shuffle
+		sort.Slice(task.Containers, func(i, j int) bool {
+			return task.Containers[i].DockerId < task.Containers[j].DockerId
+		})
+
+		for _, container := range task.Containers {
+			if !container.isHealthy() {
+				continue
+			}
+
+			svc, svcLabels := ecsToService(task, &container, d.Hostname)
+
+			// Skip containers that are purposely excluded from discovery.
+			if svcLabels["SidecarDiscover"] == "false" {
+				continue
+			}
+
+			services = append(services, svc)
+			labels[svc.ID] = svcLabels
+		}
+	}
+
+	d.Lock()
+	d.services = services
+	d.labels = labels
+	d.Unlock()
+}
+
+// Validate checks that we can fetch the task metadata
+func (d *EcsDiscovery) Validate() error {
+	if d.MetadataURL == "" {
+		return fmt.Errorf("No ECS metadata URL configured, and %s isn't set", ECS_METADATA_ENV)
+	}
+
+	_, err := d.getTask()
+	if err != nil {
+		return fmt.Errorf("Can't fetch ECS task metadata: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (d *EcsDiscovery) getTask() (*EcsTask, error) {
+	resp, err := d.Client.Get(d.MetadataURL + "/taskWithTags")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Bad status code from ECS (%d)", resp.StatusCode)
+	}
+
+	var task EcsTask
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// Running, and healthy if the task definition gives it a health check.
+// Skips the ECS agent's own containers, like the awsvpc pause container.
+func (c *EcsContainer) isHealthy() bool {
+	if c.KnownStatus != "RUNNING" || c.DockerId == "" {
+		return false
+	}
+
+	if c.Type != "" && c.Type != "NORMAL" {
+		return false
+	}
+
+	if c.Health == nil || c.Health.Status == "" {
+		return true
+	}
+
+	return c.Health.Status == "HEALTHY"
+}
+
+// Format a container from the ECS task metadata into a service. Its Docker
+// labels work just like they do for DockerDiscovery. The task tags are
+// turned into metadata, though "Metadata_xxx" labels on the container take
+// precedence.
+func ecsToService(task *EcsTask, container *EcsContainer, hostname string) (service.Service, map[string]string) {
+	var svc service.Service
+
+	labels := make(map[string]string, len(task.TaskTags)+len(container.Labels))
+	for key, value := range task.TaskTags {
+		labels[service.METADATA_PREFIX+key] = value
+	}
+	for key, value := range container.Labels {
+		labels[key] = value
+	}
+
+	svc.ID = container.DockerId
+	if len(svc.ID) > 12 {
+		svc.ID = svc.ID[:12] // Use short IDs, like Docker
+	}
+	svc.Name = container.Name
+	svc.Image = container.Image
+	svc.Created = container.CreatedAt.UTC()
+	svc.Updated = time.Now().UTC()
+	svc.Hostname = hostname
+	svc.Status = service.ALIVE
+
+	if mode, ok := labels["ProxyMode"]; ok {
+		svc.ProxyMode = mode
+	} else {
+		svc.ProxyMode = "http"
+	}
+
+	svc.Metadata = service.MetadataFromLabels(labels)
+	svc.Tags = service.TagsFromLabels(labels)
+	svc.Weight = service.WeightFromLabels(labels)
+	svc.Sticky, svc.StickyCookie = service.StickyFromLabels(labels)
+
+	svc.Ports = make([]service.Port, 0, len(container.Ports))
+	for _, ecsPort := range container.Ports {
+		if ecsPort.HostPort == 0 {
+			continue
+		}
+
+		port := service.Port{Type: ecsPort.Protocol, Port: ecsPort.HostPort}
+		if port.Type == "" {
+			port.Type = "tcp"
+		}
+		port.Name = labels[fmt.Sprintf("PortName_%d", ecsPort.ContainerPort)]
+
+		svcPortLabel := fmt.Sprintf("ServicePort_%d", ecsPort.ContainerPort)
+		if value, ok := labels[svcPortLabel]; ok {
+			svcPortInt, err := strconv.Atoi(value)
+			if err != nil {
+				log.Errorf("Error converting label value for %s to integer: %s",
+					svcPortLabel,
+					err.Error(),
+				)
+			} else {
+				port.ServicePort = int64(svcPortInt)
+			}
+		}
+
+		svc.Ports = append(svc.Ports, port)
+	}
+
+	return svc, labels
+}
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/mockhttp"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	ecsTask = `{
+		"TaskARN": "arn:aws:ecs:us-east-1:012345678910:task/default/abc123", "Family": "web", "KnownStatus": "RUNNING",
+		"TaskTags": {"team": "search", "canary": "false"},
+		"Containers": [
+			{"DockerId": "deadbeef12345678", "Name": "web", "Image": "web:1.2", "KnownStatus": "RUNNING", "Type": "NORMAL",
+			 "CreatedAt": "2017-07-14T02:40:00Z",
+			 "Labels": {"ServicePort_8080": "10100", "PortName_8080": "api", "HealthCheck": "HttpGet",
+				"HealthCheckArgs": "http://:8080/", "HealthCheckInterval": "10s", "Metadata_canary": "true"},
+			 "Ports": [{"ContainerPort": 8080, "HostPort": 32768, "Protocol": "tcp"}, {"ContainerPort": 9000, "Protocol": "tcp"}],
+			 "Health": {"status": "HEALTHY"}},
+			{"DockerId": "feedface12345678", "Name": "worker", "Image": "worker:1.2", "KnownStatus": "RUNNING",
+			 "Labels": {"ProxyMode": "tcp"},
+			 "Ports": [{"ContainerPort": 5000, "HostPort": 5000, "Protocol": "udp"}]},
+			{"DockerId": "badf00d123456789", "Name": "starting", "KnownStatus": "RUNNING",
+			 "Health": {"status": "UNKNOWN"}},
+			{"DockerId": "c0ffee1234567890", "Name": "sick", "KnownStatus": "RUNNING",
+			 "Health": {"status": "UNHEALTHY"}},
+			{"DockerId": "0ddba11123456789", "Name": "migrate", "KnownStatus": "STOPPED"},
+			{"DockerId": "abad1dea12345678", "Name": "hidden", "KnownStatus": "RUNNING",
+			 "Labels": {"SidecarDiscover": "false"}},
+			{"DockerId": "0000000012345678", "Name": "~internal~ecs~pause", "KnownStatus": "RUNNING", "Type": "CNI_PAUSE"}
+		]
+	}`
+)
+
+func Test_EcsDiscovery(t *testing.T) {
+	Convey("Working with the ECS task metadata", t, func() {
+		expectations := []mockhttp.HttpExpectation{
+			{Expect: "/v4/abc/taskWithTags", Send: ecsTask, Content: "application/json"},
+		}
+
+		disco := NewEcsDiscovery("http://169.254.170.2/v4/abc/")
+		disco.Hostname = hostname
+		disco.Client = mockhttp.ClientWithExpectations(expectations)
+
+		Convey("New() configures the URL without a trailing slash", func() {
+			So(disco.MetadataURL, ShouldEqual, "http://169.254.170.2/v4/abc")
+		})
+
+		Convey("New() falls back to the URL in the environment", func() {
+			os.Setenv(ECS_METADATA_ENV, "http://169.254.170.2/v4/def")
+			defer os.Unsetenv(ECS_METADATA_ENV)
+
+			So(NewEcsDiscovery("").MetadataURL, ShouldEqual, "http://169.254.170.2/v4/def")
+		})
+
+		Convey("getServices() finds the running, healthy containers", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(len(services), ShouldEqual, 2)
+			So(services[0].ID, ShouldEqual, "deadbeef1234")
+			So(services[0].Name, ShouldEqual, "web")
+			So(services[0].Image, ShouldEqual, "web:1.2")
+			So(services[0].Hostname, ShouldEqual, hostname)
+			So(services[0].Created, ShouldResemble, time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC))
+			So(services[0].ProxyMode, ShouldEqual, "http")
+			So(len(services[0].Ports), ShouldEqual, 1)
+			So(services[0].Ports[0].Port, ShouldEqual, 32768)
+			So(services[0].Ports[0].Name, ShouldEqual, "api")
+			So(services[0].Ports[0].ServicePort, ShouldEqual, 10100)
+
+			So(services[1].Name, ShouldEqual, "worker")
+			So(services[1].ProxyMode, ShouldEqual, "tcp")
+			So(services[1].Ports[0].Type, ShouldEqual, "udp")
+		})
+
+		Convey("getServices() turns the task tags into metadata", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(services[0].Metadata["team"], ShouldEqual, "search")
+			So(services[0].Metadata["canary"], ShouldEqual, "true")
+			So(services[1].Metadata["canary"], ShouldEqual, "false")
+		})
+
+		Convey("getServices() skips tasks that aren't running", func() {
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/taskWithTags", Send: `{"KnownStatus": "STOPPED", "Containers": [
+					{"DockerId": "deadbeef12345678", "Name": "web", "KnownStatus": "RUNNING"}]}`,
+					Content: "application/json"},
+			})
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 0)
+		})
+
+		Convey("getServices() leaves the services alone on errors", func() {
+			disco.getServices()
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/taskWithTags", Err: errors.New("Oh no!")},
+			})
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 2)
+		})
+
+		Convey("HealthCheck() uses the container labels", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			check, args := disco.HealthCheck(&services[0])
+			So(check, ShouldEqual, "HttpGet")
+			So(args, ShouldEqual, "http://:8080/")
+		})
+
+		Convey("CheckConfig() uses the container labels", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(disco.CheckConfig(&services[0]).Interval, ShouldEqual, 10*time.Second)
+		})
+
+		Convey("Validate() checks that we can fetch the metadata", func() {
+			So(disco.Validate(), ShouldBeNil)
+
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/taskWithTags", Err: errors.New("Oh no!")},
+			})
+			So(disco.Validate(), ShouldNotBeNil)
+
+			disco.MetadataURL = ""
+			So(disco.Validate().Error(), ShouldContainSubstring, ECS_METADATA_ENV)
+		})
+
+		Convey("Run() polls the metadata", func() {
+			looper := director.NewFreeLooper(director.ONCE, make(chan error))
+			disco.Run(looper)
+			looper.Wait()
+
+			So(len(disco.Services()), ShouldEqual, 2)
+		})
+	})
+}
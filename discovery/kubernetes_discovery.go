@@ -0,0 +1,586 @@
+package discovery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/service"
+	"github.com/relistan/go-director"
+)
+
+const (
+	KUBE_SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+	KUBE_CLIENT_TIMEOUT      = 3 * time.Second
+)
+
+// The parts of the Kubernetes API objects that we care about. We talk to
+// the API over plain HTTP + JSON rather than pulling in the client library.
+type KubeObjectMeta struct {
+	Name        string
+	Namespace   string
+	UID         string
+	Annotations map[string]string
+}
+
+type KubeObjectReference struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+type KubeEndpointAddress struct {
+	IP        string
+	NodeName  string
+	TargetRef *KubeObjectReference
+}
+
+type KubeEndpointPort struct {
+	Name     string
+	Port     int64
+	Protocol string
+}
+
+type KubeEndpointSubset struct {
+	Addresses []KubeEndpointAddress
+	Ports     []KubeEndpointPort
+}
+
+type KubeEndpoints struct {
+	Metadata KubeObjectMeta
+	Subsets  []KubeEndpointSubset
+}
+
+type KubeEndpointsList struct {
+	Items []KubeEndpoints
+}
+
+type KubeContainer struct {
+	Name  string
+	Image string
+}
+
+type KubePodCondition struct {
+	Type   string
+	Status string
+}
+
+type KubePod struct {
+	Metadata KubeObjectMeta
+	Spec     struct {
+		NodeName   string
+		Containers []KubeContainer
+	}
+	Status struct {
+		Phase      string
+		PodIP      string
+		StartTime  time.Time
+		Conditions []KubePodCondition
+	}
+}
+
+type KubePodList struct {
+	Items []KubePod
+}
+
+type KubernetesClient interface {
+	ListEndpoints(namespace string) (*KubeEndpointsList, error)
+	ListPods(namespace string) (*KubePodList, error)
+}
+
+type KubernetesDiscovery struct {
+	KubeConfig     string                           // Path to a kubeconfig, empty for in-cluster
+	Namespace      string                           // Namespace to watch, empty for all
+	Hostname       string                           // The node we're running on
+	ClientProvider func() (KubernetesClient, error) // Return the client we'll use to connect
+	services       []service.Service                // The list of services we know about
+	annotations    map[string]map[string]string     // Pod annotations, by service ID
+	sync.RWMutex                                    // Reader/Writer lock
+}
+
+func NewKubernetesDiscovery(kubeConfig string, namespace string) *KubernetesDiscovery {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Errorf("Error getting hostname! %s", err.Error())
+	}
+
+	discovery := KubernetesDiscovery{
+		KubeConfig:  kubeConfig,
+		Namespace:   namespace,
+		Hostname:    hostname,
+		annotations: make(map[string]map[string]string),
+	}
+
+	// Default to our own method for returning this
+	discovery.ClientProvider = discovery.getKubernetesClient
+
+	return &discovery
+}
+
+func (d *KubernetesDiscovery) getKubernetesClient() (KubernetesClient, error) {
+	if d.KubeConfig != "" {
+		return newKubeClientFromConfig(d.KubeConfig)
+	}
+
+	return newInClusterKubeClient()
+}
+
+// HealthCheck uses pod annotations in the same way that the DockerDiscovery
+// uses container labels.
+func (d *KubernetesDiscovery) HealthCheck(svc *service.Service) (string, string) {
+	d.RLock()
+	defer d.RUnlock()
+
+	annotations, ok := d.annotations[svc.ID]
+	if !ok {
+		return "", ""
+	}
+
+	return annotations["HealthCheck"], annotations["HealthCheckArgs"]
+}
+
+func (d *KubernetesDiscovery) CheckConfig(svc *service.Service) CheckConfig {
+	d.RLock()
+	defer d.RUnlock()
+
+	return CheckConfigFromLabels(d.annotations[svc.ID])
+}
+
+func (d *KubernetesDiscovery) Services() []service.Service {
+	d.RLock()
+	defer d.RUnlock()
+
+	svcList := make([]service.Service, len(d.services))
+	copy(svcList, d.services)
+
+	return svcList
+}
+
+// The main loop, re-list the Endpoints and Pods continuously.
+func (d *KubernetesDiscovery) Run(looper director.Looper) {
+	go looper.Loop(func() error {
+		d.getServices()
+		return nil
+	})
+}
+
+// Validate checks that we can load the credentials and list pods
+func (d *KubernetesDiscovery) Validate() error {
+	client, err := d.ClientProvider()
+	if err != nil {
+		return fmt.Errorf("Can't create Kubernetes client: %s", err.Error())
+	}
+
+	_, err = client.ListPods(d.Namespace)
+	if err != nil {
+		return fmt.Errorf("Can't list Kubernetes pods: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (d *KubernetesDiscovery) getServices() {
+	// New connection every time
+	client, err := d.ClientProvider()
+	if err != nil {
+		log.Errorf("Error when creating Kubernetes client: %s", err.Error())
+		return
+	}
+
+	pods, err := client.ListPods(d.Namespace)
+	if err != nil {
+		log.WithField("event", "discovery_failed").Errorf("Error listing Kubernetes pods: %s", err.Error())
+		return
+	}
+
+	endpoints, err := client.ListEndpoints(d.Namespace)
+	if err != nil {
+		log.Errorf("Error listing Kubernetes endpoints: %s", err.Error())
+		return
+	}
+
+	services, annotations := d.servicesFrom(pods, endpoints)
+
+	d.Lock()
+	d.services = services
+	d.annotations = annotations
+	d.Unlock()
+}
+
+// Walk the ready addresses in each Endpoints object and match them up with
+// the Pods they point at. Each ready pod running on this node becomes a
+// service, with one Port for each port in the Endpoints subset.
+func (d *KubernetesDiscovery) servicesFrom(pods *KubePodList,
+	endpoints *KubeEndpointsList) ([]service.Service, map[string]map[string]string) {
+
+	podMap := make(map[string]*KubePod, len(pods.Items))
+	for i, pod := range pods.Items {
+		podMap[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = &pods.Items[i]
+	}
+
+	services := make([]service.Service, 0, len(pods.Items))
+	annotations := make(map[string]map[string]string, len(pods.Items))
+
+	for _, endpoint := range endpoints.Items {
+		for _, subset := range endpoint.Subsets {
+			for _, address := range subset.Addresses {
+				if address.TargetRef == nil || address.TargetRef.Kind != "Pod" {
+					continue
+				}
+
+				pod, ok := podMap[address.TargetRef.Namespace+"/"+address.TargetRef.Name]
+				if !ok || !d.isLocalReadyPod(pod) {
+					continue
+				}
+
+				// Skip services that are purposely excluded from discovery.
+				if pod.Metadata.Annotations["SidecarDiscover"] == "false" {
+					continue
+				}
+
+				svc := kubeToService(pod, &endpoint, subset.Ports, d.Hostname, address.IP)
+				services = append(services, svc)
+				annotations[svc.ID] = pod.Metadata.Annotations
+			}
+		}
+	}
+
+	return services, annotations
+}
+
+// Only pods scheduled on this node which have passed their readiness
+// gates are of interest to us.
+func (d *KubernetesDiscovery) isLocalReadyPod(pod *KubePod) bool {
+	if pod.Spec.NodeName != d.Hostname || pod.Status.Phase != "Running" {
+		return false
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+
+	return false
+}
+
+// Format a Pod and its Endpoints into a service. Annotations are handled
+// the same way as Docker labels, so "ProxyMode", "ProxyWeight",
+// "ProxySticky", "ServicePort_xxx", "Metadata_xxx" and "Tag_xxx" work as expected.
+// The pod is reached on its own IP, since nothing listens on the node's
+// address for the container ports.
+func kubeToService(pod *KubePod, endpoint *KubeEndpoints,
+	ports []KubeEndpointPort, hostname string, ip string) service.Service {
+
+	var svc service.Service
+
+	svc.ID = kubeServiceID(pod.Metadata.UID, endpoint.Metadata.Name)
+	svc.Name = endpoint.Metadata.Name
+	if len(pod.Spec.Containers) > 0 {
+		svc.Image = pod.Spec.Containers[0].Image
+	}
+	svc.Created = pod.Status.StartTime.UTC()
+	svc.Updated = time.Now().UTC()
+	svc.Hostname = hostname
+	svc.IP = ip
+	if svc.IP == "" {
+		svc.IP = pod.Status.PodIP
+	}
+	svc.Status = service.ALIVE
+
+	if mode, ok := pod.Metadata.Annotations["ProxyMode"]; ok {
+		svc.ProxyMode = mode
+	} else {
+		svc.ProxyMode = "http"
+	}
+
+	svc.Metadata = service.MetadataFromLabels(pod.Metadata.Annotations)
+	svc.Tags = service.TagsFromLabels(pod.Metadata.Annotations)
+	svc.Weight = service.WeightFromLabels(pod.Metadata.Annotations)
+	svc.Sticky, svc.StickyCookie = service.StickyFromLabels(pod.Metadata.Annotations)
+
+	svc.Ports = make([]service.Port, 0, len(ports))
+	for _, port := range ports {
+		svcPort := service.Port{
+			Type: strings.ToLower(port.Protocol),
+			Port: port.Port,
+			Name: port.Name,
+		}
+
+		svcPortLabel := fmt.Sprintf("ServicePort_%d", port.Port)
+		if value, ok := pod.Metadata.Annotations[svcPortLabel]; ok {
+			svcPortInt, err := strconv.Atoi(value)
+			if err != nil {
+				log.Errorf("Error converting annotation value for %s to integer: %s",
+					svcPortLabel,
+					err.Error(),
+				)
+			} else {
+				svcPort.ServicePort = int64(svcPortInt)
+			}
+		}
+
+		svc.Ports = append(svc.Ports, svcPort)
+	}
+
+	return svc
+}
+
+// A pod can back more than one Kubernetes service, so the ID is derived
+// from both. It must be stable across polls.
+func kubeServiceID(podUID string, endpointName string) string {
+	id := strings.Replace(podUID, "-", "", -1)
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	if endpointName == "" {
+		return id
+	}
+
+	return id + "-" + endpointName
+}
+
+// kubeClient is a minimal client for the Kubernetes API
+type kubeClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+func (k *kubeClient) get(path string, result interface{}) error {
+	req, err := http.NewRequest("GET", k.server+path, nil)
+	if err != nil {
+		return err
+	}
+
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Bad status code from Kubernetes API (%d)", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func kubeNamespacePath(namespace string, resource string) string {
+	if namespace == "" {
+		return "/api/v1/" + resource
+	}
+
+	return "/api/v1/namespaces/" + namespace + "/" + resource
+}
+
+func (k *kubeClient) ListEndpoints(namespace string) (*KubeEndpointsList, error) {
+	var endpoints KubeEndpointsList
+	err := k.get(kubeNamespacePath(namespace, "endpoints"), &endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	return &endpoints, nil
+}
+
+func (k *kubeClient) ListPods(namespace string) (*KubePodList, error) {
+	var pods KubePodList
+	err := k.get(kubeNamespacePath(namespace, "pods"), &pods)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pods, nil
+}
+
+// Configure a client from the service account that Kubernetes mounts
+// into every pod.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster")
+	}
+
+	token, err := ioutil.ReadFile(KUBE_SERVICE_ACCOUNT_DIR + "/token")
+	if err != nil {
+		return nil, err
+	}
+
+	caData, err := ioutil.ReadFile(KUBE_SERVICE_ACCOUNT_DIR + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := kubeTLSConfig(caData, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout:   KUBE_CLIENT_TIMEOUT,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// The subset of a kubeconfig file that we understand
+type kubeConfigFile struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+		}
+	}
+	Contexts []struct {
+		Name    string
+		Context struct {
+			Cluster string
+			User    string
+		}
+	}
+}
+
+// Configure a client from a kubeconfig file. Since we don't carry a YAML
+// parser, the file must be in JSON format, as produced by
+// `kubectl config view --raw -o json`.
+func newKubeClientFromConfig(path string) (*kubeClient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config kubeConfigFile
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse kubeconfig '%s' as JSON: %s", path, err.Error())
+	}
+
+	var clusterName, userName string
+	for _, ctx := range config.Contexts {
+		if ctx.Name == config.CurrentContext {
+			clusterName, userName = ctx.Context.Cluster, ctx.Context.User
+		}
+	}
+
+	client := &kubeClient{}
+	var caData, certData, keyData []byte
+	var insecure bool
+
+	for _, cluster := range config.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+
+		client.server = strings.TrimRight(cluster.Cluster.Server, "/")
+		insecure = cluster.Cluster.InsecureSkipTLSVerify
+		caData, err = kubeConfigData(
+			cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if client.server == "" {
+		return nil, fmt.Errorf("No cluster found for context '%s'", config.CurrentContext)
+	}
+
+	for _, user := range config.Users {
+		if user.Name != userName {
+			continue
+		}
+
+		client.token = user.User.Token
+		certData, err = kubeConfigData(user.User.ClientCertificateData, user.User.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+		keyData, err = kubeConfigData(user.User.ClientKeyData, user.User.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConfig, err := kubeTLSConfig(caData, certData, keyData, insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	client.client = &http.Client{
+		Timeout:   KUBE_CLIENT_TIMEOUT,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	return client, nil
+}
+
+// Kubeconfig values can be supplied inline (base64 encoded) or as a path
+func kubeConfigData(data string, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+
+	return nil, nil
+}
+
+func kubeTLSConfig(caData []byte, certData []byte, keyData []byte, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+
+	if len(caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("Unable to parse Kubernetes CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(certData) > 0 && len(keyData) > 0 {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Define a stubKubernetesClient that we can use to test the discovery
+type stubKubernetesClient struct {
+	Pods          *KubePodList
+	Endpoints     *KubeEndpointsList
+	ErrorOnList   bool
+	LastNamespace string
+}
+
+func (s *stubKubernetesClient) ListEndpoints(namespace string) (*KubeEndpointsList, error) {
+	s.LastNamespace = namespace
+	if s.ErrorOnList {
+		return nil, errors.New("Oh no!")
+	}
+	return s.Endpoints, nil
+}
+
+func (s *stubKubernetesClient) ListPods(namespace string) (*KubePodList, error) {
+	s.LastNamespace = namespace
+	if s.ErrorOnList {
+		return nil, errors.New("Oh no!")
+	}
+	return s.Pods, nil
+}
+
+func makeKubePod(name string, uid string, node string, ready string) KubePod {
+	var pod KubePod
+	pod.Metadata = KubeObjectMeta{
+		Name:      name,
+		Namespace: "default",
+		UID:       uid,
+		Annotations: map[string]string{
+			"HealthCheck":        "HttpGet",
+			"HealthCheckArgs":    "http://{{ host }}:{{ tcp 10100 }}/",
+			"Metadata_canary":    "true",
+			"ServicePort_8080":   "10100",
+			"UnhealthyThreshold": "3",
+		},
+	}
+	pod.Spec.NodeName = node
+	pod.Spec.Containers = []KubeContainer{{Name: "web", Image: "web:abc123"}}
+	pod.Status.Phase = "Running"
+	pod.Status.Conditions = []KubePodCondition{{Type: "Ready", Status: ready}}
+
+	return pod
+}
+
+func Test_KubernetesDiscovery(t *testing.T) {
+	Convey("Working with Kubernetes pods", t, func() {
+		pod1 := makeKubePod("web-1", "deadbeef-1231-4444-8888-000000000001", hostname, "True")
+		pod2 := makeKubePod("web-2", "deadbeef-1011-4444-8888-000000000002", hostname, "False")
+		pod3 := makeKubePod("web-3", "deadbeef-1211-4444-8888-000000000003", "elsewhere", "True")
+
+		endpoints := KubeEndpoints{
+			Metadata: KubeObjectMeta{Name: "web", Namespace: "default"},
+			Subsets: []KubeEndpointSubset{
+				{
+					Addresses: []KubeEndpointAddress{
+						{IP: "10.1.0.1", TargetRef: &KubeObjectReference{Kind: "Pod", Namespace: "default", Name: "web-1"}},
+						{IP: "10.1.0.2", TargetRef: &KubeObjectReference{Kind: "Pod", Namespace: "default", Name: "web-2"}},
+						{IP: "10.1.0.3", TargetRef: &KubeObjectReference{Kind: "Pod", Namespace: "default", Name: "web-3"}},
+					},
+					Ports: []KubeEndpointPort{{Name: "http", Port: 8080, Protocol: "TCP"}},
+				},
+			},
+		}
+
+		stub := &stubKubernetesClient{
+			Pods:      &KubePodList{Items: []KubePod{pod1, pod2, pod3}},
+			Endpoints: &KubeEndpointsList{Items: []KubeEndpoints{endpoints}},
+		}
+
+		disco := NewKubernetesDiscovery("", "default")
+		disco.Hostname = hostname
+		disco.ClientProvider = func() (KubernetesClient, error) { return stub, nil }
+
+		Convey("getServices() only finds ready pods on this node", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(len(services), ShouldEqual, 1)
+			So(services[0].ID, ShouldEqual, "deadbeef1231-web")
+			So(services[0].Name, ShouldEqual, "web")
+			So(services[0].Image, ShouldEqual, "web:abc123")
+			So(services[0].Hostname, ShouldEqual, hostname)
+			So(services[0].ProxyMode, ShouldEqual, "http")
+		})
+
+		Convey("getServices() reaches the pod on its own IP", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(services[0].IP, ShouldEqual, "10.1.0.1")
+			So(services[0].Address(), ShouldEqual, "10.1.0.1")
+		})
+
+		Convey("getServices() maps ports and ServicePort annotations", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(len(services[0].Ports), ShouldEqual, 1)
+			So(services[0].Ports[0].Type, ShouldEqual, "tcp")
+			So(services[0].Ports[0].Port, ShouldEqual, 8080)
+			So(services[0].Ports[0].ServicePort, ShouldEqual, 10100)
+			So(services[0].Ports[0].Name, ShouldEqual, "http")
+		})
+
+		Convey("getServices() passes the namespace to the client", func() {
+			disco.getServices()
+			So(stub.LastNamespace, ShouldEqual, "default")
+		})
+
+		Convey("getServices() keeps IDs stable across polls", func() {
+			disco.getServices()
+			first := disco.Services()
+			disco.getServices()
+			second := disco.Services()
+
+			So(first[0].ID, ShouldEqual, second[0].ID)
+		})
+
+		Convey("getServices() skips pods excluded from discovery", func() {
+			stub.Pods.Items[0].Metadata.Annotations["SidecarDiscover"] = "false"
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 0)
+		})
+
+		Convey("getServices() leaves the services alone on errors", func() {
+			disco.getServices()
+			stub.ErrorOnList = true
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 1)
+		})
+
+		Convey("HealthCheck() uses the pod annotations", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			check, args := disco.HealthCheck(&services[0])
+			So(check, ShouldEqual, "HttpGet")
+			So(args, ShouldEqual, "http://{{ host }}:{{ tcp 10100 }}/")
+		})
+
+		Convey("CheckConfig() uses the pod annotations", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(disco.CheckConfig(&services[0]).UnhealthyThreshold, ShouldEqual, 3)
+		})
+
+		Convey("getServices() picks up metadata annotations", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(services[0].Metadata["canary"], ShouldEqual, "true")
+		})
+
+		Convey("Run() lists the services", func() {
+			looper := director.NewFreeLooper(director.ONCE, make(chan error))
+			disco.Run(looper)
+			looper.Wait()
+
+			So(len(disco.Services()), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,358 @@
+package discovery
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/service"
+	"github.com/relistan/go-director"
+)
+
+const (
+	NOMAD_CLIENT_TIMEOUT = 3 * time.Second
+)
+
+// The parts of a Nomad allocation list entry that we care about
+type NomadAllocationStub struct {
+	ID               string
+	NodeName         string
+	ClientStatus     string
+	ModifyIndex      uint64
+	DeploymentStatus *struct {
+		Healthy *bool
+	}
+}
+
+type NomadPort struct {
+	Label string
+	Value int64
+	To    int64
+}
+
+type NomadService struct {
+	Name      string
+	PortLabel string
+	Tags      []string
+}
+
+// The parts of a full Nomad allocation that we care about
+type NomadAllocation struct {
+	ID                 string
+	JobID              string
+	TaskGroup          string
+	CreateTime         int64
+	ModifyIndex        uint64
+	AllocatedResources struct {
+		Shared struct {
+			Networks []struct {
+				IP            string
+				ReservedPorts []NomadPort
+				DynamicPorts  []NomadPort
+			}
+		}
+	}
+	Job struct {
+		TaskGroups []struct {
+			Name     string
+			Services []NomadService
+			Tasks    []struct {
+				Services []NomadService
+			}
+		}
+	}
+}
+
+type NomadDiscovery struct {
+	NomadURL    string            // The Nomad agent/server to talk to
+	Region      string            // Optional region to query
+	Namespace   string            // Optional namespace to query
+	Hostname    string            // The Nomad node name we announce services for
+	Client      *http.Client      // The HTTP client used to talk to Nomad
+	services    []service.Service // The list of services we know about
+	labels      map[string]map[string]string
+	allocations map[string]*NomadAllocation // Cache, so we only fetch allocations that changed
+	sync.RWMutex
+}
+
+func NewNomadDiscovery(nomadURL string) *NomadDiscovery {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Errorf("Error getting hostname! %s", err.Error())
+	}
+
+	return &NomadDiscovery{
+		NomadURL:    strings.TrimRight(nomadURL, "/"),
+		Hostname:    hostname,
+		Client:      &http.Client{Timeout: NOMAD_CLIENT_TIMEOUT},
+		labels:      make(map[string]map[string]string),
+		allocations: make(map[string]*NomadAllocation),
+	}
+}
+
+// HealthCheck uses the Nomad service tags in the form "key=value" in the
+// same way that the DockerDiscovery uses container labels.
+func (d *NomadDiscovery) HealthCheck(svc *service.Service) (string, string) {
+	d.RLock()
+	defer d.RUnlock()
+
+	labels, ok := d.labels[svc.ID]
+	if !ok {
+		return "", ""
+	}
+
+	return labels["HealthCheck"], labels["HealthCheckArgs"]
+}
+
+func (d *NomadDiscovery) CheckConfig(svc *service.Service) CheckConfig {
+	d.RLock()
+	defer d.RUnlock()
+
+	return CheckConfigFromLabels(d.labels[svc.ID])
+}
+
+func (d *NomadDiscovery) Services() []service.Service {
+	d.RLock()
+	defer d.RUnlock()
+
+	svcList := make([]service.Service, len(d.services))
+	copy(svcList, d.services)
+
+	return svcList
+}
+
+// The main loop, poll the Nomad allocations continuously.
+func (d *NomadDiscovery) Run(looper director.Looper) {
+	go looper.Loop(func() error {
+		d.getServices()
+		return nil
+	})
+}
+
+func (d *NomadDiscovery) getServices() {
+	var stubs []NomadAllocationStub
+	err := d.get("/v1/allocations", &stubs)
+	if err != nil {
+		log.WithField("event", "discovery_failed").Errorf("Error listing Nomad allocations: %s", err.Error())
+		return
+	}
+
+	// Iterate in a stable order so the service list doesn't shuffle
+	sort.Slice(stubs, func(i, j int) bool { return stubs[i].ID < stubs[j].ID })
+
+	services := make([]service.Service, 0, len(stubs))
+	labels := make(map[string]map[string]string, len(stubs))
+	allocations := make(map[string]*NomadAllocation, len(stubs))
+
+	for _, stub := range stubs {
+		if stub.NodeName != d.Hostname || !stub.isHealthy() {
+			continue
+		}
+
+		// Only fetch the whole allocation when it has changed
+		alloc, ok := d.allocations[stub.ID]
+		if !ok || alloc.ModifyIndex != stub.ModifyIndex {
+			alloc = &NomadAllocation{}
+			err := d.get("/v1/allocation/"+url.PathEscape(stub.ID), alloc)
+			if err != nil {
+				log.Errorf("Error fetching Nomad allocation %s: %s", stub.ID, err.Error())
+				// Don't half-update: keep what we had until the next poll
+				return
+			}
+		}
+		allocations[stub.ID] = alloc
+
+		for _, nomadSvc := range alloc.services() {
+			svc, svcLabels := nomadToService(alloc, &nomadSvc, d.Hostname)
+
+			// Skip services that are purposely excluded from discovery.
+			if svcLabels["SidecarDiscover"] == "false" {
+				continue
+			}
+
+			services = append(services, svc)
+			labels[svc.ID] = svcLabels
+		}
+	}
+
+	// Only touched from the discovery loop, so doesn't need the lock
+	d.allocations = allocations
+
+	d.Lock()
+	d.services = services
+	d.labels = labels
+	d.Unlock()
+}
+
+// Validate checks that we can list the Nomad allocations
+func (d *NomadDiscovery) Validate() error {
+	var stubs []NomadAllocationStub
+	err := d.get("/v1/allocations", &stubs)
+	if err != nil {
+		return fmt.Errorf("Can't list Nomad allocations: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (d *NomadDiscovery) get(path string, result interface{}) error {
+	query := url.Values{}
+	if d.Region != "" {
+		query.Set("region", d.Region)
+	}
+	if d.Namespace != "" {
+		query.Set("namespace", d.Namespace)
+	}
+
+	reqUrl := d.NomadURL + path
+	if len(query) > 0 {
+		reqUrl = reqUrl + "?" + query.Encode()
+	}
+
+	resp, err := d.Client.Get(reqUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Bad status code from Nomad (%d)", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Running, and not marked unhealthy by a deployment. Allocations that
+// aren't part of a deployment don't have a health status, so running
+// is all we can go on.
+func (s *NomadAllocationStub) isHealthy() bool {
+	if s.ClientStatus != "running" {
+		return false
+	}
+
+	if s.DeploymentStatus == nil || s.DeploymentStatus.Healthy == nil {
+		return true
+	}
+
+	return *s.DeploymentStatus.Healthy
+}
+
+// The services declared for this allocation's task group, at either the
+// group or the task level
+func (a *NomadAllocation) services() []NomadService {
+	var services []NomadService
+	for _, group := range a.Job.TaskGroups {
+		if group.Name != a.TaskGroup {
+			continue
+		}
+
+		services = append(services, group.Services...)
+		for _, task := range group.Tasks {
+			services = append(services, task.Services...)
+		}
+	}
+
+	return services
+}
+
+// Find the allocated port with this label
+func (a *NomadAllocation) port(label string) (NomadPort, bool) {
+	for _, network := range a.AllocatedResources.Shared.Networks {
+		for _, ports := range [][]NomadPort{network.ReservedPorts, network.DynamicPorts} {
+			for _, port := range ports {
+				if port.Label == label {
+					return port, true
+				}
+			}
+		}
+	}
+
+	return NomadPort{}, false
+}
+
+// Format a service declared in a Nomad allocation into a service. Tags in
+// the form "key=value" are treated like Docker labels, so "ProxyMode",
+// "ProxyWeight", "ProxySticky", "ServicePort_xxx", "Metadata_xxx" and
+// "Tag_xxx" work as expected. ServicePort_xxx refers to the port inside the
+// task (the "to" port) when there is one, so it doesn't change with dynamic
+// ports.
+func nomadToService(alloc *NomadAllocation, nomadSvc *NomadService, hostname string) (service.Service, map[string]string) {
+	var svc service.Service
+
+	labels := make(map[string]string, len(nomadSvc.Tags))
+	for _, tag := range nomadSvc.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+
+	svc.ID = nomadServiceID(alloc.ID, nomadSvc.Name)
+	svc.Name = nomadSvc.Name
+	svc.Image = nomadSvc.Name
+	svc.Created = time.Unix(0, alloc.CreateTime).UTC()
+	svc.Updated = time.Now().UTC()
+	svc.Hostname = hostname
+	svc.Status = service.ALIVE
+
+	if mode, ok := labels["ProxyMode"]; ok {
+		svc.ProxyMode = mode
+	} else {
+		svc.ProxyMode = "http"
+	}
+
+	svc.Metadata = service.MetadataFromLabels(labels)
+	svc.Tags = service.TagsFromLabels(labels)
+	svc.Weight = service.WeightFromLabels(labels)
+	svc.Sticky, svc.StickyCookie = service.StickyFromLabels(labels)
+
+	nomadPort, ok := alloc.port(nomadSvc.PortLabel)
+	if !ok {
+		if nomadSvc.PortLabel != "" {
+			log.Warnf("Nomad service %s uses unknown port %s", nomadSvc.Name, nomadSvc.PortLabel)
+		}
+		return svc, labels
+	}
+
+	port := service.Port{Type: "tcp", Port: nomadPort.Value, Name: nomadPort.Label}
+
+	privatePort := nomadPort.To
+	if privatePort <= 0 {
+		privatePort = nomadPort.Value
+	}
+
+	svcPortLabel := fmt.Sprintf("ServicePort_%d", privatePort)
+	if value, ok := labels[svcPortLabel]; ok {
+		svcPortInt, err := strconv.Atoi(value)
+		if err != nil {
+			log.Errorf("Error converting tag value for %s to integer: %s",
+				svcPortLabel,
+				err.Error(),
+			)
+		} else {
+			port.ServicePort = int64(svcPortInt)
+		}
+	}
+
+	svc.Ports = []service.Port{port}
+
+	return svc, labels
+}
+
+// Nomad allocation IDs are UUIDs, so we hash them down, with the service
+// name, to the same short hex format as Docker IDs. They must be stable
+// across polls.
+func nomadServiceID(allocID string, name string) string {
+	sum := sha1.Sum([]byte(allocID + "/" + name))
+	return hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,173 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/mockhttp"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	nomadAllocations = `[
+		{"ID": "alloc-1", "NodeName": "shakespeare", "ClientStatus": "running", "ModifyIndex": 10},
+		{"ID": "alloc-2", "NodeName": "shakespeare", "ClientStatus": "pending", "ModifyIndex": 10},
+		{"ID": "alloc-3", "NodeName": "shakespeare", "ClientStatus": "running", "ModifyIndex": 10,
+		 "DeploymentStatus": {"Healthy": false}},
+		{"ID": "alloc-4", "NodeName": "marlowe", "ClientStatus": "running", "ModifyIndex": 10}
+	]`
+	nomadAllocation = `{
+		"ID": "alloc-1", "JobID": "web", "TaskGroup": "web", "CreateTime": 1500000000000000000, "ModifyIndex": 10,
+		"AllocatedResources": {"Shared": {"Networks": [{
+			"IP": "10.0.0.1",
+			"ReservedPorts": [{"Label": "admin", "Value": 9000}],
+			"DynamicPorts": [{"Label": "http", "Value": 23456, "To": 8080}]
+		}]}},
+		"Job": {"TaskGroups": [
+			{"Name": "other", "Services": [{"Name": "other", "PortLabel": "http"}]},
+			{"Name": "web",
+			 "Services": [{"Name": "web", "PortLabel": "http",
+				"Tags": ["ServicePort_8080=10100", "HealthCheck=HttpGet", "HealthCheckArgs=http://:8080/", "HealthCheckInterval=10s", "Metadata_canary=true"]}],
+			 "Tasks": [{"Services": [{"Name": "web-admin", "PortLabel": "admin", "Tags": ["ProxyMode=tcp"]},
+				{"Name": "web-hidden", "PortLabel": "admin", "Tags": ["SidecarDiscover=false"]}]}]}
+		]}
+	}`
+)
+
+func Test_NomadDiscovery(t *testing.T) {
+	Convey("Working with Nomad allocations", t, func() {
+		expectations := []mockhttp.HttpExpectation{
+			{Expect: "/v1/allocations", Send: nomadAllocations, Content: "application/json"},
+			{Expect: "/v1/allocation/alloc-1", Send: nomadAllocation, Content: "application/json"},
+		}
+
+		disco := NewNomadDiscovery("http://nomad.example.com:4646/")
+		disco.Hostname = hostname
+		disco.Client = mockhttp.ClientWithExpectations(expectations)
+
+		Convey("New() configures the URL without a trailing slash", func() {
+			So(disco.NomadURL, ShouldEqual, "http://nomad.example.com:4646")
+		})
+
+		Convey("getServices() finds the services in healthy allocations on this node", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(len(services), ShouldEqual, 2)
+			So(services[0].Name, ShouldEqual, "web")
+			So(services[0].Hostname, ShouldEqual, hostname)
+			So(services[0].Created.Unix(), ShouldEqual, 1500000000)
+			So(services[0].Ports[0].Port, ShouldEqual, 23456)
+			So(services[0].Ports[0].Name, ShouldEqual, "http")
+			So(services[0].Ports[0].ServicePort, ShouldEqual, 10100)
+			So(services[0].ProxyMode, ShouldEqual, "http")
+
+			So(services[1].Name, ShouldEqual, "web-admin")
+			So(services[1].Ports[0].Port, ShouldEqual, 9000)
+			So(services[1].ProxyMode, ShouldEqual, "tcp")
+		})
+
+		Convey("getServices() keeps IDs stable across polls", func() {
+			disco.getServices()
+			first := disco.Services()
+			disco.getServices()
+			second := disco.Services()
+
+			So(len(first[0].ID), ShouldEqual, 12)
+			So(first[0].ID, ShouldEqual, second[0].ID)
+			So(first[0].ID, ShouldNotEqual, first[1].ID)
+		})
+
+		Convey("getServices() doesn't refetch allocations that haven't changed", func() {
+			disco.getServices()
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/v1/allocations", Send: nomadAllocations, Content: "application/json"},
+				{Expect: "/v1/allocation/alloc-1", Err: errors.New("Oh no!")},
+			})
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 2)
+		})
+
+		Convey("getServices() leaves the services alone on errors", func() {
+			disco.getServices()
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/v1/allocations", Err: errors.New("Oh no!")},
+			})
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 2)
+		})
+
+		Convey("getServices() drops allocations that stop running", func() {
+			disco.getServices()
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/v1/allocations", Send: "[]", Content: "application/json"},
+			})
+			disco.getServices()
+
+			So(len(disco.Services()), ShouldEqual, 0)
+		})
+
+		Convey("HealthCheck() uses the service tags", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			check, args := disco.HealthCheck(&services[0])
+			So(check, ShouldEqual, "HttpGet")
+			So(args, ShouldEqual, "http://:8080/")
+		})
+
+		Convey("CheckConfig() uses the service tags", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(disco.CheckConfig(&services[0]).Interval, ShouldEqual, 10*time.Second)
+		})
+
+		Convey("getServices() picks up metadata tags", func() {
+			disco.getServices()
+			services := disco.Services()
+
+			So(services[0].Metadata["canary"], ShouldEqual, "true")
+		})
+
+		Convey("Validate() checks that we can list allocations", func() {
+			So(disco.Validate(), ShouldBeNil)
+
+			disco.Client = mockhttp.ClientWithExpectations([]mockhttp.HttpExpectation{
+				{Expect: "/v1/allocations", Err: errors.New("Oh no!")},
+			})
+			So(disco.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Run() polls the allocations", func() {
+			looper := director.NewFreeLooper(director.ONCE, make(chan error))
+			disco.Run(looper)
+			looper.Wait()
+
+			So(len(disco.Services()), ShouldEqual, 2)
+		})
+	})
+
+	Convey("Deciding whether an allocation is healthy", t, func() {
+		healthy, unhealthy := true, false
+		stub := NomadAllocationStub{ClientStatus: "running"}
+
+		So(stub.isHealthy(), ShouldBeTrue)
+
+		stub.DeploymentStatus = &struct{ Healthy *bool }{}
+		So(stub.isHealthy(), ShouldBeTrue)
+
+		stub.DeploymentStatus.Healthy = &unhealthy
+		So(stub.isHealthy(), ShouldBeFalse)
+
+		stub.DeploymentStatus.Healthy = &healthy
+		So(stub.isHealthy(), ShouldBeTrue)
+
+		stub.ClientStatus = "complete"
+		So(stub.isHealthy(), ShouldBeFalse)
+	})
+}
@@ -1,14 +1,24 @@
 package discovery
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
+	"github.com/fsnotify/fsnotify"
 	"github.com/relistan/go-director"
 
 	"github.com/newrelic/sidecar/service"
@@ -21,27 +31,53 @@ type Target struct {
 
 type StaticDiscovery struct {
 	Targets    []*Target
-	ConfigFile string
+	ConfigFile []string // Files or globs, merged in this order
 	Hostname   string
+	files      map[string]*configFile // What we last parsed from each file
+	sync.RWMutex
+}
+
+// The contents of one config file when we last parsed it, and its Targets
+type configFile struct {
+	data    []byte
+	targets []*Target
 }
 
 type StaticCheck struct {
-	Type string
-	Args string
+	Type               string
+	Args               string
+	Interval           string
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	ExpectedStatus     string
+	ExpectedBody       string
+	Timeout            string
+	Host               string
+	Path               string
+	Headers            map[string]string
+	Scheme             string
+	TLSSkipVerify      bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	Port               string
 }
 
-func NewStaticDiscovery(filename string) *StaticDiscovery {
+func NewStaticDiscovery(filenames ...string) *StaticDiscovery {
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Errorf("Error getting hostname! %s", err.Error())
 	}
 	return &StaticDiscovery{
-		ConfigFile: filename,
+		ConfigFile: filenames,
 		Hostname:   hostname,
 	}
 }
 
 func (d *StaticDiscovery) HealthCheck(svc *service.Service) (string, string) {
+	d.RLock()
+	defer d.RUnlock()
+
 	for _, target := range d.Targets {
 		if svc.ID == target.Service.ID {
 			return target.Check.Type, target.Check.Args
@@ -50,9 +86,40 @@ func (d *StaticDiscovery) HealthCheck(svc *service.Service) (string, string) {
 	return "", ""
 }
 
+func (d *StaticDiscovery) CheckConfig(svc *service.Service) CheckConfig {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, target := range d.Targets {
+		if svc.ID == target.Service.ID {
+			return CheckConfig{
+				Interval:           parseCheckDuration(target.Check.Interval),
+				HealthyThreshold:   target.Check.HealthyThreshold,
+				UnhealthyThreshold: target.Check.UnhealthyThreshold,
+				ExpectedStatus:     target.Check.ExpectedStatus,
+				ExpectedBody:       target.Check.ExpectedBody,
+				Timeout:            parseCheckDuration(target.Check.Timeout),
+				Host:               target.Check.Host,
+				Path:               target.Check.Path,
+				Headers:            target.Check.Headers,
+				Scheme:             target.Check.Scheme,
+				TLSSkipVerify:      target.Check.TLSSkipVerify,
+				CAFile:             target.Check.CAFile,
+				CertFile:           target.Check.CertFile,
+				KeyFile:            target.Check.KeyFile,
+				Port:               target.Check.Port,
+			}
+		}
+	}
+	return CheckConfig{}
+}
+
 // Returns the list of services derived from the targets that were parsed
 // out of the config file.
 func (d *StaticDiscovery) Services() []service.Service {
+	d.Lock()
+	defer d.Unlock()
+
 	var services []service.Service
 	for _, target := range d.Targets {
 		target.Service.Updated = time.Now().UTC()
@@ -61,15 +128,254 @@ func (d *StaticDiscovery) Services() []service.Service {
 	return services
 }
 
-// Causes the configuration to be parsed and loaded. There is no background
-// processing needed on an ongoing basis.
+// Causes the configuration to be parsed and loaded. The files are then
+// watched for changes so that we pick them up right away. We also check
+// them on each run of the looper in case we missed a change event, for
+// example when an editor replaces a file by renaming over it. The
+// watcher is stopped when the looper exits.
 func (d *StaticDiscovery) Run(looper director.Looper) {
-	var err error
+	d.Reload()
+
+	// We watch the directories rather than the files so that we still see
+	// changes after a file has been replaced, or a new one matches a glob.
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		dirs := make(map[string]bool)
+		for _, pattern := range d.ConfigFile {
+			dir := filepath.Dir(pattern)
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+
+			err = watcher.Add(dir)
+			if err != nil {
+				watcher.Close()
+				break
+			}
+		}
+	}
 
-	d.Targets, err = d.ParseConfig(d.ConfigFile)
 	if err != nil {
-		log.Errorf("StaticDiscovery cannot parse: %s", err.Error())
+		log.Warnf("StaticDiscovery can't watch '%s', relying on polling: %s",
+			strings.Join(d.ConfigFile, ", "), err.Error())
+		watcher = nil
+	} else {
+		go d.watch(watcher)
+	}
+
+	go func() {
+		looper.Loop(func() error {
+			d.Reload()
+			return nil
+		})
+
+		if watcher != nil {
+			watcher.Close()
+		}
+	}()
+}
+
+// Reload the config whenever the watcher sees one of our files change.
+// Removals matter too, since a file that's gone from a glob takes its
+// services with it. Returns when the watcher is closed.
+func (d *StaticDiscovery) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if d.isConfigFile(event.Name) {
+				d.Reload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warnf("StaticDiscovery watcher error on '%s': %s",
+				strings.Join(d.ConfigFile, ", "), err.Error())
+		}
+	}
+}
+
+// Does this filename match one of our files or globs?
+func (d *StaticDiscovery) isConfigFile(filename string) bool {
+	for _, pattern := range d.ConfigFile {
+		matched, _ := filepath.Match(filepath.Clean(pattern), filepath.Clean(filename))
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// The files to load, in order, with the globs expanded. A plain filename
+// is kept even if it doesn't exist, so that we warn about it.
+func (d *StaticDiscovery) configFiles() []string {
+	var files []string
+	seen := make(map[string]bool)
+
+	for _, pattern := range d.ConfigFile {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Warnf("StaticDiscovery ignoring bad pattern '%s': %s", pattern, err.Error())
+			continue
+		}
+
+		if len(matches) == 0 && !strings.ContainsAny(pattern, `*?[\`) {
+			matches = []string{pattern}
+		}
+
+		for _, filename := range matches {
+			if !seen[filename] {
+				seen[filename] = true
+				files = append(files, filename)
+			}
+		}
+	}
+
+	return files
+}
+
+// Validate checks that there's at least one config file, and that they
+// all parse
+func (d *StaticDiscovery) Validate() error {
+	files := d.configFiles()
+	if len(files) == 0 {
+		return fmt.Errorf("No config files match '%s'", strings.Join(d.ConfigFile, ", "))
+	}
+
+	for _, filename := range files {
+		_, err := d.ParseConfig(filename)
+		if err != nil {
+			return fmt.Errorf("Bad config file '%s': %s", filename, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Reload the config files that have changed since we last parsed them, and
+// merge the Targets from all of them. If a file can't be read or parsed, we
+// keep the last good Targets from that file. Targets which are unchanged
+// keep their IDs so they aren't tombstoned.
+func (d *StaticDiscovery) Reload() {
+	files := d.configFiles()
+
+	data := make([][]byte, len(files))
+	for i, filename := range files {
+		var err error
+		data[i], err = ioutil.ReadFile(filename)
+		if err != nil {
+			log.Warnf("StaticDiscovery cannot read '%s', keeping last good config: %s",
+				filename, err.Error())
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	changed := false
+	loaded := make(map[string]*configFile, len(files))
+
+	for i, filename := range files {
+		last := d.files[filename]
+		if data[i] == nil || (last != nil && bytes.Equal(data[i], last.data)) {
+			if last != nil {
+				loaded[filename] = last
+			}
+			continue
+		}
+
+		targets, err := d.parseTargets(data[i])
+		if err != nil {
+			log.Warnf("StaticDiscovery cannot parse '%s', keeping last good config: %s",
+				filename, err.Error())
+			if last != nil {
+				loaded[filename] = last
+			}
+			continue
+		}
+
+		loaded[filename] = &configFile{data: data[i], targets: targets}
+		changed = true
+	}
+
+	// A file that went away takes its Targets with it
+	if len(loaded) != len(d.files) {
+		changed = true
+	}
+
+	if !changed && d.files != nil {
+		return
+	}
+
+	d.Targets = d.mergeTargets(files, loaded)
+	d.files = loaded
+
+	metrics.IncrCounter([]string{"static_discovery", "reloads"}, 1)
+}
+
+// Merge the Targets from each file in order. The same service defined in
+// more than one file is only announced once, from the first file.
+func (d *StaticDiscovery) mergeTargets(files []string, loaded map[string]*configFile) []*Target {
+	var targets []*Target
+	var sources []string // The file each of the targets came from
+
+	for _, filename := range files {
+		file, ok := loaded[filename]
+		if !ok {
+			continue
+		}
+
+		for _, target := range file.targets {
+			if i := duplicateOf(target, targets); i >= 0 {
+				log.Warnf("StaticDiscovery: service '%s' in '%s' duplicates one in '%s', skipping it",
+					target.Service.Name, filename, sources[i])
+				continue
+			}
+
+			for _, oldTarget := range d.Targets {
+				if target.sameAs(oldTarget) {
+					target.Service.ID = oldTarget.Service.ID
+					target.Service.Created = oldTarget.Service.Created
+					break
+				}
+			}
+
+			targets = append(targets, target)
+			sources = append(sources, filename)
+		}
 	}
+
+	return targets
+}
+
+// Returns the index of the Target with the same service name and ports, or
+// -1 if there isn't one
+func duplicateOf(target *Target, targets []*Target) int {
+	for i, existing := range targets {
+		if target.Service.Name == existing.Service.Name &&
+			reflect.DeepEqual(target.Service.Ports, existing.Service.Ports) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Is this the same Target, ignoring the fields that we stamp at parse time?
+func (t *Target) sameAs(other *Target) bool {
+	return t.Service.Name == other.Service.Name &&
+		t.Service.Image == other.Service.Image &&
+		t.Service.ProxyMode == other.Service.ProxyMode &&
+		t.Service.Weight == other.Service.Weight &&
+		t.Service.Sticky == other.Service.Sticky &&
+		t.Service.StickyCookie == other.Service.StickyCookie &&
+		reflect.DeepEqual(t.Service.Ports, other.Service.Ports) &&
+		reflect.DeepEqual(t.Service.Metadata, other.Service.Metadata) &&
+		reflect.DeepEqual(t.Service.Tags, other.Service.Tags) &&
+		reflect.DeepEqual(t.Check, other.Check)
 }
 
 // Parses a JSON config file containing an array of Targets. These are
@@ -84,8 +390,16 @@ func (d *StaticDiscovery) ParseConfig(filename string) ([]*Target, error) {
 		return nil, err
 	}
 
-	var targets []*Target
-	json.Unmarshal(file, &targets)
+	return d.parseTargets(file)
+}
+
+// Parses the contents of a config file. See ParseConfig().
+func (d *StaticDiscovery) parseTargets(data []byte) ([]*Target, error) {
+	targets, err := decodeTargets(data)
+	if err != nil {
+		log.Errorf("Unable to parse announcements file: '%s!'", err.Error())
+		return nil, err
+	}
 
 	// Have to loop with traditional 'for' loop so we can modify entries
 	for _, target := range targets {
@@ -98,14 +412,121 @@ func (d *StaticDiscovery) ParseConfig(filename string) ([]*Target, error) {
 		target.Service.ID = string(idBytes)
 		target.Service.Created = time.Now().UTC()
 		target.Service.Hostname = d.Hostname
-		log.Printf("Discovered service: %s, ID: %s",
-			target.Service.Name,
-			target.Service.ID,
-		)
+		log.WithFields(log.Fields{
+			"service": target.Service.Name,
+			"node":    target.Service.Hostname,
+			"event":   "discovered",
+		}).Printf("Discovered service: %s, ID: %s", target.Service.Name, target.Service.ID)
+	}
+	return targets, nil
+}
+
+// Strictly decodes a list of Targets, so that a typo is an error rather than
+// a service that quietly goes missing. Errors say which target, and the line
+// the problem is on.
+func decodeTargets(data []byte) ([]*Target, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	token, err := dec.Token()
+	if err != nil {
+		return nil, jsonError(data, 0, err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("line %d: expected a list of targets", lineAt(data, 0))
+	}
+
+	var targets []*Target
+	for i := 1; dec.More(); i++ {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err != nil {
+			return nil, jsonError(data, 0, err)
+		}
+
+		// Where this target starts, for the line numbers
+		start := int(dec.InputOffset()) - len(raw)
+
+		target := &Target{}
+		targetDec := json.NewDecoder(bytes.NewReader(raw))
+		targetDec.DisallowUnknownFields()
+		err = targetDec.Decode(target)
+		if err != nil {
+			return nil, fmt.Errorf("target %d, %s", i, jsonError(data, start, err))
+		}
+
+		err = target.validate()
+		if err != nil {
+			return nil, fmt.Errorf("target %d, line %d: %s", i, lineAt(data, start), err)
+		}
+
+		targets = append(targets, target)
 	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return nil, jsonError(data, 0, err)
+	}
+
 	return targets, nil
 }
 
+// Adds the line to a JSON error. Offsets in the error are from start.
+func jsonError(data []byte, start int, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("line %d: %s", lineAt(data, start+int(e.Offset)), e.Error())
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("line %d: %s should be a %s, not a %s", lineAt(data, start+int(e.Offset)), e.Field, e.Type, e.Value)
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("line %d: unexpected end of file", lineAt(data, len(data)))
+	}
+
+	// Unknown fields don't come with an offset, so we look for the name
+	msg := strings.TrimPrefix(err.Error(), "json: ")
+	if strings.HasPrefix(msg, "unknown field ") {
+		field := strings.TrimPrefix(msg, "unknown field ")
+		if i := bytes.Index(data[start:], []byte(field)); i >= 0 {
+			start += i
+		}
+	}
+
+	return fmt.Errorf("line %d: %s", lineAt(data, start), msg)
+}
+
+// The line number of an offset in the data, counting from 1
+func lineAt(data []byte, offset int) int {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Catch the things that would otherwise give us a service we can't proxy
+func (t *Target) validate() error {
+	if t.Service.Name == "" {
+		return errors.New("Service has no Name")
+	}
+
+	if len(t.Service.Ports) == 0 {
+		return fmt.Errorf("Service '%s' has no Ports", t.Service.Name)
+	}
+
+	for i, port := range t.Service.Ports {
+		if port.Port <= 0 || port.Port > 65535 {
+			return fmt.Errorf("Service '%s' port %d has no valid Port", t.Service.Name, i+1)
+		}
+
+		if port.Type != "tcp" && port.Type != "udp" {
+			return fmt.Errorf("Service '%s' port %d has Type '%s', should be 'tcp' or 'udp'",
+				t.Service.Name, i+1, port.Type)
+		}
+	}
+
+	return nil
+}
+
 // Return a defined number of random bytes as a slice
 func RandomHex(count int) ([]byte, error) {
 	raw := make([]byte, count)
@@ -1,7 +1,12 @@
 package discovery
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
@@ -36,6 +41,125 @@ func Test_ParseConfig(t *testing.T) {
 	})
 }
 
+func Test_decodeTargets(t *testing.T) {
+	Convey("decodeTargets()", t, func() {
+		decodeError := func(data string) string {
+			targets, err := decodeTargets([]byte(data))
+			So(targets, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			return err.Error()
+		}
+
+		Convey("Decodes a valid file", func() {
+			targets, err := decodeTargets([]byte(`[
+				{"Service": {"Name": "web", "Ports": [{"Type": "tcp", "Port": 8080}]},
+				 "Check": {"Type": "HttpGet", "Args": "http://:8080/"}}
+			]`))
+
+			So(err, ShouldBeNil)
+			So(len(targets), ShouldEqual, 1)
+			So(targets[0].Service.Name, ShouldEqual, "web")
+			So(targets[0].Check.Type, ShouldEqual, "HttpGet")
+		})
+
+		Convey("Accepts an empty list", func() {
+			targets, err := decodeTargets([]byte(`[]`))
+			So(err, ShouldBeNil)
+			So(targets, ShouldBeEmpty)
+		})
+
+		Convey("Rejects an empty file", func() {
+			So(decodeError(``), ShouldEqual, "line 1: unexpected end of file")
+		})
+
+		Convey("Rejects a file that isn't a list", func() {
+			So(decodeError(`{"Service": {}}`), ShouldEqual, "line 1: expected a list of targets")
+		})
+
+		Convey("Rejects bad JSON with the line", func() {
+			So(decodeError("[\n  {\"Service\": \n  { junk"), ShouldStartWith, "line 3: invalid character 'j'")
+		})
+
+		Convey("Rejects a file that's cut off", func() {
+			msg := decodeError(`[
+				{"Service": {"Name": "web", "Ports": [{"Type": "tcp", "Port": 8080}]}}`)
+			So(msg, ShouldEqual, "line 2: unexpected end of JSON input")
+		})
+
+		Convey("Rejects unknown fields with the target and line", func() {
+			msg := decodeError(`[
+				{"Service": {"Name": "web", "Ports": [{"Type": "tcp", "Port": 8080}]}},
+				{"Service": {"Name": "api", "Ports": [{"Type": "tcp", "Port": 8081}]},
+				 "Chekc": {"Type": "HttpGet"}}
+			]`)
+			So(msg, ShouldEqual, `target 2, line 4: unknown field "Chekc"`)
+		})
+
+		Convey("Rejects unknown fields in a service", func() {
+			msg := decodeError(`[{"Service": {"Nmae": "web", "Ports": [{"Type": "tcp", "Port": 8080}]}}]`)
+			So(msg, ShouldEqual, `target 1, line 1: unknown field "Nmae"`)
+		})
+
+		Convey("Rejects fields of the wrong type", func() {
+			msg := decodeError(`[
+				{"Service": {"Name": "web",
+				 "Ports": [{"Type": "tcp", "Port": "8080"}]}}
+			]`)
+			So(msg, ShouldStartWith, "target 1, line 3: Service.Ports.0.Port should be a int64, not a string")
+		})
+
+		Convey("Rejects a service without a name", func() {
+			msg := decodeError(`[{"Service": {"Ports": [{"Type": "tcp", "Port": 8080}]}}]`)
+			So(msg, ShouldEqual, "target 1, line 1: Service has no Name")
+		})
+
+		Convey("Rejects a service without ports", func() {
+			msg := decodeError(`[{"Service": {"Name": "web"}}]`)
+			So(msg, ShouldEqual, "target 1, line 1: Service 'web' has no Ports")
+		})
+
+		Convey("Rejects a port without a number", func() {
+			msg := decodeError(`[{"Service": {"Name": "web", "Ports": [{"Type": "tcp"}]}}]`)
+			So(msg, ShouldEqual, "target 1, line 1: Service 'web' port 1 has no valid Port")
+		})
+
+		Convey("Rejects a port without a valid type", func() {
+			msg := decodeError(`[{"Service": {"Name": "web", "Ports": [{"Port": 8080}]}}]`)
+			So(msg, ShouldEqual, "target 1, line 1: Service 'web' port 1 has Type '', should be 'tcp' or 'udp'")
+		})
+	})
+}
+
+func Test_StaticCheckConfig(t *testing.T) {
+	Convey("CheckConfig()", t, func() {
+		disco := NewStaticDiscovery(STATIC_JSON)
+		target := &Target{
+			Service: service.Service{ID: "asdf"},
+			Check: StaticCheck{
+				Interval:         "30s",
+				HealthyThreshold: 2,
+				ExpectedStatus:   "204",
+				Host:             "web.example.com",
+				Headers:          map[string]string{"X-Token": "abc"},
+			},
+		}
+		disco.Targets = []*Target{target}
+
+		Convey("Returns the settings from the target's check", func() {
+			config := disco.CheckConfig(&target.Service)
+			So(config.Interval, ShouldEqual, 30*time.Second)
+			So(config.HealthyThreshold, ShouldEqual, 2)
+			So(config.ExpectedStatus, ShouldEqual, "204")
+			So(config.Host, ShouldEqual, "web.example.com")
+			So(config.Headers, ShouldResemble, map[string]string{"X-Token": "abc"})
+		})
+
+		Convey("Returns nothing for services it doesn't know", func() {
+			So(disco.CheckConfig(&service.Service{ID: "foofoo"}), ShouldResemble, CheckConfig{})
+		})
+	})
+}
+
 func Test_Services(t *testing.T) {
 	Convey("Services()", t, func() {
 		disco := NewStaticDiscovery(STATIC_JSON)
@@ -76,3 +200,168 @@ func Test_Run(t *testing.T) {
 		})
 	})
 }
+
+func Test_Reload(t *testing.T) {
+	Convey("Reload()", t, func() {
+		data, _ := ioutil.ReadFile(STATIC_JSON)
+		tmpFile, _ := ioutil.TempFile("", "static-discovery")
+		tmpFile.Write(data)
+		tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+
+		disco := NewStaticDiscovery(tmpFile.Name())
+		disco.Reload()
+
+		So(len(disco.Targets), ShouldEqual, 1)
+		firstID := disco.Targets[0].Service.ID
+
+		Convey("Keeps the IDs of unchanged targets", func() {
+			ioutil.WriteFile(tmpFile.Name(), append(data, '\n'), 0644)
+			disco.Reload()
+
+			So(len(disco.Targets), ShouldEqual, 1)
+			So(disco.Targets[0].Service.ID, ShouldEqual, firstID)
+		})
+
+		Convey("Keeps the last good config when the file is invalid", func() {
+			ioutil.WriteFile(tmpFile.Name(), []byte("[{ junk"), 0644)
+			disco.Reload()
+
+			So(len(disco.Targets), ShouldEqual, 1)
+			So(disco.Targets[0].Service.ID, ShouldEqual, firstID)
+		})
+
+		Convey("Keeps the last good config when the file doesn't validate", func() {
+			ioutil.WriteFile(tmpFile.Name(), []byte(`[{"Service": {"Name": "web"}}]`), 0644)
+			disco.Reload()
+
+			So(len(disco.Targets), ShouldEqual, 1)
+			So(disco.Targets[0].Service.ID, ShouldEqual, firstID)
+		})
+
+		Convey("Picks up changes to the file", func() {
+			ioutil.WriteFile(tmpFile.Name(), []byte("[]"), 0644)
+			disco.Reload()
+
+			So(len(disco.Targets), ShouldEqual, 0)
+		})
+
+		Convey("Picks up changes right away when running", func() {
+			looper := director.NewTimedLooper(director.FOREVER, time.Hour, make(chan error))
+			disco.Run(looper)
+			defer looper.Quit()
+
+			ioutil.WriteFile(tmpFile.Name(), []byte("[]"), 0644)
+
+			So(func() bool {
+				for i := 0; i < 100; i++ {
+					disco.RLock()
+					count := len(disco.Targets)
+					disco.RUnlock()
+					if count == 0 {
+						return true
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return false
+			}(), ShouldBeTrue)
+		})
+	})
+}
+
+func Test_ReloadMultipleFiles(t *testing.T) {
+	Convey("Reload() with more than one file", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "static-discovery")
+		defer os.RemoveAll(tmpDir)
+
+		writeTargets := func(filename, name string, port int) string {
+			path := filepath.Join(tmpDir, filename)
+			data := fmt.Sprintf(`[{"Service": {"Name": "%s", "Ports": [{"Type": "tcp", "Port": %d}]}}]`, name, port)
+			ioutil.WriteFile(path, []byte(data), 0644)
+			return path
+		}
+
+		names := func(disco *StaticDiscovery) []string {
+			var result []string
+			for _, target := range disco.Targets {
+				result = append(result, target.Service.Name)
+			}
+			return result
+		}
+
+		fileA := writeTargets("a.json", "svc-a", 10000)
+		fileB := writeTargets("b.json", "svc-b", 10001)
+		glob := filepath.Join(tmpDir, "*.json")
+
+		Convey("Merges a list of files in order", func() {
+			disco := NewStaticDiscovery(fileB, fileA)
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-b", "svc-a"})
+		})
+
+		Convey("Merges the files matching a glob", func() {
+			disco := NewStaticDiscovery(glob)
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-a", "svc-b"})
+		})
+
+		Convey("Only loads a file once when patterns overlap", func() {
+			disco := NewStaticDiscovery(fileA, glob)
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-a", "svc-b"})
+		})
+
+		Convey("Skips a file that doesn't parse", func() {
+			ioutil.WriteFile(filepath.Join(tmpDir, "c.json"), []byte("[{ junk"), 0644)
+
+			disco := NewStaticDiscovery(glob)
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-a", "svc-b"})
+		})
+
+		Convey("Skips a file that doesn't exist", func() {
+			disco := NewStaticDiscovery(fileA, filepath.Join(tmpDir, "missing.json"))
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-a"})
+		})
+
+		Convey("Only announces a duplicated service once", func() {
+			writeTargets("c.json", "svc-a", 10000)
+
+			disco := NewStaticDiscovery(glob)
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-a", "svc-b"})
+		})
+
+		Convey("Keeps the last good targets from a file that goes bad", func() {
+			disco := NewStaticDiscovery(glob)
+			disco.Reload()
+			firstID := disco.Targets[1].Service.ID
+
+			ioutil.WriteFile(fileB, []byte("[{ junk"), 0644)
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-a", "svc-b"})
+			So(disco.Targets[1].Service.ID, ShouldEqual, firstID)
+		})
+
+		Convey("Picks up files added to and removed from a glob", func() {
+			disco := NewStaticDiscovery(glob)
+			disco.Reload()
+			firstID := disco.Targets[0].Service.ID
+
+			writeTargets("c.json", "svc-c", 10002)
+			os.Remove(fileB)
+			disco.Reload()
+
+			So(names(disco), ShouldResemble, []string{"svc-a", "svc-c"})
+			So(disco.Targets[0].Service.ID, ShouldEqual, firstID)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Characters that mean something in the DogStatsD protocol
+var dogstatsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_")
+
+// A go-metrics sink for DogStatsD, the Datadog agent's flavour of statsd.
+// The metrics are the same ones the statsd sink sends, but the node goes in
+// a tag rather than in the gauge names, along with the cluster, so they can
+// be queried on.
+type dogstatsdSink struct {
+	hostname string
+	tags     string // Ready to append, like "|#cluster:default,node:indomitable"
+	conn     net.Conn
+}
+
+func newDogstatsdSink(addr string, hostname string, tags map[string]string) (*dogstatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dogstatsdSink{hostname: hostname, tags: formatTags(tags), conn: conn}, nil
+}
+
+// Tags sorted by name, so they're always sent the same way
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	formatted := make([]string, 0, len(tags))
+	for name, value := range tags {
+		formatted = append(formatted, dogstatsdReplacer.Replace(name)+":"+dogstatsdReplacer.Replace(value))
+	}
+	sort.Strings(formatted)
+
+	return "|#" + strings.Join(formatted, ",")
+}
+
+// Join up a go-metrics key, leaving out the hostname that it puts in
+// gauge names, since that's in the tags
+func (d *dogstatsdSink) flattenKey(parts []string) string {
+	if len(parts) > 1 && parts[1] == d.hostname {
+		parts = append([]string{parts[0]}, parts[2:]...)
+	}
+
+	return dogstatsdReplacer.Replace(strings.Join(parts, "."))
+}
+
+func (d *dogstatsdSink) format(parts []string, val float32, kind string) string {
+	return fmt.Sprintf("%s:%f|%s%s", d.flattenKey(parts), val, kind, d.tags)
+}
+
+// Each metric is its own packet. Like statsd, it's best effort, so
+// errors are dropped.
+func (d *dogstatsdSink) send(metric string) {
+	d.conn.Write([]byte(metric))
+}
+
+func (d *dogstatsdSink) SetGauge(parts []string, val float32) {
+	d.send(d.format(parts, val, "g"))
+}
+
+// DogStatsD has no key/value type, so these are dropped
+func (d *dogstatsdSink) EmitKey(parts []string, val float32) {}
+
+func (d *dogstatsdSink) IncrCounter(parts []string, val float32) {
+	d.send(d.format(parts, val, "c"))
+}
+
+func (d *dogstatsdSink) AddSample(parts []string, val float32) {
+	d.send(d.format(parts, val, "ms"))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_dogstatsdSink(t *testing.T) {
+	Convey("dogstatsdSink", t, func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		sink, err := newDogstatsdSink(
+			listener.LocalAddr().String(), "indomitable",
+			map[string]string{"node": "indomitable", "cluster": "default"},
+		)
+		So(err, ShouldBeNil)
+
+		receive := func() string {
+			buf := make([]byte, 1024)
+			listener.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := listener.ReadFrom(buf)
+			So(err, ShouldBeNil)
+			return string(buf[:n])
+		}
+
+		Convey("Formats the tags sorted by name", func() {
+			So(sink.tags, ShouldEqual, "|#cluster:default,node:indomitable")
+			So(formatTags(nil), ShouldEqual, "")
+			So(formatTags(map[string]string{"service": "a:b c"}), ShouldEqual, "|#service:a_b_c")
+		})
+
+		Convey("Leaves the hostname out of the key", func() {
+			So(sink.flattenKey([]string{"sidecar", "indomitable", "services"}), ShouldEqual, "sidecar.services")
+			So(sink.flattenKey([]string{"sidecar", "haproxy", "reloads"}), ShouldEqual, "sidecar.haproxy.reloads")
+		})
+
+		Convey("Sends gauges", func() {
+			sink.SetGauge([]string{"sidecar", "indomitable", "delegate", "members"}, 3)
+			So(receive(), ShouldEqual, "sidecar.delegate.members:3.000000|g|#cluster:default,node:indomitable")
+		})
+
+		Convey("Sends counters", func() {
+			sink.IncrCounter([]string{"sidecar", "haproxy", "reloads"}, 1)
+			So(receive(), ShouldEqual, "sidecar.haproxy.reloads:1.000000|c|#cluster:default,node:indomitable")
+		})
+
+		Convey("Sends samples as timers", func() {
+			sink.AddSample([]string{"sidecar", "discovery", "run"}, 12.5)
+			So(receive(), ShouldEqual, "sidecar.discovery.run:12.500000|ms|#cluster:default,node:indomitable")
+		})
+	})
+}
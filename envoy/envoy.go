@@ -0,0 +1,311 @@
+// Manages an Envoy proxy in place of HAproxy. Envoy is started with
+// the bootstrap file we write, which points it at listener (LDS) and
+// cluster (CDS) files in the same directory. Envoy watches those files
+// itself, so "reloading" is just atomically replacing them.
+package envoy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+	"github.com/newrelic/sidecar/tracing"
+)
+
+const (
+	DEFAULT_CONFIG_DIR = "/etc/envoy/sidecar"
+	DEFAULT_ADMIN_PORT = 9901
+	CONNECT_TIMEOUT    = "1s"
+
+	DEFAULT_RELOAD_DEBOUNCE = 500 * time.Millisecond
+)
+
+// We build the Envoy config as plain JSON, which keeps us from needing
+// the whole of the Envoy API as a dependency.
+type object map[string]interface{}
+
+// Configuration for the Envoy management module
+type Envoy struct {
+	BindIP         string        // The address the listeners bind to
+	ConfigDir      string        // Where the bootstrap, LDS and CDS files are written
+	AdminPort      int           // The port for the Envoy admin interface
+	NodeID         string        // How this Envoy identifies itself, usually the hostname
+	ReloadDebounce time.Duration // How long to batch up changes before writing
+	Paused         func() bool   // Hold off writing while this returns true
+}
+
+// A service port that Envoy will listen on, and the instances behind it
+type cluster struct {
+	name      string
+	mode      string
+	port      int64
+	endpoints []object
+}
+
+// Constructs a properly configured Envoy and returns a pointer to it
+func New(configDir string, bindIP string) *Envoy {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Errorf("Error getting hostname! %s", err.Error())
+	}
+
+	return &Envoy{
+		BindIP:         bindIP,
+		ConfigDir:      configDir,
+		AdminPort:      DEFAULT_ADMIN_PORT,
+		NodeID:         hostname,
+		ReloadDebounce: DEFAULT_RELOAD_DEBOUNCE,
+	}
+}
+
+// Watch the state of a ServicesState struct and write out new listener
+// and cluster files when it changes. As with HAproxy, events are batched
+// up: the first change starts a ReloadDebounce timer and we write once
+// when it fires, with whatever the state is then. While Paused, we keep
+// re-arming the timer instead.
+func (e *Envoy) Watch(state *catalog.ServicesState) {
+	eventChannel := make(chan catalog.ChangeEvent, 2)
+	state.AddListener(eventChannel)
+
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-eventChannel:
+			if !ok {
+				return
+			}
+
+			log.WithFields(log.Fields{"node": event.Hostname, "event": "state_change"}).
+				Println("State change event from " + event.Hostname)
+
+			if timer != nil {
+				metrics.IncrCounter([]string{"envoy", "reloads", "coalesced"}, 1)
+				continue
+			}
+			timer = time.After(e.ReloadDebounce)
+
+		case <-timer:
+			if e.Paused != nil && e.Paused() {
+				timer = time.After(e.ReloadDebounce)
+				continue
+			}
+			timer = nil
+			metrics.IncrCounter([]string{"envoy", "reloads", "executed"}, 1)
+			e.writeResources(state)
+		}
+	}
+}
+
+// Write out the bootstrap and the Envoy config. After this, Envoy picks up
+// new listeners and clusters by itself and the bootstrap doesn't change.
+func (e *Envoy) WriteAndReload(state *catalog.ServicesState) {
+	err := e.writeFile("bootstrap.json", e.bootstrap())
+	if err != nil {
+		log.WithField("event", "reload_failed").
+			Errorf("Unable to write Envoy config bootstrap.json! (%s)", err.Error())
+		return
+	}
+
+	e.writeResources(state)
+}
+
+// Write the cluster and listener files. The clusters go first so that
+// new listeners never point at a cluster that doesn't exist yet.
+func (e *Envoy) writeResources(state *catalog.ServicesState) {
+	span := tracing.Start("envoy.write")
+	defer span.Finish()
+
+	clusters := e.clusters(state)
+	span.SetAttribute("clusters", len(clusters))
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"cds.json", e.clusterConfig(clusters)},
+		{"lds.json", e.listenerConfig(clusters)},
+	}
+
+	for _, file := range files {
+		err := e.writeFile(file.name, file.data)
+		if err != nil {
+			log.WithField("event", "reload_failed").
+				Errorf("Unable to write Envoy config %s! (%s)", file.name, err.Error())
+			span.SetError(err)
+			return
+		}
+	}
+
+	log.WithField("event", "reload").Debugf("Wrote Envoy config with %d clusters", len(clusters))
+}
+
+// Envoy only notices files that are moved into place, so we write to a
+// temp file and rename it.
+func (e *Envoy) writeFile(name string, data interface{}) error {
+	output, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := path.Join(e.ConfigDir, "."+name+".tmp")
+	err = ioutil.WriteFile(tmpFile, output, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, path.Join(e.ConfigDir, name))
+}
+
+func (e *Envoy) bootstrap() object {
+	pathSource := func(name string) object {
+		return object{
+			"path_config_source": object{"path": path.Join(e.ConfigDir, name)},
+		}
+	}
+
+	return object{
+		"node": object{"id": e.NodeID, "cluster": "sidecar"},
+		"admin": object{
+			"address": socketAddress("127.0.0.1", int64(e.AdminPort)),
+		},
+		"dynamic_resources": object{
+			"lds_config": pathSource("lds.json"),
+			"cds_config": pathSource("cds.json"),
+		},
+	}
+}
+
+func (e *Envoy) clusterConfig(clusters []*cluster) object {
+	resources := make([]object, 0, len(clusters))
+	for _, c := range clusters {
+		resources = append(resources, object{
+			"@type":           "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+			"name":            c.name,
+			"type":            "STRICT_DNS",
+			"connect_timeout": CONNECT_TIMEOUT,
+			"lb_policy":       "ROUND_ROBIN",
+			"load_assignment": object{
+				"cluster_name": c.name,
+				"endpoints":    []object{{"lb_endpoints": c.endpoints}},
+			},
+		})
+	}
+
+	return object{"resources": resources}
+}
+
+func (e *Envoy) listenerConfig(clusters []*cluster) object {
+	resources := make([]object, 0, len(clusters))
+	for _, c := range clusters {
+		resources = append(resources, object{
+			"@type":         "type.googleapis.com/envoy.config.listener.v3.Listener",
+			"name":          c.name,
+			"address":       socketAddress(e.BindIP, c.port),
+			"filter_chains": []object{{"filters": []object{networkFilter(c)}}},
+		})
+	}
+
+	return object{"resources": resources}
+}
+
+// HTTP services get an HTTP connection manager, everything else is
+// proxied as plain TCP.
+func networkFilter(c *cluster) object {
+	if c.mode == "tcp" {
+		return object{
+			"name": "envoy.filters.network.tcp_proxy",
+			"typed_config": object{
+				"@type":       "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy",
+				"stat_prefix": c.name,
+				"cluster":     c.name,
+			},
+		}
+	}
+
+	return object{
+		"name": "envoy.filters.network.http_connection_manager",
+		"typed_config": object{
+			"@type":       "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+			"stat_prefix": c.name,
+			"route_config": object{
+				"name": c.name,
+				"virtual_hosts": []object{{
+					"name":    c.name,
+					"domains": []string{"*"},
+					"routes": []object{{
+						"match": object{"prefix": "/"},
+						"route": object{"cluster": c.name},
+					}},
+				}},
+			},
+			"http_filters": []object{{
+				"name": "envoy.filters.http.router",
+				"typed_config": object{
+					"@type": "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router",
+				},
+			}},
+		},
+	}
+}
+
+func socketAddress(address string, port int64) object {
+	return object{
+		"socket_address": object{"address": address, "port_value": port},
+	}
+}
+
+// Group the healthy services by name and ServicePort, in the same way
+// that we build HAproxy frontends and backends.
+func (e *Envoy) clusters(state *catalog.ServicesState) []*cluster {
+	byName := make(map[string]*cluster)
+
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if !svc.IsAlive() {
+				return
+			}
+
+			svcName := service.SanitizeName(state.ServiceName(svc))
+
+			for _, port := range svc.Ports {
+				// Like HAproxy, only TCP ports with a ServicePort are proxied
+				if port.Type != "tcp" || port.ServicePort == 0 {
+					continue
+				}
+
+				name := svcName + "-" + strconv.FormatInt(port.ServicePort, 10)
+				c, ok := byName[name]
+				if !ok {
+					c = &cluster{name: name, mode: svc.ProxyMode, port: port.ServicePort}
+					byName[name] = c
+				}
+
+				c.endpoints = append(c.endpoints, object{
+					"endpoint": object{"address": socketAddress(svc.Address(), port.Port)},
+				})
+			}
+		},
+	)
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clusters := make([]*cluster, 0, len(names))
+	for _, name := range names {
+		clusters = append(clusters, byName[name])
+	}
+
+	return clusters
+}
@@ -0,0 +1,216 @@
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var hostname1 = "indomitable"
+var hostname2 = "indefatigable"
+
+func readConfig(dir string, name string) map[string]interface{} {
+	var result map[string]interface{}
+
+	data, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return nil
+	}
+	json.Unmarshal(data, &result)
+
+	return result
+}
+
+func resourceNamed(config map[string]interface{}, name string) map[string]interface{} {
+	for _, resource := range config["resources"].([]interface{}) {
+		res := resource.(map[string]interface{})
+		if res["name"] == name {
+			return res
+		}
+	}
+
+	return nil
+}
+
+func Test_Envoy(t *testing.T) {
+	Convey("Writing Envoy config", t, func() {
+		tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+		defer os.RemoveAll(tmpDir)
+
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-adfffed1233",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "web-1234fed1233",
+				Image:     "web",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10451, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef105",
+				Name:      "mysql-0123456789a",
+				Image:     "mysql",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Ports:     []service.Port{{Type: "tcp", Port: 13306, ServicePort: 3306}},
+			},
+			{
+				ID:       "deadbeef999",
+				Name:     "sick-0123456789a",
+				Image:    "sick",
+				Hostname: hostname2,
+				Updated:  baseTime,
+				Status:   service.UNHEALTHY,
+				Ports:    []service.Port{{Type: "tcp", Port: 10000, ServicePort: 9000}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New(tmpDir, "192.168.168.168")
+
+		Convey("New() returns a properly configured struct", func() {
+			So(proxy.ConfigDir, ShouldEqual, tmpDir)
+			So(proxy.AdminPort, ShouldEqual, DEFAULT_ADMIN_PORT)
+			So(proxy.NodeID, ShouldNotBeEmpty)
+			So(proxy.ReloadDebounce, ShouldEqual, DEFAULT_RELOAD_DEBOUNCE)
+		})
+
+		Convey("WriteAndReload() writes a bootstrap pointing at the LDS and CDS files", func() {
+			proxy.WriteAndReload(state)
+
+			bootstrap := readConfig(tmpDir, "bootstrap.json")
+			dynamic := bootstrap["dynamic_resources"].(map[string]interface{})
+			lds := dynamic["lds_config"].(map[string]interface{})
+			source := lds["path_config_source"].(map[string]interface{})
+			So(source["path"], ShouldEqual, path.Join(tmpDir, "lds.json"))
+		})
+
+		Convey("WriteAndReload() writes a cluster for each healthy service port", func() {
+			proxy.WriteAndReload(state)
+
+			clusters := readConfig(tmpDir, "cds.json")
+			So(len(clusters["resources"].([]interface{})), ShouldEqual, 2)
+
+			web := resourceNamed(clusters, "web-8080")
+			So(web, ShouldNotBeNil)
+
+			assignment := web["load_assignment"].(map[string]interface{})
+			endpoints := assignment["endpoints"].([]interface{})[0].(map[string]interface{})
+			So(len(endpoints["lb_endpoints"].([]interface{})), ShouldEqual, 2)
+
+			So(resourceNamed(clusters, "sick-9000"), ShouldBeNil)
+		})
+
+		Convey("WriteAndReload() writes tcp and http listeners", func() {
+			proxy.WriteAndReload(state)
+
+			listeners := readConfig(tmpDir, "lds.json")
+
+			filterName := func(listener map[string]interface{}) interface{} {
+				chain := listener["filter_chains"].([]interface{})[0].(map[string]interface{})
+				filter := chain["filters"].([]interface{})[0].(map[string]interface{})
+				return filter["name"]
+			}
+
+			web := resourceNamed(listeners, "web-8080")
+			So(filterName(web), ShouldEqual, "envoy.filters.network.http_connection_manager")
+
+			mysql := resourceNamed(listeners, "mysql-3306")
+			So(filterName(mysql), ShouldEqual, "envoy.filters.network.tcp_proxy")
+
+			address := mysql["address"].(map[string]interface{})["socket_address"].(map[string]interface{})
+			So(address["address"], ShouldEqual, "192.168.168.168")
+			So(address["port_value"], ShouldEqual, 3306)
+		})
+
+		Convey("WriteAndReload() doesn't leave temp files behind", func() {
+			proxy.WriteAndReload(state)
+
+			files, _ := ioutil.ReadDir(tmpDir)
+			So(len(files), ShouldEqual, 3)
+		})
+
+		Convey("Watch() writes out the config when the state changes", func() {
+			proxy.ReloadDebounce = time.Millisecond
+			go proxy.Watch(state)
+			time.Sleep(5 * time.Millisecond)
+
+			svc := service.Service{
+				ID:       "abcdef123123",
+				Name:     "api-befede6789a",
+				Image:    "api",
+				Hostname: hostname2,
+				Updated:  time.Now().UTC(),
+				Ports:    []service.Port{{Type: "tcp", Port: 10020, ServicePort: 9001}},
+			}
+			state.AddServiceEntry(svc)
+			time.Sleep(5 * time.Millisecond)
+
+			clusters := readConfig(tmpDir, "cds.json")
+			So(clusters, ShouldNotBeNil)
+			So(resourceNamed(clusters, "api-9001"), ShouldNotBeNil)
+		})
+
+		Convey("Watch() batches up changes into one write", func() {
+			proxy.ReloadDebounce = 50 * time.Millisecond
+
+			go proxy.Watch(state)
+			time.Sleep(5 * time.Millisecond)
+
+			newTime := time.Now().UTC()
+			for i := 0; i < 5; i++ {
+				svc := service.Service{
+					ID:       fmt.Sprintf("abcdef12312%d", i),
+					Name:     "api-befede6789a",
+					Image:    "api",
+					Hostname: hostname2,
+					Updated:  newTime,
+					Ports:    []service.Port{{Type: "tcp", Port: 10020 + int64(i), ServicePort: 9001}},
+				}
+				state.AddServiceEntry(svc)
+			}
+
+			// Nothing happens until the window is over
+			_, err := os.Stat(path.Join(tmpDir, "cds.json"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			time.Sleep(100 * time.Millisecond)
+
+			clusters := readConfig(tmpDir, "cds.json")
+			api := resourceNamed(clusters, "api-9001")
+			assignment := api["load_assignment"].(map[string]interface{})
+			endpoints := assignment["endpoints"].([]interface{})[0].(map[string]interface{})
+			So(len(endpoints["lb_endpoints"].([]interface{})), ShouldEqual, 5)
+
+			// Watch() leaves the bootstrap alone
+			_, err = os.Stat(path.Join(tmpDir, "bootstrap.json"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/haproxy"
+)
+
+// Several HAproxies fed from the one Sidecar, e.g. one for internal and
+// one for external traffic. Each has its own config and services.
+type haproxies []*haproxy.HAproxy
+
+func (proxies haproxies) Watch(state *catalog.ServicesState) {
+	var wg sync.WaitGroup
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(proxy *haproxy.HAproxy) {
+			proxy.Watch(state)
+			wg.Done()
+		}(proxy)
+	}
+	wg.Wait()
+}
+
+func (proxies haproxies) WriteAndReload(state *catalog.ServicesState) {
+	for _, proxy := range proxies {
+		proxy.WriteAndReload(state)
+	}
+}
+
+// Have they all loaded their first config?
+func (proxies haproxies) Loaded() bool {
+	for _, proxy := range proxies {
+		if !proxy.Loaded() {
+			return false
+		}
+	}
+	return true
+}
+
+// Are any of them failing to reload?
+func (proxies haproxies) Failing() bool {
+	for _, proxy := range proxies {
+		if proxy.Failing() {
+			return true
+		}
+	}
+	return false
+}
+
+// Find one by name, or nil if there isn't one
+func (proxies haproxies) named(name string) *haproxy.HAproxy {
+	for _, proxy := range proxies {
+		if proxy.Name == name {
+			return proxy
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/haproxy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_haproxyInstances(t *testing.T) {
+	Convey("Configuring more than one HAproxy", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "sidecar-haproxies")
+		defer os.RemoveAll(tmpDir)
+
+		configFile := filepath.Join(tmpDir, "sidecar.toml")
+		load := func(config string) (Config, error) {
+			ioutil.WriteFile(configFile, []byte(config), 0644)
+			return loadConfig(configFile, false)
+		}
+
+		Convey("A single [haproxy] works like it always has", func() {
+			config, err := load(`
+[haproxy]
+config_file = "/etc/haproxy.cfg"
+pid_file    = "/var/run/haproxy.pid"
+`)
+			So(err, ShouldBeNil)
+			So(config.HAproxy.Instances, ShouldBeEmpty)
+
+			proxy, err := configureProxy(config)
+			So(err, ShouldBeNil)
+			So(proxy, ShouldHaveSameTypeAs, &haproxy.HAproxy{})
+		})
+
+		Convey("Each proxy starts from the [haproxy] settings", func() {
+			config, err := load(`
+[haproxy]
+user    = "haproxy"
+balance = "leastconn"
+
+[haproxy.tls_certs]
+443 = "/etc/ssl/shared.pem"
+
+[haproxy.global_settings]
+maxconn = "8192"
+
+[[haproxy.proxies]]
+name        = "internal"
+config_file = "/etc/haproxy/internal.cfg"
+pid_file    = "/var/run/haproxy-internal.pid"
+bind_ip     = "10.0.0.1"
+exclude     = ["admin-*"]
+
+[[haproxy.proxies]]
+name        = "external"
+config_file = "/etc/haproxy/external.cfg"
+pid_file    = "/var/run/haproxy-external.pid"
+bind_ip     = "192.0.2.1"
+balance     = "roundrobin"
+include     = ["web", "api"]
+
+[haproxy.proxies.tls_certs]
+8443 = "/etc/ssl/external.pem"
+
+[haproxy.proxies.global_settings]
+"ssl-default-bind-ciphers" = "ECDHE-RSA-AES128-GCM-SHA256"
+`)
+			So(err, ShouldBeNil)
+			So(len(config.HAproxy.Instances), ShouldEqual, 2)
+
+			internal := config.HAproxy.Instances[0]
+			So(internal.Name, ShouldEqual, "internal")
+			So(internal.BindIP, ShouldEqual, "10.0.0.1")
+			So(internal.User, ShouldEqual, "haproxy")
+			So(internal.Balance, ShouldEqual, "leastconn")
+			So(internal.Exclude, ShouldResemble, []string{"admin-*"})
+			So(internal.TLSCerts, ShouldResemble, map[string]string{"443": "/etc/ssl/shared.pem"})
+			So(internal.GlobalSettings, ShouldResemble, map[string]string{"maxconn": "8192"})
+
+			external := config.HAproxy.Instances[1]
+			So(external.Name, ShouldEqual, "external")
+			So(external.User, ShouldEqual, "haproxy")
+			So(external.Balance, ShouldEqual, "roundrobin")
+			So(external.Include, ShouldResemble, []string{"web", "api"})
+			So(external.TLSCerts, ShouldResemble, map[string]string{
+				"443": "/etc/ssl/shared.pem", "8443": "/etc/ssl/external.pem",
+			})
+			So(external.GlobalSettings, ShouldResemble, map[string]string{
+				"maxconn": "8192", "ssl-default-bind-ciphers": "ECDHE-RSA-AES128-GCM-SHA256",
+			})
+
+			Convey("And configureProxy() sets up one of each", func() {
+				proxy, err := configureProxy(config)
+				So(err, ShouldBeNil)
+
+				proxies, ok := proxy.(haproxies)
+				So(ok, ShouldBeTrue)
+				So(len(proxies), ShouldEqual, 2)
+				So(proxies.named("internal").ConfigFile, ShouldEqual, "/etc/haproxy/internal.cfg")
+				So(proxies.named("internal").Exclude, ShouldResemble, []string{"admin-*"})
+				So(proxies.named("external").PidFile, ShouldEqual, "/var/run/haproxy-external.pid")
+				So(proxies.named("external").Include, ShouldResemble, []string{"web", "api"})
+				So(proxies.named("external").GlobalSettings["maxconn"], ShouldEqual, "8192")
+				So(proxies.named("missing"), ShouldBeNil)
+			})
+		})
+
+		Convey("Each proxy needs a name", func() {
+			_, err := load(`
+[[haproxy.proxies]]
+config_file = "/etc/haproxy/internal.cfg"
+`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "needs a name")
+		})
+
+		Convey("Names can't be used twice", func() {
+			_, err := load(`
+[[haproxy.proxies]]
+name        = "internal"
+config_file = "/etc/haproxy/internal.cfg"
+pid_file    = "/var/run/haproxy-internal.pid"
+
+[[haproxy.proxies]]
+name        = "internal"
+config_file = "/etc/haproxy/external.cfg"
+pid_file    = "/var/run/haproxy-external.pid"
+`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "used more than once")
+		})
+
+		Convey("Each proxy needs its own files", func() {
+			_, err := load(`
+[haproxy]
+pid_file = "/var/run/haproxy.pid"
+
+[[haproxy.proxies]]
+name        = "internal"
+config_file = "/etc/haproxy/internal.cfg"
+
+[[haproxy.proxies]]
+name        = "external"
+config_file = "/etc/haproxy/external.cfg"
+`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "'external' needs its own config_file and pid_file")
+		})
+
+		Convey("Says which proxy has a bad setting", func() {
+			config, err := load(`
+[[haproxy.proxies]]
+name        = "external"
+config_file = "/etc/haproxy/external.cfg"
+pid_file    = "/var/run/haproxy-external.pid"
+balance     = "fastest"
+`)
+			So(err, ShouldBeNil)
+
+			_, err = configureProxy(config)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Invalid HAproxy balance 'fastest' (proxy 'external')")
+		})
+	})
+}
+
+func Test_haproxies(t *testing.T) {
+	Convey("haproxies", t, func() {
+		internal := haproxy.New("/tmp/internal.cfg", "/tmp/internal.pid")
+		internal.Name = "internal"
+		external := haproxy.New("/tmp/external.cfg", "/tmp/external.pid")
+		external.Name = "external"
+		proxies := haproxies{internal, external}
+
+		Convey("Aren't loaded until all of them are", func() {
+			So(proxies.Loaded(), ShouldBeFalse)
+
+			delegate := NewServicesDelegate(catalog.NewServicesState())
+			delegate.MergeRemoteState(catalog.NewServicesState().Encode(), true)
+			So(isReady(delegate, proxies), ShouldBeFalse)
+		})
+
+		Convey("Finds them by name", func() {
+			So(proxies.named("external"), ShouldEqual, external)
+			So(proxies.named("public"), ShouldBeNil)
+		})
+	})
+}
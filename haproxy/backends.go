@@ -0,0 +1,106 @@
+package haproxy
+
+import (
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+)
+
+// What HAproxy should be running for the current state, for people trying
+// to work out why a server is or isn't there. It's built with the same code
+// as the config, so the two can't disagree.
+type BackendsView struct {
+	Generation int // How many times we've reloaded HAproxy
+	Backends   []*BackendView
+	Excluded   []*ExcludedService
+}
+
+type BackendView struct {
+	Name        string
+	Service     string
+	ServicePort string
+	Mode        string
+	Cookie      string `json:",omitempty"`
+	Route       string `json:",omitempty"` // The RouteTag value, empty for the default
+	Servers     []*ServerView
+}
+
+type ServerView struct {
+	Name     string
+	Address  string
+	Weight   int  `json:",omitempty"`
+	Draining bool `json:",omitempty"` // Gone, but finishing its connections
+	Panic    bool `json:",omitempty"` // Unhealthy, but kept since nothing else is up
+}
+
+// A service that isn't in any backend, and why
+type ExcludedService struct {
+	ID       string
+	Hostname string
+	Service  string
+	Reason   string
+}
+
+// Backends returns the backends and servers HAproxy should have for this
+// state, and the services that were left out
+func (h *HAproxy) Backends(state *catalog.ServicesState) *BackendsView {
+	view := &BackendsView{
+		Backends: []*BackendView{},
+		Excluded: []*ExcludedService{},
+	}
+
+	exclude := func(svc *service.Service, reason string) {
+		view.Excluded = append(view.Excluded, &ExcludedService{
+			ID:       svc.ID,
+			Hostname: svc.Hostname,
+			Service:  state.ServiceName(svc),
+			Reason:   reason,
+		})
+	}
+
+	panicking := make(map[string]bool)
+	services := h.groupServices(state, exclude, func(svcName string) {
+		panicking[svcName] = true
+	})
+
+	// Services without a TCP ServicePort don't get a frontend at all
+	ports := h.makePortmap(services)
+	for svcName, svcList := range services {
+		if len(ports[svcName]) > 0 {
+			continue
+		}
+		for _, svc := range svcList {
+			exclude(svc, "no TCP ServicePort")
+		}
+	}
+
+	serverAddress := h.Resolvers.addressFunc()
+	for _, backend := range h.backends(state, services) {
+		backendView := &BackendView{
+			Name:        backend.name,
+			Service:     backend.svcName,
+			ServicePort: backend.svcPort,
+			Mode:        backend.config.mode,
+			Cookie:      backend.config.cookie,
+			Route:       backend.route.Value,
+			Servers:     make([]*ServerView, 0, len(backend.route.Services)),
+		}
+
+		for _, svc := range backend.route.Services {
+			backendView.Servers = append(backendView.Servers, &ServerView{
+				Name:     svc.Hostname + "-" + svc.ID,
+				Address:  serverAddress(svc) + ":" + backend.port,
+				Weight:   svc.Weight,
+				Draining: svc.IsTombstone(),
+				Panic:    panicking[backend.svcName] && svc.Status == service.UNHEALTHY,
+			})
+		}
+
+		view.Backends = append(view.Backends, backendView)
+	}
+
+	h.lock.Lock()
+	view.Generation = h.generation
+	h.lock.Unlock()
+
+	return view
+}
@@ -0,0 +1,183 @@
+package haproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Backends(t *testing.T) {
+	Convey("Backends()", t, func() {
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		ports := []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}}
+		add := func(id, hostname string, status int, ports []service.Port) service.Service {
+			svc := service.Service{
+				ID:       id,
+				Name:     "web-" + id,
+				Image:    "web",
+				Hostname: hostname,
+				Updated:  baseTime,
+				Status:   status,
+				Ports:    ports,
+			}
+			state.AddServiceEntry(svc)
+			return svc
+		}
+
+		add("deadbeef001", "host1", service.ALIVE, ports)
+		add("deadbeef002", "host2", service.ALIVE, ports)
+
+		proxy := New("/tmp/haproxy.cfg", "/tmp/haproxy.pid")
+
+		excluded := func(view *BackendsView) map[string]string {
+			reasons := make(map[string]string)
+			for _, svc := range view.Excluded {
+				reasons[svc.ID] = svc.Reason
+			}
+			return reasons
+		}
+
+		Convey("Returns the backends and servers from the config", func() {
+			view := proxy.Backends(state)
+
+			So(len(view.Backends), ShouldEqual, 1)
+			backend := view.Backends[0]
+			So(backend.Name, ShouldEqual, "web-8080")
+			So(backend.Service, ShouldEqual, "web")
+			So(backend.ServicePort, ShouldEqual, "8080")
+			So(backend.Mode, ShouldEqual, "http")
+			So(backend.Servers, ShouldResemble, []*ServerView{
+				{Name: "host1-deadbeef001", Address: "host1:10450"},
+				{Name: "host2-deadbeef002", Address: "host2:10450"},
+			})
+			So(view.Excluded, ShouldBeEmpty)
+		})
+
+		Convey("Shows the resolver names when HAproxy looks servers up", func() {
+			proxy.Resolvers = Resolvers{
+				Nameservers:     []string{"10.0.0.2:53"},
+				HostnamePattern: "{{ .Hostname }}.node.consul",
+			}
+			view := proxy.Backends(state)
+
+			So(len(view.Backends), ShouldEqual, 1)
+			So(view.Backends[0].Servers[0].Address, ShouldEqual, "host1.node.consul:10450")
+		})
+
+		Convey("Matches the servers we'd load into HAproxy", func() {
+			view := proxy.Backends(state)
+			servers, _ := proxy.backendServers(state)
+
+			So(len(view.Backends), ShouldEqual, len(servers))
+			for _, backend := range view.Backends {
+				So(len(backend.Servers), ShouldEqual, len(servers[backend.Name]))
+				for _, server := range backend.Servers {
+					So(servers[backend.Name][server.Name].addr, ShouldEqual, server.Address)
+				}
+			}
+		})
+
+		Convey("Says why services were left out", func() {
+			add("deadbeef003", "host3", service.UNHEALTHY, ports)
+			add("deadbeef004", "host4", service.TOMBSTONE, ports)
+			add("deadbeef005", "host5", service.ALIVE, nil)
+			add("deadbeef006", "host6", service.ALIVE,
+				[]service.Port{{Type: "tcp", Port: 10450, ServicePort: 9090}})
+			add("deadbeef009", "host9", service.MAINTENANCE, ports)
+
+			view := proxy.Backends(state)
+
+			So(excluded(view), ShouldResemble, map[string]string{
+				"deadbeef003": "unhealthy",
+				"deadbeef004": "tombstone",
+				"deadbeef005": "no ports",
+				"deadbeef006": "ports don't match the other instances",
+				"deadbeef009": "maintenance",
+			})
+			So(len(view.Backends[0].Servers), ShouldEqual, 2)
+		})
+
+		Convey("Keeps draining services, marked as draining", func() {
+			svc := add("deadbeef010", "host10", service.ALIVE, ports)
+			svc.Metadata = map[string]string{service.DRAIN_GRACE_METADATA: "1m"}
+			svc.Status = service.TOMBSTONE
+			svc.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc)
+
+			view := proxy.Backends(state)
+
+			So(excluded(view), ShouldBeEmpty)
+
+			draining := make(map[string]bool)
+			for _, server := range view.Backends[0].Servers {
+				draining[server.Name] = server.Draining
+			}
+			So(draining, ShouldResemble, map[string]bool{
+				"host1-deadbeef001":  false,
+				"host2-deadbeef002":  false,
+				"host10-deadbeef010": true,
+			})
+		})
+
+		Convey("Marks the servers kept by panic mode", func() {
+			proxy.PanicMode = true
+			sick := func(svc service.Service) {
+				svc.Status = service.UNHEALTHY
+				svc.Updated = baseTime.Add(time.Second)
+				state.AddServiceEntry(svc)
+			}
+			sick(add("deadbeef001", "host1", service.ALIVE, ports))
+			sick(add("deadbeef002", "host2", service.ALIVE, ports))
+
+			view := proxy.Backends(state)
+
+			So(excluded(view), ShouldBeEmpty)
+			So(view.Backends[0].Servers, ShouldResemble, []*ServerView{
+				{Name: "host1-deadbeef001", Address: "host1:10450", Panic: true},
+				{Name: "host2-deadbeef002", Address: "host2:10450", Panic: true},
+			})
+		})
+
+		Convey("Says when a service has no TCP ServicePort", func() {
+			svc := service.Service{
+				ID: "deadbeef007", Name: "udp-deadbeef007", Image: "udp", Hostname: "host1",
+				Updated: baseTime, Ports: []service.Port{{Type: "udp", Port: 5353, ServicePort: 53}},
+			}
+			state.AddServiceEntry(svc)
+
+			So(excluded(proxy.Backends(state))["deadbeef007"], ShouldEqual, "no TCP ServicePort")
+		})
+
+		Convey("Shows routed backends", func() {
+			proxy.RouteTag = "region"
+			svc := add("deadbeef008", "host8", service.ALIVE, ports)
+			svc.Tags = map[string]string{"region": "us-east"}
+			svc.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc)
+
+			view := proxy.Backends(state)
+
+			So(len(view.Backends), ShouldEqual, 2)
+			So(view.Backends[1].Name, ShouldEqual, "web-8080-us-east")
+			So(view.Backends[1].Route, ShouldEqual, "us-east")
+			So(view.Backends[1].Servers[0].Name, ShouldEqual, "host8-deadbeef008")
+		})
+
+		Convey("Includes the reload generation", func() {
+			So(proxy.Backends(state).Generation, ShouldEqual, 0)
+
+			proxy.Template = "../views/haproxy.cfg"
+			proxy.ConfigFile = "/dev/null"
+			proxy.VerifyCmd = "true"
+			proxy.ReloadCmd = "true"
+			proxy.WriteAndReload(state)
+
+			So(proxy.Backends(state).Generation, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package haproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+)
+
+// Metadata for HAproxy's own health checks on a service's servers, in
+// addition to Sidecar's. Any valid one turns the checks on.
+const (
+	CHECK_PATH_METADATA   = "check_path"   // Makes it an HTTP check, e.g. "/healthz"
+	CHECK_METHOD_METADATA = "check_method" // GET by default
+	CHECK_STATUS_METADATA = "check_status" // The status we expect, otherwise any 2xx or 3xx
+	CHECK_INTER_METADATA  = "check_inter"  // Time between checks, like "2s" or "500ms"
+	CHECK_RISE_METADATA   = "check_rise"   // Passes before a server is up
+	CHECK_FALL_METADATA   = "check_fall"   // Failures before it's down
+)
+
+var (
+	checkPathRegexp   = regexp.MustCompile(`^/[^\s]*$`)
+	checkMethodRegexp = regexp.MustCompile(`^[A-Z]+$`)
+	checkTimeRegexp   = regexp.MustCompile(`^[0-9]+(us|ms|s|m|h|d)?$`)
+)
+
+// HAproxy's health check for a backend. Without a Path, it's a TCP check.
+type healthCheck struct {
+	Path   string
+	Method string
+	Status int
+	Inter  string
+	Rise   int
+	Fall   int
+}
+
+// The options for the check on each server line
+func (c *healthCheck) ServerOptions() string {
+	options := "check"
+	if c.Inter != "" {
+		options += " inter " + c.Inter
+	}
+	if c.Rise > 0 {
+		options += fmt.Sprintf(" rise %d", c.Rise)
+	}
+	if c.Fall > 0 {
+		options += fmt.Sprintf(" fall %d", c.Fall)
+	}
+	return options
+}
+
+// Read a service's health check from its metadata. Returns nil if it
+// doesn't have one. Values that HAproxy wouldn't take are left out, with a
+// warning, rather than breaking the config, so a check with nothing valid
+// in it isn't one at all.
+func healthCheckFor(svc *service.Service) *healthCheck {
+	var check healthCheck
+
+	invalid := func(key, value string) {
+		log.Warnf("Invalid %s '%s' for %s, ignoring it", key, value, svc.ID)
+	}
+
+	number := func(key string, min, max int) int {
+		value, ok := svc.Metadata[key]
+		if !ok {
+			return 0
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			invalid(key, value)
+			return 0
+		}
+		return n
+	}
+
+	if path, ok := svc.Metadata[CHECK_PATH_METADATA]; ok {
+		if checkPathRegexp.MatchString(path) {
+			check.Path = path
+			check.Method = "GET"
+		} else {
+			invalid(CHECK_PATH_METADATA, path)
+		}
+	}
+
+	if method, ok := svc.Metadata[CHECK_METHOD_METADATA]; ok && check.Path != "" {
+		if checkMethodRegexp.MatchString(method) {
+			check.Method = method
+		} else {
+			invalid(CHECK_METHOD_METADATA, method)
+		}
+	}
+
+	if inter, ok := svc.Metadata[CHECK_INTER_METADATA]; ok {
+		if checkTimeRegexp.MatchString(inter) {
+			check.Inter = inter
+		} else {
+			invalid(CHECK_INTER_METADATA, inter)
+		}
+	}
+
+	check.Rise = number(CHECK_RISE_METADATA, 1, 100)
+	check.Fall = number(CHECK_FALL_METADATA, 1, 100)
+
+	// Only HTTP checks have a status
+	if check.Path != "" {
+		check.Status = number(CHECK_STATUS_METADATA, 100, 599)
+	}
+
+	if check == (healthCheck{}) {
+		return nil
+	}
+	return &check
+}
+
+// The health check for each service that has one, from its metadata
+func getHealthChecks(state *catalog.ServicesState) map[string]*healthCheck {
+	checkMap := make(map[string]*healthCheck)
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if check := healthCheckFor(svc); check != nil {
+				checkMap[state.ServiceName(svc)] = check
+			}
+		},
+	)
+	return checkMap
+}
@@ -0,0 +1,62 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_healthCheckFor(t *testing.T) {
+	Convey("healthCheckFor()", t, func() {
+		checkFor := func(metadata map[string]string) *healthCheck {
+			return healthCheckFor(&service.Service{ID: "deadbeef123", Metadata: metadata})
+		}
+
+		Convey("Returns nil without any check metadata", func() {
+			So(checkFor(nil), ShouldBeNil)
+			So(checkFor(map[string]string{BALANCE_METADATA: "leastconn"}), ShouldBeNil)
+		})
+
+		Convey("Reads an HTTP check", func() {
+			check := checkFor(map[string]string{
+				CHECK_PATH_METADATA:   "/healthz",
+				CHECK_METHOD_METADATA: "HEAD",
+				CHECK_STATUS_METADATA: "204",
+				CHECK_INTER_METADATA:  "2s",
+				CHECK_RISE_METADATA:   "2",
+				CHECK_FALL_METADATA:   "3",
+			})
+
+			So(check, ShouldResemble, &healthCheck{
+				Path: "/healthz", Method: "HEAD", Status: 204, Inter: "2s", Rise: 2, Fall: 3,
+			})
+			So(check.ServerOptions(), ShouldEqual, "check inter 2s rise 2 fall 3")
+		})
+
+		Convey("Uses GET by default", func() {
+			So(checkFor(map[string]string{CHECK_PATH_METADATA: "/healthz"}).Method, ShouldEqual, "GET")
+		})
+
+		Convey("Is a TCP check without a path", func() {
+			check := checkFor(map[string]string{CHECK_INTER_METADATA: "500ms", CHECK_STATUS_METADATA: "200"})
+			So(check, ShouldResemble, &healthCheck{Inter: "500ms"})
+			So(check.ServerOptions(), ShouldEqual, "check inter 500ms")
+		})
+
+		Convey("Leaves out values HAproxy wouldn't take", func() {
+			check := checkFor(map[string]string{
+				CHECK_PATH_METADATA:   "/healthz",
+				CHECK_METHOD_METADATA: "get it",
+				CHECK_STATUS_METADATA: "2000",
+				CHECK_INTER_METADATA:  "1m30s",
+				CHECK_RISE_METADATA:   "0",
+				CHECK_FALL_METADATA:   "lots",
+			})
+			So(check, ShouldResemble, &healthCheck{Path: "/healthz", Method: "GET"})
+
+			So(checkFor(map[string]string{CHECK_PATH_METADATA: "/health check"}), ShouldBeNil)
+			So(checkFor(map[string]string{CHECK_PATH_METADATA: "healthz"}), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,223 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+)
+
+const (
+	DIFF_CONTEXT   = 3               // Lines of context around each change
+	DIFF_MAX_CELLS = 4 * 1000 * 1000 // Beyond this, changed blocks aren't matched up line by line
+)
+
+// The header has the time it was written, which would always differ
+var generatedRegexp = regexp.MustCompile(`(?m)^# Auto-generated.*$`)
+
+// A unified diff of the config file on disk against the one we'd write for
+// the state, without writing or reloading anything. It's empty when they're
+// the same, apart from when they were generated.
+func (h *HAproxy) Diff(state *catalog.ServicesState) (string, error) {
+	current, err := ioutil.ReadFile(h.ConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = h.writeConfig(state, &buf, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+
+	return unifiedDiff(
+		h.ConfigFile, generatedRegexp.ReplaceAllString(string(current), "# Auto-generated"),
+		h.ConfigFile+" (new)", generatedRegexp.ReplaceAllString(buf.String(), "# Auto-generated"),
+	), nil
+}
+
+// One line of a diff: ' ' for the same in both, '-' for removed, '+' added
+type diffLine struct {
+	op   byte
+	text string
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Diff two files in the unified format, like `diff -u`. Empty if they're
+// the same.
+func unifiedDiff(fromName string, from string, toName string, to string) string {
+	if from == to {
+		return ""
+	}
+
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+
+	// Walk the changes, grouping them into hunks with their context
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// Back up for the leading context, then carry on until we've had
+		// more than twice the context without a change
+		begin := start - DIFF_CONTEXT
+		if begin < 0 {
+			begin = 0
+		}
+
+		end, unchanged := start, 0
+		for end < len(lines) && unchanged <= 2*DIFF_CONTEXT {
+			if lines[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+			end++
+		}
+		if unchanged > DIFF_CONTEXT {
+			end -= unchanged - DIFF_CONTEXT
+		}
+
+		writeHunk(&out, lines, begin, end)
+		start = end
+	}
+
+	return out.String()
+}
+
+// Write lines[begin:end] with its @@ header, which counts lines from one
+func writeHunk(out *strings.Builder, lines []diffLine, begin int, end int) {
+	fromStart, toStart := 1, 1
+	for _, line := range lines[:begin] {
+		if line.op != '+' {
+			fromStart++
+		}
+		if line.op != '-' {
+			toStart++
+		}
+	}
+
+	var fromCount, toCount int
+	for _, line := range lines[begin:end] {
+		if line.op != '+' {
+			fromCount++
+		}
+		if line.op != '-' {
+			toCount++
+		}
+	}
+
+	// Like diff, an empty side starts at the line before it
+	if fromCount == 0 {
+		fromStart--
+	}
+	if toCount == 0 {
+		toStart--
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", fromStart, fromCount, toStart, toCount)
+	for _, line := range lines[begin:end] {
+		out.WriteByte(line.op)
+		out.WriteString(line.text)
+		out.WriteByte('\n')
+	}
+}
+
+// Line by line differences, from the longest common subsequence. The lines
+// the two have in common at the start and end are left out of that, so the
+// usual small change to a big config is cheap. If what's left is still too
+// big to compare, it's all shown as removed and then added.
+func diffLines(from []string, to []string) []diffLine {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix &&
+		from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, text := range from[:prefix] {
+		lines = append(lines, diffLine{' ', text})
+	}
+
+	a, b := from[prefix:len(from)-suffix], to[prefix:len(to)-suffix]
+	if len(a)*len(b) > DIFF_MAX_CELLS {
+		for _, text := range a {
+			lines = append(lines, diffLine{'-', text})
+		}
+		for _, text := range b {
+			lines = append(lines, diffLine{'+', text})
+		}
+	} else {
+		lines = append(lines, lcsDiff(a, b)...)
+	}
+
+	for _, text := range from[len(from)-suffix:] {
+		lines = append(lines, diffLine{' ', text})
+	}
+
+	return lines
+}
+
+func lcsDiff(a []string, b []string) []diffLine {
+	// lengths[i][j] is the LCS of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+
+	return lines
+}
@@ -0,0 +1,115 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_unifiedDiff(t *testing.T) {
+	Convey("unifiedDiff()", t, func() {
+		lines := func(from int, to int) string {
+			var text string
+			for i := from; i <= to; i++ {
+				text += strings.Repeat("x", i%3) + string(rune('a'+i%26)) + "\n"
+			}
+			return text
+		}
+
+		Convey("Is empty when they're the same", func() {
+			So(unifiedDiff("a", "one\ntwo\n", "b", "one\ntwo\n"), ShouldEqual, "")
+		})
+
+		Convey("Shows a change with its context", func() {
+			from := "global\n\tdaemon\n\tmaxconn 4096\n\tlog global\n\ndefaults\n\tretries 3\n"
+			to := "global\n\tdaemon\n\tmaxconn 8192\n\tlog global\n\ndefaults\n\tretries 3\n"
+
+			So(unifiedDiff("old", from, "new", to), ShouldEqual, `--- old
++++ new
+@@ -1,6 +1,6 @@
+ global
+ 	daemon
+-	maxconn 4096
++	maxconn 8192
+ 	log global
+ 
+ defaults
+`)
+		})
+
+		Convey("Splits changes that are far apart into hunks", func() {
+			from := lines(0, 19)
+			to := "new\n" + lines(0, 18) + "changed\n"
+
+			So(unifiedDiff("old", from, "new", to), ShouldEqual, `--- old
++++ new
+@@ -1,3 +1,4 @@
++new
+ a
+ xb
+ xxc
+@@ -17,4 +18,4 @@
+ xq
+ xxr
+ s
+-xt
++changed
+`)
+		})
+
+		Convey("Handles a file that's gone or new", func() {
+			So(unifiedDiff("old", "", "new", "one\n"), ShouldEqual, "--- old\n+++ new\n@@ -0,0 +1,1 @@\n+one\n")
+			So(unifiedDiff("old", "one\n", "new", ""), ShouldEqual, "--- old\n+++ new\n@@ -1,1 +0,0 @@\n-one\n")
+		})
+	})
+}
+
+func Test_Diff(t *testing.T) {
+	Convey("Diff()", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "sidecar-diff")
+		defer os.RemoveAll(tmpDir)
+
+		state := catalog.NewServicesState()
+		proxy := New(filepath.Join(tmpDir, "haproxy.cfg"), filepath.Join(tmpDir, "haproxy.pid"))
+		proxy.Template = "../views/haproxy.cfg"
+
+		outfile, _ := os.Create(proxy.ConfigFile)
+		proxy.WriteConfig(state, outfile)
+		outfile.Close()
+
+		Convey("Ignores when the config was generated", func() {
+			time.Sleep(time.Millisecond)
+
+			diff, err := proxy.Diff(state)
+			So(err, ShouldBeNil)
+			So(diff, ShouldBeEmpty)
+		})
+
+		Convey("Shows the servers that would be added", func() {
+			state.AddServiceEntry(service.Service{
+				ID: "deadbeef001", Name: "web-deadbeef001", Image: "web", Hostname: hostname1,
+				Updated: time.Now().UTC(), Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			})
+
+			diff, err := proxy.Diff(state)
+			So(err, ShouldBeNil)
+			So(diff, ShouldContainSubstring, "\n+backend web-8080\n")
+			So(diff, ShouldContainSubstring, "\n+\tserver "+hostname1+"-deadbeef001 ")
+		})
+
+		Convey("Shows the whole config when there isn't one yet", func() {
+			os.Remove(proxy.ConfigFile)
+
+			diff, err := proxy.Diff(state)
+			So(err, ShouldBeNil)
+			So(diff, ShouldContainSubstring, "\n+global\n")
+		})
+	})
+}
@@ -1,34 +1,133 @@
 package haproxy
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
 	"github.com/newrelic/sidecar/catalog"
 	"github.com/newrelic/sidecar/service"
+	"github.com/newrelic/sidecar/tracing"
 )
 
+const (
+	DEFAULT_RELOAD_DEBOUNCE = 500 * time.Millisecond
+	DEFAULT_BALANCE         = "roundrobin"
+	BALANCE_METADATA        = "balance"    // Metadata like "leastconn" picks the algorithm for a service
+	PANIC_METADATA          = "panic_mode" // Metadata "true" or "false" overrides the PanicMode default
+	PROTO_METADATA          = "proto"      // Metadata "h2" or "h2c" for services that speak HTTP/2
+	BIND_METADATA           = "bind"       // Metadata naming one of the BindAddresses, like "internal"
+	CANARY_METADATA         = "canary"     // Metadata "true" for instances that only get canary requests
+
+	DEFAULT_FAILURE_THRESHOLD = 3               // Failed reloads in a row before we hold off
+	DEFAULT_FAILURE_BACKOFF   = 5 * time.Second // The first hold off, doubled each time it fails again
+	MAX_FAILURE_BACKOFF       = 5 * time.Minute
+)
+
+// The balance algorithms a backend can use
+var balanceAlgorithms = map[string]bool{
+	"roundrobin": true,
+	"leastconn":  true,
+	"source":     true,
+}
+
+// Is this a balance algorithm we support?
+func ValidBalance(balance string) bool {
+	return balanceAlgorithms[balance]
+}
+
 type portset map[string]string
 type portmap map[string]portset
 
 // Configuration and state for the HAproxy management module
 type HAproxy struct {
-	ReloadCmd  string `toml:"reload_cmd"`
-	VerifyCmd  string `toml:"verify_cmd"`
-	BindIP     string `toml:"bind_ip"`
-	Template   string `toml:"template"`
-	ConfigFile string `toml:"config_file"`
-	PidFile    string `toml:"pid_file"`
-	User       string `toml:"user"`
-	Group      string `toml:"group"`
+	Name        string `toml:"name"` // Tells them apart when there's more than one
+	ReloadCmd   string `toml:"reload_cmd"`
+	VerifyCmd   string `toml:"verify_cmd"`
+	BindIP      string `toml:"bind_ip"`
+	Template    string `toml:"template"`
+	ConfigFile  string `toml:"config_file"`
+	PidFile     string `toml:"pid_file"`
+	User        string `toml:"user"`
+	Group       string `toml:"group"`
+	StatsSocket string `toml:"stats_socket"`
+
+	// Hand the listening sockets from the old process to the new one over
+	// the StatsSocket when reloading, so no connections are refused
+	SocketReload bool `toml:"socket_reload"`
+
+	// Changes are batched up for this long before we update HAproxy
+	ReloadDebounce time.Duration `toml:"reload_debounce"`
+
+	// When this many reloads fail in a row, e.g. from a bad template, we
+	// hold off for FailureBackoff before trying again rather than reloading
+	// on every change. It doubles each time it fails again.
+	FailureThreshold int           `toml:"failure_threshold"`
+	FailureBackoff   time.Duration `toml:"failure_backoff"`
+
+	// Named addresses services can bind their frontends to instead of the
+	// BindIP, e.g. "internal", picked with BIND_METADATA
+	BindAddresses map[string]string `toml:"bind_addresses"`
+
+	// Directives merged into the template's global and defaults sections,
+	// e.g. "maxconn" = "8192". These win over the template's own.
+	GlobalSettings   map[string]string `toml:"global_settings"`
+	DefaultsSettings map[string]string `toml:"defaults_settings"`
+
+	// Certificate files for frontends that terminate TLS, by ServicePort
+	TLSCerts map[string]string `toml:"tls_certs"`
+
+	// Send HTTP requests to backends by this service tag, e.g. "region".
+	// The request picks one with the RouteHeader, "X-Region" by default.
+	RouteTag    string `toml:"route_tag"`
+	RouteHeader string `toml:"route_header"`
+
+	// Send HTTP requests with this header value to the instances with
+	// CANARY_METADATA, e.g. "X-Canary: always". Everything else goes to
+	// the rest of them.
+	CanaryHeader string `toml:"canary_header"`
+	CanaryValue  string `toml:"canary_value"`
+
+	// Look the servers up in DNS from HAproxy, rather than writing in
+	// their addresses
+	Resolvers Resolvers
+
+	// The balance algorithm for services that don't pick their own
+	Balance string `toml:"balance"`
+
+	// Keep unhealthy servers in a backend when none are healthy, rather
+	// than dropping it. Services can override it with PANIC_METADATA.
+	PanicMode bool `toml:"panic_mode"`
+
+	// Only serve these services. With an include list, it's just the ones
+	// named in it, and the exclude list always wins. Globs like "api-*" work.
+	Include []string `toml:"include"`
+	Exclude []string `toml:"exclude"`
+
+	// Hold off updates while this returns true, and apply the latest
+	// state once it doesn't
+	Paused func() bool `toml:"-"`
+
+	runtime    *runtimeState
+	lastConfig []byte // Hash of the config HAproxy last loaded, nil if unsure
+	loaded     bool   // Has any config been loaded since we started?
+	generation int    // How many times we've reloaded
+
+	failures   int       // Reloads that have failed in a row
+	retryAfter time.Time // When we'll try again after they've failed
+	lock       sync.Mutex
 }
 
 // Constructs a properly configured HAProxy and returns a pointer to it
@@ -37,11 +136,15 @@ func New(configFile string, pidFile string) *HAproxy {
 	verifyCmd := "haproxy -c -f " + configFile
 
 	proxy := HAproxy{
-		ReloadCmd:  reloadCmd,
-		VerifyCmd:  verifyCmd,
-		Template:   "views/haproxy.cfg",
-		ConfigFile: configFile,
-		PidFile:    pidFile,
+		ReloadCmd:        reloadCmd,
+		VerifyCmd:        verifyCmd,
+		Template:         "views/haproxy.cfg",
+		ConfigFile:       configFile,
+		PidFile:          pidFile,
+		ReloadDebounce:   DEFAULT_RELOAD_DEBOUNCE,
+		FailureThreshold: DEFAULT_FAILURE_THRESHOLD,
+		FailureBackoff:   DEFAULT_FAILURE_BACKOFF,
+		Balance:          DEFAULT_BALANCE,
 	}
 
 	return &proxy
@@ -72,10 +175,26 @@ func (h *HAproxy) makePortmap(services map[string][]*service.Service) portmap {
 	return ports
 }
 
-// Clean up image names for writing as HAproxy frontend and backend entries
-func sanitizeName(image string) string {
-	replace := regexp.MustCompile("[^a-z0-9-]")
-	return replace.ReplaceAllString(image, "-")
+// Returns the names of the ports that have them, keyed by service name and
+// then ServicePort
+func getPortNames(services map[string][]*service.Service) map[string]map[string]string {
+	names := make(map[string]map[string]string)
+
+	for name, svcList := range services {
+		for _, svc := range svcList {
+			for _, port := range svc.Ports {
+				if port.Name == "" || port.ServicePort == 0 {
+					continue
+				}
+				if _, ok := names[name]; !ok {
+					names[name] = make(map[string]string)
+				}
+				names[name][strconv.FormatInt(port.ServicePort, 10)] = port.Name
+			}
+		}
+	}
+
+	return names
 }
 
 // Create an HAproxy config from the supplied ServicesState. Write it out to the
@@ -83,38 +202,181 @@ func sanitizeName(image string) string {
 // builds a list of unique ports for all services, then passes these to the
 // template. Ports are looked up by the func getPorts().
 func (h *HAproxy) WriteConfig(state *catalog.ServicesState, output io.Writer) {
-	services := servicesWithPorts(state)
+	err := h.writeConfig(state, output, time.Now().UTC())
+	if err != nil {
+		log.Errorf("Error rendering template '%s': %s", h.Template, err.Error())
+	}
+}
+
+// Render the config as of the given time, which only shows up in the header
+func (h *HAproxy) writeConfig(state *catalog.ServicesState, output io.Writer, now time.Time) error {
+	services := h.servicesWithPorts(state)
 	ports := h.makePortmap(services)
+	portNames := getPortNames(services)
 	modes := getModes(state)
+	cookies := getStickyCookies(state)
+	balances := getBalances(state)
+	protos := getProtos(state)
+	checks := getHealthChecks(state)
+	serviceTimeouts := getTimeouts(state)
+	binds := h.getBinds(state)
+	counts := getCounts(state, now)
+
+	routes := make(map[string][]*route, len(services))
+	for svcName, svcList := range services {
+		routes[svcName] = h.routesFor(svcList, modes[svcName])
+	}
+
+	serverAddress, err := h.Resolvers.serverAddressFunc()
+	if err != nil {
+		return err
+	}
 
 	data := struct {
-		Services map[string][]*service.Service
-		User     string
-		Group    string
+		Services     map[string][]*service.Service
+		Counts       map[string]*instanceCounts
+		User         string
+		Group        string
+		SocketReload bool
 	}{
-		Services: services,
-		User:     h.User,
-		Group:    h.Group,
+		Services:     services,
+		Counts:       counts,
+		User:         h.User,
+		Group:        h.Group,
+		SocketReload: h.socketReload(),
 	}
 
 	funcMap := template.FuncMap{
-		"now": time.Now().UTC,
+		"now": func() time.Time { return now },
 		"getMode": func(k string) string {
 			return modes[k]
 		},
 		"getPorts": func(k string) map[string]string {
 			return ports[k]
 		},
-		"bindIP":       func() string { return h.BindIP },
-		"sanitizeName": sanitizeName,
+		"portName": func(k string, port string) string {
+			return portNames[k][port]
+		},
+		"stickyCookie": func(k string) string {
+			return cookies[k]
+		},
+		"getRoutes": func(k string) []*route {
+			return routes[k]
+		},
+		// Never nil, so templates don't have to check
+		"getCounts": func(k string) *instanceCounts {
+			if c, ok := counts[k]; ok {
+				return c
+			}
+			return &instanceCounts{}
+		},
+		// "h2" when the service speaks HTTP/2, otherwise empty
+		"getProto": func(k string) string {
+			return protos[k]
+		},
+		// HAproxy's own health check for the service, nil if it has none
+		"getCheck": func(k string) *healthCheck {
+			return checks[k]
+		},
+		// The timeouts the service overrides, nil if it has none
+		"getTimeouts": func(k string) *timeouts {
+			return serviceTimeouts[k]
+		},
+		"defaultBalance": func() string { return h.Balance },
+		// Only set when the service wants something other than the default
+		"getBalance": func(k string) string {
+			if balances[k] == h.Balance {
+				return ""
+			}
+			return balances[k]
+		},
+		"routeHeader": h.routeHeader,
+		"bindIP":      func() string { return bracketIP(h.BindIP) },
+		// The BindIP, unless the service picked one of the BindAddresses
+		"bindFor": func(k string) string {
+			if address, ok := binds[k]; ok {
+				return bracketIP(address)
+			}
+			return bracketIP(h.BindIP)
+		},
+		"certFor":      func(port string) string { return h.TLSCerts[port] },
+		"sanitizeName": service.SanitizeName,
+		// The resolvers, nil unless HAproxy looks the servers up itself
+		"resolvers": func() *Resolvers {
+			if h.Resolvers.Enabled() {
+				return &h.Resolvers
+			}
+			return nil
+		},
+		"serverAddress": serverAddress,
 	}
 
 	t, err := template.New("haproxy").Funcs(funcMap).ParseFiles(h.Template)
 	if err != nil {
-		log.Errorf("Error Parsing template '%s': %s", h.Template, err.Error())
-		return
+		return err
 	}
-	t.ExecuteTemplate(output, path.Base(h.Template), data)
+
+	var rendered bytes.Buffer
+	err = t.ExecuteTemplate(&rendered, path.Base(h.Template), data)
+	if err != nil {
+		return err
+	}
+
+	config := mergeSettings(rendered.String(), "global", h.GlobalSettings)
+	config = mergeSettings(config, "defaults", h.DefaultsSettings)
+
+	_, err = io.WriteString(output, config)
+	return err
+}
+
+// Render the template against some made up services, so that a broken
+// template is caught at startup rather than on the first reload. The
+// services have every field set, so referencing one that doesn't exist
+// will fail.
+func (h *HAproxy) ValidateTemplate() error {
+	state := catalog.NewServicesState()
+	now := time.Now().UTC()
+
+	svc := service.Service{
+		ID:           "deadbeef0001",
+		Name:         "validate",
+		Image:        "validate",
+		Created:      now,
+		Hostname:     "validate-host",
+		Ports:        []service.Port{{Type: "tcp", Port: 10000, ServicePort: 10000, Name: "validate"}},
+		Updated:      now,
+		ProxyMode:    "http",
+		Status:       service.ALIVE,
+		Metadata:     map[string]string{"validate": "true", BALANCE_METADATA: "leastconn", PROTO_METADATA: "h2"},
+		Weight:       1,
+		Sticky:       true,
+		StickyCookie: "validate",
+	}
+	svc.Metadata[CHECK_PATH_METADATA] = "/validate"
+	svc.Metadata[CHECK_STATUS_METADATA] = "200"
+	svc.Metadata[CHECK_INTER_METADATA] = "2s"
+	svc.Metadata[CHECK_RISE_METADATA] = "2"
+	svc.Metadata[CHECK_FALL_METADATA] = "3"
+	svc.Metadata[TIMEOUT_CLIENT_METADATA] = "1h"
+	svc.Metadata[TIMEOUT_SERVER_METADATA] = "1h"
+	svc.Metadata[TIMEOUT_CONNECT_METADATA] = "10s"
+	state.AddServiceEntry(svc)
+
+	// A second instance so there's a routed backend too
+	svc.ID = "deadbeef0002"
+	if h.RouteTag != "" {
+		svc.Tags = map[string]string{h.RouteTag: "validate"}
+	}
+	state.AddServiceEntry(svc)
+
+	// And a canary
+	if h.CanaryHeader != "" {
+		svc.ID = "deadbeef0003"
+		svc.Metadata[CANARY_METADATA] = "true"
+		state.AddServiceEntry(svc)
+	}
+
+	return h.writeConfig(state, ioutil.Discard, now)
 }
 
 // Execute a command and log the error, but bubble it up as well
@@ -128,10 +390,29 @@ func (h *HAproxy) run(command string) error {
 	return err
 }
 
+// Are we doing seamless reloads? They need the StatsSocket.
+func (h *HAproxy) socketReload() bool {
+	return h.SocketReload && len(h.StatsSocket) > 0
+}
+
+// The command we reload with. For a seamless reload, the new process gets
+// the listening sockets from the old one with -x. Neither the socket nor the
+// pid file are there the first time HAproxy starts, so each is only passed
+// when it exists. Otherwise we use the plain ReloadCmd.
+func (h *HAproxy) reloadCommand() string {
+	if !h.socketReload() {
+		return h.ReloadCmd
+	}
+
+	return "haproxy -f " + h.ConfigFile + " -p " + h.PidFile +
+		" `[[ -S " + h.StatsSocket + " ]] && echo \"-x " + h.StatsSocket + "\"`" +
+		" `[[ -f " + h.PidFile + " ]] && echo \"-sf $(cat " + h.PidFile + ")\"`"
+}
+
 // Run the HAproxy reload command to load the new config and restart.
 // Best to use a command with -sf specified to keep the connections up.
 func (h *HAproxy) Reload() error {
-	return h.run(h.ReloadCmd)
+	return h.run(h.reloadCommand())
 }
 
 // Run HAproxy with the verify command that will check the validity of
@@ -144,32 +425,227 @@ func (h *HAproxy) Verify() error {
 // Watch the state of a ServicesState struct and generate a new proxy
 // config file (haproxy.ConfigFile) when the state changes. Also notifies
 // the service that it needs to reload once the new file has been written
-// and verified.
+// and verified. If the StatsSocket is configured, simple server changes
+// are made over the socket instead and the config is not reloaded.
+//
+// Events are batched up: the first change starts a ReloadDebounce timer
+// and we update HAproxy once, with the latest state, when it fires. While
+// Paused, we keep re-arming the timer instead. When reloads are failing,
+// the timer waits out the hold off.
 func (h *HAproxy) Watch(state *catalog.ServicesState) {
 	eventChannel := make(chan catalog.ChangeEvent, 2)
 	state.AddListener(eventChannel)
 
-	for event := range eventChannel {
-		log.Println("State change event from " + event.Hostname)
-		h.WriteAndReload(state)
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-eventChannel:
+			if !ok {
+				return
+			}
+
+			log.WithFields(log.Fields{"node": event.Hostname, "event": "state_change"}).
+				Println("State change event from " + event.Hostname)
+
+			if timer != nil {
+				metrics.IncrCounter([]string{"haproxy", "reloads", "coalesced"}, 1)
+				continue
+			}
+			timer = time.After(h.ReloadDebounce)
+
+		case <-timer:
+			if h.Paused != nil && h.Paused() {
+				timer = time.After(h.ReloadDebounce)
+				continue
+			}
+			timer = nil
+			metrics.IncrCounter([]string{"haproxy", "reloads", "executed"}, 1)
+			h.update(state)
+
+			// Try again once we're done holding off, or we'd miss this state
+			if wait := h.HoldingOff(); wait > 0 {
+				timer = time.After(wait)
+			}
+		}
+	}
+}
+
+// Apply the current state to HAproxy, over the socket if we can
+func (h *HAproxy) update(state *catalog.ServicesState) {
+	if h.StatsSocket != "" {
+		err := h.UpdateViaSocket(state)
+		if err == nil {
+			return
+		}
+		if err != ErrNeedsReload {
+			log.Warnf("Unable to update HAproxy via the stats socket: %s", err.Error())
+		}
 	}
+
+	h.WriteAndReload(state)
 }
 
-// Write out the the HAproxy config and reload the service.
+// Hash the config we'd write for this state. The time is left out of it,
+// otherwise it would never match.
+func (h *HAproxy) configHash(state *catalog.ServicesState) []byte {
+	var buf bytes.Buffer
+	// Errors are logged when we write the real thing
+	h.writeConfig(state, &buf, time.Time{})
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+// Write out the the HAproxy config and reload the service. If the config
+// is the same as the one HAproxy last loaded, we leave it alone. If it
+// doesn't verify or the reload fails, the previous config is put back.
 func (h *HAproxy) WriteAndReload(state *catalog.ServicesState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if wait := time.Until(h.retryAfter); wait > 0 {
+		log.WithField("event", "reload_held_off").
+			Debugf("HAproxy reloads are failing, holding off for another %s", wait)
+		metrics.IncrCounter([]string{"haproxy", "reloads", "held_off"}, 1)
+		return
+	}
+
+	span := tracing.Start("haproxy.reload")
+	defer span.Finish()
+
+	hash := h.configHash(state)
+	if h.lastConfig != nil && bytes.Equal(hash, h.lastConfig) {
+		log.WithField("event", "reload_skipped").Debug("HAproxy config is unchanged, skipping reload")
+		metrics.IncrCounter([]string{"haproxy", "reloads", "skipped"}, 1)
+		span.SetAttribute("skipped", true)
+		return
+	}
+
+	// Until the reload works, we don't know what HAproxy is running
+	h.runtime = nil
+	h.lastConfig = nil
+	servers, backends := h.backendServers(state)
+
+	if span != nil {
+		span.SetAttribute("skipped", false)
+		span.SetAttribute("backends", len(servers))
+		span.SetAttribute("servers", servers.count())
+	}
+
+	// Nil if there isn't one yet, in which case there's nothing to put back
+	previous, _ := ioutil.ReadFile(h.ConfigFile)
+
 	outfile, err := os.Create(h.ConfigFile)
 	if err != nil {
-		log.Errorf("Unable to write to %s! (%s)", h.ConfigFile, err.Error())
+		log.WithField("event", "reload_failed").
+			Errorf("Unable to write to %s! (%s)", h.ConfigFile, err.Error())
+		span.SetError(err)
+		h.reloadFailed()
 		return
 	}
 
 	h.WriteConfig(state, outfile)
+	outfile.Close()
+
 	if err := h.Verify(); err != nil {
-		log.Errorf("Failed to verify HAproxy config! (%s)", err.Error())
+		log.WithField("event", "reload_failed").Errorf("Failed to verify HAproxy config! (%s)", err.Error())
+		span.SetError(err)
+		h.restoreConfig(previous)
+		h.reloadFailed()
+		return
+	}
+
+	reloadStart := time.Now()
+	err = h.Reload()
+	span.SetAttribute("reload.duration_ms", time.Since(reloadStart))
+	if err != nil {
+		log.WithField("event", "reload_failed").Errorf("Failed to reload HAproxy! (%s)", err.Error())
+		span.SetError(err)
+		h.restoreConfig(previous)
+		h.reloadFailed()
+		return
+	}
+
+	log.WithField("event", "reload").
+		Infof("Reloaded HAproxy with %d backends and %d servers", len(servers), servers.count())
+
+	if h.failures > 0 {
+		log.WithField("event", "reload_recovered").
+			Infof("HAproxy reloaded after %d failed attempts", h.failures)
+	}
+	h.failures = 0
+	h.retryAfter = time.Time{}
+	metrics.SetGauge([]string{"haproxy", "reload_failures"}, 0)
+
+	h.recordReload(servers, backends)
+	h.lastConfig = hash
+	h.loaded = true
+	h.generation++
+}
+
+// Put back the config we had before a failed reload, so the file on disk
+// is what HAproxy is running
+func (h *HAproxy) restoreConfig(previous []byte) {
+	if previous == nil {
+		return
+	}
+
+	err := ioutil.WriteFile(h.ConfigFile, previous, 0644)
+	if err != nil {
+		log.Errorf("Unable to restore the previous config to %s! (%s)", h.ConfigFile, err.Error())
+	}
+}
+
+// Count a failed reload and, once there have been FailureThreshold of them
+// in a row, hold off before the next one. Call with the lock held.
+func (h *HAproxy) reloadFailed() {
+	h.failures++
+	metrics.SetGauge([]string{"haproxy", "reload_failures"}, float32(h.failures))
+
+	if h.FailureThreshold < 1 || h.failures < h.FailureThreshold {
 		return
 	}
 
-	h.Reload()
+	backoff := h.FailureBackoff
+	for i := h.FailureThreshold; i < h.failures && backoff < MAX_FAILURE_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_FAILURE_BACKOFF {
+		backoff = MAX_FAILURE_BACKOFF
+	}
+	h.retryAfter = time.Now().Add(backoff)
+
+	log.WithField("event", "reload_held_off").
+		Warnf("HAproxy reloads have failed %d times in a row, holding off for %s", h.failures, backoff)
+}
+
+// Failing is true when reloads have failed often enough that we're
+// holding off between them
+func (h *HAproxy) Failing() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.FailureThreshold > 0 && h.failures >= h.FailureThreshold
+}
+
+// HoldingOff returns how long until we'll try reloading again, or zero if
+// we aren't holding off
+func (h *HAproxy) HoldingOff() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	wait := time.Until(h.retryAfter)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Loaded is true once we've written a config and reloaded HAproxy
+// successfully at least once
+func (h *HAproxy) Loaded() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.loaded
 }
 
 func getModes(state *catalog.ServicesState) map[string]string {
@@ -177,65 +653,401 @@ func getModes(state *catalog.ServicesState) map[string]string {
 	state.EachServiceSorted(
 		func(hostname *string, serviceId *string, svc *service.Service) {
 			svcName := state.ServiceName(svc)
-			modeMap[svcName] = svc.ProxyMode
+			modeMap[svcName] = proxyModeFor(svc)
 		},
 	)
 	return modeMap
 }
 
-// Like state.ByService() but only stores information for services which
-// actually have public ports. Only matches services that have the same name
-// and the same ports. Otherwise log an error.
-func servicesWithPorts(state *catalog.ServicesState) map[string][]*service.Service {
-	serviceMap := make(map[string][]*service.Service)
+// The cookie name for each service that wants sticky sessions. It defaults
+// to the service name. Only HTTP services can have one.
+func getStickyCookies(state *catalog.ServicesState) map[string]string {
+	cookieMap := make(map[string]string)
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			svcName := state.ServiceName(svc)
+			if !svc.Sticky || proxyModeFor(svc) != "http" {
+				delete(cookieMap, svcName)
+				return
+			}
 
+			cookie := svc.StickyCookie
+			if cookie == "" {
+				cookie = service.SanitizeName(svcName)
+			}
+			cookieMap[svcName] = cookie
+		},
+	)
+	return cookieMap
+}
+
+// The balance algorithm each service asked for in its metadata. Services
+// that didn't ask, or asked for one we don't support, aren't included.
+func getBalances(state *catalog.ServicesState) map[string]string {
+	balanceMap := make(map[string]string)
 	state.EachServiceSorted(
 		func(hostname *string, serviceId *string, svc *service.Service) {
-			if len(svc.Ports) < 1 {
+			balance, ok := svc.Metadata[BALANCE_METADATA]
+			if !ok {
 				return
 			}
 
-			// We only want things that are alive and healthy!
-			if !svc.IsAlive() {
+			if !ValidBalance(balance) {
+				log.Warnf("Invalid balance '%s' for %s, using the default", balance, svc.ID)
 				return
 			}
+			balanceMap[state.ServiceName(svc)] = balance
+		},
+	)
+	return balanceMap
+}
 
-			svcName := state.ServiceName(svc)
-			if _, ok := serviceMap[svcName]; !ok {
-				serviceMap[svcName] = make([]*service.Service, 0, 3)
+// The services that speak HTTP/2, from their metadata. HAproxy only calls
+// "h2" HTTP/2, and we always talk to the servers in the clear, so "h2c"
+// means the same thing. Only HTTP services can do it.
+func getProtos(state *catalog.ServicesState) map[string]string {
+	protoMap := make(map[string]string)
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			proto, ok := svc.Metadata[PROTO_METADATA]
+			if !ok {
+				return
+			}
+
+			if proto != "h2" && proto != "h2c" {
+				log.Warnf("Invalid proto '%s' for %s, ignoring it", proto, svc.ID)
+				return
 			}
 
-			// If this is the first one, just add it to the list
-			if len(serviceMap[svcName]) < 1 {
-				serviceMap[svcName] = append(serviceMap[svcName], svc)
+			if proxyModeFor(svc) != "http" {
+				log.Warnf("Ignoring proto '%s' for %s, it's only for HTTP services", proto, svc.ID)
 				return
 			}
+			protoMap[state.ServiceName(svc)] = "h2"
+		},
+	)
+	return protoMap
+}
 
-			// Otherwise we need to make sure the ServicePorts match
-			match := serviceMap[svcName][0] // Get the first entry for comparison
+// The address a service's frontends bind to. Services can pick one of the
+// BindAddresses by name, otherwise it's the BindIP. Returns false when they
+// pick one we don't have, so that an internal-only service doesn't end up on
+// the public address.
+func (h *HAproxy) bindAddressFor(svc *service.Service) (string, bool) {
+	name, ok := svc.Metadata[BIND_METADATA]
+	if !ok {
+		return h.BindIP, true
+	}
+
+	address, ok := h.BindAddresses[name]
+	return address, ok
+}
+
+// The bind address of each service that picked one of the BindAddresses
+func (h *HAproxy) getBinds(state *catalog.ServicesState) map[string]string {
+	bindMap := make(map[string]string)
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if _, ok := svc.Metadata[BIND_METADATA]; !ok {
+				return
+			}
 
-			// Build up a sorted list of ServicePorts from the existing service
-			portsToMatch := getSortedServicePorts(match)
+			if address, ok := h.bindAddressFor(svc); ok {
+				bindMap[state.ServiceName(svc)] = address
+			}
+		},
+	)
+	return bindMap
+}
 
-			// Get the list of our ports
-			portsWeHave := getSortedServicePorts(svc)
+// How many instances of a service there are, for templates that want to
+// flag a backend that's running thin
+type instanceCounts struct {
+	TotalCount    int // Everything that isn't gone, healthy or not
+	HealthyCount  int
+	DrainingCount int
+}
 
-			// Compare the two sorted lists
-			for i, port := range portsToMatch {
-				if portsWeHave[i] != port {
-					// TODO should we just add another service with this port added
-					// to the name? We have to find out which port.
-					log.Warnf("%s service from %s not added: non-matching ports! (%v vs %v)",
-						state.ServiceName(svc), svc.Hostname, port, portsWeHave[i])
-					return
-				}
+// The instance counts for every service in the state, including the ones
+// with nothing healthy, which don't get a backend at all
+func getCounts(state *catalog.ServicesState, now time.Time) map[string]*instanceCounts {
+	countMap := make(map[string]*instanceCounts)
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			draining := svc.IsDraining(now)
+			if svc.IsTombstone() && !draining {
+				return
+			}
+
+			svcName := state.ServiceName(svc)
+			counts, ok := countMap[svcName]
+			if !ok {
+				counts = &instanceCounts{}
+				countMap[svcName] = counts
+			}
+
+			counts.TotalCount++
+			if svc.IsAlive() {
+				counts.HealthyCount++
+			}
+			if draining {
+				counts.DrainingCount++
+			}
+		},
+	)
+	return countMap
+}
+
+// The backend for one value of the RouteTag, or for the canaries. The
+// default route has no Value and gets the services without the tag.
+type route struct {
+	Header   string // The request header that picks it
+	Value    string
+	Suffix   string // Added to the backend name, empty for the default
+	Services []*service.Service
+}
+
+// Split a service's instances up by the RouteTag. There's always a default
+// route first, even if it's empty, because the frontend falls back to it.
+// Canaries come next, when there are any, so their header is matched before
+// the tag. Only HTTP services can be routed, since it's done by header.
+func (h *HAproxy) routesFor(svcList []*service.Service, mode string) []*route {
+	defaultRoute := &route{}
+	if mode != "http" || (h.RouteTag == "" && h.CanaryHeader == "") {
+		defaultRoute.Services = svcList
+		return []*route{defaultRoute}
+	}
+
+	routes := []*route{defaultRoute}
+
+	canaryRoute := &route{Header: h.CanaryHeader, Value: h.CanaryValue, Suffix: "canary"}
+	if h.CanaryHeader != "" {
+		var stable []*service.Service
+		for _, svc := range svcList {
+			if isCanary(svc) {
+				canaryRoute.Services = append(canaryRoute.Services, svc)
+			} else {
+				stable = append(stable, svc)
 			}
+		}
+		svcList = stable
+
+		if len(canaryRoute.Services) > 0 {
+			routes = append(routes, canaryRoute)
+		}
+	}
+
+	if h.RouteTag == "" {
+		defaultRoute.Services = svcList
+		return routes
+	}
+
+	bySuffix := make(map[string]*route)
+	var suffixes []string
+	for _, svc := range svcList {
+		value := svc.Tags[h.RouteTag]
+		if value == "" {
+			defaultRoute.Services = append(defaultRoute.Services, svc)
+			continue
+		}
+
+		// Header matching ignores case, so these are the same route
+		suffix := service.SanitizeName(strings.ToLower(value))
+		if _, ok := bySuffix[suffix]; !ok {
+			bySuffix[suffix] = &route{Header: h.routeHeader(), Value: value, Suffix: suffix}
+			suffixes = append(suffixes, suffix)
+		}
+		bySuffix[suffix].Services = append(bySuffix[suffix].Services, svc)
+	}
+
+	sort.Strings(suffixes)
+	for _, suffix := range suffixes {
+		routes = append(routes, bySuffix[suffix])
+	}
+
+	return routes
+}
+
+// Canaries only get the requests that ask for them
+func isCanary(svc *service.Service) bool {
+	return svc.Metadata[CANARY_METADATA] == "true"
+}
 
-			// It was a match! Append to the list.
+// The request header that picks the route, e.g. "X-Region"
+func (h *HAproxy) routeHeader() string {
+	if h.RouteHeader != "" {
+		return h.RouteHeader
+	}
+
+	return "X-" + strings.ToUpper(h.RouteTag[:1]) + h.RouteTag[1:]
+}
+
+// Services without a mode are proxied as HTTP. HAproxy only knows about
+// "http" and "tcp", but we pass anything else through so that verifying
+// the config fails rather than quietly proxying it the wrong way.
+func proxyModeFor(svc *service.Service) string {
+	mode := strings.ToLower(svc.ProxyMode)
+
+	switch mode {
+	case "":
+		return "http"
+	case "http", "tcp":
+		return mode
+	default:
+		log.Warnf("Unknown proxy mode '%s' for %s (id: %s)", svc.ProxyMode, svc.Name, svc.ID)
+		return mode
+	}
+}
+
+// Like state.ByService() but only stores information for services which
+// actually have public ports. Only matches services that have the same name
+// and the same ports. Otherwise log an error.
+func (h *HAproxy) servicesWithPorts(state *catalog.ServicesState) map[string][]*service.Service {
+	var panicking []string
+	services := h.groupServices(state, func(*service.Service, string) {}, func(svcName string) {
+		panicking = append(panicking, svcName)
+	})
+
+	for _, svcName := range panicking {
+		log.Warnf("Nothing healthy for %s, keeping its unhealthy servers (panic mode)", svcName)
+	}
+	metrics.SetGauge([]string{"haproxy", "panic_services"}, float32(len(panicking)))
+
+	return services
+}
+
+// Does this proxy serve the service? The same rules as state.Manages(),
+// but for one proxy among several.
+func (h *HAproxy) serves(svcName string) bool {
+	if matchesAny(h.Exclude, svcName) {
+		return false
+	}
+
+	return len(h.Include) == 0 || matchesAny(h.Include, svcName)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Is panic mode on for this service? Its metadata wins over the default.
+func (h *HAproxy) panicMode(svc *service.Service) bool {
+	if value, ok := svc.Metadata[PANIC_METADATA]; ok {
+		return value == "true"
+	}
+
+	return h.PanicMode
+}
+
+// Does the work for servicesWithPorts(), telling excluded() about each
+// service that's left out and why, and panicked() about each service that
+// is only there because of panic mode
+func (h *HAproxy) groupServices(state *catalog.ServicesState,
+	excluded func(svc *service.Service, reason string),
+	panicked func(svcName string)) map[string][]*service.Service {
+
+	serviceMap := make(map[string][]*service.Service)
+	healthy := make(map[string]bool)
+	var unhealthy []*service.Service // Kept back in case we need to panic
+	now := time.Now().UTC()
+
+	add := func(svc *service.Service) {
+		svcName := state.ServiceName(svc)
+		if _, ok := serviceMap[svcName]; !ok {
+			serviceMap[svcName] = make([]*service.Service, 0, 3)
+		}
+
+		// If this is the first one, just add it to the list
+		if len(serviceMap[svcName]) < 1 {
 			serviceMap[svcName] = append(serviceMap[svcName], svc)
+			return
+		}
+
+		// Otherwise we need to make sure the ServicePorts match
+		match := serviceMap[svcName][0] // Get the first entry for comparison
+
+		// Build up a sorted list of ServicePorts from the existing service
+		portsToMatch := getSortedServicePorts(match)
+
+		// Get the list of our ports
+		portsWeHave := getSortedServicePorts(svc)
+
+		// Compare the two sorted lists
+		for i, port := range portsToMatch {
+			if portsWeHave[i] != port {
+				// TODO should we just add another service with this port added
+				// to the name? We have to find out which port.
+				log.Warnf("%s service from %s not added: non-matching ports! (%v vs %v)",
+					state.ServiceName(svc), svc.Hostname, port, portsWeHave[i])
+				excluded(svc, "ports don't match the other instances")
+				return
+			}
+		}
+
+		// It was a match! Append to the list.
+		serviceMap[svcName] = append(serviceMap[svcName], svc)
+	}
+
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			// Another proxy's business, so not worth a mention
+			if !h.serves(state.ServiceName(svc)) {
+				return
+			}
+
+			if len(svc.Ports) < 1 {
+				excluded(svc, "no ports")
+				return
+			}
+
+			if _, ok := h.bindAddressFor(svc); !ok {
+				log.Warnf("%s service from %s not added: unknown bind address '%s'",
+					state.ServiceName(svc), svc.Hostname, svc.Metadata[BIND_METADATA])
+				excluded(svc, "unknown bind address")
+				return
+			}
+
+			if svc.Status == service.UNHEALTHY && h.panicMode(svc) {
+				unhealthy = append(unhealthy, svc)
+				return
+			}
+
+			// We only want things that are alive and healthy! Draining
+			// services stay too, but the template gives them no weight.
+			if !svc.IsAlive() && !svc.IsDraining(now) {
+				excluded(svc, strings.ToLower(svc.StatusString()))
+				return
+			}
+
+			if svc.IsAlive() {
+				healthy[state.ServiceName(svc)] = true
+			}
+			add(svc)
 		},
 	)
 
+	// Panic mode: when nothing is healthy, the unhealthy servers are
+	// better than no backend at all
+	panicking := make(map[string]bool)
+	for _, svc := range unhealthy {
+		svcName := state.ServiceName(svc)
+		if healthy[svcName] {
+			excluded(svc, strings.ToLower(svc.StatusString()))
+			continue
+		}
+
+		if !panicking[svcName] {
+			panicking[svcName] = true
+			panicked(svcName)
+		}
+		add(svc)
+	}
+
 	return serviceMap
 }
 
@@ -248,3 +1060,11 @@ func getSortedServicePorts(svc *service.Service) []string {
 	sort.Strings(portList)
 	return portList
 }
+
+// IPv6 literals need brackets in HAproxy when there's a port on the end
+func bracketIP(ip string) string {
+	if strings.Contains(ip, ":") && !strings.HasPrefix(ip, "[") {
+		return "[" + ip + "]"
+	}
+	return ip
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"regexp"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,8 +29,8 @@ func Test_HAproxy(t *testing.T) {
 		svcId4 := "deadbeef999"
 		baseTime := time.Now().UTC().Round(time.Second)
 
-		ports1 := []service.Port{service.Port{"tcp", 10450, 8080}, service.Port{"tcp", 10020, 9000}}
-		ports2 := []service.Port{service.Port{"tcp", 9999, 8090}}
+		ports1 := []service.Port{service.Port{Type: "tcp", Port: 10450, ServicePort: 8080}, service.Port{Type: "tcp", Port: 10020, ServicePort: 9000}}
+		ports2 := []service.Port{service.Port{Type: "tcp", Port: 9999, ServicePort: 8090}}
 
 		services := []service.Service{
 			service.Service{
@@ -83,6 +84,7 @@ func Test_HAproxy(t *testing.T) {
 			So([]byte(p.ReloadCmd), ShouldMatch, "^haproxy .*")
 			So([]byte(p.VerifyCmd), ShouldMatch, "^haproxy .*")
 			So([]byte(p.Template), ShouldMatch, "views/haproxy.cfg")
+			So(p.ReloadDebounce, ShouldEqual, DEFAULT_RELOAD_DEBOUNCE)
 		})
 
 		Convey("makePortmap() generates a properly formatted list", func() {
@@ -109,21 +111,46 @@ func Test_HAproxy(t *testing.T) {
 				Image:    "some-svc",
 				Hostname: "titanic",
 				Updated:  baseTime.Add(5 * time.Second),
-				Ports:    []service.Port{service.Port{"tcp", 666, 6666}},
+				Ports:    []service.Port{service.Port{Type: "tcp", Port: 666, ServicePort: 6666}},
 			}
 
 			svcName := state.ServiceName(&badSvc)
 			// It had 1 before
-			svcList := servicesWithPorts(state)
+			svcList := proxy.servicesWithPorts(state)
 			So(len(svcList[svcName]), ShouldEqual, 1)
 
 			// We add an entry with mismatching ports and should get no more added
 			state.AddServiceEntry(badSvc)
 
-			svcList = servicesWithPorts(state)
+			svcList = proxy.servicesWithPorts(state)
 			So(len(svcList[svcName]), ShouldEqual, 1)
 		})
 
+		Convey("servicesWithPorts() only has the services this proxy serves", func() {
+			all := proxy.servicesWithPorts(state)
+			So(len(all), ShouldEqual, 2)
+
+			proxy.Include = []string{"*-svc"}
+			proxy.Exclude = []string{"some-*"}
+
+			svcList := proxy.servicesWithPorts(state)
+			So(len(svcList), ShouldEqual, 1)
+			So(svcList["awesome-svc"], ShouldResemble, all["awesome-svc"])
+
+			proxy.Include = []string{"some-svc"}
+			proxy.Exclude = nil
+
+			svcList = proxy.servicesWithPorts(state)
+			So(len(svcList), ShouldEqual, 1)
+			So(svcList["some-svc"], ShouldResemble, all["some-svc"])
+
+			Convey("And doesn't list the others as left out", func() {
+				for _, excluded := range proxy.Backends(state).Excluded {
+					So(excluded.Service, ShouldEqual, "some-svc")
+				}
+			})
+		})
+
 		Convey("WriteConfig() writes a template from a file", func() {
 			buf := bytes.NewBuffer(make([]byte, 0, 2048))
 			proxy.WriteConfig(state, buf)
@@ -136,7 +163,86 @@ func Test_HAproxy(t *testing.T) {
 			So(output, ShouldMatch, "bind 192.168.168.168:9000")
 			So(output, ShouldMatch, "frontend some-svc-8090")
 			So(output, ShouldMatch, "backend some-svc-8090")
-			So(output, ShouldMatch, "server indefatigable-deadbeef105 indefatigable:9999 cookie indefatigable-9999")
+			So(output, ShouldMatch, "server indefatigable-deadbeef105 indefatigable:9999 \n")
+			So(output, ShouldMatch, "server indefatigable-deadbeef101 indefatigable:10450 cookie indefatigable-10450")
+		})
+
+		Convey("WriteConfig() terminates TLS on ports with a cert", func() {
+			proxy.TLSCerts = map[string]string{"8080": "/etc/ssl/awesome.pem"}
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			output := buf.Bytes()
+			So(output, ShouldMatch, "bind 192.168.168.168:8080 ssl crt /etc/ssl/awesome.pem\n")
+			So(output, ShouldMatch, "bind 192.168.168.168:9000\n")
+		})
+
+		Convey("WriteConfig() labels each port with its name", func() {
+			svc := services[0]
+			svc.Updated = baseTime.Add(10 * time.Second)
+			svc.Ports = []service.Port{
+				{Type: "tcp", Port: 10450, ServicePort: 8080, Name: "api"},
+				{Type: "tcp", Port: 10020, ServicePort: 9000, Name: "metrics"},
+			}
+			state.AddServiceEntry(svc)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, "# ----------- awesome-svc port 8080 (api) --------------\nfrontend awesome-svc-8080\n")
+			So(output, ShouldContainSubstring, "# ----------- awesome-svc port 9000 (metrics) --------------\nfrontend awesome-svc-9000\n")
+			So(output, ShouldContainSubstring, "# ----------- some-svc port 8090 --------------\n")
+		})
+
+		Convey("WriteConfig() brackets an IPv6 bind address", func() {
+			proxy.BindIP = "fd00::10"
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			So(buf.String(), ShouldContainSubstring, "bind [fd00::10]:9000\n")
+		})
+
+		Convey("bracketIP() leaves IPv4 and bracketed addresses alone", func() {
+			So(bracketIP("192.168.168.168"), ShouldEqual, "192.168.168.168")
+			So(bracketIP("[fd00::10]"), ShouldEqual, "[fd00::10]")
+			So(bracketIP("fd00::10"), ShouldEqual, "[fd00::10]")
+		})
+
+		Convey("WriteConfig() makes service metadata available to templates", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+
+			proxy.Template = tmpDir + "/metadata.cfg"
+			ioutil.WriteFile(proxy.Template, []byte(
+				`{{ range .Services }}{{ range . }}{{ .ID }}={{ index .Metadata "canary" }} {{ end }}{{ end }}`,
+			), 0644)
+
+			canary := services[2]
+			canary.Metadata = map[string]string{"canary": "true"}
+			canary.Updated = baseTime.Add(10 * time.Second)
+			state.AddServiceEntry(canary)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			So(buf.String(), ShouldContainSubstring, "deadbeef105=true")
+		})
+
+		Convey("WriteConfig() writes weights for services that have one", func() {
+			canary := services[2]
+			canary.Weight = 5
+			canary.Updated = baseTime.Add(10 * time.Second)
+			state.AddServiceEntry(canary)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			output := buf.Bytes()
+			So(output, ShouldMatch, "server indefatigable-deadbeef105 indefatigable:9999 weight 5 \n")
+			So(output, ShouldMatch, "server indefatigable-deadbeef101 indefatigable:10450 cookie indefatigable-10450 \n")
 		})
 
 		Convey("WriteConfig() only writes out healthy services", func() {
@@ -147,7 +253,7 @@ func Test_HAproxy(t *testing.T) {
 				Hostname: "titanic",
 				Status:   service.UNHEALTHY,
 				Updated:  baseTime.Add(5 * time.Second),
-				Ports:    []service.Port{service.Port{"tcp", 666, 6666}},
+				Ports:    []service.Port{service.Port{Type: "tcp", Port: 666, ServicePort: 6666}},
 			}
 			badSvc2 := service.Service{
 				ID:       "0000bad00001",
@@ -156,7 +262,7 @@ func Test_HAproxy(t *testing.T) {
 				Hostname: "titanic",
 				Status:   service.UNKNOWN,
 				Updated:  baseTime.Add(5 * time.Second),
-				Ports:    []service.Port{service.Port{"tcp", 666, 6666}},
+				Ports:    []service.Port{service.Port{Type: "tcp", Port: 666, ServicePort: 6666}},
 			}
 			state.AddServiceEntry(badSvc)
 			state.AddServiceEntry(badSvc2)
@@ -170,6 +276,25 @@ func Test_HAproxy(t *testing.T) {
 			So(output, ShouldNotMatch, "0000bad00001")
 		})
 
+		Convey("WriteConfig() keeps draining services with no weight", func() {
+			draining := services[2]
+			draining.Metadata = map[string]string{service.DRAIN_GRACE_METADATA: "1m"}
+			draining.Weight = 5
+			draining.Status = service.TOMBSTONE
+			draining.Updated = baseTime.Add(10 * time.Second)
+			state.AddServiceEntry(draining)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+			So(buf.Bytes(), ShouldMatch, "server indefatigable-deadbeef105 indefatigable:9999 weight 0 \n")
+
+			// Gone once the grace runs out
+			state.Servers[hostname2].Services[svcId3].Updated = time.Now().UTC().Add(-2 * time.Minute)
+			buf.Reset()
+			proxy.WriteConfig(state, buf)
+			So(buf.Bytes(), ShouldNotMatch, "deadbeef105")
+		})
+
 		Convey("Reload() doesn't return an error when it works", func() {
 			proxy.ReloadCmd = "/usr/bin/true"
 			err := proxy.Reload()
@@ -186,15 +311,115 @@ func Test_HAproxy(t *testing.T) {
 			So(err.Error(), ShouldEqual, "exit status 127")
 		})
 
-		Convey("sanitizeName() fixes crazy image names", func() {
-			image := "public/something-longish:latest"
-			So(sanitizeName(image), ShouldEqual, "public-something-longish-latest")
+		Convey("Holding off when reloads keep failing", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			ioutil.WriteFile(proxy.ConfigFile, []byte("the last good config"), 0644)
+			proxy.VerifyCmd = "false"
+			proxy.ReloadCmd = "true"
+			proxy.FailureThreshold = 2
+			proxy.FailureBackoff = time.Minute
+
+			proxy.WriteAndReload(state)
+			So(proxy.Failing(), ShouldBeFalse)
+			So(proxy.HoldingOff(), ShouldEqual, 0)
+
+			proxy.WriteAndReload(state)
+			So(proxy.Failing(), ShouldBeTrue)
+			So(proxy.HoldingOff(), ShouldBeBetween, 59*time.Second, time.Minute+time.Second)
+
+			Convey("Keeps the last good config", func() {
+				result, _ := ioutil.ReadFile(proxy.ConfigFile)
+				So(string(result), ShouldEqual, "the last good config")
+			})
+
+			Convey("Doesn't try again while holding off", func() {
+				proxy.VerifyCmd = "true"
+				proxy.WriteAndReload(state)
+				So(proxy.Failing(), ShouldBeTrue)
+				So(proxy.Loaded(), ShouldBeFalse)
+			})
+
+			Convey("Holds off for longer each time", func() {
+				proxy.retryAfter = time.Time{}
+				proxy.WriteAndReload(state)
+				So(proxy.HoldingOff(), ShouldBeGreaterThan, 119*time.Second)
+
+				proxy.failures = 100
+				proxy.reloadFailed()
+				So(proxy.HoldingOff(), ShouldBeLessThanOrEqualTo, MAX_FAILURE_BACKOFF)
+			})
+
+			Convey("Starts afresh once a reload works", func() {
+				proxy.retryAfter = time.Time{}
+				proxy.VerifyCmd = "true"
+				proxy.WriteAndReload(state)
+
+				So(proxy.Failing(), ShouldBeFalse)
+				So(proxy.HoldingOff(), ShouldEqual, 0)
+				So(proxy.Loaded(), ShouldBeTrue)
+			})
+		})
+
+		Convey("Puts the config back when the reload fails", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			ioutil.WriteFile(proxy.ConfigFile, []byte("the last good config"), 0644)
+			proxy.VerifyCmd = "true"
+			proxy.ReloadCmd = "false"
+
+			proxy.WriteAndReload(state)
+
+			result, _ := ioutil.ReadFile(proxy.ConfigFile)
+			So(string(result), ShouldEqual, "the last good config")
+		})
+
+		Convey("Seamless reloads", func() {
+			proxy.ConfigFile = "/etc/haproxy.cfg"
+			proxy.PidFile = "/var/run/haproxy.pid"
+			proxy.StatsSocket = "/var/run/haproxy_stats.sock"
+
+			Convey("Use the plain ReloadCmd when not enabled", func() {
+				proxy.ReloadCmd = "/usr/bin/true"
+				So(proxy.reloadCommand(), ShouldEqual, "/usr/bin/true")
+			})
+
+			Convey("Use the plain ReloadCmd without a stats socket", func() {
+				proxy.SocketReload = true
+				proxy.StatsSocket = ""
+				So(proxy.reloadCommand(), ShouldEqual, proxy.ReloadCmd)
+			})
+
+			Convey("Pass the sockets and old pids when enabled", func() {
+				proxy.SocketReload = true
+				cmd := proxy.reloadCommand()
+
+				So(cmd, ShouldStartWith, "haproxy -f /etc/haproxy.cfg -p /var/run/haproxy.pid ")
+				So(cmd, ShouldContainSubstring, `[[ -S /var/run/haproxy_stats.sock ]] && echo "-x /var/run/haproxy_stats.sock"`)
+				So(cmd, ShouldContainSubstring, `echo "-sf $(cat /var/run/haproxy.pid)"`)
+			})
+
+			Convey("Expose the listeners on the stats socket", func() {
+				buf := bytes.NewBuffer(make([]byte, 0, 2048))
+				proxy.WriteConfig(state, buf)
+				So(buf.String(), ShouldNotContainSubstring, "expose-fd listeners")
+
+				proxy.SocketReload = true
+				buf.Reset()
+				proxy.WriteConfig(state, buf)
+				So(buf.String(), ShouldContainSubstring, "level admin expose-fd listeners\n")
+			})
 		})
 
 		Convey("Watch() writes out a config when the state changes", func() {
 			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
 			config := fmt.Sprintf("%s/haproxy.cfg", tmpDir)
 			proxy.ConfigFile = config
+			proxy.ReloadDebounce = time.Millisecond
 
 			go proxy.Watch(state)
 			newTime := time.Now().UTC()
@@ -205,7 +430,7 @@ func Test_HAproxy(t *testing.T) {
 				Image:    "some-svc",
 				Hostname: hostname2,
 				Updated:  newTime,
-				Ports:    []service.Port{service.Port{"tcp", 1337, 8090}},
+				Ports:    []service.Port{service.Port{Type: "tcp", Port: 1337, ServicePort: 8090}},
 			}
 			time.Sleep(5 * time.Millisecond)
 			state.AddServiceEntry(svc)
@@ -217,6 +442,137 @@ func Test_HAproxy(t *testing.T) {
 			os.Remove(config)
 			os.Remove(tmpDir)
 		})
+
+		Convey("Watch() batches up changes into one reload", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+
+			// Count the reloads by appending to a file
+			reloads := fmt.Sprintf("%s/reloads", tmpDir)
+			proxy.ConfigFile = fmt.Sprintf("%s/haproxy.cfg", tmpDir)
+			proxy.VerifyCmd = "true"
+			proxy.ReloadCmd = "echo >> " + reloads
+			proxy.ReloadDebounce = 50 * time.Millisecond
+
+			go proxy.Watch(state)
+			time.Sleep(5 * time.Millisecond)
+
+			newTime := time.Now().UTC()
+			for i := 0; i < 5; i++ {
+				svc := service.Service{
+					ID:       fmt.Sprintf("abcdef12312%d", i),
+					Name:     "some-svc-befede6789a",
+					Image:    "some-svc",
+					Hostname: hostname2,
+					Updated:  newTime,
+					Ports:    []service.Port{service.Port{Type: "tcp", Port: 1337, ServicePort: 8090}},
+				}
+				state.AddServiceEntry(svc)
+			}
+
+			// Nothing happens until the window is over
+			_, err := os.Stat(reloads)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			time.Sleep(100 * time.Millisecond)
+
+			result, _ := ioutil.ReadFile(reloads)
+			So(len(result), ShouldEqual, 1)
+
+			config, _ := ioutil.ReadFile(proxy.ConfigFile)
+			So(config, ShouldMatch, "abcdef123124")
+		})
+
+		Convey("Watch() holds off updates while paused", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+
+			proxy.ConfigFile = fmt.Sprintf("%s/haproxy.cfg", tmpDir)
+			proxy.ReloadDebounce = time.Millisecond
+
+			var paused int32 = 1
+			proxy.Paused = func() bool { return atomic.LoadInt32(&paused) == 1 }
+
+			go proxy.Watch(state)
+			time.Sleep(5 * time.Millisecond)
+
+			state.AddServiceEntry(service.Service{
+				ID:       "abcdef123123125",
+				Name:     "some-svc-befede6789a",
+				Image:    "some-svc",
+				Hostname: hostname2,
+				Updated:  time.Now().UTC(),
+				Ports:    []service.Port{service.Port{Type: "tcp", Port: 1337, ServicePort: 8090}},
+			})
+			time.Sleep(10 * time.Millisecond)
+
+			_, err := os.Stat(proxy.ConfigFile)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			atomic.StoreInt32(&paused, 0)
+			time.Sleep(10 * time.Millisecond)
+
+			config, _ := ioutil.ReadFile(proxy.ConfigFile)
+			So(config, ShouldMatch, "port 8090")
+		})
+
+		Convey("WriteAndReload() only reloads when the config changed", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+
+			reloads := fmt.Sprintf("%s/reloads", tmpDir)
+			proxy.ConfigFile = fmt.Sprintf("%s/haproxy.cfg", tmpDir)
+			proxy.VerifyCmd = "true"
+			proxy.ReloadCmd = "echo >> " + reloads
+
+			countReloads := func() int {
+				result, _ := ioutil.ReadFile(reloads)
+				return len(result)
+			}
+
+			Convey("always writes the first time", func() {
+				So(proxy.Loaded(), ShouldBeFalse)
+				proxy.WriteAndReload(state)
+				So(countReloads(), ShouldEqual, 1)
+				So(proxy.Loaded(), ShouldBeTrue)
+			})
+
+			Convey("skips the reload when nothing changed", func() {
+				proxy.WriteAndReload(state)
+				proxy.WriteAndReload(state)
+				So(countReloads(), ShouldEqual, 1)
+			})
+
+			Convey("reloads again when the services change", func() {
+				proxy.WriteAndReload(state)
+
+				svc := services[0]
+				svc.Updated = baseTime.Add(10 * time.Second)
+				svc.Ports = []service.Port{service.Port{Type: "tcp", Port: 1337, ServicePort: 8090}}
+				state.AddServiceEntry(svc)
+				proxy.WriteAndReload(state)
+
+				So(countReloads(), ShouldEqual, 2)
+			})
+
+			Convey("reloads again when the settings change", func() {
+				proxy.WriteAndReload(state)
+				proxy.BindIP = "10.0.0.1"
+				proxy.WriteAndReload(state)
+
+				So(countReloads(), ShouldEqual, 2)
+			})
+
+			Convey("retries after a failed reload", func() {
+				proxy.ReloadCmd = "false"
+				proxy.WriteAndReload(state)
+				So(proxy.Loaded(), ShouldBeFalse)
+
+				proxy.ReloadCmd = "echo >> " + reloads
+				proxy.WriteAndReload(state)
+				So(countReloads(), ShouldEqual, 1)
+			})
+		})
 	})
 }
 
@@ -245,3 +601,1017 @@ func ShouldNotMatch(actual interface{}, expected ...interface{}) string {
 
 	return ""
 }
+
+func Test_WriteConfigGolden(t *testing.T) {
+	Convey("WriteConfig() renders mixed tcp and http services", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-adfffed1233",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "mysql-1234fed1233",
+				Image:     "mysql",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Ports:     []service.Port{{Type: "tcp", Port: 13306, ServicePort: 3306}},
+			},
+			{
+				ID:       "deadbeef105",
+				Name:     "api-0123456789a",
+				Image:    "api",
+				Hostname: hostname3,
+				Updated:  baseTime,
+				// No ProxyMode, should default to http
+				Ports: []service.Port{{Type: "tcp", Port: 10020, ServicePort: 9000}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-mixed.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigStickyGolden(t *testing.T) {
+	Convey("WriteConfig() renders sticky and non-sticky services together", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-adfffed1233",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime.Add(-time.Second), // Keeps the servers in order
+				ProxyMode: "http",
+				Sticky:    true,
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef124",
+				Name:      "web-bdfffed1233",
+				Image:     "web",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Sticky:    true,
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:           "deadbeef101",
+				Name:         "shop-1234fed1233",
+				Image:        "shop",
+				Hostname:     hostname2,
+				Updated:      baseTime,
+				ProxyMode:    "http",
+				Sticky:       true,
+				StickyCookie: "SHOPSESSION",
+				Ports:        []service.Port{{Type: "tcp", Port: 10460, ServicePort: 8081}},
+			},
+			{
+				ID:       "deadbeef105",
+				Name:     "api-0123456789a",
+				Image:    "api",
+				Hostname: hostname3,
+				Updated:  baseTime,
+				Ports:    []service.Port{{Type: "tcp", Port: 10020, ServicePort: 9000}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-sticky.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigBalanceGolden(t *testing.T) {
+	Convey("WriteConfig() renders backends with different balance algorithms", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-adfffed1233",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata:  map[string]string{BALANCE_METADATA: "leastconn"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "db-1234fed1233",
+				Image:     "db",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Metadata:  map[string]string{BALANCE_METADATA: "source"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10460, ServicePort: 5432}},
+			},
+			{
+				ID:       "deadbeef105",
+				Name:     "api-0123456789a",
+				Image:    "api",
+				Hostname: hostname3,
+				Updated:  baseTime,
+				Metadata: map[string]string{BALANCE_METADATA: "roundrobin"},
+				Ports:    []service.Port{{Type: "tcp", Port: 10020, ServicePort: 9000}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-balance.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigProtoGolden(t *testing.T) {
+	Convey("WriteConfig() renders HTTP/2 and HTTP/1.1 backends together", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "grpc-adfffed1233",
+				Image:     "grpc",
+				Hostname:  hostname1,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata:  map[string]string{PROTO_METADATA: "h2c"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 9090}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "grpc-tls-1234fed1233",
+				Image:     "grpc-tls",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata:  map[string]string{PROTO_METADATA: "h2"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10460, ServicePort: 443}},
+			},
+			{
+				ID:        "deadbeef105",
+				Name:      "web-0123456789a",
+				Image:     "web",
+				Hostname:  hostname3,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10020, ServicePort: 8080}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.TLSCerts = map[string]string{"443": "/etc/ssl/private/grpc.pem"}
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-proto.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigChecksGolden(t *testing.T) {
+	Convey("WriteConfig() renders HTTP and TCP health checks from metadata", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-0123456789a",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata: map[string]string{
+					CHECK_PATH_METADATA:   "/healthz",
+					CHECK_METHOD_METADATA: "HEAD",
+					CHECK_STATUS_METADATA: "204",
+					CHECK_INTER_METADATA:  "2s",
+					CHECK_RISE_METADATA:   "2",
+					CHECK_FALL_METADATA:   "3",
+				},
+				Ports: []service.Port{{Type: "tcp", Port: 10020, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "redis-1234fed1233",
+				Image:     "redis",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Metadata:  map[string]string{CHECK_INTER_METADATA: "500ms"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10460, ServicePort: 6379}},
+			},
+			{
+				ID:        "deadbeef105",
+				Name:      "api-adfffed1233",
+				Image:     "api",
+				Hostname:  hostname3,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 9000}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-checks.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigBindsGolden(t *testing.T) {
+	Convey("WriteConfig() binds internal services to the internal address", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "admin-0123456789a",
+				Image:     "admin",
+				Hostname:  hostname1,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata:  map[string]string{BIND_METADATA: "internal"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10020, ServicePort: 8081}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "web-1234fed1233",
+				Image:     "web",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10460, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef105",
+				Name:      "metrics-adfffed1233",
+				Image:     "metrics",
+				Hostname:  hostname3,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Metadata:  map[string]string{BIND_METADATA: "internal6"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 9100}},
+			},
+			{
+				ID:        "deadbeef106",
+				Name:      "secret-adfffed1233",
+				Image:     "secret",
+				Hostname:  hostname3,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata:  map[string]string{BIND_METADATA: "nowhere"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10470, ServicePort: 9200}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.BindAddresses = map[string]string{"internal": "10.0.0.1", "internal6": "fd00::1"}
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-binds.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_getProtos(t *testing.T) {
+	Convey("getProtos()", t, func() {
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		add := func(id string, name string, mode string, proto string) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Image: name, Hostname: hostname1, Updated: baseTime,
+				ProxyMode: mode, Metadata: map[string]string{PROTO_METADATA: proto},
+			})
+		}
+
+		add("deadbeef001", "grpc", "http", "h2")
+		add("deadbeef002", "grpc-plain", "http", "h2c")
+		add("deadbeef003", "quic", "http", "h3")
+		add("deadbeef004", "db", "tcp", "h2")
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef005", Name: "web", Image: "web", Hostname: hostname1, Updated: baseTime,
+		})
+
+		So(getProtos(state), ShouldResemble, map[string]string{"grpc": "h2", "grpc-plain": "h2"})
+	})
+}
+
+func Test_getBalances(t *testing.T) {
+	Convey("getBalances()", t, func() {
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef123", Name: "web", Image: "web", Hostname: hostname1, Updated: baseTime,
+			Metadata: map[string]string{BALANCE_METADATA: "leastconn"},
+		})
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef101", Name: "db", Image: "db", Hostname: hostname1, Updated: baseTime,
+			Metadata: map[string]string{BALANCE_METADATA: "fastest"},
+		})
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef105", Name: "api", Image: "api", Hostname: hostname1, Updated: baseTime,
+		})
+
+		Convey("only has the services that picked a valid algorithm", func() {
+			So(getBalances(state), ShouldResemble, map[string]string{"web": "leastconn"})
+		})
+
+		Convey("uses the configured default for the rest", func() {
+			proxy := New("tmpConfig", "tmpPid")
+			proxy.Template = "../views/haproxy.cfg"
+			proxy.Balance = "leastconn"
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			So(buf.String(), ShouldContainSubstring, "balance  leastconn")
+			So(buf.String(), ShouldNotContainSubstring, "\tbalance leastconn")
+		})
+	})
+}
+
+func Test_getCounts(t *testing.T) {
+	Convey("Counting instances for the template", t, func() {
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC().Round(time.Second)
+		ports := []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}}
+
+		add := func(id string, name string, status int, metadata map[string]string) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Image: name, Hostname: hostname1, Updated: baseTime,
+				Ports: ports, Status: status, Metadata: metadata,
+			})
+		}
+
+		add("deadbeef001", "web", service.ALIVE, nil)
+		add("deadbeef002", "web", service.UNHEALTHY, nil)
+		add("deadbeef003", "web", service.TOMBSTONE, map[string]string{service.DRAIN_GRACE_METADATA: "1m"})
+		add("deadbeef004", "web", service.TOMBSTONE, nil)
+		add("deadbeef005", "db", service.UNHEALTHY, nil)
+		add("deadbeef006", "db", service.UNKNOWN, nil)
+
+		Convey("getCounts() counts total, healthy and draining instances", func() {
+			counts := getCounts(state, baseTime)
+
+			So(counts["web"], ShouldResemble, &instanceCounts{TotalCount: 3, HealthyCount: 1, DrainingCount: 1})
+		})
+
+		Convey("getCounts() includes services with nothing healthy", func() {
+			counts := getCounts(state, baseTime)
+
+			So(counts["db"], ShouldResemble, &instanceCounts{TotalCount: 2})
+		})
+
+		Convey("getCounts() stops counting draining instances when the grace is up", func() {
+			counts := getCounts(state, baseTime.Add(2*time.Minute))
+
+			So(counts["web"], ShouldResemble, &instanceCounts{TotalCount: 2, HealthyCount: 1})
+		})
+
+		Convey("the counts are available in the template", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+
+			proxy := New("tmpConfig", "tmpPid")
+			proxy.Template = fmt.Sprintf("%s/haproxy.cfg", tmpDir)
+			ioutil.WriteFile(proxy.Template, []byte(
+				`{{ range $name, $c := .Counts }}{{ $name }} {{ $c.HealthyCount }}/{{ $c.TotalCount }} {{ $c.DrainingCount }}
+{{ end }}{{ with getCounts "web" }}web {{ .HealthyCount }}{{ end }}
+{{ with getCounts "missing" }}missing {{ .HealthyCount }}/{{ .TotalCount }}{{ end }}`,
+			), 0644)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.writeConfig(state, buf, baseTime)
+
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldEqual, "db 0/2 0\nweb 1/3 1\nweb 1\nmissing 0/0")
+		})
+	})
+}
+
+func Test_PanicMode(t *testing.T) {
+	Convey("Panic mode", t, func() {
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC().Round(time.Second)
+		ports := []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}}
+
+		add := func(id string, hostname string, status int, updated time.Time) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: "web", Image: "web", Hostname: hostname, Updated: updated,
+				Ports: ports, Status: status,
+			})
+		}
+
+		add("deadbeef001", hostname1, service.ALIVE, baseTime)
+		add("deadbeef002", hostname2, service.ALIVE, baseTime)
+
+		proxy := New("tmpConfig", "tmpPid")
+
+		// Every instance starts failing its health checks
+		failAll := func() {
+			add("deadbeef001", hostname1, service.UNHEALTHY, baseTime.Add(time.Second))
+			add("deadbeef002", hostname2, service.UNHEALTHY, baseTime.Add(time.Second))
+		}
+
+		Convey("is off by default, and the backend goes away", func() {
+			So(len(proxy.servicesWithPorts(state)["web"]), ShouldEqual, 2)
+
+			failAll()
+
+			So(proxy.servicesWithPorts(state), ShouldBeEmpty)
+		})
+
+		Convey("keeps the unhealthy servers when nothing is healthy", func() {
+			proxy.PanicMode = true
+			failAll()
+
+			services := proxy.servicesWithPorts(state)
+			So(len(services["web"]), ShouldEqual, 2)
+			So(services["web"][0].ID, ShouldEqual, "deadbeef002")
+			So(services["web"][1].ID, ShouldEqual, "deadbeef001")
+		})
+
+		Convey("only kicks in when nothing is healthy", func() {
+			proxy.PanicMode = true
+			add("deadbeef001", hostname1, service.UNHEALTHY, baseTime.Add(time.Second))
+
+			services := proxy.servicesWithPorts(state)
+			So(len(services["web"]), ShouldEqual, 1)
+			So(services["web"][0].ID, ShouldEqual, "deadbeef002")
+		})
+
+		Convey("doesn't keep servers that are gone", func() {
+			proxy.PanicMode = true
+			add("deadbeef001", hostname1, service.UNHEALTHY, baseTime.Add(time.Second))
+			add("deadbeef002", hostname2, service.TOMBSTONE, baseTime.Add(time.Second))
+
+			services := proxy.servicesWithPorts(state)
+			So(len(services["web"]), ShouldEqual, 1)
+			So(services["web"][0].ID, ShouldEqual, "deadbeef001")
+		})
+
+		Convey("can be turned on and off by metadata", func() {
+			proxy.PanicMode = true
+			So(proxy.panicMode(&service.Service{}), ShouldBeTrue)
+			So(proxy.panicMode(&service.Service{Metadata: map[string]string{PANIC_METADATA: "false"}}), ShouldBeFalse)
+
+			proxy.PanicMode = false
+			So(proxy.panicMode(&service.Service{}), ShouldBeFalse)
+			So(proxy.panicMode(&service.Service{Metadata: map[string]string{PANIC_METADATA: "true"}}), ShouldBeTrue)
+		})
+
+		Convey("keeps the servers in the config", func() {
+			proxy.Template = "../views/haproxy.cfg"
+			proxy.PanicMode = true
+			failAll()
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			So(buf.String(), ShouldContainSubstring, "backend web-8080")
+			So(buf.String(), ShouldContainSubstring, "server indomitable-deadbeef001 indomitable:10450")
+			So(buf.String(), ShouldContainSubstring, "server indefatigable-deadbeef002 indefatigable:10450")
+		})
+	})
+}
+
+func Test_Environments(t *testing.T) {
+	Convey("The same service in two environments", t, func() {
+		state := catalog.NewServicesState()
+		now := time.Now().UTC()
+
+		add := func(id, hostname, env string, servicePort int64) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: "api", Image: "api", Hostname: hostname, Updated: now, Status: service.ALIVE,
+				Ports:    []service.Port{{Type: "tcp", Port: 10450, ServicePort: servicePort}},
+				Metadata: map[string]string{service.ENVIRONMENT_METADATA: env},
+			})
+		}
+		add("deadbeef001", hostname1, "a", 8080)
+		add("deadbeef002", hostname2, "b", 8081)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.Template = "../views/haproxy.cfg"
+
+		Convey("gets a backend for each", func() {
+			services := proxy.servicesWithPorts(state)
+			So(len(services), ShouldEqual, 2)
+			So(services["a-api"][0].ID, ShouldEqual, "deadbeef001")
+			So(services["b-api"][0].ID, ShouldEqual, "deadbeef002")
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+
+			So(buf.String(), ShouldContainSubstring, "backend a-api-8080")
+			So(buf.String(), ShouldContainSubstring, "backend b-api-8081")
+			So(buf.String(), ShouldNotContainSubstring, "backend api-")
+		})
+	})
+}
+
+func Test_routesFor(t *testing.T) {
+	Convey("routesFor()", t, func() {
+		proxy := New("tmpConfig", "tmpPid")
+		east := &service.Service{ID: "deadbeef123", Tags: map[string]string{"region": "us-east"}}
+		east2 := &service.Service{ID: "deadbeef124", Tags: map[string]string{"region": "US-East"}}
+		west := &service.Service{ID: "deadbeef125", Tags: map[string]string{"region": "eu-west"}}
+		plain := &service.Service{ID: "deadbeef126"}
+		svcList := []*service.Service{east, plain, west, east2}
+
+		Convey("Puts everything in the default route without a route tag", func() {
+			routes := proxy.routesFor(svcList, "http")
+			So(len(routes), ShouldEqual, 1)
+			So(routes[0].Value, ShouldEqual, "")
+			So(routes[0].Services, ShouldResemble, svcList)
+		})
+
+		Convey("Groups services by tag, sorted, after the default route", func() {
+			proxy.RouteTag = "region"
+			routes := proxy.routesFor(svcList, "http")
+
+			So(len(routes), ShouldEqual, 3)
+			So(routes[0].Services, ShouldResemble, []*service.Service{plain})
+			So(routes[1].Suffix, ShouldEqual, "eu-west")
+			So(routes[2].Suffix, ShouldEqual, "us-east")
+			So(routes[2].Services, ShouldResemble, []*service.Service{east, east2})
+		})
+
+		Convey("Always has a default route, even when it's empty", func() {
+			proxy.RouteTag = "region"
+			routes := proxy.routesFor([]*service.Service{west}, "http")
+			So(len(routes), ShouldEqual, 2)
+			So(routes[0].Services, ShouldBeEmpty)
+		})
+
+		Convey("Doesn't route TCP services", func() {
+			proxy.RouteTag = "region"
+			So(len(proxy.routesFor(svcList, "tcp")), ShouldEqual, 1)
+		})
+
+		Convey("Names the header after the tag unless told otherwise", func() {
+			proxy.RouteTag = "region"
+			So(proxy.routeHeader(), ShouldEqual, "X-Region")
+
+			proxy.RouteHeader = "X-Edge-Region"
+			So(proxy.routeHeader(), ShouldEqual, "X-Edge-Region")
+		})
+	})
+}
+
+func Test_WriteConfigRoutesGolden(t *testing.T) {
+	Convey("WriteConfig() routes services in two regions by tag", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-adfffed1233",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime.Add(-2 * time.Second), // Keeps the servers in order
+				ProxyMode: "http",
+				Tags:      map[string]string{"region": "us-east"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef124",
+				Name:      "web-bdfffed1233",
+				Image:     "web",
+				Hostname:  hostname2,
+				Updated:   baseTime.Add(-time.Second),
+				ProxyMode: "http",
+				Tags:      map[string]string{"region": "eu-west"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef125",
+				Name:      "web-cdfffed1233",
+				Image:     "web",
+				Hostname:  hostname3,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "mysql-1234fed1233",
+				Image:     "mysql",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Tags:      map[string]string{"region": "eu-west"},
+				Ports:     []service.Port{{Type: "tcp", Port: 13306, ServicePort: 3306}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.RouteTag = "region"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-routes.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigCanaryGolden(t *testing.T) {
+	Convey("WriteConfig() sends requests with the canary header to the canaries", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-adfffed1233",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime.Add(-2 * time.Second), // Keeps the servers in order
+				ProxyMode: "http",
+				Tags:      map[string]string{"region": "us-east"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef124",
+				Name:      "web-bdfffed1233",
+				Image:     "web",
+				Hostname:  hostname2,
+				Updated:   baseTime.Add(-time.Second),
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef125",
+				Name:      "web-cdfffed1233",
+				Image:     "web",
+				Hostname:  hostname3,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata:  map[string]string{CANARY_METADATA: "true"},
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				// No canaries, so everything goes to the stable backend
+				ID:        "deadbeef126",
+				Name:      "api-1234fed1233",
+				Image:     "api",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10470, ServicePort: 9000}},
+			},
+			{
+				// TCP can't be routed by header, so the canary stays put
+				ID:        "deadbeef101",
+				Name:      "mysql-1234fed1233",
+				Image:     "mysql",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Metadata:  map[string]string{CANARY_METADATA: "true"},
+				Ports:     []service.Port{{Type: "tcp", Port: 13306, ServicePort: 3306}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.RouteTag = "region"
+		proxy.CanaryHeader = "X-Canary"
+		proxy.CanaryValue = "always"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-canary.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_ValidateTemplate(t *testing.T) {
+	Convey("ValidateTemplate()", t, func() {
+		tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+		defer os.RemoveAll(tmpDir)
+
+		proxy := New("/tmp/haproxy.cfg", "/tmp/haproxy.pid")
+		proxy.Template = "../views/haproxy.cfg"
+
+		writeTemplate := func(contents string) {
+			proxy.Template = fmt.Sprintf("%s/haproxy.cfg", tmpDir)
+			ioutil.WriteFile(proxy.Template, []byte(contents), 0644)
+		}
+
+		Convey("Accepts the supplied template", func() {
+			So(proxy.ValidateTemplate(), ShouldBeNil)
+		})
+
+		Convey("Accepts the supplied template with routing", func() {
+			proxy.RouteTag = "region"
+			So(proxy.ValidateTemplate(), ShouldBeNil)
+		})
+
+		Convey("Fails when the template is missing", func() {
+			proxy.Template = fmt.Sprintf("%s/missing.cfg", tmpDir)
+			So(proxy.ValidateTemplate(), ShouldNotBeNil)
+		})
+
+		Convey("Fails when the template doesn't parse", func() {
+			writeTemplate("{{ range .Services }}")
+			So(proxy.ValidateTemplate(), ShouldNotBeNil)
+		})
+
+		Convey("Fails on an unknown function", func() {
+			writeTemplate("{{ getPortz }}")
+			So(proxy.ValidateTemplate(), ShouldNotBeNil)
+		})
+
+		Convey("Fails on an unknown service field", func() {
+			writeTemplate("{{ range $name, $svcs := .Services }}{{ range $svcs }}{{ .Hostnme }}{{ end }}{{ end }}")
+			err := proxy.ValidateTemplate()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Hostnme")
+		})
+
+		Convey("Fails on an unknown field in a routed backend", func() {
+			proxy.RouteTag = "region"
+			writeTemplate(`{{ range $name, $svcs := .Services }}{{ range getRoutes $name }}{{ if .Value }}{{ range .Services }}{{ .Regon }}{{ end }}{{ end }}{{ end }}{{ end }}`)
+			So(proxy.ValidateTemplate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_WriteConfigResolversGolden(t *testing.T) {
+	Convey("WriteConfig() has HAproxy resolve the servers when there are nameservers", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				ID:        "deadbeef123",
+				Name:      "web-adfffed1233",
+				Image:     "web",
+				Hostname:  hostname1,
+				Updated:   baseTime.Add(-time.Second), // Keeps the servers in order
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef124",
+				Name:      "web-bdfffed1233",
+				Image:     "web",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+			{
+				ID:        "deadbeef101",
+				Name:      "mysql-1234fed1233",
+				Image:     "mysql",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "tcp",
+				Ports:     []service.Port{{Type: "tcp", Port: 13306, ServicePort: 3306}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.Resolvers = Resolvers{
+			Nameservers:     []string{"10.0.0.2:53", "10.0.0.3:53"},
+			HostnamePattern: "{{ .Hostname }}.node.consul",
+			HoldValid:       10 * time.Second,
+			ResolveRetries:  3,
+			TimeoutRetry:    time.Second,
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-resolvers.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigTimeoutsGolden(t *testing.T) {
+	Convey("WriteConfig() overrides the timeouts for services that set them", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		services := []service.Service{
+			{
+				// Long polling, so it needs the connections kept open
+				ID:        "deadbeef123",
+				Name:      "events-adfffed1233",
+				Image:     "events",
+				Hostname:  hostname1,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Metadata: map[string]string{
+					TIMEOUT_CLIENT_METADATA:  "1h",
+					TIMEOUT_SERVER_METADATA:  "1h",
+					TIMEOUT_CONNECT_METADATA: "10s",
+				},
+				Ports: []service.Port{{Type: "tcp", Port: 10460, ServicePort: 8090}},
+			},
+			{
+				ID:        "deadbeef124",
+				Name:      "web-bdfffed1233",
+				Image:     "web",
+				Hostname:  hostname2,
+				Updated:   baseTime,
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+			},
+		}
+
+		for _, svc := range services {
+			state.AddServiceEntry(svc)
+		}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		// The timestamp changes every time
+		generated := regexp.MustCompile("(?m)^# Auto-generated.*$")
+		output := generated.ReplaceAllString(buf.String(), "# Auto-generated")
+
+		golden, err := ioutil.ReadFile("../fixtures/haproxy-timeouts.cfg")
+		So(err, ShouldBeNil)
+		So(output, ShouldEqual, string(golden))
+	})
+}
+
+func Test_WriteConfigServiceIP(t *testing.T) {
+	Convey("WriteConfig() sends traffic to a service's own IP when it has one", t, func() {
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:        "deadbeef123",
+			Name:      "web-adfffed1233",
+			Image:     "web",
+			Hostname:  hostname1,
+			IP:        "10.1.0.1", // Like a Kubernetes pod
+			ProxyMode: "http",
+			Ports:     []service.Port{{Type: "tcp", Port: 8080, ServicePort: 10100}},
+		})
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.Template = "../views/haproxy.cfg"
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		So(buf.String(), ShouldContainSubstring, "server indomitable-deadbeef123 10.1.0.1:8080 ")
+	})
+}
@@ -0,0 +1,105 @@
+package haproxy
+
+import (
+	"bytes"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/service"
+)
+
+const (
+	DEFAULT_RESOLVERS_NAME   = "sidecar"
+	DEFAULT_HOSTNAME_PATTERN = "{{ .Hostname }}"
+)
+
+// Have HAproxy look the servers up in DNS rather than writing in their
+// addresses, so their IPs can change without a reload. Only used when
+// there are Nameservers.
+type Resolvers struct {
+	Name        string   // The resolvers section, "sidecar" by default
+	Nameservers []string // Like "10.0.0.2:53"
+
+	// The DNS name for each server, a template given the service, like
+	// "{{ .Hostname }}.node.consul". Just the hostname by default.
+	HostnamePattern string
+
+	// How long HAproxy keeps using the last answer, how many times it asks
+	// before giving up, and how long it waits between tries. Zero leaves
+	// them to HAproxy.
+	HoldValid      time.Duration
+	ResolveRetries int
+	TimeoutRetry   time.Duration
+}
+
+func (r *Resolvers) Enabled() bool {
+	return len(r.Nameservers) > 0
+}
+
+func (r *Resolvers) SectionName() string {
+	if r.Name == "" {
+		return DEFAULT_RESOLVERS_NAME
+	}
+	return r.Name
+}
+
+// HAproxy durations without a unit are milliseconds
+func (r *Resolvers) HoldValidMs() int64    { return int64(r.HoldValid / time.Millisecond) }
+func (r *Resolvers) TimeoutRetryMs() int64 { return int64(r.TimeoutRetry / time.Millisecond) }
+
+// Returns a func for the template that gives the address to write for each
+// server: its address, or its DNS name when HAproxy resolves them.
+func (r *Resolvers) serverAddressFunc() (func(*service.Service) (string, error), error) {
+	if !r.Enabled() {
+		return func(svc *service.Service) (string, error) { return svc.Address(), nil }, nil
+	}
+
+	pattern := r.HostnamePattern
+	if pattern == "" {
+		pattern = DEFAULT_HOSTNAME_PATTERN
+	}
+
+	t, err := template.New("hostname_pattern").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(svc *service.Service) (string, error) {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, svc)
+		return buf.String(), err
+	}, nil
+}
+
+// The same addresses for the runtime API and /backends. A pattern that
+// doesn't work fails the template first, so there's no config to match,
+// and these fall back to the service's address with a warning.
+func (r *Resolvers) addressFunc() func(*service.Service) string {
+	serverAddress, err := r.serverAddressFunc()
+	if err != nil {
+		log.Warnf("Invalid hostname_pattern '%s': %s", r.HostnamePattern, err.Error())
+		serverAddress = nil
+	}
+
+	return func(svc *service.Service) string {
+		if serverAddress == nil {
+			return svc.Address()
+		}
+
+		address, err := serverAddress(svc)
+		if err != nil {
+			log.Warnf("Invalid hostname_pattern '%s' for %s: %s", r.HostnamePattern, svc.ID, err.Error())
+			return svc.Address()
+		}
+		return address
+	}
+}
+
+// The resolvers options on each server line, empty without nameservers
+func (r *Resolvers) serverOptions() string {
+	if !r.Enabled() {
+		return ""
+	}
+	return "resolvers " + r.SectionName() + " init-addr libc,none"
+}
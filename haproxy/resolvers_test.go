@@ -0,0 +1,53 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_serverAddressFunc(t *testing.T) {
+	Convey("serverAddressFunc()", t, func() {
+		svc := &service.Service{ID: "deadbeef123", Name: "web", Hostname: "indomitable"}
+		resolvers := Resolvers{}
+
+		Convey("Writes in the hostname without any nameservers", func() {
+			resolvers.HostnamePattern = "{{ .Hostname }}.node.consul"
+			address, err := resolvers.serverAddressFunc()
+			So(err, ShouldBeNil)
+
+			name, err := address(svc)
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "indomitable")
+		})
+
+		Convey("Renders the hostname pattern for each service", func() {
+			resolvers.Nameservers = []string{"10.0.0.2:53"}
+			resolvers.HostnamePattern = "{{ .Hostname }}.node.consul"
+			address, err := resolvers.serverAddressFunc()
+			So(err, ShouldBeNil)
+
+			name, err := address(svc)
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "indomitable.node.consul")
+		})
+
+		Convey("Uses the hostname when there's no pattern", func() {
+			resolvers.Nameservers = []string{"10.0.0.2:53"}
+			address, _ := resolvers.serverAddressFunc()
+
+			name, err := address(svc)
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "indomitable")
+			So(resolvers.SectionName(), ShouldEqual, DEFAULT_RESOLVERS_NAME)
+		})
+
+		Convey("Returns an error for a bad pattern", func() {
+			resolvers.Nameservers = []string{"10.0.0.2:53"}
+			resolvers.HostnamePattern = "{{ .Hostname"
+			_, err := resolvers.serverAddressFunc()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
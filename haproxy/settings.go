@@ -0,0 +1,156 @@
+package haproxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// Merge settings from the config into a section of the rendered config,
+// like "global". A setting replaces every line in the section that starts
+// with its key, so "timeout connect" replaces just that timeout, while
+// "log" replaces all the log lines. Settings the template doesn't have are
+// added at the end of the section. Each line of a value is a directive of
+// its own, so there can be more than one log target. If the template has
+// no such section, it's added ahead of the first proxy.
+func mergeSettings(config string, section string, settings map[string]string) string {
+	if len(settings) == 0 {
+		return config
+	}
+
+	var merged []string
+	var used map[string]bool
+	inSection, found := false, false
+
+	// The comments and blank lines at the end of a section belong to
+	// whatever comes next, so the new settings go above them
+	finishSection := func() {
+		end := len(merged)
+		for end > 0 && isTrailer(merged[end-1]) {
+			end--
+		}
+		tail := append([]string{}, merged[end:]...)
+		merged = append(merged[:end], unusedSettings(settings, used)...)
+		merged = append(merged, tail...)
+		inSection = false
+	}
+
+	for _, line := range strings.Split(config, "\n") {
+		if keyword := sectionKeyword(line); keyword != "" {
+			if inSection {
+				finishSection()
+			}
+
+			if keyword == section {
+				inSection, found = true, true
+				used = make(map[string]bool, len(settings))
+			} else if !found && keyword != "global" && keyword != "defaults" {
+				merged = append(merged, section)
+				merged = append(merged, unusedSettings(settings, nil)...)
+				merged = append(merged, "")
+				found = true
+			}
+
+			merged = append(merged, line)
+			continue
+		}
+
+		if inSection {
+			if key := settingKey(line, settings); key != "" {
+				if !used[key] {
+					merged = append(merged, directives(key, settings[key])...)
+					used[key] = true
+				}
+				continue
+			}
+		}
+
+		merged = append(merged, line)
+	}
+
+	if inSection {
+		finishSection()
+	}
+
+	if !found {
+		merged = append(merged, section)
+		merged = append(merged, unusedSettings(settings, nil)...)
+		merged = append(merged, "")
+	}
+
+	return strings.Join(merged, "\n")
+}
+
+// Sections start in the first column, directives are indented
+func sectionKeyword(line string) string {
+	if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+		return ""
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func isTrailer(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// The setting that a directive is for, empty if none of them. When more
+// than one matches, the longest key wins.
+func settingKey(line string, settings map[string]string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return ""
+	}
+
+	var found string
+	var foundLen int
+	for key := range settings {
+		keyFields := strings.Fields(key)
+		if len(keyFields) == 0 || len(keyFields) > len(fields) || len(keyFields) <= foundLen {
+			continue
+		}
+
+		if strings.Join(fields[:len(keyFields)], " ") == strings.Join(keyFields, " ") {
+			found, foundLen = key, len(keyFields)
+		}
+	}
+
+	return found
+}
+
+// The settings that haven't been used yet, sorted by key
+func unusedSettings(settings map[string]string, used map[string]bool) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		if !used[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, directives(key, settings[key])...)
+	}
+	return lines
+}
+
+// One directive for each line of the value. An empty value is just the
+// key, for flags like "daemon".
+func directives(key string, value string) []string {
+	var lines []string
+	for _, arg := range strings.Split(value, "\n") {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			lines = append(lines, "\t"+strings.TrimSpace(key)+" "+arg)
+		}
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, "\t"+strings.TrimSpace(key))
+	}
+	return lines
+}
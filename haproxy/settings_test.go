@@ -0,0 +1,113 @@
+package haproxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/newrelic/sidecar/catalog"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_mergeSettings(t *testing.T) {
+	Convey("mergeSettings()", t, func() {
+		rendered := `# Header
+global
+	daemon
+	maxconn 4096
+	log     127.0.0.1 local0
+	log     127.0.0.1 local1 notice
+
+defaults
+	maxconn  4096
+	timeout  connect 5s
+	timeout  client  1m
+
+# -------------- STATS --------------
+frontend stats
+	maxconn 10
+`
+
+		Convey("Leaves the config alone without any settings", func() {
+			So(mergeSettings(rendered, "global", nil), ShouldEqual, rendered)
+		})
+
+		Convey("Replaces the template's settings in place, and adds the rest", func() {
+			merged := mergeSettings(rendered, "global", map[string]string{
+				"maxconn":                  "8192",
+				"log":                      "10.0.0.1:514 local0\n10.0.0.2:514 local0",
+				"ssl-default-bind-ciphers": "ECDHE-RSA-AES128-GCM-SHA256",
+			})
+
+			So(merged, ShouldEqual, `# Header
+global
+	daemon
+	maxconn 8192
+	log 10.0.0.1:514 local0
+	log 10.0.0.2:514 local0
+	ssl-default-bind-ciphers ECDHE-RSA-AES128-GCM-SHA256
+
+defaults
+	maxconn  4096
+	timeout  connect 5s
+	timeout  client  1m
+
+# -------------- STATS --------------
+frontend stats
+	maxconn 10
+`)
+		})
+
+		Convey("Matches multi-word keys, ahead of the other sections' comments", func() {
+			merged := mergeSettings(rendered, "defaults", map[string]string{
+				"timeout connect": "10s",
+				"option httplog":  "",
+			})
+
+			So(merged, ShouldEqual, `# Header
+global
+	daemon
+	maxconn 4096
+	log     127.0.0.1 local0
+	log     127.0.0.1 local1 notice
+
+defaults
+	maxconn  4096
+	timeout connect 10s
+	timeout  client  1m
+	option httplog
+
+# -------------- STATS --------------
+frontend stats
+	maxconn 10
+`)
+		})
+
+		Convey("Adds the section ahead of the proxies when the template has none", func() {
+			merged := mergeSettings("global\n\tdaemon\n\nfrontend stats\n", "defaults", map[string]string{
+				"maxconn": "100",
+			})
+
+			So(merged, ShouldEqual, "global\n\tdaemon\n\ndefaults\n\tmaxconn 100\n\nfrontend stats\n")
+		})
+	})
+}
+
+func Test_WriteConfigSettings(t *testing.T) {
+	Convey("WriteConfig() merges the settings into the template", t, func() {
+		state := catalog.NewServicesState()
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.GlobalSettings = map[string]string{"maxconn": "8192"}
+		proxy.DefaultsSettings = map[string]string{"timeout connect": "10s"}
+
+		buf := bytes.NewBuffer(make([]byte, 0, 2048))
+		proxy.WriteConfig(state, buf)
+
+		So(buf.String(), ShouldContainSubstring, "global\n\tdaemon")
+		So(buf.String(), ShouldContainSubstring, "\tmaxconn 8192\n")
+		So(buf.String(), ShouldContainSubstring, "\tmaxconn  4096\n") // The defaults keep theirs
+		So(buf.String(), ShouldContainSubstring, "\ttimeout connect 10s\n")
+		So(buf.String(), ShouldNotContainSubstring, "timeout  connect 5s")
+	})
+}
@@ -0,0 +1,348 @@
+package haproxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+)
+
+const (
+	SOCKET_TIMEOUT = 2 * time.Second
+)
+
+var ErrNeedsReload = errors.New("HAproxy config has changed and needs a reload")
+
+// A server line in a backend, as the template writes it
+type backendServer struct {
+	addr      string
+	resolvers string // The resolvers options, when HAproxy looks it up
+	cookie    string // The server's cookie value, for HTTP servers
+	weight    int    // Zero when it's left to HAproxy
+	draining  bool   // Tombstoned but inside its drain grace, so weight 0
+	proto     string // "h2" for HTTP/2 servers
+	check     string // The health check options, if it has one
+}
+
+// The server options for "add server", the same as in the template
+func (s backendServer) options() string {
+	var options string
+	if s.resolvers != "" {
+		options = " " + s.resolvers
+	}
+
+	if s.cookie != "" {
+		options += " cookie " + s.cookie
+	}
+
+	if s.draining {
+		options += " weight 0"
+	} else if s.weight != 0 {
+		options += fmt.Sprintf(" weight %d", s.weight)
+	}
+
+	if s.proto != "" {
+		options += " proto " + s.proto
+	}
+
+	if s.check != "" {
+		options += " " + s.check
+	}
+
+	return options
+}
+
+// The weight to set at runtime. No weight means the default of 1.
+func (s backendServer) runtimeWeight() int {
+	switch {
+	case s.draining:
+		return 0
+	case s.weight == 0:
+		return 1
+	default:
+		return s.weight
+	}
+}
+
+// The servers in each backend, keyed by backend name and then server name.
+// Mirrors what the template writes.
+type serverMap map[string]map[string]backendServer
+
+// How many servers there are across all the backends
+func (s serverMap) count() int {
+	total := 0
+	for _, servers := range s {
+		total += len(servers)
+	}
+	return total
+}
+
+// The settings of a backend that can only be changed with a reload
+type backendConfig struct {
+	mode    string
+	cookie  string // Empty unless it has sticky sessions
+	balance string // Empty unless it picked its own
+	proto   string // Empty unless it speaks HTTP/2
+	check   healthCheck
+	bind    string // Empty unless it picked one of the BindAddresses
+	// The service's own timeouts. The client one is on the frontend, but
+	// that's reloaded with its backends anyway.
+	timeouts timeouts
+}
+
+// What we last told HAproxy about, so we can work out what changed
+type runtimeState struct {
+	backends map[string]backendConfig // Settings of each backend
+	servers  serverMap                // Every server HAproxy knows about
+	ready    serverMap                // The servers that are in service
+}
+
+// One backend, as the template writes it
+type backend struct {
+	name    string
+	svcName string
+	svcPort string // Where the frontend listens
+	port    string // Where each of the servers listens
+	route   *route
+	config  backendConfig
+}
+
+// Work out the backends in the same way as the template does, sorted by name
+func (h *HAproxy) backends(state *catalog.ServicesState, services map[string][]*service.Service) []*backend {
+	ports := h.makePortmap(services)
+	modes := getModes(state)
+	cookies := getStickyCookies(state)
+	balances := getBalances(state)
+	protos := getProtos(state)
+	checks := getHealthChecks(state)
+	serviceTimeouts := getTimeouts(state)
+	binds := h.getBinds(state)
+
+	var backends []*backend
+	for svcName, svcList := range services {
+		routes := h.routesFor(svcList, modes[svcName])
+
+		var check healthCheck
+		if checks[svcName] != nil {
+			check = *checks[svcName]
+		}
+
+		var svcTimeouts timeouts
+		if serviceTimeouts[svcName] != nil {
+			svcTimeouts = *serviceTimeouts[svcName]
+		}
+
+		// Like getBalance in the template, the default isn't written out
+		balance := balances[svcName]
+		if balance == h.Balance {
+			balance = ""
+		}
+
+		for svcPort, port := range ports[svcName] {
+			for _, route := range routes {
+				name := service.SanitizeName(svcName) + "-" + svcPort
+				if route.Suffix != "" {
+					name += "-" + route.Suffix
+				}
+
+				backends = append(backends, &backend{
+					name:    name,
+					svcName: svcName,
+					svcPort: svcPort,
+					port:    port,
+					route:   route,
+					config: backendConfig{
+						mode: modes[svcName], cookie: cookies[svcName], balance: balance, proto: protos[svcName],
+						check: check, bind: binds[svcName], timeouts: svcTimeouts,
+					},
+				})
+			}
+		}
+	}
+
+	sort.Slice(backends, func(i, j int) bool { return backends[i].name < backends[j].name })
+
+	return backends
+}
+
+// Build the backends and their servers in the same way as the template does
+func (h *HAproxy) backendServers(state *catalog.ServicesState) (serverMap, map[string]backendConfig) {
+	servers := make(serverMap)
+	backends := make(map[string]backendConfig)
+	serverAddress := h.Resolvers.addressFunc()
+	resolvers := h.Resolvers.serverOptions()
+
+	for _, backend := range h.backends(state, h.servicesWithPorts(state)) {
+		backends[backend.name] = backend.config
+		servers[backend.name] = make(map[string]backendServer, len(backend.route.Services))
+
+		var check string
+		if backend.config.check != (healthCheck{}) {
+			check = backend.config.check.ServerOptions()
+		}
+
+		for _, svc := range backend.route.Services {
+			var cookie string
+			if backend.config.mode == "http" {
+				cookie = svc.Hostname + "-" + backend.port
+			}
+
+			servers[backend.name][svc.Hostname+"-"+svc.ID] = backendServer{
+				addr:      serverAddress(svc) + ":" + backend.port,
+				resolvers: resolvers,
+				cookie:    cookie,
+				weight:    svc.Weight,
+				draining:  svc.IsTombstone(),
+				proto:     backend.config.proto,
+				check:     check,
+			}
+		}
+	}
+
+	return servers, backends
+}
+
+// Remember what we just loaded into HAproxy with a full reload
+func (h *HAproxy) recordReload(servers serverMap, backends map[string]backendConfig) {
+	h.runtime = &runtimeState{
+		backends: backends,
+		servers:  servers.copy(),
+		ready:    servers.copy(),
+	}
+}
+
+// UpdateViaSocket pushes server changes to HAproxy over the stats socket
+// (the runtime API) rather than rewriting the config and reloading. Servers
+// that went away are put into maintenance, and new ones are added. Anything
+// else, like a new frontend or a mode, cookie or balance change, returns
+// ErrNeedsReload and leaves HAproxy alone. Weight changes are applied in
+// place.
+func (h *HAproxy) UpdateViaSocket(state *catalog.ServicesState) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.StatsSocket == "" || h.runtime == nil {
+		return ErrNeedsReload
+	}
+
+	servers, backends := h.backendServers(state)
+
+	if len(backends) != len(h.runtime.backends) {
+		return ErrNeedsReload
+	}
+	for backend, config := range backends {
+		if oldConfig, ok := h.runtime.backends[backend]; !ok || oldConfig != config {
+			return ErrNeedsReload
+		}
+	}
+
+	var commands []string
+
+	for backend, backendServers := range servers {
+		for server, current := range backendServers {
+			old, known := h.runtime.servers[backend][server]
+			if known && old.addr != current.addr {
+				return ErrNeedsReload
+			}
+
+			if !known {
+				commands = append(commands,
+					fmt.Sprintf("add server %s/%s %s%s", backend, server, current.addr, current.options()),
+				)
+				// Checks on added servers are off until we turn them on
+				if current.check != "" {
+					commands = append(commands, fmt.Sprintf("enable health %s/%s", backend, server))
+				}
+			} else if old.runtimeWeight() != current.runtimeWeight() {
+				commands = append(commands,
+					fmt.Sprintf("set weight %s/%s %d", backend, server, current.runtimeWeight()),
+				)
+			}
+
+			if _, ok := h.runtime.ready[backend][server]; !ok {
+				commands = append(commands, fmt.Sprintf("set server %s/%s state ready", backend, server))
+			}
+		}
+	}
+
+	for backend, backendServers := range h.runtime.ready {
+		for server := range backendServers {
+			if _, ok := servers[backend][server]; !ok {
+				commands = append(commands, fmt.Sprintf("set server %s/%s state maint", backend, server))
+			}
+		}
+	}
+
+	for _, command := range commands {
+		if err := h.socketCommand(command); err != nil {
+			// We don't know what state HAproxy is in now
+			h.runtime = nil
+			h.lastConfig = nil
+			return err
+		}
+	}
+
+	for backend, backendServers := range servers {
+		for server, current := range backendServers {
+			h.runtime.servers[backend][server] = current
+		}
+	}
+	h.runtime.ready = servers.copy()
+
+	if len(commands) > 0 {
+		log.WithField("event", "socket_update").
+			Infof("Updated HAproxy via the stats socket (%d commands)", len(commands))
+		// HAproxy isn't running the config file any more
+		h.lastConfig = nil
+	}
+
+	return nil
+}
+
+// Send a single command to the HAproxy runtime API. Successful commands
+// either print nothing or confirm a new server.
+func (h *HAproxy) socketCommand(command string) error {
+	conn, err := net.DialTimeout("unix", h.StatsSocket, SOCKET_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(SOCKET_TIMEOUT))
+
+	_, err = conn.Write([]byte(command + "\n"))
+	if err != nil {
+		return err
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+
+	output := strings.TrimSpace(string(response))
+	if output != "" && !strings.HasPrefix(output, "New server registered") {
+		return fmt.Errorf("HAproxy rejected '%s': %s", command, output)
+	}
+
+	return nil
+}
+
+func (s serverMap) copy() serverMap {
+	result := make(serverMap, len(s))
+	for backend, servers := range s {
+		result[backend] = make(map[string]backendServer, len(servers))
+		for server, current := range servers {
+			result[backend][server] = current
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,393 @@
+package haproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A fake HAproxy runtime API that records the commands it gets
+type fakeRuntimeSocket struct {
+	Path     string
+	Commands []string
+	Response string
+	listener net.Listener
+	sync.Mutex
+}
+
+func newFakeRuntimeSocket(dir string) *fakeRuntimeSocket {
+	socketPath := path.Join(dir, "haproxy.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		panic(err)
+	}
+
+	fake := &fakeRuntimeSocket{Path: socketPath, listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			fake.Lock()
+			fake.Commands = append(fake.Commands, strings.TrimSpace(line))
+			response := fake.Response
+			fake.Unlock()
+
+			conn.Write([]byte(response))
+			conn.Close()
+		}
+	}()
+
+	return fake
+}
+
+func (f *fakeRuntimeSocket) SortedCommands() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	commands := make([]string, len(f.Commands))
+	copy(commands, f.Commands)
+	sort.Strings(commands)
+
+	return commands
+}
+
+func Test_UpdateViaSocket(t *testing.T) {
+	Convey("Updating HAproxy via the stats socket", t, func() {
+		tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+		defer os.RemoveAll(tmpDir)
+
+		fake := newFakeRuntimeSocket(tmpDir)
+		defer fake.listener.Close()
+
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		svc1 := service.Service{
+			ID:        "deadbeef123",
+			Name:      "awesome-svc-adfffed1233",
+			Image:     "awesome-svc",
+			Hostname:  hostname1,
+			Updated:   baseTime,
+			ProxyMode: "http",
+			Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080}},
+		}
+		svc2 := svc1
+		svc2.ID = "deadbeef101"
+		svc2.Hostname = hostname2
+
+		state.AddServiceEntry(svc1)
+
+		proxy := New(path.Join(tmpDir, "haproxy.cfg"), path.Join(tmpDir, "haproxy.pid"))
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.ReloadCmd = "true"
+		proxy.VerifyCmd = "true"
+		proxy.StatsSocket = fake.Path
+
+		Convey("needs a reload before anything has been loaded", func() {
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("needs a reload when there's no socket configured", func() {
+			proxy.StatsSocket = ""
+			proxy.WriteAndReload(state)
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("does nothing when nothing changed", func() {
+			proxy.WriteAndReload(state)
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(len(fake.SortedCommands()), ShouldEqual, 0)
+		})
+
+		Convey("adds new servers to existing backends", func() {
+			proxy.WriteAndReload(state)
+			fake.Response = "New server registered.\n"
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(fake.SortedCommands(), ShouldResemble, []string{
+				"add server awesome-svc-8080/indefatigable-deadbeef101 indefatigable:10450 cookie indefatigable-10450",
+				"set server awesome-svc-8080/indefatigable-deadbeef101 state ready",
+			})
+		})
+
+		Convey("adds TCP servers without a cookie", func() {
+			svc1.ProxyMode = "tcp"
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+			proxy.WriteAndReload(state)
+			fake.Response = "New server registered.\n"
+			svc2.ProxyMode = "tcp"
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(fake.SortedCommands()[0], ShouldEqual,
+				"add server awesome-svc-8080/indefatigable-deadbeef101 indefatigable:10450",
+			)
+		})
+
+		Convey("adds new servers with their weight", func() {
+			proxy.WriteAndReload(state)
+			fake.Response = "New server registered.\n"
+			svc2.Weight = 5
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(fake.SortedCommands()[0], ShouldEqual,
+				"add server awesome-svc-8080/indefatigable-deadbeef101 indefatigable:10450 cookie indefatigable-10450 weight 5",
+			)
+		})
+
+		Convey("adds servers by their resolver name when HAproxy looks them up", func() {
+			proxy.Resolvers = Resolvers{
+				Nameservers:     []string{"10.0.0.2:53"},
+				HostnamePattern: "{{ .Hostname }}.node.consul",
+			}
+			proxy.WriteAndReload(state)
+			fake.Response = "New server registered.\n"
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(fake.SortedCommands()[0], ShouldEqual,
+				"add server awesome-svc-8080/indefatigable-deadbeef101 indefatigable.node.consul:10450 resolvers sidecar init-addr libc,none cookie indefatigable-10450",
+			)
+		})
+
+		Convey("adds HTTP/2 servers with their proto", func() {
+			svc1.Metadata = map[string]string{PROTO_METADATA: "h2"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+			proxy.WriteAndReload(state)
+			fake.Response = "New server registered.\n"
+			svc2.Metadata = svc1.Metadata
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(fake.SortedCommands()[0], ShouldEqual,
+				"add server awesome-svc-8080/indefatigable-deadbeef101 indefatigable:10450 cookie indefatigable-10450 proto h2",
+			)
+		})
+
+		Convey("needs a reload when a service starts speaking HTTP/2", func() {
+			proxy.WriteAndReload(state)
+
+			svc1.Metadata = map[string]string{PROTO_METADATA: "h2"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("adds servers with their health check and turns it on", func() {
+			svc1.Metadata = map[string]string{CHECK_PATH_METADATA: "/healthz", CHECK_INTER_METADATA: "2s"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+			proxy.WriteAndReload(state)
+			fake.Response = "New server registered.\n"
+			svc2.Metadata = svc1.Metadata
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(fake.SortedCommands(), ShouldResemble, []string{
+				"add server awesome-svc-8080/indefatigable-deadbeef101 indefatigable:10450 cookie indefatigable-10450 check inter 2s",
+				"enable health awesome-svc-8080/indefatigable-deadbeef101",
+				"set server awesome-svc-8080/indefatigable-deadbeef101 state ready",
+			})
+		})
+
+		Convey("needs a reload when a service's health check changes", func() {
+			proxy.WriteAndReload(state)
+
+			svc1.Metadata = map[string]string{CHECK_PATH_METADATA: "/healthz"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("needs a reload when a service moves to another bind address", func() {
+			proxy.BindAddresses = map[string]string{"internal": "10.0.0.1"}
+			proxy.WriteAndReload(state)
+
+			svc1.Metadata = map[string]string{BIND_METADATA: "internal"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("changes server weights in place", func() {
+			state.AddServiceEntry(svc2)
+			proxy.WriteAndReload(state)
+
+			svc2.Weight = 5
+			svc2.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc2)
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+
+			svc2.Weight = 0
+			svc2.Updated = baseTime.Add(2 * time.Second)
+			state.AddServiceEntry(svc2)
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+
+			So(fake.SortedCommands(), ShouldResemble, []string{
+				"set weight awesome-svc-8080/indefatigable-deadbeef101 1",
+				"set weight awesome-svc-8080/indefatigable-deadbeef101 5",
+			})
+		})
+
+		Convey("drains servers that are tombstoned with a drain grace", func() {
+			svc2.Metadata = map[string]string{service.DRAIN_GRACE_METADATA: "1m"}
+			state.AddServiceEntry(svc2)
+			proxy.WriteAndReload(state)
+
+			svc2.Status = service.TOMBSTONE
+			svc2.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc2)
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+
+			So(fake.SortedCommands(), ShouldResemble, []string{
+				"set weight awesome-svc-8080/indefatigable-deadbeef101 0",
+			})
+		})
+
+		Convey("puts servers that went away into maintenance, and back", func() {
+			state.AddServiceEntry(svc2)
+			proxy.WriteAndReload(state)
+
+			svc2.Status = service.UNHEALTHY
+			svc2.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc2)
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+
+			svc2.Status = service.ALIVE
+			svc2.Updated = baseTime.Add(2 * time.Second)
+			state.AddServiceEntry(svc2)
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+
+			So(fake.SortedCommands(), ShouldResemble, []string{
+				"set server awesome-svc-8080/indefatigable-deadbeef101 state maint",
+				"set server awesome-svc-8080/indefatigable-deadbeef101 state ready",
+			})
+		})
+
+		Convey("needs a reload when there's a new frontend", func() {
+			proxy.WriteAndReload(state)
+
+			svc3 := svc1
+			svc3.ID = "deadbeef105"
+			svc3.Name = "some-svc-0123456789a"
+			svc3.Image = "some-svc"
+			svc3.Ports = []service.Port{{Type: "tcp", Port: 9999, ServicePort: 8090}}
+			state.AddServiceEntry(svc3)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+			So(len(fake.SortedCommands()), ShouldEqual, 0)
+		})
+
+		Convey("needs a reload when the mode changes", func() {
+			proxy.WriteAndReload(state)
+
+			svc1.ProxyMode = "tcp"
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("adds routed servers to their route's backend", func() {
+			proxy.RouteTag = "region"
+			svc1.Tags = map[string]string{"region": "us-east"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+			proxy.WriteAndReload(state)
+			fake.Response = "New server registered.\n"
+
+			svc2.Tags = map[string]string{"region": "us-east"}
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+			So(fake.SortedCommands(), ShouldResemble, []string{
+				"add server awesome-svc-8080-us-east/indefatigable-deadbeef101 indefatigable:10450 cookie indefatigable-10450",
+				"set server awesome-svc-8080-us-east/indefatigable-deadbeef101 state ready",
+			})
+		})
+
+		Convey("needs a reload when there's a new route", func() {
+			proxy.RouteTag = "region"
+			proxy.WriteAndReload(state)
+
+			svc2.Tags = map[string]string{"region": "eu-west"}
+			state.AddServiceEntry(svc2)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("needs a reload when a service's balance changes", func() {
+			proxy.WriteAndReload(state)
+
+			svc1.Metadata = map[string]string{BALANCE_METADATA: "leastconn"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("needs a reload when a service's timeouts change", func() {
+			svc1.Metadata = map[string]string{TIMEOUT_SERVER_METADATA: "1h"}
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+			proxy.WriteAndReload(state)
+			So(proxy.UpdateViaSocket(state), ShouldBeNil)
+
+			svc1.Metadata = map[string]string{TIMEOUT_SERVER_METADATA: "1h", TIMEOUT_CLIENT_METADATA: "1h"}
+			svc1.Updated = baseTime.Add(2 * time.Second)
+			state.AddServiceEntry(svc1)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("needs a reload when a service becomes sticky", func() {
+			proxy.WriteAndReload(state)
+
+			svc1.Sticky = true
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("returns errors from HAproxy and forgets its state", func() {
+			proxy.WriteAndReload(state)
+			fake.Response = "No such backend.\n"
+			state.AddServiceEntry(svc2)
+
+			err := proxy.UpdateViaSocket(state)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "No such backend.")
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+
+		Convey("doesn't record a reload that failed", func() {
+			proxy.ReloadCmd = "false"
+			proxy.WriteAndReload(state)
+			So(proxy.UpdateViaSocket(state), ShouldEqual, ErrNeedsReload)
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package haproxy
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+)
+
+// Metadata overriding the template's timeouts for one service, like "1h"
+// for long polling. HAproxy only uses the client timeout on the frontend,
+// so that's where it goes. The others go on the backends.
+const (
+	TIMEOUT_CLIENT_METADATA  = "timeout_client"
+	TIMEOUT_SERVER_METADATA  = "timeout_server"
+	TIMEOUT_CONNECT_METADATA = "timeout_connect"
+)
+
+// A service's timeouts, in HAproxy's format. Empty ones keep the defaults.
+type timeouts struct {
+	Client  string
+	Server  string
+	Connect string
+}
+
+// Read a service's timeouts from its metadata. Returns nil if it doesn't
+// set any. Like the health checks, ones HAproxy wouldn't take are left out
+// with a warning.
+func timeoutsFor(svc *service.Service) *timeouts {
+	var result timeouts
+
+	timeout := func(key string) string {
+		value, ok := svc.Metadata[key]
+		if !ok {
+			return ""
+		}
+
+		if !checkTimeRegexp.MatchString(value) {
+			log.Warnf("Invalid %s '%s' for %s, ignoring it", key, value, svc.ID)
+			return ""
+		}
+		return value
+	}
+
+	result.Client = timeout(TIMEOUT_CLIENT_METADATA)
+	result.Server = timeout(TIMEOUT_SERVER_METADATA)
+	result.Connect = timeout(TIMEOUT_CONNECT_METADATA)
+
+	if result == (timeouts{}) {
+		return nil
+	}
+	return &result
+}
+
+// The timeouts for each service that overrides any
+func getTimeouts(state *catalog.ServicesState) map[string]*timeouts {
+	timeoutMap := make(map[string]*timeouts)
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if t := timeoutsFor(svc); t != nil {
+				timeoutMap[state.ServiceName(svc)] = t
+			}
+		},
+	)
+	return timeoutMap
+}
@@ -0,0 +1,44 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_timeoutsFor(t *testing.T) {
+	Convey("timeoutsFor()", t, func() {
+		timeoutsOf := func(metadata map[string]string) *timeouts {
+			return timeoutsFor(&service.Service{ID: "deadbeef123", Metadata: metadata})
+		}
+
+		Convey("Returns nil without any timeout metadata", func() {
+			So(timeoutsOf(nil), ShouldBeNil)
+			So(timeoutsOf(map[string]string{BALANCE_METADATA: "leastconn"}), ShouldBeNil)
+		})
+
+		Convey("Reads the timeouts", func() {
+			So(timeoutsOf(map[string]string{
+				TIMEOUT_CLIENT_METADATA:  "1h",
+				TIMEOUT_SERVER_METADATA:  "90s",
+				TIMEOUT_CONNECT_METADATA: "500ms",
+			}), ShouldResemble, &timeouts{Client: "1h", Server: "90s", Connect: "500ms"})
+
+			So(timeoutsOf(map[string]string{TIMEOUT_SERVER_METADATA: "30000"}),
+				ShouldResemble, &timeouts{Server: "30000"})
+		})
+
+		Convey("Leaves out values HAproxy wouldn't take", func() {
+			So(timeoutsOf(map[string]string{
+				TIMEOUT_CLIENT_METADATA: "1m30s",
+				TIMEOUT_SERVER_METADATA: "forever",
+			}), ShouldBeNil)
+
+			So(timeoutsOf(map[string]string{
+				TIMEOUT_CLIENT_METADATA: "1h",
+				TIMEOUT_SERVER_METADATA: "-1s",
+			}), ShouldResemble, &timeouts{Client: "1h"})
+		})
+	})
+}
@@ -4,32 +4,344 @@
 package healthy
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DEFAULT_TCP_TIMEOUT     = 1 * time.Second
+	DEFAULT_UDP_TIMEOUT     = 1 * time.Second
+	MAX_UDP_REPLY           = 4096 // Bigger replies are cut short
+	MAX_HTTP_CHECK_BODY     = 4096
+	DEFAULT_COMMAND_TIMEOUT = HEALTH_INTERVAL
+	DEFAULT_HTTP_TIMEOUT    = HEALTH_INTERVAL
+	MAX_COMMAND_OUTPUT      = 4096            // How much command output we keep for the logs
+	COMMAND_WAIT_DELAY      = 1 * time.Second // How long we wait for output after a kill
 )
 
 // A Checker that makes an HTTP get call and expects to get
 // a 200-299 back as success. Anything else is considered
 // a failure. The URL to hit is passed as the args to the
-// Run method.
-type HttpGetCmd struct{}
+// Run method. The expected status codes can be changed, and
+// the body can be required to contain a string, see Expect(). Extra
+// headers and a Host header can be sent for name-based virtual hosts.
+// HTTPS URLs work too, see ConfigureTLS() for the options. Requests that
+// take longer than the Timeout, to connect or to send the whole response,
+// are SICKLY.
+type HttpGetCmd struct {
+	MinStatus int               // Lowest healthy status code, zero means 200
+	MaxStatus int               // Highest healthy status code, zero means 299
+	BodyMatch string            // If set, the body must contain this
+	Host      string            // If set, sent as the Host header
+	Headers   map[string]string // Any other headers to send
+	Client    *http.Client      // Only set when we need special TLS settings
+	Timeout   time.Duration     // Zero means DEFAULT_HTTP_TIMEOUT
+}
 
 func (h *HttpGetCmd) Run(args string) (int, error) {
-	resp, err := http.Get(args)
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_HTTP_TIMEOUT
+	}
+
+	// Covers connecting and reading the body. Canceling the request
+	// closes the connection, so a hung backend doesn't keep the socket.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", args, nil)
+	if err != nil {
+		return UNKNOWN, err
+	}
+
+	for name, value := range h.Headers {
+		// Go ignores a Host in the headers, it has to go on the request
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	if h.Host != "" {
+		req.Host = h.Host
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// Failed TLS handshakes end up here too, just like refused connections
+	resp, err := client.Do(req)
+	if ctx.Err() == context.DeadlineExceeded {
+		return SICKLY, timeoutError{"HTTP check", timeout}
+	}
 	if resp == nil {
 		return UNKNOWN, errors.New("No body from HTTP response!")
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+	if !h.statusMatches(resp.StatusCode) {
+		return SICKLY, err
+	}
+
+	if h.BodyMatch == "" {
 		return HEALTHY, nil
 	}
 
-	return SICKLY, err
+	// Only look at the start of the body, in case something is streaming
+	// us a huge response
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_HTTP_CHECK_BODY))
+	if ctx.Err() == context.DeadlineExceeded {
+		return SICKLY, timeoutError{"HTTP check", timeout}
+	}
+	if err != nil {
+		return UNKNOWN, err
+	}
+
+	if !strings.Contains(string(body), h.BodyMatch) {
+		log.Debugf("HTTP check body for %s doesn't contain '%s'", args, h.BodyMatch)
+		return SICKLY, nil
+	}
+
+	return HEALTHY, nil
+}
+
+// Expect configures the healthy status codes and body match. The status
+// is either a single code like "204" or a range like "200-399". Empty
+// values leave the defaults alone.
+func (h *HttpGetCmd) Expect(status string, body string) error {
+	h.BodyMatch = body
+
+	if status == "" {
+		return nil
+	}
+
+	parts := strings.SplitN(status, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return fmt.Errorf("Invalid expected status '%s'", status)
+	}
+
+	max := min
+	if len(parts) == 2 {
+		max, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || max < min {
+			return fmt.Errorf("Invalid expected status '%s'", status)
+		}
+	}
+
+	h.MinStatus, h.MaxStatus = min, max
+
+	return nil
+}
+
+// ConfigureTLS sets up how HTTPS checks talk to the service. The certificate
+// can be left unverified, or verified against a CA file rather than the
+// system roots. A client certificate and key can be given for mTLS. With
+// none of these, the defaults are used.
+func (h *HttpGetCmd) ConfigureTLS(skipVerify bool, caFile string, certFile string, keyFile string) error {
+	h.Client = nil
+	if !skipVerify && caFile == "" && certFile == "" && keyFile == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipVerify}
+
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("Can't read CA file: %s", err.Error())
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("No certificates found in CA file '%s'", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Can't load client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	h.Client = &http.Client{Transport: transport}
+
+	return nil
+}
+
+func (h *HttpGetCmd) statusMatches(code int) bool {
+	if h.MinStatus == 0 && h.MaxStatus == 0 {
+		return code >= 200 && code < 300
+	}
+
+	return code >= h.MinStatus && code <= h.MaxStatus
+}
+
+// A Checker that speaks the standard gRPC health checking protocol
+// (grpc.health.v1.Health/Check) over plaintext HTTP/2. A SERVING response
+// is healthy and anything else is SICKLY. The args are the address to
+// dial, optionally followed by the name of the gRPC service to check, e.g.
+// "localhost:9000" or "localhost:9000/my.package.Service".
+type GrpcGetCmd struct{}
+
+func (g *GrpcGetCmd) Run(args string) (int, error) {
+	address, serviceName := args, ""
+	if i := strings.Index(args, "/"); i >= 0 {
+		address, serviceName = args[:i], args[i+1:]
+	}
+
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return UNKNOWN, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_INTERVAL)
+	defer cancel()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(
+		ctx, &grpc_health_v1.HealthCheckRequest{Service: serviceName},
+	)
+	if err != nil {
+		// Like an HTTP check with no response, we don't know if it's healthy
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return UNKNOWN, err
+		default:
+			return SICKLY, err
+		}
+	}
+
+	if resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING {
+		return HEALTHY, nil
+	}
+
+	return SICKLY, nil
+}
+
+// A Checker that simply opens a TCP connection and considers the service
+// healthy if the connection succeeds. The args are the address to dial,
+// optionally followed by a timeout, e.g. "localhost:6379 500ms". The port
+// doesn't have to be the service's advertised port. Without a timeout,
+// DEFAULT_TCP_TIMEOUT is used.
+type TcpConnectCmd struct{}
+
+func (t *TcpConnectCmd) Run(args string) (int, error) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 {
+		return UNKNOWN, errors.New("No address to connect to!")
+	}
+
+	timeout := DEFAULT_TCP_TIMEOUT
+	if len(fields) > 1 {
+		var err error
+		timeout, err = time.ParseDuration(fields[1])
+		if err != nil {
+			return UNKNOWN, err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", fields[0], timeout)
+	if err != nil {
+		return SICKLY, err
+	}
+	conn.Close()
+
+	return HEALTHY, nil
+}
+
+// A Checker for services that only speak UDP. It sends a probe, the args
+// after the address, e.g. "localhost:8125 ping", or "localhost:8125" for
+// an empty one. A probe in double quotes can have Go escapes, like
+// "\x00\n". With WaitForReply, it's healthy when a reply comes back within
+// the Timeout, and contains ReplyMatch if that's set. Without, there's no
+// way to know if anyone heard it, so sending it is good enough.
+type UdpProbeCmd struct {
+	WaitForReply bool
+	ReplyMatch   string        // If set, the reply must contain this
+	Timeout      time.Duration // Zero means DEFAULT_UDP_TIMEOUT
+}
+
+func (u *UdpProbeCmd) Run(args string) (int, error) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if fields[0] == "" {
+		return UNKNOWN, errors.New("No address to send to!")
+	}
+
+	var probe string
+	if len(fields) > 1 {
+		probe = strings.TrimSpace(fields[1])
+		if strings.HasPrefix(probe, `"`) {
+			if unquoted, err := strconv.Unquote(probe); err == nil {
+				probe = unquoted
+			}
+		}
+	}
+
+	timeout := u.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_UDP_TIMEOUT
+	}
+
+	conn, err := net.DialTimeout("udp", fields[0], timeout)
+	if err != nil {
+		return UNKNOWN, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = conn.Write([]byte(probe))
+	if err != nil {
+		return SICKLY, err
+	}
+
+	if !u.WaitForReply {
+		return HEALTHY, nil
+	}
+
+	reply := make([]byte, MAX_UDP_REPLY)
+	n, err := conn.Read(reply)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return SICKLY, timeoutError{"UDP check", timeout}
+	}
+	if err != nil {
+		// Usually the port is closed and we got an ICMP error back
+		return SICKLY, err
+	}
+
+	if !strings.Contains(string(reply[:n]), u.ReplyMatch) {
+		log.Debugf("UDP check reply from %s doesn't contain '%s'", fields[0], u.ReplyMatch)
+		return SICKLY, nil
+	}
+
+	return HEALTHY, nil
 }
 
 // A Checker that works with Nagios checks or other simple
@@ -54,6 +366,100 @@ func (e *ExternalCmd) Run(args string) (int, error) {
 	return SICKLY, err
 }
 
+// A Checker that runs a local command, like a script that pokes at a
+// socket, and expects a 0 exit code. Like ExternalCmd, the command is the
+// args and is run without a shell. Commands that take longer than the
+// Timeout are killed and are SICKLY. The start of the output is logged
+// when the check fails.
+type CommandCheck struct {
+	Timeout time.Duration // Zero means DEFAULT_COMMAND_TIMEOUT
+}
+
+func (c *CommandCheck) Run(args string) (int, error) {
+	cliArgs := strings.Fields(args)
+	if len(cliArgs) < 1 {
+		return UNKNOWN, errors.New("No command to run!")
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_COMMAND_TIMEOUT
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The context kills the command when it times out, and Wait reaps it.
+	// WaitDelay stops us hanging on anything it left holding the output.
+	output := &boundedBuffer{limit: MAX_COMMAND_OUTPUT}
+	cmd := exec.CommandContext(ctx, cliArgs[0], cliArgs[1:]...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = COMMAND_WAIT_DELAY
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = timeoutError{"Command", timeout}
+	}
+
+	if err == nil {
+		return HEALTHY, nil
+	}
+
+	log.Errorf("Error running command: %s (%s)", err.Error(), output.String())
+	return SICKLY, err
+}
+
+// A Checker that trusts the health Docker reports for a container with a
+// HEALTHCHECK, rather than probing the service again. The args are the
+// service ID, and the health comes from the latest discovery.
+type DockerHealthCmd struct {
+	DiscoveryFn func() []service.Service
+}
+
+func (d *DockerHealthCmd) Run(args string) (int, error) {
+	var services []service.Service
+	if d.DiscoveryFn != nil {
+		services = d.DiscoveryFn()
+	}
+
+	for _, svc := range services {
+		if svc.ID != args {
+			continue
+		}
+
+		switch svc.DockerHealth {
+		case service.DOCKER_HEALTHY:
+			return HEALTHY, nil
+		case service.DOCKER_UNHEALTHY:
+			return SICKLY, errors.New("Docker reports the container is unhealthy")
+		default:
+			return UNKNOWN, fmt.Errorf("Docker health is '%s'", svc.DockerHealth)
+		}
+	}
+
+	return UNKNOWN, fmt.Errorf("No Docker health found for %s", args)
+}
+
+// Keeps the first part of what's written to it and quietly drops the rest,
+// so a chatty command can't fill up memory, or block on a full pipe.
+type boundedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
 // A Checker that always returns success. Usually used in
 // cases where a service can't actually be health checked for
 // some reason.
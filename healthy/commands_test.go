@@ -0,0 +1,586 @@
+package healthy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Start a real gRPC server with the standard health service
+func newGrpcHealthServer() (*grpc.Server, *health.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+
+	return server, healthServer, listener.Addr().String()
+}
+
+func Test_GrpcGetCmd(t *testing.T) {
+	Convey("GrpcGetCmd", t, func() {
+		server, healthServer, address := newGrpcHealthServer()
+		defer server.Stop()
+
+		healthServer.SetServingStatus("my.Serving", grpc_health_v1.HealthCheckResponse_SERVING)
+		healthServer.SetServingStatus("my.NotServing", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+		cmd := &GrpcGetCmd{}
+
+		Convey("is healthy when the server is SERVING", func() {
+			status, err := cmd.Run(address)
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("checks a named service", func() {
+			status, err := cmd.Run(address + "/my.Serving")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is sickly when the service is NOT_SERVING", func() {
+			status, err := cmd.Run(address + "/my.NotServing")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is sickly when the server returns an error", func() {
+			status, err := cmd.Run(address + "/my.Unknown")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is unknown when it can't connect", func() {
+			server.Stop()
+			status, err := cmd.Run(address)
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, UNKNOWN)
+		})
+
+		Convey("is selectable by name", func() {
+			monitor := NewMonitor(hostname, "/")
+			So(monitor.GetCommandNamed("GrpcGet"), ShouldResemble, &GrpcGetCmd{})
+		})
+	})
+}
+
+func Test_TcpConnectCmd(t *testing.T) {
+	Convey("TcpConnectCmd", t, func() {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer listener.Close()
+
+		address := listener.Addr().String()
+		cmd := &TcpConnectCmd{}
+
+		Convey("is healthy when the connection succeeds", func() {
+			status, err := cmd.Run(address)
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("accepts a timeout", func() {
+			status, err := cmd.Run(address + " 500ms")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is sickly when the connection is refused", func() {
+			listener.Close()
+			status, err := cmd.Run(address)
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is unknown when the args are bad", func() {
+			status, err := cmd.Run(address + " soon")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, UNKNOWN)
+
+			status, err = cmd.Run("")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, UNKNOWN)
+		})
+
+		Convey("fails the check after the normal threshold", func() {
+			listener.Close()
+			check := &Check{Args: address, Command: cmd, MaxCount: 2}
+
+			check.UpdateStatus(check.Command.Run(check.Args))
+			So(check.Status, ShouldNotEqual, FAILED)
+			check.UpdateStatus(check.Command.Run(check.Args))
+			So(check.Status, ShouldEqual, FAILED)
+		})
+
+		Convey("is selectable by name", func() {
+			monitor := NewMonitor(hostname, "/")
+			So(monitor.GetCommandNamed("TcpConnect"), ShouldResemble, &TcpConnectCmd{})
+		})
+	})
+}
+
+func Test_UdpProbeCmd(t *testing.T) {
+	Convey("UdpProbeCmd", t, func() {
+		// Echoes back what it gets, or "pong" for a "ping"
+		server, _ := net.ListenPacket("udp", "127.0.0.1:0")
+		defer server.Close()
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := server.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				reply := buf[:n]
+				if string(reply) == "ping" {
+					reply = []byte("pong")
+				}
+				server.WriteTo(reply, addr)
+			}
+		}()
+
+		address := server.LocalAddr().String()
+		cmd := &UdpProbeCmd{WaitForReply: true, Timeout: 200 * time.Millisecond}
+
+		Convey("is healthy when a reply comes back", func() {
+			status, err := cmd.Run(address + " ping")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("checks the reply when there's something to match", func() {
+			cmd.ReplyMatch = "pong"
+			status, err := cmd.Run(address + " ping")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+
+			status, _ = cmd.Run(address + " hello")
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("sends quoted probes with escapes", func() {
+			cmd.ReplyMatch = "a\nb"
+			status, err := cmd.Run(address + ` "a\nb"`)
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is sickly when nothing comes back in time", func() {
+			quiet, _ := net.ListenPacket("udp", "127.0.0.1:0")
+			defer quiet.Close()
+
+			status, err := cmd.Run(quiet.LocalAddr().String() + " ping")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "timed out")
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is sickly when the port is closed", func() {
+			server.Close()
+			status, err := cmd.Run(address + " ping")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is healthy once it's sent without waiting for a reply", func() {
+			quiet, _ := net.ListenPacket("udp", "127.0.0.1:0")
+			defer quiet.Close()
+
+			send := &UdpProbeCmd{}
+			status, err := send.Run(quiet.LocalAddr().String() + " ping")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is unknown without an address", func() {
+			status, err := cmd.Run("")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, UNKNOWN)
+		})
+
+		Convey("fails the check after the normal threshold", func() {
+			server.Close()
+			check := &Check{Args: address + " ping", Command: cmd, MaxCount: 2}
+
+			check.UpdateStatus(check.Command.Run(check.Args))
+			So(check.Status, ShouldNotEqual, FAILED)
+			check.UpdateStatus(check.Command.Run(check.Args))
+			So(check.Status, ShouldEqual, FAILED)
+		})
+
+		Convey("is selectable by name", func() {
+			monitor := NewMonitor(hostname, "/")
+			So(monitor.GetCommandNamed("UdpProbe"), ShouldResemble, &UdpProbeCmd{WaitForReply: true})
+			So(monitor.GetCommandNamed("UdpSend"), ShouldResemble, &UdpProbeCmd{})
+		})
+	})
+}
+
+func Test_CommandCheck(t *testing.T) {
+	Convey("CommandCheck", t, func() {
+		cmd := &CommandCheck{Timeout: 2 * time.Second}
+
+		Convey("is healthy when the command exits 0", func() {
+			status, err := cmd.Run("true")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is sickly when the command fails", func() {
+			status, err := cmd.Run("false")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is sickly when the command doesn't exist", func() {
+			status, err := cmd.Run("/nonexistent/check-socket")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is unknown when there's no command", func() {
+			status, err := cmd.Run("  ")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, UNKNOWN)
+		})
+
+		Convey("kills commands that take too long", func() {
+			cmd.Timeout = 100 * time.Millisecond
+
+			start := time.Now()
+			status, err := cmd.Run("sleep 10")
+
+			So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+			So(err.Error(), ShouldContainSubstring, "timed out")
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is selectable by name", func() {
+			monitor := NewMonitor(hostname, "/")
+			So(monitor.GetCommandNamed("Command"), ShouldResemble, &CommandCheck{})
+		})
+	})
+}
+
+func Test_DockerHealthCmd(t *testing.T) {
+	Convey("DockerHealthCmd", t, func() {
+		services := []service.Service{
+			{ID: "deadbeef123", DockerHealth: service.DOCKER_HEALTHY},
+			{ID: "deadbeef101", DockerHealth: service.DOCKER_UNHEALTHY},
+			{ID: "deadbeef102", DockerHealth: service.DOCKER_STARTING},
+		}
+		cmd := &DockerHealthCmd{DiscoveryFn: func() []service.Service { return services }}
+
+		Convey("is healthy when Docker says so", func() {
+			status, err := cmd.Run("deadbeef123")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is sickly when Docker says it's unhealthy", func() {
+			status, err := cmd.Run("deadbeef101")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is unknown while the container is starting", func() {
+			status, _ := cmd.Run("deadbeef102")
+			So(status, ShouldEqual, UNKNOWN)
+		})
+
+		Convey("is unknown when the service is gone", func() {
+			status, err := cmd.Run("missing")
+			So(err, ShouldNotBeNil)
+			So(status, ShouldEqual, UNKNOWN)
+		})
+
+		Convey("uses the Monitor's discovery when selected by name", func() {
+			monitor := NewMonitor(hostname, "/")
+			named := monitor.GetCommandNamed("DockerHealth")
+
+			status, _ := named.Run("deadbeef123")
+			So(status, ShouldEqual, UNKNOWN)
+
+			monitor.DiscoveryFn = func() []service.Service { return services }
+			status, _ = named.Run("deadbeef123")
+			So(status, ShouldEqual, HEALTHY)
+		})
+	})
+}
+
+func Test_boundedBuffer(t *testing.T) {
+	Convey("boundedBuffer keeps only the start of the output", t, func() {
+		buf := &boundedBuffer{limit: 8}
+
+		n, err := buf.Write([]byte("12345"))
+		So(n, ShouldEqual, 5)
+		So(err, ShouldBeNil)
+
+		n, _ = buf.Write([]byte("67890"))
+		So(n, ShouldEqual, 5)
+
+		buf.Write([]byte("more"))
+		So(buf.String(), ShouldEqual, "12345678")
+	})
+}
+
+func Test_HttpGetCmd(t *testing.T) {
+	Convey("HttpGetCmd", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/empty":
+				w.WriteHeader(204)
+			case "/big":
+				w.Write([]byte(strings.Repeat("x", MAX_HTTP_CHECK_BODY) + "OK"))
+			default:
+				w.Write([]byte("status: OK"))
+			}
+		}))
+		defer server.Close()
+
+		cmd := &HttpGetCmd{}
+
+		Convey("is healthy on any 2xx by default", func() {
+			status, _ := cmd.Run(server.URL + "/empty")
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is sickly when the status isn't expected", func() {
+			So(cmd.Expect("200", ""), ShouldBeNil)
+			status, _ := cmd.Run(server.URL + "/empty")
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("accepts a range of status codes", func() {
+			So(cmd.Expect("200-204", ""), ShouldBeNil)
+			status, _ := cmd.Run(server.URL + "/empty")
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("checks that the body contains a string", func() {
+			So(cmd.Expect("", "OK"), ShouldBeNil)
+			status, _ := cmd.Run(server.URL + "/")
+			So(status, ShouldEqual, HEALTHY)
+
+			cmd.BodyMatch = "FINE"
+			status, _ = cmd.Run(server.URL + "/")
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("only reads the start of the body", func() {
+			So(cmd.Expect("", "OK"), ShouldBeNil)
+			status, _ := cmd.Run(server.URL + "/big")
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("rejects bad expected statuses", func() {
+			So(cmd.Expect("often", ""), ShouldNotBeNil)
+			So(cmd.Expect("299-200", ""), ShouldNotBeNil)
+			So(cmd.MinStatus, ShouldEqual, 0)
+		})
+	})
+
+	Convey("HttpGetCmd with a slow backend", t, func() {
+		// Tells us when the server sees the client hang up
+		closed := make(chan struct{}, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow-body" {
+				w.Write([]byte("status: "))
+				w.(http.Flusher).Flush()
+			}
+
+			select {
+			case <-r.Context().Done():
+				closed <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer server.Close()
+
+		cmd := &HttpGetCmd{Timeout: 50 * time.Millisecond}
+
+		waitForClose := func() bool {
+			select {
+			case <-closed:
+				return true
+			case <-time.After(time.Second):
+				return false
+			}
+		}
+
+		Convey("is sickly when the response doesn't come in time", func() {
+			start := time.Now()
+			status, err := cmd.Run(server.URL + "/slow")
+
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(status, ShouldEqual, SICKLY)
+			So(err.Error(), ShouldEqual, "HTTP check timed out after 50ms")
+			So(waitForClose(), ShouldBeTrue)
+		})
+
+		Convey("is sickly when the body doesn't come in time", func() {
+			So(cmd.Expect("", "OK"), ShouldBeNil)
+
+			status, err := cmd.Run(server.URL + "/slow-body")
+
+			So(status, ShouldEqual, SICKLY)
+			So(err, ShouldHaveSameTypeAs, timeoutError{})
+			So(waitForClose(), ShouldBeTrue)
+		})
+
+		Convey("counts against the service", func() {
+			check := NewCheck("slow")
+			check.Command = cmd
+			check.Args = server.URL + "/slow"
+			check.MaxCount = 2
+
+			status, err := cmd.Run(check.Args)
+			check.UpdateStatus(status, err)
+			So(check.Status, ShouldEqual, SICKLY)
+
+			status, err = cmd.Run(check.Args)
+			check.UpdateStatus(status, err)
+			So(check.Status, ShouldEqual, FAILED)
+			So(check.ServiceStatus(), ShouldEqual, service.UNHEALTHY)
+		})
+	})
+
+	Convey("HttpGetCmd with name-based virtual hosts", t, func() {
+		var gotHeader string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotHeader = r.Header.Get("X-Check")
+			if r.Host != "web.example.com" {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write([]byte("OK"))
+		}))
+		defer server.Close()
+
+		Convey("is sickly without the right Host", func() {
+			cmd := &HttpGetCmd{}
+			status, _ := cmd.Run(server.URL + "/")
+			So(status, ShouldEqual, SICKLY)
+		})
+
+		Convey("is healthy with a Host override", func() {
+			cmd := &HttpGetCmd{Host: "web.example.com"}
+			status, _ := cmd.Run(server.URL + "/")
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("takes a Host from the headers too", func() {
+			cmd := &HttpGetCmd{Headers: map[string]string{"host": "web.example.com"}}
+			status, _ := cmd.Run(server.URL + "/")
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("sends the extra headers", func() {
+			cmd := &HttpGetCmd{Host: "web.example.com", Headers: map[string]string{"X-Check": "sidecar"}}
+			cmd.Run(server.URL + "/")
+			So(gotHeader, ShouldEqual, "sidecar")
+		})
+	})
+}
+
+// Write out the test server's certificate and key, which we use as both
+// the CA and the client certificate
+func writeServerCert(server *httptest.Server, dir string) (string, string) {
+	cert := server.TLS.Certificates[0]
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	key, _ := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	return certFile, keyFile
+}
+
+func Test_HttpGetCmdTLS(t *testing.T) {
+	Convey("HttpGetCmd over HTTPS", t, func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer server.Close()
+
+		tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+		defer os.RemoveAll(tmpDir)
+		certFile, keyFile := writeServerCert(server, tmpDir)
+
+		cmd := &HttpGetCmd{}
+
+		Convey("fails like a dead service when the certificate isn't trusted", func() {
+			status, err := cmd.Run(server.URL + "/")
+			So(err, ShouldNotBeNil)
+
+			closed := httptest.NewServer(http.NotFoundHandler())
+			closed.Close()
+			deadStatus, _ := cmd.Run(closed.URL + "/")
+			So(status, ShouldEqual, deadStatus)
+		})
+
+		Convey("is healthy when skipping verification", func() {
+			So(cmd.ConfigureTLS(true, "", "", ""), ShouldBeNil)
+			status, err := cmd.Run(server.URL + "/")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("is healthy when verifying against a pinned CA", func() {
+			So(cmd.ConfigureTLS(false, certFile, "", ""), ShouldBeNil)
+			status, err := cmd.Run(server.URL + "/")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("presents a client certificate", func() {
+			mtls := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("OK"))
+			}))
+			mtls.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+			mtls.StartTLS()
+			defer mtls.Close()
+
+			So(cmd.ConfigureTLS(true, "", "", ""), ShouldBeNil)
+			_, err := cmd.Run(mtls.URL + "/")
+			So(err, ShouldNotBeNil)
+
+			So(cmd.ConfigureTLS(true, "", certFile, keyFile), ShouldBeNil)
+			status, err := cmd.Run(mtls.URL + "/")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("returns an error for bad files", func() {
+			So(cmd.ConfigureTLS(false, filepath.Join(tmpDir, "missing.pem"), "", ""), ShouldNotBeNil)
+			So(cmd.ConfigureTLS(false, keyFile, "", ""), ShouldNotBeNil)
+			So(cmd.ConfigureTLS(false, "", certFile, ""), ShouldNotBeNil)
+			So(cmd.Client, ShouldBeNil)
+		})
+
+		Convey("uses the default client without any settings", func() {
+			So(cmd.ConfigureTLS(false, "", "", ""), ShouldBeNil)
+			So(cmd.Client, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,135 @@
+package healthy
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/service"
+)
+
+const (
+	DEPENDENCIES_MET     = ""
+	DEPENDENCIES_PENDING = "pending"
+	DEPENDENCIES_CYCLE   = "cycle"
+)
+
+// Hold a healthy service as UNKNOWN while any of the services it depends on
+// has no healthy instance in the cluster, so it's not advertised before
+// them. Services that depend on each other in a circle would wait forever,
+// so those are logged and left alone instead.
+func (m *Monitor) holdForDependencies(svc *service.Service, cluster map[string][]*service.Service) {
+	dependencies := svc.Dependencies()
+	if len(dependencies) == 0 || svc.Status != service.ALIVE {
+		m.setDependencyState(svc, DEPENDENCIES_MET, nil)
+		return
+	}
+
+	if cycle := dependencyCycle(m.nameFor(svc), dependencies, cluster); cycle != nil {
+		m.setDependencyState(svc, DEPENDENCIES_CYCLE, cycle)
+		return
+	}
+
+	var missing []string
+	for _, name := range dependencies {
+		if !anyAlive(cluster[name]) {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) == 0 {
+		m.setDependencyState(svc, DEPENDENCIES_MET, nil)
+		return
+	}
+
+	svc.Status = service.UNKNOWN
+	m.setDependencyState(svc, DEPENDENCIES_PENDING, missing)
+}
+
+func (m *Monitor) nameFor(svc *service.Service) string {
+	if m.ServiceNameFn != nil {
+		return m.ServiceNameFn(svc)
+	}
+	return svc.Name
+}
+
+// Log when a service starts or stops waiting, rather than on every pass
+func (m *Monitor) setDependencyState(svc *service.Service, state string, names []string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.dependencyStates == nil {
+		m.dependencyStates = make(map[string]string)
+	}
+
+	previous := m.dependencyStates[svc.ID]
+	if state == previous {
+		return
+	}
+
+	if state == DEPENDENCIES_MET {
+		delete(m.dependencyStates, svc.ID)
+	} else {
+		m.dependencyStates[svc.ID] = state
+	}
+
+	switch state {
+	case DEPENDENCIES_PENDING:
+		log.Infof("Holding %s (ID: %s) until its dependencies are healthy: %s",
+			m.nameFor(svc), svc.ID, strings.Join(names, ", "))
+	case DEPENDENCIES_CYCLE:
+		log.Warnf("Ignoring the dependencies of %s (ID: %s), they go round in a circle: %s",
+			m.nameFor(svc), svc.ID, strings.Join(names, " -> "))
+	default:
+		if previous == DEPENDENCIES_PENDING {
+			log.Infof("Dependencies of %s (ID: %s) are healthy", m.nameFor(svc), svc.ID)
+		}
+	}
+}
+
+func anyAlive(instances []*service.Service) bool {
+	for _, svc := range instances {
+		if svc.IsAlive() {
+			return true
+		}
+	}
+	return false
+}
+
+// A path from the service back to itself through the dependencies declared
+// by it and by the services in the cluster, or nil if there isn't one
+func dependencyCycle(name string, dependencies []string, cluster map[string][]*service.Service) []string {
+	dependenciesOf := func(other string) []string {
+		if other == name {
+			return dependencies
+		}
+
+		var names []string
+		for _, svc := range cluster[other] {
+			names = append(names, svc.Dependencies()...)
+		}
+		return names
+	}
+
+	visited := map[string]bool{name: true}
+	var visit func(path []string) []string
+	visit = func(path []string) []string {
+		for _, dependency := range dependenciesOf(path[len(path)-1]) {
+			next := append(append([]string{}, path...), dependency)
+			if dependency == name {
+				return next
+			}
+
+			if visited[dependency] {
+				continue
+			}
+			visited[dependency] = true
+
+			if cycle := visit(next); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+
+	return visit([]string{name})
+}
@@ -0,0 +1,106 @@
+package healthy
+
+import (
+	"testing"
+
+	"github.com/newrelic/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_holdForDependencies(t *testing.T) {
+	Convey("Holding services for their dependencies", t, func() {
+		api := service.Service{
+			ID:       "deadbeef123",
+			Name:     "api",
+			Hostname: hostname,
+			Metadata: map[string]string{service.DEPENDS_ON_METADATA: "db"},
+		}
+		db := service.Service{ID: "deadbeef101", Name: "db", Hostname: hostname}
+
+		monitor := NewMonitor(hostname, "/")
+		monitor.DiscoveryFn = func() []service.Service { return []service.Service{api, db} }
+		monitor.AddCheck(&Check{ID: api.ID, Status: HEALTHY})
+		monitor.AddCheck(&Check{ID: db.ID, Status: HEALTHY})
+
+		// The cluster only sees what we've discovered, like a new node
+		cluster := map[string][]*service.Service{}
+		monitor.ClusterServicesFn = func() map[string][]*service.Service { return cluster }
+		publish := func(services []service.Service) {
+			cluster = map[string][]*service.Service{}
+			for i := range services {
+				cluster[services[i].Name] = append(cluster[services[i].Name], &services[i])
+			}
+		}
+		statuses := func() map[string]int {
+			result := map[string]int{}
+			for _, svc := range monitor.Services() {
+				result[svc.Name] = svc.Status
+			}
+			return result
+		}
+
+		Convey("Holds a service until its dependency is healthy in the cluster", func() {
+			first := statuses()
+			So(first["db"], ShouldEqual, service.ALIVE)
+			So(first["api"], ShouldEqual, service.UNKNOWN)
+
+			publish(monitor.Services())
+			So(statuses()["api"], ShouldEqual, service.ALIVE)
+		})
+
+		Convey("Holds it again when the dependency goes away", func() {
+			publish(monitor.Services())
+			publish(monitor.Services())
+			So(statuses()["api"], ShouldEqual, service.ALIVE)
+
+			cluster["db"][0].Status = service.UNHEALTHY
+			So(statuses()["api"], ShouldEqual, service.UNKNOWN)
+		})
+
+		Convey("Leaves services that aren't healthy themselves alone", func() {
+			monitor.AddCheck(&Check{ID: api.ID, Status: FAILED})
+			So(statuses()["api"], ShouldEqual, service.UNHEALTHY)
+		})
+
+		Convey("Ignores dependencies that go round in a circle", func() {
+			db.Metadata = map[string]string{service.DEPENDS_ON_METADATA: "api"}
+			publish([]service.Service{db})
+
+			So(statuses()["api"], ShouldEqual, service.ALIVE)
+			So(monitor.dependencyStates[api.ID], ShouldEqual, DEPENDENCIES_CYCLE)
+		})
+
+		Convey("Ignores dependencies without the cluster's services", func() {
+			monitor.ClusterServicesFn = nil
+			So(statuses()["api"], ShouldEqual, service.ALIVE)
+		})
+	})
+}
+
+func Test_dependencyCycle(t *testing.T) {
+	Convey("dependencyCycle()", t, func() {
+		depending := func(names string) *service.Service {
+			return &service.Service{Metadata: map[string]string{service.DEPENDS_ON_METADATA: names}}
+		}
+
+		cluster := map[string][]*service.Service{
+			"db":     {depending("")},
+			"cache":  {depending("db")},
+			"queue":  {depending("worker")},
+			"worker": {depending("cache"), depending("api")},
+		}
+
+		Convey("Finds nothing when the dependencies end somewhere", func() {
+			So(dependencyCycle("api", []string{"cache", "db"}, cluster), ShouldBeNil)
+		})
+
+		Convey("Finds the way back round, through any instance", func() {
+			So(dependencyCycle("api", []string{"db", "queue"}, cluster),
+				ShouldResemble, []string{"api", "queue", "worker", "api"})
+		})
+
+		Convey("Finds a service that depends on itself", func() {
+			So(dependencyCycle("api", []string{"api"}, cluster), ShouldResemble, []string{"api", "api"})
+		})
+	})
+}
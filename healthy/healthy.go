@@ -1,17 +1,21 @@
 // A lightweight health-checking module so we can make
 // sure that services are running and healthy before
 // we announce them to our peers. Has a standard check
-// interval for all checks, not configurable per check.
+// interval for all checks, which can be overridden per
+// check.
 
 package healthy
 
 import (
-	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
 	"github.com/newrelic/sidecar/service"
+	"github.com/newrelic/sidecar/tracing"
 	"github.com/relistan/go-director"
 )
 
@@ -23,23 +27,52 @@ const (
 )
 
 const (
-	FOREVER         = -1
-	WATCH_INTERVAL  = 500 * time.Millisecond
-	HEALTH_INTERVAL = 3 * time.Second
+	FOREVER           = -1
+	WATCH_INTERVAL    = 500 * time.Millisecond
+	HEALTH_INTERVAL   = 3 * time.Second
+	DEFAULT_THRESHOLD = 1
 )
 
 // The Monitor is responsible for managing and running Checks.
-// It has a fixed check interval that is used for all checks.
-// Access must be synchronized so direct access to struct
-// members is possible but requires use of the RWMutex.
+// It has a default check interval that is used for all checks
+// which don't specify their own. Each check has its own ticker
+// that says when it's due to run again. The thresholds are the
+// default number of consecutive results needed before a check
+// changes between healthy and unhealthy. Access must be
+// synchronized so direct access to struct members is possible
+// but requires use of the RWMutex.
 type Monitor struct {
 	Checks               map[string]*Check
 	CheckInterval        time.Duration
+	HealthyThreshold     int
+	UnhealthyThreshold   int
 	DefaultCheckHost     string
 	DiscoveryFn          func() []service.Service
 	ServiceNameFn        func(*service.Service) string
 	DefaultCheckEndpoint string
+	MaxConcurrentChecks  int           // Most checks we run at once, zero for no limit
+	CheckTimeout         time.Duration // For checks that don't set their own, zero for the defaults
+	// The cluster's services by name, to hold services back until their
+	// dependencies are healthy. Dependencies are ignored without it.
+	ClusterServicesFn func() map[string][]*service.Service
 	sync.RWMutex
+
+	// What we last logged about each service's dependencies
+	dependencyStates map[string]string
+
+	// Checks running right now, and waiting for a free slot
+	inFlight int32
+	queued   int32
+
+	// Shared by every pass, so slow checks hold their slot until they're
+	// done. Nil when there's no limit.
+	slots chan struct{}
+
+	// The checks that haven't finished yet, so Run can wait on them
+	running sync.WaitGroup
+
+	// Makes the ticker for each check, swapped out in tests
+	newTicker func(time.Duration) (<-chan time.Time, func())
 }
 
 // A Check defines some information about how to talk to the
@@ -52,6 +85,10 @@ type Check struct {
 	// The ID of this check
 	ID string
 
+	// The service it checks, and where it runs, for the logs
+	ServiceName string
+	Hostname    string
+
 	// The most recent status of this check
 	Status int
 
@@ -72,6 +109,34 @@ type Check struct {
 
 	// The last recorded error on this check
 	LastError error
+
+	// How often to run this check. Zero means use the Monitor's
+	// CheckInterval.
+	Interval time.Duration
+
+	// How many results in a row it takes to become healthy, or
+	// unhealthy. Anything below 2 changes status right away.
+	HealthyThreshold   int
+	UnhealthyThreshold int
+
+	// How many results in a row have disagreed with the current status
+	streak int
+
+	// For HTTP checks, the status code (e.g. "204") or range (e.g.
+	// "200-399") that is healthy, and a string the body must contain
+	ExpectedStatus string
+	ExpectedBody   string
+
+	// For HTTP and command checks, how long they can take before they
+	// count as failed
+	Timeout time.Duration
+
+	// Fires when this check is due to run again
+	ticks      <-chan time.Time
+	stopTicker func()
+
+	// Still running from an earlier pass, so it's skipped until it's done
+	inFlight bool
 }
 
 type Checker interface {
@@ -92,25 +157,94 @@ func NewCheck(id string) *Check {
 }
 
 // UpdateStatus take the status integer and error and applies them to the status
-// of the current Check.
+// of the current Check. A change between healthy and unhealthy only happens
+// once the check's threshold has been reached.
 func (check *Check) UpdateStatus(status int, err error) {
+	newStatus := status
 	if err != nil {
-		log.Debugf("Error executing check, status UNKNOWN: (id %s)", check.ID)
-		check.Status = UNKNOWN
 		check.LastError = err
-	} else {
-		check.Status = status
+
+		// Timing out is an answer: the service is too slow. Anything else
+		// means we couldn't find out.
+		if _, ok := err.(timeoutError); !ok {
+			log.Debugf("Error executing check, status UNKNOWN: (id %s)", check.ID)
+			newStatus = UNKNOWN
+		}
 	}
 
 	if status == HEALTHY {
 		check.Count = 0
+	} else {
+		check.Count = check.Count + 1
+
+		if check.Count >= check.MaxCount {
+			newStatus = FAILED
+		}
+	}
+
+	if !check.reachedThreshold(newStatus) {
+		log.Debugf("Suppressed status change for check %s (%d/%d)",
+			check.ID, check.streak, check.thresholdFor(newStatus))
+		metrics.IncrCounter([]string{"healthy", "suppressed_transitions"}, 1)
 		return
 	}
 
-	check.Count = check.Count + 1
+	if (newStatus == HEALTHY) != (check.Status == HEALTHY) {
+		metrics.IncrCounter([]string{"healthy", "transitions"}, 1)
 
-	if check.Count >= check.MaxCount {
-		check.Status = FAILED
+		health := "unhealthy"
+		if newStatus == HEALTHY {
+			health = "healthy"
+		}
+		log.WithFields(check.logFields("health_changed")).
+			Infof("Service %s (id: %s) is now %s", check.ServiceName, check.ID, health)
+	}
+
+	check.Status = newStatus
+}
+
+// Log fields for an event about this check
+func (check *Check) logFields(event string) log.Fields {
+	return log.Fields{
+		"service": check.ServiceName,
+		"node":    check.Hostname,
+		"event":   event,
+	}
+}
+
+// Track the streak of results that disagree with the current status, and
+// tell us whether it's long enough to change it. Results that agree with
+// the current status reset the streak.
+func (check *Check) reachedThreshold(newStatus int) bool {
+	if (newStatus == HEALTHY) == (check.Status == HEALTHY) {
+		check.streak = 0
+		return true
+	}
+
+	check.streak = check.streak + 1
+	if check.streak >= check.thresholdFor(newStatus) {
+		check.streak = 0
+		return true
+	}
+
+	return false
+}
+
+func (check *Check) thresholdFor(status int) int {
+	if status == HEALTHY {
+		return check.HealthyThreshold
+	}
+
+	return check.UnhealthyThreshold
+}
+
+// Stop the ticker that schedules this check, if there is one. Must be
+// called with the Monitor locked.
+func (check *Check) stopTimer() {
+	if check.ticks != nil {
+		check.stopTicker()
+		check.ticks = nil
+		check.stopTicker = nil
 	}
 }
 
@@ -132,17 +266,26 @@ func NewMonitor(defaultCheckHost string, defaultCheckEndpoint string) *Monitor {
 	monitor := Monitor{
 		Checks:               make(map[string]*Check, 5),
 		CheckInterval:        HEALTH_INTERVAL,
+		HealthyThreshold:     DEFAULT_THRESHOLD,
+		UnhealthyThreshold:   DEFAULT_THRESHOLD,
 		DefaultCheckHost:     defaultCheckHost,
 		DefaultCheckEndpoint: defaultCheckEndpoint,
+		newTicker:            newTicker,
 	}
 	return &monitor
 }
 
+func newTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
 // Add a Check to the list. Handles synchronization.
 func (m *Monitor) AddCheck(check *Check) {
 	m.Lock()
 	defer m.Unlock()
-	log.Printf("Adding health check: %s (ID: %s), Args: %s", check.Type, check.ID, check.Args)
+	log.WithFields(check.logFields("check_added")).
+		Printf("Adding health check: %s (ID: %s), Args: %s", check.Type, check.ID, check.Args)
 	m.Checks[check.ID] = check
 }
 
@@ -163,44 +306,139 @@ func (m *Monitor) MarkService(svc *service.Service) {
 	m.RUnlock()
 }
 
-// Run runs the main monitoring loop. The looper controls the actual run behavior.
+// Run runs the main monitoring loop. The looper controls the actual run
+// behavior. Each iteration runs any check that is new, or whose ticker has
+// fired since the last pass. Checks run on their own interval that way,
+// until they're removed or the looper exits.
 func (m *Monitor) Run(looper director.Looper) {
 	looper.Loop(func() error {
 		log.Debugf("Running checks")
+		m.runDueChecks()
+		return nil
+	})
 
-		var wg sync.WaitGroup
-
-		wg.Add(len(m.Checks))
-		for _, check := range m.Checks {
-			// Run all checks in parallel in goroutines
-			resultChan := make(chan checkResult, 1)
-			go func(check *Check) {
-				result, err := check.Command.Run(check.Args)
-				resultChan <- checkResult{result, err}
-			}(check) // copy check pointer for the goroutine
-
-			go func(check *Check) {
-				// We make the call but we time out if it gets too close to the
-				// m.CheckInterval.
-				select {
-				case result := <-resultChan:
-					check.UpdateStatus(result.status, result.err)
-				case <-time.After(m.CheckInterval - 1*time.Millisecond):
-					log.Errorf("Error, check %s timed out! (%v)", check.ID, check.Args)
-					check.UpdateStatus(UNKNOWN, errors.New("Timed out!"))
-				}
-				wg.Done()
-			}(check) // copy check pointer for the goroutine
+	m.running.Wait()
+
+	m.Lock()
+	for _, check := range m.Checks {
+		check.stopTimer()
+	}
+	m.Unlock()
+}
+
+// Start all the checks that are due, starting tickers for new ones. It
+// doesn't wait for them, so one slow check doesn't hold up the rest. A
+// check that's still running from an earlier pass is skipped until it
+// finishes.
+func (m *Monitor) runDueChecks() {
+	var dueChecks []*Check
+
+	span := tracing.Start("health.checks")
+	defer span.Finish()
+
+	m.Lock()
+	for _, check := range m.Checks {
+		if m.isDue(check) && !check.inFlight {
+			check.inFlight = true
+			dueChecks = append(dueChecks, check)
 		}
+	}
 
-		// Let's make sure we don't continue to spool up
-		// huge quantities of goroutines. Wait on all of them
-		// to complete before moving on. This could slow down
-		// our check loop if something doesn't time out properly.
-		wg.Wait()
+	// Checks beyond the limit wait their turn. They still all run, so a
+	// check can be late but is never dropped.
+	if m.slots == nil && m.MaxConcurrentChecks > 0 {
+		m.slots = make(chan struct{}, m.MaxConcurrentChecks)
+	}
+	slots := m.slots
+	span.SetAttribute("checks", len(m.Checks))
+	m.Unlock()
 
-		return nil
-	})
+	span.SetAttribute("checks.due", len(dueChecks))
+
+	m.running.Add(len(dueChecks))
+	for _, check := range dueChecks {
+		// Run all checks in parallel in goroutines
+		go func(check *Check) {
+			defer m.running.Done()
+
+			if slots != nil {
+				m.countChecks(&m.queued, "queued", 1)
+				slots <- struct{}{}
+				m.countChecks(&m.queued, "queued", -1)
+			}
+
+			m.countChecks(&m.inFlight, "in_flight", 1)
+			m.runCheck(check)
+			m.countChecks(&m.inFlight, "in_flight", -1)
+
+			if slots != nil {
+				<-slots
+			}
+
+			m.Lock()
+			check.inFlight = false
+			m.Unlock()
+		}(check) // copy check pointer for the goroutine
+	}
+}
+
+// Keep one of the check counters and its gauge up to date
+func (m *Monitor) countChecks(counter *int32, name string, delta int32) {
+	value := atomic.AddInt32(counter, delta)
+	metrics.SetGauge([]string{"healthy", "checks", name}, float32(value))
+}
+
+// A check is due when it has never run, or its ticker has fired. Must be
+// called with the Monitor locked.
+func (m *Monitor) isDue(check *Check) bool {
+	if check.ticks == nil {
+		check.ticks, check.stopTicker = m.newTicker(m.intervalFor(check))
+		return true
+	}
+
+	select {
+	case <-check.ticks:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Monitor) intervalFor(check *Check) time.Duration {
+	if check.Interval > 0 {
+		return check.Interval
+	}
+
+	return m.CheckInterval
+}
+
+// Run a check once. We make the call but we time out if it gets too
+// close to the check's interval.
+func (m *Monitor) runCheck(check *Check) {
+	resultChan := make(chan checkResult, 1)
+	go func() {
+		result, err := check.Command.Run(check.Args)
+		resultChan <- checkResult{result, err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		check.UpdateStatus(result.status, result.err)
+	case <-time.After(m.intervalFor(check) - 1*time.Millisecond):
+		log.WithFields(check.logFields("check_timeout")).
+			Errorf("Error, check %s timed out! (%v)", check.ID, check.Args)
+		check.UpdateStatus(SICKLY, timeoutError{"Check", m.intervalFor(check)})
+	}
+}
+
+// A check that took too long, which counts against the service
+type timeoutError struct {
+	what    string
+	timeout time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.what, e.timeout)
 }
 
 type checkResult struct {
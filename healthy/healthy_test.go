@@ -2,6 +2,9 @@ package healthy
 
 import (
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -27,6 +30,8 @@ func Test_NewMonitor(t *testing.T) {
 		monitor := NewMonitor(hostname, "/")
 
 		So(monitor.CheckInterval, ShouldEqual, HEALTH_INTERVAL)
+		So(monitor.HealthyThreshold, ShouldEqual, DEFAULT_THRESHOLD)
+		So(monitor.UnhealthyThreshold, ShouldEqual, DEFAULT_THRESHOLD)
 		So(len(monitor.Checks), ShouldEqual, 0)
 	})
 }
@@ -47,14 +52,50 @@ type mockCommand struct {
 	LastArgs      string
 	DesiredResult int
 	Error         error
+	sync.Mutex
 }
 
 func (m *mockCommand) Run(args string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
 	m.CallCount = m.CallCount + 1
 	m.LastArgs = args
 	return m.DesiredResult, m.Error
 }
 
+func (m *mockCommand) Calls() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.CallCount
+}
+
+// A ticker that has always fired, so checks are due on every pass
+func alwaysTicking(interval time.Duration) (<-chan time.Time, func()) {
+	ticks := make(chan time.Time)
+	close(ticks)
+	return ticks, func() {}
+}
+
+// A ticker that never fires
+func neverTicking(interval time.Duration) (<-chan time.Time, func()) {
+	return make(chan time.Time), func() {}
+}
+
+// A FreeLooper that lets each pass's checks finish before the next, so
+// none of them are skipped for still running
+type settledLooper struct {
+	*director.FreeLooper
+	monitor *Monitor
+}
+
+func (l *settledLooper) Loop(fn func() error) {
+	l.FreeLooper.Loop(func() error {
+		err := fn()
+		l.monitor.running.Wait()
+		return err
+	})
+}
+
 type slowCommand struct{}
 
 func (s *slowCommand) Run(args string) (int, error) {
@@ -62,9 +103,128 @@ func (s *slowCommand) Run(args string) (int, error) {
 	return HEALTHY, nil
 }
 
+// Keeps track of the most runs at once
+type concurrentCommand struct {
+	running int
+	most    int
+	sync.Mutex
+}
+
+func (c *concurrentCommand) Run(args string) (int, error) {
+	c.Lock()
+	c.running++
+	if c.running > c.most {
+		c.most = c.running
+	}
+	c.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	c.Lock()
+	c.running--
+	c.Unlock()
+
+	return HEALTHY, nil
+}
+
+func Test_CheckConcurrency(t *testing.T) {
+	Convey("Limiting how many checks run at once", t, func() {
+		monitor := NewMonitor(hostname, "/")
+		monitor.newTicker = alwaysTicking
+		cmd := &concurrentCommand{}
+
+		var checks []*Check
+		for i := 0; i < 10; i++ {
+			check := &Check{ID: fmt.Sprintf("check%d", i), Type: "mock", Command: cmd, Status: UNKNOWN}
+			checks = append(checks, check)
+			monitor.AddCheck(check)
+		}
+
+		Convey("Runs them all at once by default", func() {
+			monitor.runDueChecks()
+			monitor.running.Wait()
+			So(cmd.most, ShouldBeGreaterThan, 3)
+		})
+
+		Convey("Runs no more than the limit at once", func() {
+			monitor.MaxConcurrentChecks = 3
+			monitor.runDueChecks()
+			monitor.running.Wait()
+
+			So(cmd.most, ShouldEqual, 3)
+		})
+
+		Convey("Still runs every check that was due", func() {
+			monitor.MaxConcurrentChecks = 3
+			monitor.runDueChecks()
+			monitor.running.Wait()
+
+			for _, check := range checks {
+				So(check.Status, ShouldEqual, HEALTHY)
+			}
+			So(monitor.inFlight, ShouldEqual, 0)
+			So(monitor.queued, ShouldEqual, 0)
+		})
+	})
+}
+
+// Runs until it's told to finish
+type blockingCommand struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (c *blockingCommand) Run(args string) (int, error) {
+	atomic.AddInt32(&c.calls, 1)
+	<-c.release
+	return HEALTHY, nil
+}
+
+func Test_SlowChecks(t *testing.T) {
+	Convey("Checks that are still running", t, func() {
+		monitor := NewMonitor(hostname, "/")
+		monitor.newTicker = alwaysTicking
+		monitor.CheckInterval = 10 * time.Second
+
+		slow := &blockingCommand{release: make(chan struct{})}
+		slowCheck := &Check{ID: "slow", Type: "mock", Command: slow, Status: UNKNOWN}
+		monitor.AddCheck(slowCheck)
+
+		fast := mockCommand{DesiredResult: HEALTHY}
+		monitor.AddCheck(&Check{ID: "fast", Type: "mock", Command: &fast, Status: UNKNOWN})
+
+		Convey("Don't hold up the other checks", func() {
+			monitor.runDueChecks()
+			for i := 0; i < 100 && fast.Calls() < 1; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			So(fast.Calls(), ShouldEqual, 1)
+
+			close(slow.release)
+			monitor.running.Wait()
+		})
+
+		Convey("Are skipped until they finish", func() {
+			monitor.runDueChecks()
+			monitor.runDueChecks()
+			So(atomic.LoadInt32(&slow.calls), ShouldBeLessThanOrEqualTo, 1)
+
+			close(slow.release)
+			monitor.running.Wait()
+			So(atomic.LoadInt32(&slow.calls), ShouldEqual, 1)
+			So(slowCheck.inFlight, ShouldBeFalse)
+
+			monitor.runDueChecks()
+			monitor.running.Wait()
+			So(atomic.LoadInt32(&slow.calls), ShouldEqual, 2)
+		})
+	})
+}
+
 func Test_RunningChecks(t *testing.T) {
 	Convey("Working with health checks", t, func() {
 		monitor := NewMonitor(hostname, "/")
+		monitor.newTicker = alwaysTicking
 		cmd := mockCommand{DesiredResult: HEALTHY}
 		check := &Check{
 			Type:    "mock",
@@ -77,14 +237,14 @@ func Test_RunningChecks(t *testing.T) {
 
 		Convey("The Check Command gets evaluated", func() {
 			monitor.Run(looper)
-			So(cmd.CallCount, ShouldEqual, 1)
+			So(cmd.Calls(), ShouldEqual, 1)
 			So(cmd.LastArgs, ShouldEqual, "testing")
 			So(cmd.DesiredResult, ShouldEqual, HEALTHY) // We know it's our cmd
 		})
 
 		Convey("Healthy Checks are marked healthy", func() {
 			monitor.Run(looper)
-			So(cmd.CallCount, ShouldEqual, 1)
+			So(cmd.Calls(), ShouldEqual, 1)
 			So(cmd.LastArgs, ShouldEqual, "testing")
 			So(check.Status, ShouldEqual, HEALTHY)
 		})
@@ -100,7 +260,7 @@ func Test_RunningChecks(t *testing.T) {
 			monitor.AddCheck(badCheck)
 			monitor.Run(looper)
 
-			So(fail.CallCount, ShouldEqual, 1)
+			So(fail.Calls(), ShouldEqual, 1)
 			So(badCheck.Status, ShouldEqual, SICKLY)
 		})
 
@@ -115,7 +275,7 @@ func Test_RunningChecks(t *testing.T) {
 			monitor.AddCheck(badCheck)
 			monitor.Run(looper)
 
-			So(fail.CallCount, ShouldEqual, 1)
+			So(fail.Calls(), ShouldEqual, 1)
 			So(badCheck.Status, ShouldEqual, UNKNOWN)
 		})
 
@@ -129,12 +289,53 @@ func Test_RunningChecks(t *testing.T) {
 				MaxCount: maxCount,
 			}
 			monitor.AddCheck(badCheck)
-			monitor.Run(director.NewFreeLooper(maxCount, nil))
-			So(fail.CallCount, ShouldEqual, maxCount)
+			monitor.Run(&settledLooper{director.NewFreeLooper(maxCount, nil), monitor})
+			So(fail.Calls(), ShouldEqual, maxCount)
 			So(badCheck.Count, ShouldEqual, maxCount)
 			So(badCheck.Status, ShouldEqual, FAILED)
 		})
 
+		Convey("Checks run on their own interval", func() {
+			slow := mockCommand{DesiredResult: HEALTHY}
+			fast := mockCommand{DesiredResult: HEALTHY}
+			slowCheck := &Check{ID: "slow", Command: &slow, Interval: 1 * time.Hour}
+			fastCheck := &Check{ID: "fast", Command: &fast, Interval: 5 * time.Millisecond}
+			monitor.AddCheck(slowCheck)
+			monitor.AddCheck(fastCheck)
+
+			var intervals []time.Duration
+			monitor.newTicker = func(interval time.Duration) (<-chan time.Time, func()) {
+				intervals = append(intervals, interval)
+				if interval == fastCheck.Interval {
+					return alwaysTicking(interval)
+				}
+				return neverTicking(interval)
+			}
+
+			monitor.Run(&settledLooper{director.NewFreeLooper(3, nil), monitor})
+
+			So(fast.Calls(), ShouldEqual, 3)
+			So(slow.Calls(), ShouldEqual, 1)
+			So(intervals, ShouldContain, 1*time.Hour)
+			So(intervals, ShouldContain, HEALTH_INTERVAL)
+		})
+
+		Convey("Checks without an interval use the default", func() {
+			So(monitor.intervalFor(&Check{}), ShouldEqual, HEALTH_INTERVAL)
+			So(monitor.intervalFor(&Check{Interval: time.Minute}), ShouldEqual, time.Minute)
+		})
+
+		Convey("Stops the tickers when the looper exits", func() {
+			var stopped bool
+			monitor.newTicker = func(interval time.Duration) (<-chan time.Time, func()) {
+				return make(chan time.Time), func() { stopped = true }
+			}
+
+			monitor.Run(looper)
+			So(stopped, ShouldBeTrue)
+			So(check.ticks, ShouldBeNil)
+		})
+
 		Convey("Checks that were failed return to health", func() {
 			healthy := mockCommand{DesiredResult: HEALTHY}
 			badCheck := &Check{
@@ -164,8 +365,9 @@ func Test_RunningChecks(t *testing.T) {
 			monitor.CheckInterval = 1 * time.Millisecond
 			monitor.Run(looper)
 
-			So(check.Status, ShouldEqual, UNKNOWN)
-			So(check.LastError.Error(), ShouldEqual, "Timed out!")
+			// Too slow is a failed check, not one we couldn't run
+			So(check.Status, ShouldEqual, SICKLY)
+			So(check.LastError.Error(), ShouldEqual, "Check timed out after 1ms")
 		})
 
 		Convey("Checks that had an error become UNKNOWN on first pass", func() {
@@ -179,6 +381,59 @@ func Test_RunningChecks(t *testing.T) {
 	})
 }
 
+func Test_Thresholds(t *testing.T) {
+	Convey("When a check has thresholds", t, func() {
+		check := NewCheck("test")
+		check.MaxCount = 1
+		check.Status = HEALTHY
+		check.HealthyThreshold = 2
+		check.UnhealthyThreshold = 3
+
+		Convey("Stays healthy until enough failures in a row", func() {
+			check.UpdateStatus(FAILED, nil)
+			check.UpdateStatus(FAILED, nil)
+			So(check.Status, ShouldEqual, HEALTHY)
+
+			check.UpdateStatus(FAILED, nil)
+			So(check.Status, ShouldEqual, FAILED)
+		})
+
+		Convey("Resets the streak when a result contradicts it", func() {
+			check.UpdateStatus(FAILED, nil)
+			check.UpdateStatus(FAILED, nil)
+			check.UpdateStatus(HEALTHY, nil)
+			check.UpdateStatus(FAILED, nil)
+			check.UpdateStatus(FAILED, nil)
+			So(check.Status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("Needs enough successes in a row to recover", func() {
+			check.Status = FAILED
+
+			check.UpdateStatus(HEALTHY, nil)
+			So(check.Status, ShouldEqual, FAILED)
+
+			check.UpdateStatus(HEALTHY, nil)
+			So(check.Status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("Errors count towards the unhealthy threshold", func() {
+			check.UpdateStatus(HEALTHY, errors.New("Borked!"))
+			check.UpdateStatus(HEALTHY, errors.New("Borked!"))
+			So(check.Status, ShouldEqual, HEALTHY)
+
+			check.UpdateStatus(HEALTHY, errors.New("Borked!"))
+			So(check.Status, ShouldEqual, UNKNOWN)
+		})
+
+		Convey("Changes right away without thresholds", func() {
+			check.UnhealthyThreshold = 0
+			check.UpdateStatus(FAILED, nil)
+			So(check.Status, ShouldEqual, FAILED)
+		})
+	})
+}
+
 func Test_MarkingServices(t *testing.T) {
 
 	Convey("When marking services", t, func() {
@@ -3,6 +3,8 @@ package healthy
 import (
 	"bytes"
 	"fmt"
+	"net"
+	"strconv"
 	"text/template"
 
 	log "github.com/Sirupsen/logrus"
@@ -23,6 +25,11 @@ func (m *Monitor) Services() []service.Service {
 		return []service.Service{}
 	}
 
+	var cluster map[string][]*service.Service
+	if m.ClusterServicesFn != nil {
+		cluster = m.ClusterServicesFn()
+	}
+
 	for _, svc := range m.DiscoveryFn() {
 		if svc.ID == "" {
 			log.Errorf("Error: monitor found empty service ID")
@@ -30,6 +37,9 @@ func (m *Monitor) Services() []service.Service {
 		}
 
 		m.MarkService(&svc)
+		if cluster != nil {
+			m.holdForDependencies(&svc, cluster)
+		}
 		svcList = append(svcList, svc)
 	}
 
@@ -45,21 +55,55 @@ func findFirstTCPPort(svc *service.Service) *service.Port {
 	return nil
 }
 
+func findPortNamed(svc *service.Service, name string) *service.Port {
+	for _, port := range svc.Ports {
+		if port.Name == name {
+			return &port
+		}
+	}
+	return nil
+}
+
 // Configure a default check for a service. The default is to return an HTTP
 // check on the first TCP port on the endpoint set in DEFAULT_STATUS_ENDPOINT.
-func (m *Monitor) defaultCheckForService(svc *service.Service) *Check {
-	port := findFirstTCPPort(svc)
+// The service can ask for a different port by name, a different path, or
+// for HTTPS.
+func (m *Monitor) defaultCheckForService(svc *service.Service, config discovery.CheckConfig) *Check {
+	var port *service.Port
+	if config.Port != "" {
+		port = findPortNamed(svc, config.Port)
+		if port == nil {
+			log.Warnf("No port named '%s' for service %s (id: %s), using the first TCP port",
+				config.Port, svc.Name, svc.ID)
+		}
+	}
+
+	if port == nil {
+		port = findFirstTCPPort(svc)
+	}
+
 	if port == nil {
 		return &Check{ID: svc.ID, Command: &AlwaysSuccessfulCmd{}}
 	}
 
 	// Use the const default unless we've been provided something else
 	defaultCheckEndpoint := DEFAULT_STATUS_ENDPOINT
-	if len(m.DefaultCheckEndpoint) != 0 {
+	if len(config.Path) != 0 {
+		defaultCheckEndpoint = config.Path
+	} else if len(m.DefaultCheckEndpoint) != 0 {
 		defaultCheckEndpoint = m.DefaultCheckEndpoint
 	}
 
-	url := fmt.Sprintf("http://%v:%v%v", m.DefaultCheckHost, port.Port, defaultCheckEndpoint)
+	hostPort := net.JoinHostPort(m.checkHostFor(svc), strconv.FormatInt(port.Port, 10))
+	scheme := "http"
+	if config.Scheme == "https" {
+		scheme = "https"
+	} else if config.Scheme != "" && config.Scheme != "http" {
+		log.Warnf("Unknown health check scheme '%s' for service %s (id: %s), using http",
+			config.Scheme, svc.Name, svc.ID)
+	}
+
+	url := fmt.Sprintf("%s://%v%v", scheme, hostPort, defaultCheckEndpoint)
 	return &Check{
 		ID:      svc.ID,
 		Type:    "HttpGet",
@@ -75,6 +119,23 @@ func (m *Monitor) GetCommandNamed(name string) Checker {
 		return &HttpGetCmd{}
 	case "External":
 		return &ExternalCmd{}
+	case "GrpcGet":
+		return &GrpcGetCmd{}
+	case "TcpConnect":
+		return &TcpConnectCmd{}
+	case "UdpProbe":
+		return &UdpProbeCmd{WaitForReply: true}
+	case "UdpSend":
+		return &UdpProbeCmd{}
+	case "Command":
+		return &CommandCheck{}
+	case "DockerHealth":
+		return &DockerHealthCmd{DiscoveryFn: func() []service.Service {
+			if m.DiscoveryFn == nil {
+				return nil
+			}
+			return m.DiscoveryFn()
+		}}
 	default:
 		return &HttpGetCmd{}
 	}
@@ -101,13 +162,22 @@ func (m *Monitor) fetchCheckForService(svc *service.Service, disco discovery.Dis
 	return check
 }
 
+// Services with their own IP, like Kubernetes pods, are checked there
+func (m *Monitor) checkHostFor(svc *service.Service) string {
+	if svc.IP != "" {
+		return svc.IP
+	}
+	return m.DefaultCheckHost
+}
+
 // Use templating to substitute in some info about the service.  Important because
 // we won't know the actual Port that the container will bind to, for example.
 func (m *Monitor) templateCheckArgs(check *Check, svc *service.Service) string {
 	funcMap := template.FuncMap{
 		"tcp":  func(p int64) int64 { return svc.PortForServicePort(p, "tcp") },
 		"udp":  func(p int64) int64 { return svc.PortForServicePort(p, "udp") },
-		"host": func() string { return m.DefaultCheckHost },
+		"port": func(name string) int64 { return svc.PortForName(name) },
+		"host": func() string { return m.checkHostFor(svc) },
 	}
 
 	t, err := template.New("check").Funcs(funcMap).Parse(check.Args)
@@ -125,14 +195,66 @@ func (m *Monitor) templateCheckArgs(check *Check, svc *service.Service) string {
 // CheckForService returns a Check that has been properly configured for this
 // particular service.
 func (m *Monitor) CheckForService(svc *service.Service, disco discovery.Discoverer) *Check {
+	config := disco.CheckConfig(svc)
+
 	check := m.fetchCheckForService(svc, disco)
 	if check == nil { // We got nothing
 		log.Warnf("Using default check for service %s (id: %s).", svc.Name, svc.ID)
-		check = m.defaultCheckForService(svc)
+		check = m.defaultCheckForService(svc, config)
 	}
 
 	check.Args = m.templateCheckArgs(check, svc)
 
+	check.ServiceName = svc.Name
+	if m.ServiceNameFn != nil {
+		check.ServiceName = m.ServiceNameFn(svc)
+	}
+	check.Hostname = svc.Hostname
+
+	check.Interval = config.Interval
+
+	check.ExpectedStatus = config.ExpectedStatus
+	check.ExpectedBody = config.ExpectedBody
+	if cmd, ok := check.Command.(*HttpGetCmd); ok {
+		err := cmd.Expect(check.ExpectedStatus, check.ExpectedBody)
+		if err != nil {
+			log.Errorf("Bad check expectations for service %s (id: %s): %s",
+				svc.Name, svc.ID, err.Error())
+		}
+		cmd.Host = config.Host
+		cmd.Headers = config.Headers
+
+		err = cmd.ConfigureTLS(config.TLSSkipVerify, config.CAFile, config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Errorf("Bad TLS settings for service %s (id: %s): %s",
+				svc.Name, svc.ID, err.Error())
+		}
+	}
+
+	check.Timeout = config.Timeout
+	if check.Timeout == 0 {
+		check.Timeout = m.CheckTimeout
+	}
+	switch cmd := check.Command.(type) {
+	case *CommandCheck:
+		cmd.Timeout = check.Timeout
+	case *HttpGetCmd:
+		cmd.Timeout = check.Timeout
+	case *UdpProbeCmd:
+		cmd.Timeout = check.Timeout
+		cmd.ReplyMatch = check.ExpectedBody
+	}
+
+	check.HealthyThreshold = m.HealthyThreshold
+	if config.HealthyThreshold > 0 {
+		check.HealthyThreshold = config.HealthyThreshold
+	}
+
+	check.UnhealthyThreshold = m.UnhealthyThreshold
+	if config.UnhealthyThreshold > 0 {
+		check.UnhealthyThreshold = config.UnhealthyThreshold
+	}
+
 	return check
 }
 
@@ -175,6 +297,9 @@ func (m *Monitor) Watch(disco discovery.Discoverer, looper director.Looper) {
 			}
 
 			// Remove checks for services that are no longer running
+			log.WithFields(check.logFields("check_removed")).
+				Infof("Removing health check for %s (ID: %s)", check.ServiceName, check.ID)
+			check.stopTimer()
 			delete(m.Checks, check.ID)
 		}
 
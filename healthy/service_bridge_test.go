@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/newrelic/sidecar/discovery"
 	"github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/newrelic/sidecar/service"
@@ -13,6 +14,7 @@ var hostname string = "indefatigable"
 
 type mockDiscoverer struct {
 	listFn func() []service.Service
+	config discovery.CheckConfig
 }
 
 func (m *mockDiscoverer) Services() []service.Service {
@@ -23,10 +25,23 @@ func (m *mockDiscoverer) HealthCheck(svc *service.Service) (string, string) {
 	if svc.Name == "hasCheck" {
 		return "HttpGet", "http://{{ host }}:{{ tcp 8081 }}/status/check"
 	}
+	if svc.Name == "hasNamedPortCheck" {
+		return "HttpGet", "http://{{ host }}:{{ port \"metrics\" }}/metrics"
+	}
+	if svc.Name == "hasCommandCheck" {
+		return "Command", "/usr/local/bin/check-socket"
+	}
+	if svc.Name == "hasUdpCheck" {
+		return "UdpProbe", "{{ host }}:{{ udp 8125 }} ping"
+	}
 
 	return "", ""
 }
 
+func (m *mockDiscoverer) CheckConfig(svc *service.Service) discovery.CheckConfig {
+	return m.config
+}
+
 func (m *mockDiscoverer) Run(director.Looper) { }
 
 func Test_ServicesBridge(t *testing.T) {
@@ -128,7 +143,7 @@ func Test_ServicesBridge(t *testing.T) {
 		Convey("Responds to changes in a list of services", func() {
 			So(len(monitor.Checks), ShouldEqual, 4)
 
-			ports := []service.Port{service.Port{"udp", 11234, 8080}, service.Port{"tcp", 1234, 8081}}
+			ports := []service.Port{service.Port{Type: "udp", Port: 11234, ServicePort: 8080}, service.Port{Type: "tcp", Port: 1234, ServicePort: 8081}}
 			svc := service.Service{ID: "babbacabba", Name: "testing-12312312", Ports: ports}
 			svcList := []service.Service{svc}
 
@@ -136,11 +151,15 @@ func Test_ServicesBridge(t *testing.T) {
 
 			cmd := HttpGetCmd{}
 			check := &Check{
-				ID:      svc.ID,
-				Command: &cmd,
-				Type:    "HttpGet",
-				Args:    "http://" + hostname + ":1234/",
-				Status:  FAILED,
+				ID:          svc.ID,
+				ServiceName: svc.Name,
+				Command:     &cmd,
+				Type:        "HttpGet",
+				Args:        "http://" + hostname + ":1234/",
+				Status:      FAILED,
+
+				HealthyThreshold:   DEFAULT_THRESHOLD,
+				UnhealthyThreshold: DEFAULT_THRESHOLD,
 			}
 			looper := director.NewTimedLooper(5, 5*time.Nanosecond, nil)
 
@@ -149,6 +168,92 @@ func Test_ServicesBridge(t *testing.T) {
 			So(len(monitor.Checks), ShouldEqual, 1)
 			So(monitor.Checks[svc.ID], ShouldResemble, check)
 		})
+
+		Convey("Stops the tickers of checks that are removed", func() {
+			var stopped bool
+			check1.ticks = make(chan time.Time)
+			check1.stopTicker = func() { stopped = true }
+
+			disco := &mockDiscoverer{listFn: func() []service.Service { return []service.Service{} }}
+			monitor.Watch(disco, director.NewFreeLooper(director.ONCE, nil))
+
+			So(stopped, ShouldBeTrue)
+			So(check1.ticks, ShouldBeNil)
+		})
+
+		Convey("Uses the service's check interval", func() {
+			svc := service.Service{ID: "babbacabba"}
+			disco := &mockDiscoverer{config: discovery.CheckConfig{Interval: 30 * time.Second}}
+			check := monitor.CheckForService(&svc, disco)
+			So(check.Interval, ShouldEqual, 30*time.Second)
+		})
+
+		Convey("Configures the expectations for HTTP checks", func() {
+			svc := service.Service{ID: "babbacabba", Name: "hasCheck"}
+			disco := &mockDiscoverer{
+				config: discovery.CheckConfig{ExpectedStatus: "204", ExpectedBody: "OK"},
+			}
+			check := monitor.CheckForService(&svc, disco)
+			So(check.ExpectedStatus, ShouldEqual, "204")
+			So(check.Command, ShouldResemble, &HttpGetCmd{MinStatus: 204, MaxStatus: 204, BodyMatch: "OK"})
+		})
+
+		Convey("Configures the timeout for command checks", func() {
+			svc := service.Service{ID: "babbacabba", Name: "hasCommandCheck"}
+			disco := &mockDiscoverer{
+				config: discovery.CheckConfig{Timeout: 5 * time.Second},
+			}
+			check := monitor.CheckForService(&svc, disco)
+			So(check.Timeout, ShouldEqual, 5*time.Second)
+			So(check.Command, ShouldResemble, &CommandCheck{Timeout: 5 * time.Second})
+		})
+
+		Convey("Configures the timeout for HTTP checks", func() {
+			svc := service.Service{ID: "babbacabba", Name: "hasCheck"}
+			disco := &mockDiscoverer{
+				config: discovery.CheckConfig{Timeout: 5 * time.Second},
+			}
+			check := monitor.CheckForService(&svc, disco)
+			So(check.Command, ShouldResemble, &HttpGetCmd{Timeout: 5 * time.Second})
+		})
+
+		Convey("Configures the timeout and reply for UDP checks", func() {
+			svc := service.Service{ID: "babbacabba", Name: "hasUdpCheck"}
+			disco := &mockDiscoverer{
+				config: discovery.CheckConfig{Timeout: 5 * time.Second, ExpectedBody: "pong"},
+			}
+			check := monitor.CheckForService(&svc, disco)
+			So(check.Command, ShouldResemble, &UdpProbeCmd{WaitForReply: true, ReplyMatch: "pong", Timeout: 5 * time.Second})
+		})
+
+		Convey("Uses the Monitor's timeout by default", func() {
+			monitor.CheckTimeout = 2 * time.Second
+
+			svc := service.Service{ID: "babbacabba", Name: "hasCheck"}
+			check := monitor.CheckForService(&svc, &mockDiscoverer{})
+			So(check.Timeout, ShouldEqual, 2*time.Second)
+			So(check.Command, ShouldResemble, &HttpGetCmd{Timeout: 2 * time.Second})
+		})
+
+		Convey("Uses the Monitor's thresholds by default", func() {
+			monitor.HealthyThreshold = 2
+			monitor.UnhealthyThreshold = 3
+
+			svc := service.Service{ID: "babbacabba"}
+			check := monitor.CheckForService(&svc, &mockDiscoverer{})
+			So(check.HealthyThreshold, ShouldEqual, 2)
+			So(check.UnhealthyThreshold, ShouldEqual, 3)
+		})
+
+		Convey("Uses the service's thresholds when set", func() {
+			svc := service.Service{ID: "babbacabba"}
+			disco := &mockDiscoverer{
+				config: discovery.CheckConfig{HealthyThreshold: 4, UnhealthyThreshold: 5},
+			}
+			check := monitor.CheckForService(&svc, disco)
+			So(check.HealthyThreshold, ShouldEqual, 4)
+			So(check.UnhealthyThreshold, ShouldEqual, 5)
+		})
 	})
 }
 
@@ -156,8 +261,9 @@ func Test_CheckForService(t *testing.T) {
 	Convey("When building a default check", t, func() {
 		svcId1 := "deadbeef123"
 		ports := []service.Port{
-			service.Port{"udp", 11234, 8080},
-			service.Port{"tcp", 1234, 8081},
+			service.Port{Type: "udp", Port: 11234, ServicePort: 8080},
+			service.Port{Type: "tcp", Port: 1234, ServicePort: 8081},
+			service.Port{Type: "tcp", Port: 1235, ServicePort: 9090, Name: "metrics"},
 		}
 		service1 := service.Service{ID: svcId1, Hostname: hostname, Ports: ports}
 
@@ -174,6 +280,17 @@ func Test_CheckForService(t *testing.T) {
 			So(check.ID, ShouldEqual, service1.ID)
 		})
 
+		Convey("Records the service and host for the logs", func() {
+			monitor := NewMonitor(hostname, "/")
+			service1.Name = "bocaccio"
+			check := monitor.CheckForService(&service1, &mockDiscoverer{})
+			So(check.ServiceName, ShouldEqual, "bocaccio")
+			So(check.Hostname, ShouldEqual, hostname)
+
+			monitor.ServiceNameFn = func(*service.Service) string { return "renamed" }
+			So(monitor.CheckForService(&service1, &mockDiscoverer{}).ServiceName, ShouldEqual, "renamed")
+		})
+
 		Convey("Templates in the check arguments", func() {
 			monitor := NewMonitor(hostname, "/")
 			service1.Name = "hasCheck"
@@ -181,11 +298,67 @@ func Test_CheckForService(t *testing.T) {
 			So(check.Args, ShouldEqual, "http://indefatigable:1234/status/check")
 		})
 
+		Convey("Templates in named ports", func() {
+			monitor := NewMonitor(hostname, "/")
+			service1.Name = "hasNamedPortCheck"
+			check := monitor.CheckForService(&service1, &mockDiscoverer{})
+			So(check.Args, ShouldEqual, "http://indefatigable:1235/metrics")
+		})
+
+		Convey("Uses the named port for the default check", func() {
+			monitor := NewMonitor(hostname, "/")
+			disco := &mockDiscoverer{config: discovery.CheckConfig{Port: "metrics"}}
+			check := monitor.CheckForService(&service1, disco)
+			So(check.Args, ShouldEqual, "http://indefatigable:1235/")
+		})
+
+		Convey("Falls back to the first TCP port when the named port is missing", func() {
+			monitor := NewMonitor(hostname, "/")
+			disco := &mockDiscoverer{config: discovery.CheckConfig{Port: "grpc"}}
+			check := monitor.CheckForService(&service1, disco)
+			So(check.Args, ShouldEqual, "http://indefatigable:1234/")
+		})
+
 		Convey("Uses the right default endpoint when it's configured", func() {
 			monitor := NewMonitor(hostname, "/something/else")
 			check := monitor.CheckForService(&service1, &mockDiscoverer{})
 			So(check.Args, ShouldEqual, "http://indefatigable:1234/something/else")
 		})
+
+		Convey("Uses the service's own path over the default endpoint", func() {
+			monitor := NewMonitor(hostname, "/something/else")
+			disco := &mockDiscoverer{config: discovery.CheckConfig{Path: "/healthz"}}
+			check := monitor.CheckForService(&service1, disco)
+			So(check.Args, ShouldEqual, "http://indefatigable:1234/healthz")
+		})
+
+		Convey("Uses HTTPS for the default check when asked", func() {
+			monitor := NewMonitor(hostname, "/")
+			disco := &mockDiscoverer{config: discovery.CheckConfig{Scheme: "https", TLSSkipVerify: true}}
+			check := monitor.CheckForService(&service1, disco)
+			So(check.Args, ShouldEqual, "https://indefatigable:1234/")
+			So(check.Command.(*HttpGetCmd).Client, ShouldNotBeNil)
+		})
+
+		Convey("Falls back to HTTP for unknown schemes", func() {
+			monitor := NewMonitor(hostname, "/")
+			disco := &mockDiscoverer{config: discovery.CheckConfig{Scheme: "gopher"}}
+			check := monitor.CheckForService(&service1, disco)
+			So(check.Args, ShouldEqual, "http://indefatigable:1234/")
+		})
+
+		Convey("Configures the Host and headers for HTTP checks", func() {
+			monitor := NewMonitor(hostname, "/")
+			disco := &mockDiscoverer{config: discovery.CheckConfig{
+				Host:    "web.example.com",
+				Headers: map[string]string{"X-Check": "sidecar"},
+			}}
+			check := monitor.CheckForService(&service1, disco)
+			So(check.Command, ShouldResemble, &HttpGetCmd{
+				Host:    "web.example.com",
+				Headers: map[string]string{"X-Check": "sidecar"},
+			})
+		})
 	})
 }
 
@@ -1,22 +1,50 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/haproxy"
 	"github.com/newrelic/sidecar/output"
 	"github.com/newrelic/sidecar/service"
 	"github.com/nitro/memberlist"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	EVENTS_BUFFER        = 50              // Events we'll hold for each /events client
+	EVENTS_WRITE_TIMEOUT = 5 * time.Second // How long a client has to take an event
+	NODE_UPDATE_TIMEOUT  = 2 * time.Second // How long we wait to tell peers we're draining
+
+	DEFAULT_BIND_ADDR = "0.0.0.0"
+	DEFAULT_API_PORT  = 7777
+)
+
+// An event sent to /events clients when a service changes
+type serviceEvent struct {
+	Transition     string
+	Hostname       string
+	Time           time.Time
+	PreviousStatus int
+	Service        service.Service
+}
+
 func makeHandler(fn func(http.ResponseWriter, *http.Request,
 	*memberlist.Memberlist, *catalog.ServicesState),
 	list *memberlist.Memberlist, state *catalog.ServicesState) http.HandlerFunc {
@@ -49,6 +77,97 @@ func watchHandler(response http.ResponseWriter, req *http.Request, list *memberl
 	}
 }
 
+// Stream state changes to the client as server-sent events. The client
+// first gets a snapshot of the whole state, then one event per service
+// change. Clients that can't keep up are disconnected, and will get a
+// new snapshot when they reconnect. We take over the connection so that
+// each write can have its own deadline.
+func eventsHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+	defer req.Body.Close()
+
+	hijacker, ok := response.(http.Hijacker)
+	if !ok {
+		http.Error(response, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Listen before taking the snapshot so we don't miss anything
+	events := make(chan catalog.ChangeEvent, EVENTS_BUFFER)
+	state.AddServiceListener(events)
+	defer state.RemoveServiceListener(events)
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to stream /events to %s: %s", req.RemoteAddr, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// The client doesn't send anything else, so a read only returns
+	// when it has gone away
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, buf)
+		close(closed)
+	}()
+
+	buf.WriteString("HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/event-stream\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n\r\n",
+	)
+
+	send := func(name string, data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(EVENTS_WRITE_TIMEOUT))
+		fmt.Fprintf(buf, "event: %s\ndata: %s\n\n", name, data)
+		return buf.Flush()
+	}
+
+	if send("snapshot", state.Encode()) != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-events:
+			// If the buffer filled up, we've probably missed events
+			if len(events) >= cap(events)-1 {
+				log.Warnf("Dropping slow /events client %s", req.RemoteAddr)
+				return
+			}
+
+			jsonStr, _ := json.Marshal(serviceEvent{
+				Transition:     transitionFor(&event),
+				Hostname:       event.Hostname,
+				Time:           event.Time,
+				PreviousStatus: event.PreviousStatus,
+				Service:        event.Service,
+			})
+
+			if send("service", jsonStr) != nil {
+				log.Warnf("Dropping /events client %s", req.RemoteAddr)
+				return
+			}
+		}
+	}
+}
+
+// Describe what happened to the service in a ChangeEvent
+func transitionFor(event *catalog.ChangeEvent) string {
+	switch {
+	case event.Removed:
+		return "removed"
+	case event.Service.IsTombstone():
+		return "tombstoned"
+	case event.PreviousStatus == catalog.NEW_SERVICE:
+		return "added"
+	default:
+		return "changed"
+	}
+}
+
 func servicesHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
 	params := mux.Vars(req)
 
@@ -62,6 +181,65 @@ func servicesHandler(response http.ResponseWriter, req *http.Request, list *memb
 	}
 }
 
+// Returns the instances of one service, named the same way as in
+// /services.json. Pass healthy=true to leave out the ones that aren't Alive.
+func serviceHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+	params := mux.Vars(req)
+
+	defer req.Body.Close()
+
+	instances, ok := state.ByService()[params["name"]]
+	if !ok {
+		http.Error(response, "Unknown service", http.StatusNotFound)
+		return
+	}
+
+	onlyHealthy := req.URL.Query().Get("healthy") == "true"
+
+	services := make([]*service.Service, 0, len(instances))
+	for _, svc := range instances {
+		if onlyHealthy && svc.Status != service.ALIVE {
+			continue
+		}
+		services = append(services, svc)
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonStr, _ := json.MarshalIndent(services, "", "  ")
+	response.Write(jsonStr)
+}
+
+// One of our own services, and whether we're telling the cluster it's Alive
+type localService struct {
+	service.Service
+	BroadcastAlive bool
+}
+
+// Returns only the services this node is advertising, grouped by name like
+// /services.json. Handy for checking discovery without involving gossip.
+func localServicesHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+	defer req.Body.Close()
+
+	draining := state.IsDraining()
+	services := make(map[string][]localService)
+	for name, instances := range state.ByService() {
+		for _, svc := range instances {
+			if svc.Hostname != state.Hostname {
+				continue
+			}
+
+			services[name] = append(services[name], localService{
+				Service:        *svc,
+				BroadcastAlive: svc.IsAlive() && !draining,
+			})
+		}
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonStr, _ := json.MarshalIndent(services, "", "  ")
+	response.Write(jsonStr)
+}
+
 func serversHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
 	defer req.Body.Close()
 
@@ -74,12 +252,346 @@ func serversHandler(response http.ResponseWriter, req *http.Request, list *membe
 	    	<pre>` + state.Format(list) + "</pre>"))
 }
 
+// What ?compact=true returns for each service: enough to find it and see
+// whether it's up
+type compactService struct {
+	ID       string
+	Name     string
+	Hostname string
+	Ports    []service.Port
+	Status   int
+	Updated  time.Time
+}
+
+type compactServer struct {
+	Name     string
+	Services map[string]compactService
+}
+
+// The whole state, as we gossip it. Dashboards polling a big cluster can
+// ask for less with ?service= (a name prefix), ?node= and ?healthy=true,
+// and ?compact=true leaves out the fields they probably don't need.
+// ?limit= and ?offset= page through the servers by name, and X-Total-Count
+// says how many there are in all. Without any of them, it's the full dump.
 func stateHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
 	defer req.Body.Close()
 
+	params := req.URL.Query()
+	if len(params) == 0 {
+		response.Header().Set("Content-Type", "application/json")
+		response.Write(state.Encode())
+		return
+	}
+
+	limit, err := queryInt(params, "limit")
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offset, err := queryInt(params, "offset")
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	servers := state.Query(catalog.StateQuery{
+		ServicePrefix: params.Get("service"),
+		Node:          params.Get("node"),
+		HealthyOnly:   params.Get("healthy") == "true",
+	})
+
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	total := len(names)
+	if offset > total {
+		offset = total
+	}
+	names = names[offset:]
+	if limit > 0 && limit < len(names) {
+		names = names[:limit]
+	}
+
+	var page interface{}
+	if params.Get("compact") == "true" {
+		compact := make(map[string]*compactServer, len(names))
+		for _, name := range names {
+			server := &compactServer{Name: name, Services: make(map[string]compactService)}
+			for id, svc := range servers[name].Services {
+				server.Services[id] = compactService{
+					ID: svc.ID, Name: svc.Name, Hostname: svc.Hostname,
+					Ports: svc.Ports, Status: svc.Status, Updated: svc.Updated,
+				}
+			}
+			compact[name] = server
+		}
+		page = compact
+	} else {
+		full := make(map[string]*catalog.Server, len(names))
+		for _, name := range names {
+			full[name] = servers[name]
+		}
+		page = full
+	}
+
 	response.Header().Set("Content-Type", "application/json")
-	response.Write(state.Encode())
-	return
+	response.Header().Set("X-Total-Count", strconv.Itoa(total))
+	jsonStr, _ := json.Marshal(page)
+	response.Write(jsonStr)
+}
+
+// A non-negative number from the query string, zero when it's not there
+func queryInt(params url.Values, name string) (int, error) {
+	value := params.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s '%s'", name, value)
+	}
+	return n, nil
+}
+
+// The gossip cluster members and their metadata, so monitoring can spot
+// draining nodes, or a node that can only see part of the cluster
+func membersHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonStr, _ := json.MarshalIndent(clusterMembers(list), "", "  ")
+	response.Write(jsonStr)
+}
+
+// Take this node out of service, or put it back in. Peers find out about
+// the node state from our memberlist metadata, and about our services
+// the next time we broadcast them.
+func drainHandler(draining bool) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		state.SetDraining(draining)
+		log.Warnf("Draining set to %t from %s", draining, req.RemoteAddr)
+
+		if list != nil {
+			err := list.UpdateNode(NODE_UPDATE_TIMEOUT)
+			if err != nil {
+				log.Errorf("Can't update node metadata: %s", err.Error())
+			}
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		jsonStr, _ := json.Marshal(struct{ Draining bool }{draining})
+		response.Write(jsonStr)
+	}
+}
+
+// Put one of this node's services into maintenance, or take it back out.
+// Peers find out the next time we broadcast it, which is right away since
+// its status changes.
+func maintenanceHandler(maintenance bool) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		id := mux.Vars(req)["id"]
+
+		if state.GetLocalService(id) == nil {
+			http.Error(response, "No such service on this node", http.StatusNotFound)
+			return
+		}
+
+		state.SetMaintenance(id, maintenance)
+		log.Warnf("Maintenance for %s set to %t from %s", id, maintenance, req.RemoteAddr)
+
+		response.Header().Set("Content-Type", "application/json")
+		jsonStr, _ := json.Marshal(struct {
+			ID          string
+			Maintenance bool
+		}{id, maintenance})
+		response.Write(jsonStr)
+	}
+}
+
+// Tombstone a service that should have gone away but didn't, and tell the
+// cluster. Works for services on any node. Returns the tombstoned service.
+func expireHandler(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+	defer req.Body.Close()
+
+	id := mux.Vars(req)["id"]
+
+	svc := state.ExpireService(id)
+	if svc == nil {
+		http.Error(response, "Unknown service", http.StatusNotFound)
+		return
+	}
+
+	log.Warnf("Service %s on %s force expired from %s", id, svc.Hostname, req.RemoteAddr)
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonStr, _ := json.MarshalIndent(svc, "", "  ")
+	response.Write(jsonStr)
+}
+
+// Returns 200 once we're ready for traffic, and 503 until then, so it can
+// be used as a readiness probe
+func readyHandler(ready func() bool, paused func() bool, failing func() bool) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		isReady := ready()
+
+		response.Header().Set("Content-Type", "application/json")
+		if !isReady {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+		// Being paused doesn't make us unready, but it's worth knowing.
+		// Neither do failing reloads: HAproxy still has the last good
+		// config, and a bad template shouldn't take out the whole fleet.
+		jsonStr, _ := json.Marshal(struct {
+			Ready          bool
+			Paused         bool `json:",omitempty"`
+			ReloadsFailing bool `json:",omitempty"`
+		}{isReady, paused(), failing()})
+		response.Write(jsonStr)
+	}
+}
+
+// Shows what HAproxy should be running, as JSON. Returns a 404 when we're
+// not managing HAproxy. With more than one, ?proxy=<name> picks which, and
+// it's the first one otherwise.
+func backendsHandler(proxies haproxies) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		proxy := requestedProxy(response, req, proxies)
+		if proxy == nil {
+			return
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		jsonStr, _ := json.MarshalIndent(proxy.Backends(state), "", "  ")
+		response.Write(jsonStr)
+	}
+}
+
+// Shows how the HAproxy config on disk differs from what we'd write now, as
+// a unified diff, without reloading. It's empty when they're the same.
+// Picks the HAproxy the same way as /backends.
+func backendsDiffHandler(proxies haproxies) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		proxy := requestedProxy(response, req, proxies)
+		if proxy == nil {
+			return
+		}
+
+		diff, err := proxy.Diff(state)
+		if err != nil {
+			http.Error(response, "Can't diff the HAproxy config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response.Header().Set("Content-Type", "text/plain")
+		response.Write([]byte(diff))
+	}
+}
+
+// The HAproxy named by ?proxy=<name>, or the first one. Writes a 404 and
+// returns nil if there isn't one.
+func requestedProxy(response http.ResponseWriter, req *http.Request, proxies haproxies) *haproxy.HAproxy {
+	if len(proxies) < 1 {
+		http.Error(response, "HAproxy is not enabled", http.StatusNotFound)
+		return nil
+	}
+
+	name := req.URL.Query().Get("proxy")
+	if name == "" {
+		return proxies[0]
+	}
+
+	proxy := proxies.named(name)
+	if proxy == nil {
+		http.Error(response, "No such HAproxy: "+name, http.StatusNotFound)
+	}
+	return proxy
+}
+
+// Shows the config we're running with, as JSON, minus the secrets. Even
+// so, it says a lot about the setup, so it's only served when the API
+// needs credentials.
+func configHandler(config Config) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		auth := config.Sidecar.ApiAuth
+		if auth.Username == "" && auth.Token == "" {
+			http.Error(response, "/config needs api_auth to be configured", http.StatusForbidden)
+			return
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		jsonStr, _ := json.MarshalIndent(config.redacted(), "", "  ")
+		response.Write(jsonStr)
+	}
+}
+
+// Require the API credentials on every request, except for /ready and
+// /healthz so that they still work as probes. Does nothing when there
+// aren't any.
+func requireAuth(auth ApiAuthConfig, next http.Handler) http.Handler {
+	if auth.Username == "" && auth.Token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(response http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ready" || req.URL.Path == "/healthz" || auth.allows(req) {
+			next.ServeHTTP(response, req)
+			return
+		}
+
+		if auth.Username != "" {
+			response.Header().Set("WWW-Authenticate", `Basic realm="sidecar"`)
+		} else {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(response, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Does the request have the bearer token or the basic auth credentials?
+func (auth ApiAuthConfig) allows(req *http.Request) bool {
+	header := req.Header.Get("Authorization")
+	if auth.Token != "" && strings.HasPrefix(header, "Bearer ") {
+		if secureCompare(strings.TrimPrefix(header, "Bearer "), auth.Token) {
+			return true
+		}
+	}
+
+	if auth.Username != "" {
+		username, password, ok := req.BasicAuth()
+		// Check both so the time taken doesn't say which one was wrong
+		usernameOk := secureCompare(username, auth.Username)
+		passwordOk := secureCompare(password, auth.Password)
+		if ok && usernameOk && passwordOk {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compare in constant time. Hashing first means the time doesn't give away
+// the length either.
+func secureCompare(given, expected string) bool {
+	givenHash := sha256.Sum256([]byte(given))
+	expectedHash := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(givenHash[:], expectedHash[:]) == 1
 }
 
 func statusStr(status int) string {
@@ -90,6 +602,8 @@ func statusStr(status int) string {
 		return "Tombstone"
 	case 2:
 		return "Unhealthy"
+	case 4:
+		return "Maintenance"
 	default:
 		return "Unknown"
 	}
@@ -175,13 +689,43 @@ func viewHandler(response http.ResponseWriter, req *http.Request, list *memberli
 	t.ExecuteTemplate(response, "services.html", viewData)
 }
 
-func serveHttp(list *memberlist.Memberlist, state *catalog.ServicesState) {
+// Grab the API port up front, so that if something else already has it we
+// find out before joining the cluster rather than after
+func listenHttp(bindAddr string, port int) (net.Listener, error) {
+	return net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+}
+
+func serveHttp(listener net.Listener, list *memberlist.Memberlist, state *catalog.ServicesState,
+	registry *prometheus.Registry, proxies haproxies, ready func() bool, pauser *pauseSwitch,
+	live *liveness, config Config) {
+
 	router := mux.NewRouter()
 
 	router.HandleFunc(
 		"/services{extension}", makeHandler(servicesHandler, list, state),
 	).Methods("GET")
 
+	// Has to come before /services/{name} or it would be taken for a name
+	router.HandleFunc(
+		"/services/local", makeHandler(localServicesHandler, list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/services/{name}", makeHandler(serviceHandler, list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/services/{id}/maintenance", makeHandler(maintenanceHandler(true), list, state),
+	).Methods("POST")
+
+	router.HandleFunc(
+		"/services/{id}/maintenance", makeHandler(maintenanceHandler(false), list, state),
+	).Methods("DELETE")
+
+	router.HandleFunc(
+		"/services/{id}/expire", makeHandler(expireHandler, list, state),
+	).Methods("POST")
+
 	router.HandleFunc(
 		"/servers", makeHandler(serversHandler, list, state),
 	).Methods("GET")
@@ -198,12 +742,66 @@ func serveHttp(list *memberlist.Memberlist, state *catalog.ServicesState) {
 		"/watch", makeHandler(watchHandler, list, state),
 	).Methods("GET")
 
+	router.HandleFunc(
+		"/events", makeHandler(eventsHandler, list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/ready", makeHandler(readyHandler(ready, pauser.Paused, proxies.Failing), list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/healthz", makeHandler(healthzHandler(live), list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/version", makeHandler(versionHandler(startTime, pauser.Paused), list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/backends", makeHandler(backendsHandler(proxies), list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/backends/diff", makeHandler(backendsDiffHandler(proxies), list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/config", makeHandler(configHandler(config), list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/cluster/members", makeHandler(membersHandler, list, state),
+	).Methods("GET")
+
+	router.HandleFunc(
+		"/drain", makeHandler(drainHandler(true), list, state),
+	).Methods("POST")
+
+	router.HandleFunc(
+		"/undrain", makeHandler(drainHandler(false), list, state),
+	).Methods("POST")
+
+	router.HandleFunc(
+		"/pause", makeHandler(pauseHandler(pauser, true), list, state),
+	).Methods("POST")
+
+	router.HandleFunc(
+		"/resume", makeHandler(pauseHandler(pauser, false), list, state),
+	).Methods("POST")
+
+	if registry != nil {
+		router.Handle(
+			"/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		).Methods("GET")
+	}
+
 	fs := http.FileServer(http.Dir("views/static/"))
 
 	router.Handle("/static/{file}", http.StripPrefix("/static/", fs))
 
-	http.Handle("/", router)
+	http.Handle("/", requireAuth(config.Sidecar.ApiAuth, router))
 
-	err := http.ListenAndServe("0.0.0.0:7777", nil)
-	exitWithError(err, "Can't start HTTP server")
+	err := http.Serve(listener, nil)
+	exitWithError(err, "HTTP server failed")
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/nitro/memberlist"
+	"github.com/relistan/go-director"
+)
+
+const (
+	DEFAULT_STALL_TIMEOUT = time.Minute // How long a key loop can go without running before /healthz fails
+)
+
+// Tracks when each of the key loops last ran, so /healthz can tell when one
+// of them has got stuck
+type liveness struct {
+	StallTimeout   time.Duration
+	MaxHealthScore int // Memberlist's worst health score, zero to ignore it
+	beats          map[string]time.Time
+	sync.RWMutex
+}
+
+func newLiveness(stallTimeout time.Duration, maxHealthScore int) *liveness {
+	return &liveness{
+		StallTimeout:   stallTimeout,
+		MaxHealthScore: maxHealthScore,
+		beats:          make(map[string]time.Time),
+	}
+}
+
+// Record that a loop ran
+func (l *liveness) Beat(name string) {
+	l.Lock()
+	defer l.Unlock()
+	l.beats[name] = time.Now().UTC()
+}
+
+// The loops that haven't run for longer than the StallTimeout, sorted
+func (l *liveness) Stalled(now time.Time) []string {
+	l.RLock()
+	defer l.RUnlock()
+
+	var stalled []string
+	for name, last := range l.beats {
+		if now.Sub(last) > l.StallTimeout {
+			stalled = append(stalled, name)
+		}
+	}
+	sort.Strings(stalled)
+
+	return stalled
+}
+
+// Wrap a looper so each run is recorded under the name. It beats when the
+// loop starts, so it's tracked from then, and after every run, paused or
+// not, so a run that never finishes shows up as stalled.
+func (l *liveness) Track(name string, looper director.Looper) director.Looper {
+	return &heartbeatLooper{Looper: looper, name: name, live: l}
+}
+
+type heartbeatLooper struct {
+	director.Looper
+	name string
+	live *liveness
+}
+
+func (l *heartbeatLooper) Loop(fn func() error) {
+	l.live.Beat(l.name)
+	l.Looper.Loop(func() error {
+		err := fn()
+		l.live.Beat(l.name)
+		return err
+	})
+}
+
+// What /healthz returns
+type healthzInfo struct {
+	Healthy     bool
+	Stalled     []string `json:",omitempty"` // Loops that haven't run in a while
+	HealthScore int      `json:",omitempty"` // From memberlist, zero is healthy
+}
+
+// Returns 200 as long as the key loops are running and memberlist is
+// healthy, and 503 otherwise, so it can be used as a liveness probe.
+// Unlike /ready, it doesn't care whether we've synced with the cluster.
+func healthzHandler(live *liveness) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		info := healthzInfo{Stalled: live.Stalled(time.Now().UTC())}
+		if list != nil {
+			info.HealthScore = list.GetHealthScore()
+		}
+
+		memberlistHealthy := live.MaxHealthScore < 1 || info.HealthScore < live.MaxHealthScore
+		info.Healthy = len(info.Stalled) == 0 && memberlistHealthy
+
+		response.Header().Set("Content-Type", "application/json")
+		if !info.Healthy {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+		jsonStr, _ := json.Marshal(info)
+		response.Write(jsonStr)
+	}
+}
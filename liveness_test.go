@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_liveness(t *testing.T) {
+	Convey("liveness", t, func() {
+		live := newLiveness(time.Minute, 7)
+
+		Convey("Nothing is stalled until it's been tracked", func() {
+			So(live.Stalled(time.Now().UTC()), ShouldBeEmpty)
+		})
+
+		Convey("Finds the loops that haven't run for the stall timeout", func() {
+			live.Beat("services")
+			live.Beat("discovery")
+			live.beats["discovery"] = time.Now().UTC().Add(-2 * time.Minute)
+
+			So(live.Stalled(time.Now().UTC()), ShouldResemble, []string{"discovery"})
+			So(live.Stalled(time.Now().UTC().Add(2*time.Minute)), ShouldResemble, []string{"discovery", "services"})
+		})
+
+		Convey("Track() beats when the loop starts and after every run", func() {
+			looper := live.Track("services", director.NewFreeLooper(2, nil))
+
+			runs := 0
+			looper.Loop(func() error {
+				runs++
+				live.beats["services"] = time.Time{}
+				return nil
+			})
+
+			So(runs, ShouldEqual, 2)
+			So(live.Stalled(time.Now().UTC()), ShouldBeEmpty)
+		})
+
+		Convey("Track() passes on errors", func() {
+			err := errors.New("boom")
+			done := make(chan error, 1)
+			looper := live.Track("services", director.NewFreeLooper(director.FOREVER, done))
+
+			looper.Loop(func() error { return err })
+
+			So(<-done, ShouldEqual, err)
+			So(live.Stalled(time.Now().UTC()), ShouldBeEmpty)
+		})
+	})
+}
+
+func Test_healthzHandler(t *testing.T) {
+	Convey("GET /healthz", t, func() {
+		state := catalog.NewServicesState()
+		live := newLiveness(time.Minute, 7)
+		live.Beat("services")
+
+		router := mux.NewRouter()
+		router.HandleFunc("/healthz", makeHandler(healthzHandler(live), nil, state)).Methods("GET")
+
+		Convey("Returns a 200 while the loops are running", func() {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldEqual, `{"Healthy":true}`)
+		})
+
+		Convey("Returns a 503 when a loop is stuck", func() {
+			live.beats["services"] = time.Now().UTC().Add(-2 * time.Minute)
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+			So(recorder.Code, ShouldEqual, 503)
+			So(recorder.Body.String(), ShouldEqual, `{"Healthy":false,"Stalled":["services"]}`)
+		})
+	})
+}
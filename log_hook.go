@@ -0,0 +1,33 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// Adds the cluster name to every log line, so logs from more than one
+// cluster can be told apart once they're shipped somewhere together.
+// Anything that already set the field keeps its own value, e.g. when
+// logging about a member of a different cluster.
+type clusterLogHook struct {
+	cluster string
+}
+
+func (h *clusterLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *clusterLogHook) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data["cluster"]; ok {
+		return nil
+	}
+
+	// The map can be shared with other entries, so we don't change it
+	data := make(log.Fields, len(entry.Data)+1)
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+	data["cluster"] = h.cluster
+	entry.Data = data
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_clusterLogHook(t *testing.T) {
+	Convey("clusterLogHook", t, func() {
+		hook := &clusterLogHook{cluster: "default"}
+
+		Convey("Fires for every level", func() {
+			So(hook.Levels(), ShouldResemble, log.AllLevels)
+		})
+
+		Convey("Adds the cluster to the entry", func() {
+			entry := log.WithField("node", "beowulf")
+
+			So(hook.Fire(entry), ShouldBeNil)
+			So(entry.Data["cluster"], ShouldEqual, "default")
+			So(entry.Data["node"], ShouldEqual, "beowulf")
+		})
+
+		Convey("Keeps a cluster that was already set", func() {
+			entry := log.WithField("cluster", "other")
+
+			hook.Fire(entry)
+			So(entry.Data["cluster"], ShouldEqual, "other")
+		})
+
+		Convey("Doesn't change the fields it was given", func() {
+			fields := log.Fields{"node": "beowulf"}
+			entry := log.WithFields(fields)
+
+			hook.Fire(entry)
+			So(fields, ShouldNotContainKey, "cluster")
+		})
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/relistan/go-director"
+)
+
+// A director.Looper like the TimedLooper, but each wait is varied at random
+// by up to Jitter, a fraction of the Interval. On average it still runs once
+// per Interval, but nodes that were started together drift apart rather than
+// all hitting the same health endpoints and gossiping at the same moment.
+type jitteredLooper struct {
+	Count    int
+	Interval time.Duration
+	Jitter   float64
+	DoneChan chan error
+	quitChan chan bool
+}
+
+func newJitteredLooper(count int, interval time.Duration, jitter float64, done chan error) *jitteredLooper {
+	return &jitteredLooper{
+		Count:    count,
+		Interval: interval,
+		Jitter:   jitter,
+		DoneChan: done,
+		quitChan: make(chan bool),
+	}
+}
+
+// How long to wait before the next run. Spread evenly around the Interval
+// so the average doesn't change.
+func (l *jitteredLooper) nextWait() time.Duration {
+	if l.Jitter <= 0 {
+		return l.Interval
+	}
+
+	offset := (rand.Float64()*2 - 1) * l.Jitter
+	return time.Duration(float64(l.Interval) * (1 + offset))
+}
+
+func (l *jitteredLooper) Loop(fn func() error) {
+	for i := 0; l.Count == director.FOREVER || i < l.Count; i++ {
+		timer := time.NewTimer(l.nextWait())
+
+		select {
+		case <-timer.C:
+		case <-l.quitChan:
+			timer.Stop()
+			l.Done(nil)
+			return
+		}
+
+		err := fn()
+		if err != nil {
+			l.Done(err)
+			return
+		}
+	}
+
+	l.Done(nil)
+}
+
+func (l *jitteredLooper) Wait() error {
+	return <-l.DoneChan
+}
+
+func (l *jitteredLooper) Done(err error) {
+	if l.DoneChan != nil {
+		l.DoneChan <- err
+	}
+}
+
+// Stop before the next run. Like the TimedLooper, this doesn't interrupt
+// a run that's in progress.
+func (l *jitteredLooper) Quit() {
+	go func() {
+		l.quitChan <- true
+	}()
+}
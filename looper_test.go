@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_jitteredLooper(t *testing.T) {
+	Convey("jitteredLooper", t, func() {
+		Convey("Waits exactly the interval without jitter", func() {
+			looper := newJitteredLooper(director.FOREVER, time.Second, 0, nil)
+			So(looper.nextWait(), ShouldEqual, time.Second)
+		})
+
+		Convey("Keeps the waits within the jitter and averages the interval", func() {
+			looper := newJitteredLooper(director.FOREVER, time.Second, 0.1, nil)
+
+			var total time.Duration
+			for i := 0; i < 1000; i++ {
+				wait := looper.nextWait()
+				So(wait, ShouldBeBetweenOrEqual, 900*time.Millisecond, 1100*time.Millisecond)
+				total += wait
+			}
+
+			So(total/1000, ShouldBeBetween, 980*time.Millisecond, 1020*time.Millisecond)
+		})
+
+		Convey("Runs the requested number of times", func() {
+			looper := newJitteredLooper(3, time.Millisecond, 0.1, make(chan error))
+			count := 0
+
+			go looper.Loop(func() error {
+				count++
+				return nil
+			})
+
+			So(looper.Wait(), ShouldBeNil)
+			So(count, ShouldEqual, 3)
+		})
+
+		Convey("Stops when the function returns an error", func() {
+			looper := newJitteredLooper(director.FOREVER, time.Millisecond, 0.1, make(chan error))
+
+			go looper.Loop(func() error {
+				return errors.New("stop")
+			})
+
+			So(looper.Wait(), ShouldNotBeNil)
+		})
+
+		Convey("Quits without running again", func() {
+			looper := newJitteredLooper(director.FOREVER, time.Hour, 0.1, make(chan error))
+			count := 0
+
+			go looper.Loop(func() error {
+				count++
+				return nil
+			})
+			looper.Quit()
+
+			So(looper.Wait(), ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/nitro/memberlist"
+	"github.com/relistan/go-director"
+)
+
+const (
+	PAUSE_WARN_INTERVAL = time.Minute // How often we remind the logs that we're paused
+)
+
+// Pausing stops discovery and health checks and holds off proxy updates,
+// so we can poke at a problem without Sidecar reacting to it. Loopers
+// can't be restarted once they quit, so they keep running and skip their
+// work while we're paused.
+type pauseSwitch struct {
+	paused bool
+	since  time.Time
+	sync.RWMutex
+}
+
+// Pause returns false if we were already paused
+func (p *pauseSwitch) Pause() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.paused {
+		return false
+	}
+
+	p.paused = true
+	p.since = time.Now().UTC()
+	return true
+}
+
+// Resume returns false if we weren't paused
+func (p *pauseSwitch) Resume() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.paused {
+		return false
+	}
+
+	p.paused = false
+	p.since = time.Time{}
+	return true
+}
+
+func (p *pauseSwitch) Paused() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.paused
+}
+
+// When we were paused, zero if we aren't
+func (p *pauseSwitch) Since() time.Time {
+	p.RLock()
+	defer p.RUnlock()
+	return p.since
+}
+
+// Wraps a director.Looper so each run is skipped while we're paused. The
+// looper itself keeps ticking, so resuming picks up on the next run.
+type pausableLooper struct {
+	director.Looper
+	paused func() bool
+}
+
+func (l *pausableLooper) Loop(fn func() error) {
+	l.Looper.Loop(func() error {
+		if l.paused() {
+			return nil
+		}
+		return fn()
+	})
+}
+
+// What /pause and /resume return
+type pauseInfo struct {
+	Paused bool
+	Since  *time.Time `json:",omitempty"`
+}
+
+// Pause or resume discovery and health checks. Logs loudly, since
+// nothing on this node tracks reality while it's paused.
+func pauseHandler(pauser *pauseSwitch, pause bool) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		if pause {
+			if pauser.Pause() {
+				log.WithField("event", "paused").
+					Warn("PAUSED: discovery, health checks, and proxy updates are stopped until /resume")
+			}
+		} else {
+			if pauser.Resume() {
+				log.WithField("event", "resumed").
+					Warn("RESUMED: discovery, health checks, and proxy updates are running again")
+			}
+		}
+
+		info := pauseInfo{Paused: pauser.Paused()}
+		if info.Paused {
+			since := pauser.Since()
+			info.Since = &since
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		jsonStr, _ := json.Marshal(info)
+		response.Write(jsonStr)
+	}
+}
+
+// Keep reminding whoever is watching the logs that we're paused
+func warnWhilePaused(pauser *pauseSwitch, looper director.Looper) {
+	looper.Loop(func() error {
+		if pauser.Paused() {
+			log.WithField("event", "paused").
+				Warnf("Still PAUSED since %s, POST to /resume to start again",
+					pauser.Since().Format(time.RFC3339))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_pauseSwitch(t *testing.T) {
+	Convey("pauseSwitch", t, func() {
+		pauser := &pauseSwitch{}
+
+		Convey("Starts out running", func() {
+			So(pauser.Paused(), ShouldBeFalse)
+			So(pauser.Since().IsZero(), ShouldBeTrue)
+		})
+
+		Convey("Pauses and resumes once", func() {
+			So(pauser.Pause(), ShouldBeTrue)
+			So(pauser.Pause(), ShouldBeFalse)
+			So(pauser.Paused(), ShouldBeTrue)
+			So(pauser.Since().IsZero(), ShouldBeFalse)
+
+			So(pauser.Resume(), ShouldBeTrue)
+			So(pauser.Resume(), ShouldBeFalse)
+			So(pauser.Paused(), ShouldBeFalse)
+			So(pauser.Since().IsZero(), ShouldBeTrue)
+		})
+	})
+}
+
+func Test_pausableLooper(t *testing.T) {
+	Convey("pausableLooper", t, func() {
+		paused := false
+		runs := 0
+		looper := &pausableLooper{
+			director.NewFreeLooper(3, make(chan error)),
+			func() bool { return paused },
+		}
+
+		Convey("Runs normally when we're not paused", func() {
+			go looper.Loop(func() error { runs++; return nil })
+			looper.Wait()
+			So(runs, ShouldEqual, 3)
+		})
+
+		Convey("Skips the runs while we're paused", func() {
+			paused = true
+			go looper.Loop(func() error { runs++; return nil })
+			looper.Wait()
+			So(runs, ShouldEqual, 0)
+		})
+	})
+}
+
+func Test_pauseHandler(t *testing.T) {
+	Convey("POST /pause and /resume", t, func() {
+		state := catalog.NewServicesState()
+		pauser := &pauseSwitch{}
+
+		router := mux.NewRouter()
+		router.HandleFunc("/pause", makeHandler(pauseHandler(pauser, true), nil, state)).Methods("POST")
+		router.HandleFunc("/resume", makeHandler(pauseHandler(pauser, false), nil, state)).Methods("POST")
+
+		post := func(path string) pauseInfo {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest("POST", path, nil))
+			So(recorder.Code, ShouldEqual, 200)
+
+			var info pauseInfo
+			So(json.Unmarshal(recorder.Body.Bytes(), &info), ShouldBeNil)
+			return info
+		}
+
+		Convey("Pauses, and says since when", func() {
+			info := post("/pause")
+			So(info.Paused, ShouldBeTrue)
+			So(info.Since, ShouldNotBeNil)
+			So(pauser.Paused(), ShouldBeTrue)
+
+			Convey("Pausing again keeps the original time", func() {
+				So(post("/pause").Since.Equal(*info.Since), ShouldBeTrue)
+			})
+
+			Convey("Resumes", func() {
+				info := post("/resume")
+				So(info.Paused, ShouldBeFalse)
+				So(info.Since, ShouldBeNil)
+				So(pauser.Paused(), ShouldBeFalse)
+			})
+		})
+
+		Convey("Doesn't accept a GET", func() {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest("GET", "/pause", nil))
+			So(recorder.Code, ShouldNotEqual, 200)
+		})
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// A go-metrics sink that keeps everything in a Prometheus registry, so it
+// can be scraped from /metrics. Works alongside the statsd sink.
+type prometheusSink struct {
+	hostname   string
+	registerer prometheus.Registerer
+	gauges     map[string]prometheus.Gauge
+	summaries  map[string]prometheus.Summary
+	counters   map[string]prometheus.Counter
+	sync.Mutex
+}
+
+// Returns a sink that registers its metrics with the registerer. The
+// hostname is dropped from gauge names because Prometheus already knows
+// which host it scraped.
+func newPrometheusSink(registerer prometheus.Registerer, hostname string) *prometheusSink {
+	return &prometheusSink{
+		hostname:   hostname,
+		registerer: registerer,
+		gauges:     make(map[string]prometheus.Gauge),
+		summaries:  make(map[string]prometheus.Summary),
+		counters:   make(map[string]prometheus.Counter),
+	}
+}
+
+// Turn a go-metrics key into a valid Prometheus metric name
+func (p *prometheusSink) flattenKey(parts []string) string {
+	if len(parts) > 1 && parts[1] == p.hostname {
+		parts = append([]string{parts[0]}, parts[2:]...)
+	}
+
+	return invalidMetricChars.ReplaceAllString(strings.Join(parts, "_"), "_")
+}
+
+func (p *prometheusSink) SetGauge(parts []string, val float32) {
+	p.Lock()
+	defer p.Unlock()
+
+	key := p.flattenKey(parts)
+	gauge, ok := p.gauges[key]
+	if !ok {
+		gauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: key, Help: key})
+		p.registerer.MustRegister(gauge)
+		p.gauges[key] = gauge
+	}
+	gauge.Set(float64(val))
+}
+
+func (p *prometheusSink) AddSample(parts []string, val float32) {
+	p.Lock()
+	defer p.Unlock()
+
+	key := p.flattenKey(parts)
+	summary, ok := p.summaries[key]
+	if !ok {
+		summary = prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:   key,
+			Help:   key,
+			MaxAge: 10 * time.Second,
+		})
+		p.registerer.MustRegister(summary)
+		p.summaries[key] = summary
+	}
+	summary.Observe(float64(val))
+}
+
+// Prometheus has no type for this, since it pulls rather than being
+// pushed to, so these are dropped.
+func (p *prometheusSink) EmitKey(parts []string, val float32) {}
+
+func (p *prometheusSink) IncrCounter(parts []string, val float32) {
+	p.Lock()
+	defer p.Unlock()
+
+	key := p.flattenKey(parts)
+	counter, ok := p.counters[key]
+	if !ok {
+		counter = prometheus.NewCounter(prometheus.CounterOpts{Name: key, Help: key})
+		p.registerer.MustRegister(counter)
+		p.counters[key] = counter
+	}
+	counter.Add(float64(val))
+}
+
+// Reports how many instances of each service are in the state, by status.
+// This is worked out when we're scraped, so it's never stale.
+type servicesCollector struct {
+	state *catalog.ServicesState
+	desc  *prometheus.Desc
+}
+
+func newServicesCollector(state *catalog.ServicesState) *servicesCollector {
+	return &servicesCollector{
+		state: state,
+		desc: prometheus.NewDesc(
+			"sidecar_services",
+			"Instances of each service in the cluster, by status",
+			[]string{"service", "status"}, nil,
+		),
+	}
+}
+
+func (c *servicesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *servicesCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, services := range c.state.ByService() {
+		counts := make(map[string]int)
+		for _, svc := range services {
+			counts[svc.StatusString()]++
+		}
+
+		for status, count := range counts {
+			ch <- prometheus.MustNewConstMetric(
+				c.desc, prometheus.GaugeValue, float64(count), name, status,
+			)
+		}
+	}
+}
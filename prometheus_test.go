@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Find a metric family in the registry by name
+func gatherFamily(registry *prometheus.Registry, name string) *dto.MetricFamily {
+	families, _ := registry.Gather()
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+
+	return nil
+}
+
+func Test_prometheusSink(t *testing.T) {
+	Convey("prometheusSink", t, func() {
+		registry := prometheus.NewRegistry()
+		sink := newPrometheusSink(registry, "indomitable")
+
+		Convey("Flattens keys into valid names", func() {
+			So(sink.flattenKey([]string{"sidecar", "haproxy", "reloads"}), ShouldEqual, "sidecar_haproxy_reloads")
+			So(sink.flattenKey([]string{"sidecar", "some.thing-else"}), ShouldEqual, "sidecar_some_thing_else")
+		})
+
+		Convey("Leaves the hostname out of gauge names", func() {
+			So(sink.flattenKey([]string{"sidecar", "indomitable", "goroutines"}), ShouldEqual, "sidecar_goroutines")
+		})
+
+		Convey("Accumulates counters", func() {
+			sink.IncrCounter([]string{"sidecar", "haproxy", "reloads"}, 1)
+			sink.IncrCounter([]string{"sidecar", "haproxy", "reloads"}, 2)
+
+			family := gatherFamily(registry, "sidecar_haproxy_reloads")
+			So(family, ShouldNotBeNil)
+			So(family.Metric[0].GetCounter().GetValue(), ShouldEqual, 3)
+		})
+
+		Convey("Keeps the last value of gauges", func() {
+			sink.SetGauge([]string{"sidecar", "indomitable", "pending"}, 5)
+			sink.SetGauge([]string{"sidecar", "indomitable", "pending"}, 2)
+
+			family := gatherFamily(registry, "sidecar_pending")
+			So(family, ShouldNotBeNil)
+			So(family.Metric[0].GetGauge().GetValue(), ShouldEqual, 2)
+		})
+	})
+}
+
+func Test_servicesCollector(t *testing.T) {
+	Convey("servicesCollector counts services by name and status", t, func() {
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		state.AddServiceEntry(service.Service{ID: "deadbeef123", Image: "web", Hostname: "indomitable", Updated: baseTime})
+		state.AddServiceEntry(service.Service{ID: "deadbeef101", Image: "web", Hostname: "indefatigable", Updated: baseTime})
+		state.AddServiceEntry(service.Service{ID: "deadbeef105", Image: "web", Hostname: "indefatigable", Updated: baseTime, Status: service.UNHEALTHY})
+
+		registry := prometheus.NewRegistry()
+		prometheus.WrapRegistererWith(prometheus.Labels{"cluster": "default"}, registry).
+			MustRegister(newServicesCollector(state))
+
+		family := gatherFamily(registry, "sidecar_services")
+		So(family, ShouldNotBeNil)
+		So(len(family.Metric), ShouldEqual, 2)
+
+		counts := make(map[string]float64)
+		for _, metric := range family.Metric {
+			labels := make(map[string]string)
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			So(labels["cluster"], ShouldEqual, "default")
+			So(labels["service"], ShouldEqual, "web")
+			counts[labels["status"]] = metric.GetGauge().GetValue()
+		}
+
+		So(counts["Alive"], ShouldEqual, 2)
+		So(counts["Unhealthy"], ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DNS_SRV_PREFIX       = "dnssrv:"       // Seeds like "dnssrv:_sidecar._tcp.example.com"
+	SEED_LOOKUP_ATTEMPTS = 5               // DNS can lag behind new pods, so we retry
+	SEED_LOOKUP_INTERVAL = 2 * time.Second // Time between lookups
+
+	DEFAULT_JOIN_RETRY_TIMEOUT = time.Minute      // How long we keep trying to join the cluster
+	JOIN_RETRY_INTERVAL        = time.Second      // Wait before the first retry, it doubles each time
+	JOIN_MAX_RETRY_INTERVAL    = 15 * time.Second // But never waits longer than this
+)
+
+// Looks up SRV records by their full name, like net.LookupSRV
+type srvLookupFunc func(name string) ([]*net.SRV, error)
+
+func lookupSRV(name string) ([]*net.SRV, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	return addrs, err
+}
+
+// Expand any DNS SRV entries in the seeds into host:port pairs, leaving
+// everything else alone. Records that come back empty are retried a few
+// times. It's an error to end up without any seeds at all.
+func resolveSeeds(seeds []string, lookup srvLookupFunc, attempts int, interval time.Duration) ([]string, error) {
+	var resolved []string
+
+	for _, seed := range seeds {
+		if !strings.HasPrefix(seed, DNS_SRV_PREFIX) {
+			resolved = append(resolved, seed)
+			continue
+		}
+
+		name := strings.TrimPrefix(seed, DNS_SRV_PREFIX)
+		for i := 0; i < attempts; i++ {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+
+			addrs, err := lookup(name)
+			if err != nil || len(addrs) == 0 {
+				log.Warnf("No seeds found for %s, attempt %d of %d (%v)", name, i+1, attempts, err)
+				continue
+			}
+
+			for _, addr := range addrs {
+				host := strings.TrimSuffix(addr.Target, ".")
+				resolved = append(resolved, net.JoinHostPort(host, strconv.Itoa(int(addr.Port))))
+			}
+			break
+		}
+	}
+
+	if len(resolved) == 0 {
+		return nil, errors.New("No cluster seeds found")
+	}
+
+	return resolved, nil
+}
+
+// Seeds can have their own ports, like "10.0.0.1:8000" or "[fc00::1]:8000".
+// The ones that don't get the port we gossip on. Memberlist would use its
+// bind port instead, and mistakes a bare IPv6 address for one with a port.
+func seedsWithPort(seeds []string, port int) []string {
+	result := make([]string, 0, len(seeds))
+	for _, seed := range seeds {
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			seed = net.JoinHostPort(strings.Trim(seed, "[]"), strconv.Itoa(port))
+		}
+		result = append(result, seed)
+	}
+
+	return result
+}
+
+// Joins the seeds and returns how many it reached, like memberlist's Join
+type joinFunc func(seeds []string) (int, error)
+
+// Join the cluster, retrying with backoff until at least one seed answers
+// or the timeout runs out. When seeds are started at the same time as we
+// are, they can take a few seconds to come up. With no timeout, it's tried
+// just once. Reaching only some of the seeds is good enough, since they'll
+// tell us about the rest.
+func joinCluster(seeds []string, join joinFunc, timeout time.Duration, interval time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+
+	for attempt := 1; ; attempt++ {
+		joined, err := join(seeds)
+		if err == nil && joined > 0 {
+			if joined < len(seeds) {
+				log.Warnf("Joined the cluster on attempt %d, but only reached %d of %d seeds", attempt, joined, len(seeds))
+			} else {
+				log.Infof("Joined the cluster on attempt %d, reached all %d seeds", attempt, joined)
+			}
+			return joined, nil
+		}
+
+		if err == nil {
+			err = errors.New("No seeds could be reached")
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			log.Errorf("Giving up joining the cluster after %d attempts: %s", attempt, err)
+			return 0, err
+		}
+
+		if interval < wait {
+			wait = interval
+		}
+		log.Warnf("Failed to join the cluster, attempt %d, retrying in %s: %s", attempt, wait, err)
+		time.Sleep(wait)
+
+		interval *= 2
+		if interval > JOIN_MAX_RETRY_INTERVAL {
+			interval = JOIN_MAX_RETRY_INTERVAL
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_resolveSeeds(t *testing.T) {
+	Convey("resolveSeeds()", t, func() {
+		lookups := 0
+		records := []*net.SRV{
+			{Target: "sidecar1.example.com.", Port: 7946},
+			{Target: "sidecar2.example.com.", Port: 7947},
+		}
+		lookup := func(name string) ([]*net.SRV, error) {
+			lookups++
+			if name != "_sidecar._tcp.example.com" {
+				return nil, errors.New("no such host")
+			}
+			return records, nil
+		}
+
+		Convey("Leaves literal seeds alone", func() {
+			seeds, err := resolveSeeds([]string{"10.0.0.1", "10.0.0.2:7946"}, lookup, 3, 0)
+
+			So(err, ShouldBeNil)
+			So(seeds, ShouldResemble, []string{"10.0.0.1", "10.0.0.2:7946"})
+			So(lookups, ShouldEqual, 0)
+		})
+
+		Convey("Expands SRV records alongside literal seeds", func() {
+			seeds, err := resolveSeeds(
+				[]string{"10.0.0.1", "dnssrv:_sidecar._tcp.example.com"}, lookup, 3, 0,
+			)
+
+			So(err, ShouldBeNil)
+			So(seeds, ShouldResemble, []string{
+				"10.0.0.1", "sidecar1.example.com:7946", "sidecar2.example.com:7947",
+			})
+		})
+
+		Convey("Retries lookups that find nothing", func() {
+			empty := 2
+			lagging := func(name string) ([]*net.SRV, error) {
+				lookups++
+				if lookups <= empty {
+					return []*net.SRV{}, nil
+				}
+				return records, nil
+			}
+
+			seeds, err := resolveSeeds([]string{"dnssrv:_sidecar._tcp.example.com"}, lagging, 3, 0)
+
+			So(err, ShouldBeNil)
+			So(lookups, ShouldEqual, 3)
+			So(len(seeds), ShouldEqual, 2)
+		})
+
+		Convey("Returns an error when there are no seeds", func() {
+			_, err := resolveSeeds([]string{"dnssrv:_missing._tcp.example.com"}, lookup, 3, 0)
+
+			So(err, ShouldNotBeNil)
+			So(lookups, ShouldEqual, 3)
+		})
+
+		Convey("Carries on with literal seeds when a lookup fails", func() {
+			seeds, err := resolveSeeds(
+				[]string{"dnssrv:_missing._tcp.example.com", "10.0.0.1"}, lookup, 2, 0,
+			)
+
+			So(err, ShouldBeNil)
+			So(seeds, ShouldResemble, []string{"10.0.0.1"})
+		})
+	})
+}
+
+func Test_seedsWithPort(t *testing.T) {
+	Convey("seedsWithPort()", t, func() {
+		Convey("Gives seeds without a port the gossip port", func() {
+			So(seedsWithPort([]string{"10.0.0.1", "sidecar1.example.com"}, 8000), ShouldResemble,
+				[]string{"10.0.0.1:8000", "sidecar1.example.com:8000"})
+		})
+
+		Convey("Keeps the ports seeds already have", func() {
+			So(seedsWithPort([]string{"10.0.0.1:7946", "[fc00::1]:7947"}, 8000), ShouldResemble,
+				[]string{"10.0.0.1:7946", "[fc00::1]:7947"})
+		})
+
+		Convey("Handles bare IPv6 addresses", func() {
+			So(seedsWithPort([]string{"fc00::1", "[fc00::2]"}, 8000), ShouldResemble,
+				[]string{"[fc00::1]:8000", "[fc00::2]:8000"})
+		})
+	})
+}
+
+func Test_joinCluster(t *testing.T) {
+	Convey("joinCluster()", t, func() {
+		seeds := []string{"10.0.0.1:7946", "10.0.0.2:7946"}
+		attempts := 0
+
+		// Fails until the given attempt, then reaches this many seeds
+		joinAfter := func(attempt int, reached int) joinFunc {
+			return func(seeds []string) (int, error) {
+				attempts++
+				if attempts < attempt {
+					return 0, errors.New("connection refused")
+				}
+				return reached, nil
+			}
+		}
+
+		Convey("Joins on the first attempt when it can", func() {
+			joined, err := joinCluster(seeds, joinAfter(1, 2), time.Second, time.Millisecond)
+
+			So(err, ShouldBeNil)
+			So(joined, ShouldEqual, 2)
+			So(attempts, ShouldEqual, 1)
+		})
+
+		Convey("Retries until the seeds come up", func() {
+			joined, err := joinCluster(seeds, joinAfter(3, 2), time.Second, time.Millisecond)
+
+			So(err, ShouldBeNil)
+			So(joined, ShouldEqual, 2)
+			So(attempts, ShouldEqual, 3)
+		})
+
+		Convey("Accepts reaching only some of the seeds", func() {
+			joined, err := joinCluster(seeds, joinAfter(1, 1), time.Second, time.Millisecond)
+
+			So(err, ShouldBeNil)
+			So(joined, ShouldEqual, 1)
+		})
+
+		Convey("Gives up when the timeout runs out", func() {
+			joined, err := joinCluster(seeds, joinAfter(1000, 2), 20*time.Millisecond, time.Millisecond)
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "connection refused")
+			So(joined, ShouldEqual, 0)
+			So(attempts, ShouldBeGreaterThan, 1)
+		})
+
+		Convey("Tries just once without a timeout", func() {
+			_, err := joinCluster(seeds, joinAfter(2, 2), 0, time.Millisecond)
+
+			So(err, ShouldNotBeNil)
+			So(attempts, ShouldEqual, 1)
+		})
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,12 +20,43 @@ const (
 	TOMBSTONE = iota
 	UNHEALTHY = iota
 	UNKNOWN   = iota
+	// Deliberately out of rotation, but still listed and not failing
+	MAINTENANCE = iota
+)
+
+const (
+	METADATA_PREFIX = "Metadata_" // Labels like "Metadata_canary=true" become metadata
+	MAX_METADATA    = 16          // Metadata beyond this is dropped, it's gossiped a lot
+	TAG_PREFIX      = "Tag_"      // Labels like "Tag_region=us-east" become tags
+	MAX_TAGS        = 8           // Tags beyond this are dropped, like metadata
+	MAX_WEIGHT      = 256         // The highest server weight HAproxy accepts
+	// Metadata like "60s": how long the proxy keeps a service after it's
+	// tombstoned, so it can finish what it's doing
+	DRAIN_GRACE_METADATA = "drain_grace"
+	// Metadata naming the environment the service belongs to. Services
+	// with one are grouped under "<environment>-<name>".
+	ENVIRONMENT_METADATA = "environment"
+	// Metadata "true" keeps a service on this host: it goes in the local
+	// state and proxy, but it's never gossiped to the rest of the cluster
+	LOCAL_ONLY_METADATA = "local_only"
+	// Metadata like "db,cache": the services that need to be healthy
+	// somewhere in the cluster before this one is advertised as healthy
+	DEPENDS_ON_METADATA = "depends_on"
+)
+
+// What Docker says about a container with a HEALTHCHECK
+const (
+	DOCKER_HEALTHY   = "healthy"
+	DOCKER_UNHEALTHY = "unhealthy"
+	DOCKER_STARTING  = "starting"
 )
 
 type Port struct {
 	Type        string
 	Port        int64
 	ServicePort int64
+	// Optional, like "api" or "metrics". Left out when empty for older nodes.
+	Name string `json:",omitempty"`
 }
 
 type Service struct {
@@ -36,6 +69,21 @@ type Service struct {
 	Updated     time.Time
 	ProxyMode string
 	Status      int
+	// Left out when empty so messages from older nodes look the same
+	Metadata map[string]string `json:",omitempty"`
+	// Share of traffic relative to other instances. Zero means the default.
+	Weight int `json:",omitempty"`
+	// Pin clients to one instance with a cookie. The cookie name is optional.
+	Sticky       bool   `json:",omitempty"`
+	StickyCookie string `json:",omitempty"`
+	// Used for routing, e.g. by region. Can come from the service or the node.
+	Tags map[string]string `json:",omitempty"`
+	// Where to reach it when that's not its host, like a Kubernetes pod IP.
+	// Left out when empty for older nodes.
+	IP string `json:",omitempty"`
+	// The container's Docker health, if it has a HEALTHCHECK. Only used
+	// locally, it's never gossiped.
+	DockerHealth string `json:"-"`
 }
 
 func (svc Service) Encode() ([]byte, error) {
@@ -50,11 +98,21 @@ func (svc *Service) StatusString() string {
 		return "Unhealthy"
 	case UNKNOWN:
 		return "Unknown"
+	case MAINTENANCE:
+		return "Maintenance"
 	default:
 		return "Tombstone"
 	}
 }
 
+// The address to send traffic to: its own IP if it has one, otherwise its host
+func (svc *Service) Address() string {
+	if svc.IP != "" {
+		return svc.IP
+	}
+	return svc.Hostname
+}
+
 func (svc *Service) IsAlive() bool {
 	return svc.Status == ALIVE
 }
@@ -63,6 +121,54 @@ func (svc *Service) IsTombstone() bool {
 	return svc.Status == TOMBSTONE
 }
 
+func (svc *Service) IsMaintenance() bool {
+	return svc.Status == MAINTENANCE
+}
+
+// The names of the services this one depends on, from its metadata
+func (svc *Service) Dependencies() []string {
+	var names []string
+	for _, name := range strings.Split(svc.Metadata[DEPENDS_ON_METADATA], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// How long the service keeps draining after it's tombstoned. Zero when
+// it's not set, or doesn't parse.
+func (svc *Service) DrainGrace() time.Duration {
+	value, ok := svc.Metadata[DRAIN_GRACE_METADATA]
+	if !ok {
+		return 0
+	}
+
+	grace, err := time.ParseDuration(value)
+	if err != nil || grace < 0 {
+		log.Warnf("Ignoring bad %s '%s' for service %s", DRAIN_GRACE_METADATA, value, svc.ID)
+		return 0
+	}
+
+	return grace
+}
+
+// Tombstoned, but still inside its drain grace, so the proxy should keep
+// existing connections but not send it new ones
+func (svc *Service) IsDraining(now time.Time) bool {
+	if !svc.IsTombstone() {
+		return false
+	}
+
+	grace := svc.DrainGrace()
+	return grace > 0 && now.Before(svc.Updated.Add(grace))
+}
+
+// Should the service stay off the gossip?
+func (svc *Service) IsLocalOnly() bool {
+	return svc.Metadata[LOCAL_ONLY_METADATA] == "true"
+}
+
 func (svc *Service) Invalidates(otherSvc *Service) bool {
 	return otherSvc != nil && svc.Updated.After(otherSvc.Updated)
 }
@@ -101,6 +207,25 @@ func (svc *Service) PortForServicePort(findPort int64, pType string) int64 {
 	return -1
 }
 
+// Look up a mapped Port for a service by the port's name
+func (svc *Service) PortForName(name string) int64 {
+	for _, port := range svc.Ports {
+		if port.Name == name {
+			return port.Port
+		}
+	}
+
+	log.Warnf("Unable to find port named '%s' for service %s", name, svc.ID)
+	return -1
+}
+
+// Clean up image names for use in proxy configs, e.g. as HAproxy frontends
+// and backends, or Envoy listeners and clusters
+func SanitizeName(image string) string {
+	replace := regexp.MustCompile("[^a-z0-9-]")
+	return replace.ReplaceAllString(image, "-")
+}
+
 func Decode(data []byte) *Service {
 	var svc Service
 	json.Unmarshal(data, &svc)
@@ -128,6 +253,12 @@ func ToService(container *docker.APIContainers) Service {
 		svc.ProxyMode = "http"
 	}
 
+	svc.Metadata = MetadataFromLabels(container.Labels)
+	svc.Tags = TagsFromLabels(container.Labels)
+	svc.Weight = WeightFromLabels(container.Labels)
+	svc.Sticky, svc.StickyCookie = StickyFromLabels(container.Labels)
+	svc.DockerHealth = DockerHealthFromStatus(container.Status)
+
 	svc.Ports = make([]Port, 0)
 
 	for _, port := range container.Ports {
@@ -139,6 +270,125 @@ func ToService(container *docker.APIContainers) Service {
 	return svc
 }
 
+// Docker puts the health in the container status, like "Up 5 minutes
+// (healthy)". Returns an empty string for containers without a HEALTHCHECK.
+func DockerHealthFromStatus(status string) string {
+	switch {
+	case strings.HasSuffix(status, "(healthy)"):
+		return DOCKER_HEALTHY
+	case strings.HasSuffix(status, "(unhealthy)"):
+		return DOCKER_UNHEALTHY
+	case strings.HasSuffix(status, "(health: starting)"):
+		return DOCKER_STARTING
+	default:
+		return ""
+	}
+}
+
+// Pull the metadata out of a set of labels. Metadata labels are named
+// by convention in the format "Metadata_canary=true". Only MAX_METADATA
+// entries are kept, in order of their keys.
+func MetadataFromLabels(labels map[string]string) map[string]string {
+	return labelsWithPrefix(labels, METADATA_PREFIX, MAX_METADATA, "metadata")
+}
+
+// Pull the tags out of a set of labels, in the format "Tag_region=us-east".
+// Only MAX_TAGS entries are kept, in order of their keys.
+func TagsFromLabels(labels map[string]string) map[string]string {
+	return labelsWithPrefix(labels, TAG_PREFIX, MAX_TAGS, "tag")
+}
+
+// Collect the labels starting with the prefix, with the prefix removed.
+// Returns nil when there aren't any.
+func labelsWithPrefix(labels map[string]string, prefix string, max int, kind string) map[string]string {
+	var keys []string
+	for label := range labels {
+		if strings.HasPrefix(label, prefix) && len(label) > len(prefix) {
+			keys = append(keys, label)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Strings(keys)
+	if len(keys) > max {
+		log.Warnf("Dropping %d %s labels over the limit of %d", len(keys)-max, kind, max)
+		keys = keys[:max]
+	}
+
+	result := make(map[string]string, len(keys))
+	for _, label := range keys {
+		result[strings.TrimPrefix(label, prefix)] = labels[label]
+	}
+
+	return result
+}
+
+// Add the node's tags to the service's own, which take precedence. This
+// makes a new map, so the service's original tags are left alone.
+func (svc *Service) AddTags(tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	merged := make(map[string]string, len(tags)+len(svc.Tags))
+	for key, value := range tags {
+		merged[key] = value
+	}
+	for key, value := range svc.Tags {
+		merged[key] = value
+	}
+
+	svc.Tags = merged
+}
+
+// The environment the service belongs to, empty if it doesn't have one
+func (svc *Service) Environment() string {
+	return svc.Metadata[ENVIRONMENT_METADATA]
+}
+
+// Put the service in the node's environment, unless it picked its own.
+// Like AddTags, this makes a new map rather than changing the original.
+func (svc *Service) SetEnvironment(env string) {
+	if env == "" || svc.Environment() != "" {
+		return
+	}
+
+	metadata := make(map[string]string, len(svc.Metadata)+1)
+	for key, value := range svc.Metadata {
+		metadata[key] = value
+	}
+	metadata[ENVIRONMENT_METADATA] = env
+
+	svc.Metadata = metadata
+}
+
+// Pull the proxy weight out of a set of labels, from "ProxyWeight=5".
+// Returns 0, meaning no weight, when it's missing or out of range.
+func WeightFromLabels(labels map[string]string) int {
+	value, ok := labels["ProxyWeight"]
+	if !ok {
+		return 0
+	}
+
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 || weight > MAX_WEIGHT {
+		log.Warnf("Ignoring ProxyWeight '%s', should be from 1 to %d", value, MAX_WEIGHT)
+		return 0
+	}
+
+	return weight
+}
+
+// Work out if a service wants sticky sessions from "ProxySticky=true", or
+// from naming the cookie with "ProxyStickyCookie=SESSION".
+func StickyFromLabels(labels map[string]string) (bool, string) {
+	cookie := labels["ProxyStickyCookie"]
+	return labels["ProxySticky"] == "true" || cookie != "", cookie
+}
+
 // Figure out the correct port configuration for a service
 func buildPortFor(port *docker.APIPort, container *docker.APIContainers) Port {
 	// We look up service port labels by convention in the format "ServicePort_8080=80"
@@ -146,6 +396,9 @@ func buildPortFor(port *docker.APIPort, container *docker.APIContainers) Port {
 
 	returnPort := Port{Port: port.PublicPort, Type: port.Type}
 
+	// Ports can be named, like "PortName_8080=api"
+	returnPort.Name = container.Labels[fmt.Sprintf("PortName_%d", port.PrivatePort)]
+
 	if svcPort, ok := container.Labels[svcPortLabel]; ok {
 		svcPortInt, err := strconv.Atoi(svcPort)
 		if err != nil {
@@ -1,9 +1,11 @@
 package service
 
 import (
+	"fmt"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	. "github.com/smartystreets/goconvey/convey"
@@ -14,8 +16,8 @@ func Test_PortForServicePort(t *testing.T) {
 		svc := &Service{
 			ID: "deadbeef001",
 			Ports: []Port{
-				{"tcp", 8173, 8080},
-				{"udp", 8172, 8080},
+				{Type: "tcp", Port: 8173, ServicePort: 8080},
+				{Type: "udp", Port: 8172, ServicePort: 8080},
 			},
 		}
 
@@ -29,6 +31,101 @@ func Test_PortForServicePort(t *testing.T) {
 	})
 }
 
+func Test_PortForName(t *testing.T) {
+	Convey("PortForName()", t, func() {
+		svc := &Service{
+			ID: "deadbeef001",
+			Ports: []Port{
+				{Type: "tcp", Port: 8173, ServicePort: 8080, Name: "api"},
+				{Type: "tcp", Port: 8174, ServicePort: 9090, Name: "metrics"},
+			},
+		}
+
+		Convey("Returns the port with that name", func() {
+			So(svc.PortForName("metrics"), ShouldEqual, 8174)
+		})
+
+		Convey("Returns -1 when there is no match", func() {
+			So(svc.PortForName("grpc"), ShouldEqual, -1)
+		})
+	})
+}
+
+func Test_StatusString(t *testing.T) {
+	Convey("StatusString() names each status", t, func() {
+		statuses := map[int]string{
+			ALIVE:       "Alive",
+			TOMBSTONE:   "Tombstone",
+			UNHEALTHY:   "Unhealthy",
+			UNKNOWN:     "Unknown",
+			MAINTENANCE: "Maintenance",
+		}
+
+		for status, name := range statuses {
+			svc := Service{Status: status}
+			So(svc.StatusString(), ShouldEqual, name)
+		}
+
+		svc := Service{Status: MAINTENANCE}
+		So(svc.IsMaintenance(), ShouldBeTrue)
+		So(svc.IsAlive(), ShouldBeFalse)
+		So(svc.IsTombstone(), ShouldBeFalse)
+	})
+}
+
+func Test_DrainGrace(t *testing.T) {
+	Convey("Draining", t, func() {
+		now := time.Now().UTC()
+		svc := Service{
+			Status:   TOMBSTONE,
+			Updated:  now,
+			Metadata: map[string]string{DRAIN_GRACE_METADATA: "60s"},
+		}
+
+		Convey("DrainGrace() reads the metadata", func() {
+			So(svc.DrainGrace(), ShouldEqual, 60*time.Second)
+		})
+
+		Convey("DrainGrace() is zero when it's missing or bad", func() {
+			So((&Service{}).DrainGrace(), ShouldEqual, 0)
+
+			svc.Metadata[DRAIN_GRACE_METADATA] = "a while"
+			So(svc.DrainGrace(), ShouldEqual, 0)
+
+			svc.Metadata[DRAIN_GRACE_METADATA] = "-5s"
+			So(svc.DrainGrace(), ShouldEqual, 0)
+		})
+
+		Convey("IsDraining() is only true for tombstones inside the grace", func() {
+			So(svc.IsDraining(now.Add(59*time.Second)), ShouldBeTrue)
+			So(svc.IsDraining(now.Add(60*time.Second)), ShouldBeFalse)
+
+			svc.Status = ALIVE
+			So(svc.IsDraining(now), ShouldBeFalse)
+
+			svc.Status = TOMBSTONE
+			delete(svc.Metadata, DRAIN_GRACE_METADATA)
+			So(svc.IsDraining(now), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_Dependencies(t *testing.T) {
+	Convey("Dependencies() reads the metadata", t, func() {
+		svc := Service{Metadata: map[string]string{DEPENDS_ON_METADATA: "db, cache,,"}}
+		So(svc.Dependencies(), ShouldResemble, []string{"db", "cache"})
+
+		So((&Service{}).Dependencies(), ShouldBeEmpty)
+	})
+}
+
+func Test_SanitizeName(t *testing.T) {
+	Convey("SanitizeName() fixes crazy image names", t, func() {
+		image := "public/something-longish:latest"
+		So(SanitizeName(image), ShouldEqual, "public-something-longish-latest")
+	})
+}
+
 func Test_buildPortFor(t *testing.T) {
 	Convey("buildPortFor()", t, func() {
 		port := docker.APIPort{
@@ -61,6 +158,19 @@ func Test_buildPortFor(t *testing.T) {
 			So(port.Type, ShouldEqual, "tcp")
 		})
 
+		Convey("Names the port from a label", func() {
+			container.Labels["PortName_80"] = "api"
+			port := buildPortFor(&port, container)
+
+			So(port.Name, ShouldEqual, "api")
+			So(port.ServicePort, ShouldEqual, 8080)
+		})
+
+		Convey("Leaves the name empty without a label", func() {
+			port := buildPortFor(&port, container)
+			So(port.Name, ShouldEqual, "")
+		})
+
 		Convey("Skips the service port when there is a conversion error", func() {
 			container.Labels["ServicePort_80"] = "not a number"
 			port := buildPortFor(&port, container)
@@ -101,6 +211,7 @@ func Test_ToService(t *testing.T) {
 			"ProxyMode":      "tcp",
 			"HealthCheck":      "HttpGet",
 			"HealthCheckArgs":  "http://127.0.0.1:39519/status/check",
+			"Metadata_canary":  "true",
 		},
 	}
 
@@ -127,6 +238,215 @@ func Test_ToService(t *testing.T) {
 			So(service.Updated, ShouldNotBeNil)
 			So(service.ProxyMode, ShouldEqual, "tcp")
 			So(service.Status, ShouldEqual, 0)
+			So(service.Metadata, ShouldResemble, map[string]string{"canary": "true"})
+			So(service.DockerHealth, ShouldEqual, "")
+		})
+
+		Convey("Picks up the Docker health", func() {
+			container := *sampleAPIContainer
+			container.Status = "Up 34 seconds (healthy)"
+
+			service := ToService(&container)
+			So(service.DockerHealth, ShouldEqual, DOCKER_HEALTHY)
+
+			encoded, _ := service.Encode()
+			So(string(encoded), ShouldNotContainSubstring, "DockerHealth")
+		})
+	})
+}
+
+func Test_DockerHealthFromStatus(t *testing.T) {
+	Convey("DockerHealthFromStatus()", t, func() {
+		So(DockerHealthFromStatus("Up 5 minutes (healthy)"), ShouldEqual, DOCKER_HEALTHY)
+		So(DockerHealthFromStatus("Up 5 minutes (unhealthy)"), ShouldEqual, DOCKER_UNHEALTHY)
+		So(DockerHealthFromStatus("Up 2 seconds (health: starting)"), ShouldEqual, DOCKER_STARTING)
+		So(DockerHealthFromStatus("Up 5 minutes"), ShouldEqual, "")
+		So(DockerHealthFromStatus(""), ShouldEqual, "")
+	})
+}
+
+func Test_WeightFromLabels(t *testing.T) {
+	Convey("WeightFromLabels()", t, func() {
+		Convey("Reads the ProxyWeight label", func() {
+			So(WeightFromLabels(map[string]string{"ProxyWeight": "5"}), ShouldEqual, 5)
+		})
+
+		Convey("Returns 0 when there isn't one", func() {
+			So(WeightFromLabels(map[string]string{"ProxyMode": "tcp"}), ShouldEqual, 0)
+		})
+
+		Convey("Ignores weights HAproxy won't take", func() {
+			So(WeightFromLabels(map[string]string{"ProxyWeight": "heavy"}), ShouldEqual, 0)
+			So(WeightFromLabels(map[string]string{"ProxyWeight": "0"}), ShouldEqual, 0)
+			So(WeightFromLabels(map[string]string{"ProxyWeight": "257"}), ShouldEqual, 0)
+		})
+	})
+}
+
+func Test_StickyFromLabels(t *testing.T) {
+	Convey("StickyFromLabels()", t, func() {
+		Convey("Isn't sticky without a label", func() {
+			sticky, cookie := StickyFromLabels(map[string]string{"ProxyMode": "http"})
+			So(sticky, ShouldBeFalse)
+			So(cookie, ShouldBeEmpty)
+		})
+
+		Convey("Is sticky with ProxySticky=true", func() {
+			sticky, cookie := StickyFromLabels(map[string]string{"ProxySticky": "true"})
+			So(sticky, ShouldBeTrue)
+			So(cookie, ShouldBeEmpty)
+		})
+
+		Convey("Is sticky when a cookie is named", func() {
+			sticky, cookie := StickyFromLabels(map[string]string{"ProxyStickyCookie": "SESSION"})
+			So(sticky, ShouldBeTrue)
+			So(cookie, ShouldEqual, "SESSION")
+		})
+	})
+}
+
+func Test_MetadataFromLabels(t *testing.T) {
+	Convey("MetadataFromLabels()", t, func() {
+		Convey("Picks out the metadata labels", func() {
+			metadata := MetadataFromLabels(map[string]string{
+				"Metadata_sha":    "deadbeef",
+				"Metadata_canary": "true",
+				"ProxyMode":       "tcp",
+				"Metadata_":       "nope",
+			})
+			So(metadata, ShouldResemble, map[string]string{"sha": "deadbeef", "canary": "true"})
+		})
+
+		Convey("Returns nil when there isn't any", func() {
+			So(MetadataFromLabels(map[string]string{"ProxyMode": "tcp"}), ShouldBeNil)
+		})
+
+		Convey("Caps the number of entries", func() {
+			labels := make(map[string]string)
+			for i := 0; i < MAX_METADATA+5; i++ {
+				labels[fmt.Sprintf("Metadata_key%02d", i)] = "value"
+			}
+
+			metadata := MetadataFromLabels(labels)
+			So(len(metadata), ShouldEqual, MAX_METADATA)
+			So(metadata, ShouldContainKey, "key00")
+			So(metadata, ShouldNotContainKey, fmt.Sprintf("key%02d", MAX_METADATA))
+		})
+	})
+}
+
+func Test_Tags(t *testing.T) {
+	Convey("TagsFromLabels()", t, func() {
+		Convey("Picks out the tag labels", func() {
+			tags := TagsFromLabels(map[string]string{
+				"Tag_region":    "us-east",
+				"Metadata_tier": "web",
+				"Tag_":          "nope",
+			})
+			So(tags, ShouldResemble, map[string]string{"region": "us-east"})
+		})
+
+		Convey("Caps the number of tags", func() {
+			labels := make(map[string]string)
+			for i := 0; i < MAX_TAGS+2; i++ {
+				labels[fmt.Sprintf("Tag_key%02d", i)] = "value"
+			}
+			So(len(TagsFromLabels(labels)), ShouldEqual, MAX_TAGS)
+		})
+	})
+
+	Convey("AddTags()", t, func() {
+		nodeTags := map[string]string{"region": "us-east", "tier": "web"}
+
+		Convey("Lets the service's own tags win", func() {
+			original := map[string]string{"tier": "batch"}
+			svc := Service{Tags: original}
+			svc.AddTags(nodeTags)
+
+			So(svc.Tags, ShouldResemble, map[string]string{"region": "us-east", "tier": "batch"})
+			So(original, ShouldResemble, map[string]string{"tier": "batch"})
+		})
+
+		Convey("Leaves the service alone without node tags", func() {
+			svc := Service{}
+			svc.AddTags(nil)
+			So(svc.Tags, ShouldBeNil)
+		})
+	})
+
+	Convey("SetEnvironment()", t, func() {
+		Convey("Puts the service in the environment", func() {
+			original := map[string]string{"canary": "true"}
+			svc := Service{Metadata: original}
+			svc.SetEnvironment("staging")
+
+			So(svc.Environment(), ShouldEqual, "staging")
+			So(svc.Metadata["canary"], ShouldEqual, "true")
+			So(original, ShouldResemble, map[string]string{"canary": "true"})
+		})
+
+		Convey("Lets the service pick its own", func() {
+			svc := Service{Metadata: map[string]string{ENVIRONMENT_METADATA: "prod"}}
+			svc.SetEnvironment("staging")
+			So(svc.Environment(), ShouldEqual, "prod")
+		})
+
+		Convey("Leaves the service alone without an environment", func() {
+			svc := Service{}
+			svc.SetEnvironment("")
+			So(svc.Metadata, ShouldBeNil)
+			So(svc.Environment(), ShouldBeEmpty)
+		})
+	})
+}
+
+func Test_MetadataEncoding(t *testing.T) {
+	Convey("Metadata survives gossip encoding", t, func() {
+		svc := Service{ID: "deadbeef123", Metadata: map[string]string{"sha": "deadbeef"}}
+
+		Convey("Round trips through Encode() and Decode()", func() {
+			encoded, _ := svc.Encode()
+			So(Decode(encoded).Metadata, ShouldResemble, svc.Metadata)
+		})
+
+		Convey("Is left out when there isn't any", func() {
+			svc.Metadata = nil
+			encoded, _ := svc.Encode()
+			So(string(encoded), ShouldNotContainSubstring, "Metadata")
+		})
+
+		Convey("Decodes messages from older nodes", func() {
+			decoded := Decode([]byte(`{"ID":"deadbeef123","Status":0}`))
+			So(decoded.ID, ShouldEqual, "deadbeef123")
+			So(decoded.Metadata, ShouldBeNil)
+		})
+	})
+}
+
+func Test_PortEncoding(t *testing.T) {
+	Convey("Port names survive gossip encoding", t, func() {
+		svc := Service{
+			ID: "deadbeef123",
+			Ports: []Port{
+				{Type: "tcp", Port: 8173, ServicePort: 8080, Name: "api"},
+				{Type: "tcp", Port: 8174, ServicePort: 9090},
+			},
+		}
+
+		Convey("Round trips through Encode() and Decode()", func() {
+			encoded, _ := svc.Encode()
+			So(Decode(encoded).Ports, ShouldResemble, svc.Ports)
+		})
+
+		Convey("Leaves out the name when there isn't one", func() {
+			svc.Ports = svc.Ports[1:]
+			encoded, _ := svc.Encode()
+			So(string(encoded), ShouldContainSubstring, `{"Type":"tcp","Port":8174,"ServicePort":9090}`)
+		})
+
+		Convey("Decodes ports from older nodes", func() {
+			decoded := Decode([]byte(`{"ID":"deadbeef123","Ports":[{"Type":"tcp","Port":8173,"ServicePort":8080}]}`))
+			So(decoded.Ports, ShouldResemble, []Port{{Type: "tcp", Port: 8173, ServicePort: 8080}})
 		})
 	})
 }
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"time"
-
+	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/armon/go-metrics"
@@ -14,7 +16,8 @@ import (
 )
 
 const (
-	MAX_PENDING_LENGTH = 100 // Number of messages we can replace into the pending queue
+	MAX_PENDING_LENGTH = 100              // Number of messages we can replace into the pending queue
+	FAILURE_GRACE      = 10 * time.Second // How long we wait for a failed member to come back
 )
 
 type servicesDelegate struct {
@@ -22,13 +25,61 @@ type servicesDelegate struct {
 	pendingBroadcasts [][]byte
 	notifications     chan []byte
 	inProcess         bool
+	synced            bool // Have we merged state from the cluster yet?
 	Metadata          NodeMetadata
+	foreignMembers    map[string]bool        // Members that say they're in another cluster
+	failedMembers     map[string]*time.Timer // Failed members we'll expire unless they come back
+	members           map[string]bool        // Everyone in the cluster, for the metrics
+	leaving           bool                   // Are we shutting down?
+	// Drop services from foreign members rather than just warning about them
+	IgnoreForeignClusters bool
+	// How long to wait before expiring the services of a member that failed,
+	// rather than left cleanly
+	FailureGrace time.Duration
+	// Drop service updates from peers while this returns true
+	Paused func() bool
 	sync.Mutex
 }
 
 type NodeMetadata struct {
 	ClusterName string
 	State       string
+	Environment string `json:",omitempty"` // Prefixed to the names of our services
+}
+
+// A member of the gossip cluster, as we see it
+type ClusterMember struct {
+	Name     string
+	Address  string
+	Local    bool // Is this us?
+	Metadata NodeMetadata
+}
+
+// Describe the cluster members, sorted by name. The metadata is whatever the
+// node last gossiped, so a node that sent something we can't decode just
+// has empty metadata.
+func clusterMembers(list *memberlist.Memberlist) []*ClusterMember {
+	localName := list.LocalNode().Name
+
+	nodes := list.Members()
+	members := make([]*ClusterMember, 0, len(nodes))
+	for _, node := range nodes {
+		member := &ClusterMember{
+			Name:    node.Name,
+			Address: net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port))),
+			Local:   node.Name == localName,
+		}
+
+		if err := json.Unmarshal(node.Meta, &member.Metadata); err != nil {
+			log.Debugf("Can't decode metadata for %s: %s", node.Name, err)
+		}
+
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+
+	return members
 }
 
 func NewServicesDelegate(state *catalog.ServicesState) *servicesDelegate {
@@ -38,6 +89,10 @@ func NewServicesDelegate(state *catalog.ServicesState) *servicesDelegate {
 		notifications:     make(chan []byte, 25),
 		inProcess:         false,
 		Metadata:          NodeMetadata{ClusterName: "default"},
+		foreignMembers:    make(map[string]bool),
+		failedMembers:     make(map[string]*time.Timer),
+		members:           make(map[string]bool),
+		FailureGrace:      FAILURE_GRACE,
 	}
 
 	return &delegate
@@ -45,7 +100,20 @@ func NewServicesDelegate(state *catalog.ServicesState) *servicesDelegate {
 
 func (d *servicesDelegate) NodeMeta(limit int) []byte {
 	log.Debugf("NodeMeta(): %d", limit)
-	data, err := json.Marshal(d.Metadata)
+
+	// Let the cluster see when we're in maintenance, or on our way out
+	metadata := d.Metadata
+	if d.state.IsDraining() {
+		metadata.State = "Draining"
+	}
+
+	d.Lock()
+	if d.leaving {
+		metadata.State = "Leaving"
+	}
+	d.Unlock()
+
+	data, err := json.Marshal(metadata)
 	if err != nil {
 		log.Error("Error encoding Node metadata!")
 		data = []byte("{}")
@@ -62,6 +130,7 @@ func (d *servicesDelegate) NotifyMsg(message []byte) {
 	}
 
 	log.Debugf("NotifyMsg(): %s", string(message))
+	metrics.IncrCounter([]string{"delegate", "messages", "received"}, 1)
 
 	// TODO don't just send container structs, send message structs
 	d.notifications <- message
@@ -77,6 +146,14 @@ func (d *servicesDelegate) NotifyMsg(message []byte) {
 					log.Errorf("NotifyMsg(): error decoding!")
 					continue
 				}
+				if d.ignoring(entry.Hostname) {
+					log.Debugf("NotifyMsg(): ignoring %s from foreign member %s", entry.ID, entry.Hostname)
+					continue
+				}
+				if d.paused() {
+					log.Debugf("NotifyMsg(): paused, dropping %s from %s", entry.ID, entry.Hostname)
+					continue
+				}
 				d.state.AddServiceEntry(*entry)
 			}
 		}()
@@ -122,6 +199,7 @@ func (d *servicesDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 	log.Debugf("Sending broadcast %d msgs %d 1st length",
 		len(broadcast), len(broadcast[0]),
 	)
+	metrics.IncrCounter([]string{"delegate", "messages", "sent"}, float32(len(broadcast)))
 	if len(leftover) > 0 {
 		log.Warnf("Leaving %d messages unsent", len(leftover))
 	}
@@ -130,8 +208,10 @@ func (d *servicesDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 }
 
 func (d *servicesDelegate) LocalState(join bool) []byte {
+	defer metrics.MeasureSince([]string{"delegate", "LocalState"}, time.Now())
+
 	log.Debugf("LocalState(): %b", join)
-	return d.state.Encode()
+	return d.state.EncodeShared()
 }
 
 func (d *servicesDelegate) MergeRemoteState(buf []byte, join bool) {
@@ -139,28 +219,189 @@ func (d *servicesDelegate) MergeRemoteState(buf []byte, join bool) {
 
 	log.Debugf("MergeRemoteState(): %s %b", string(buf), join)
 
+	if d.paused() {
+		log.Debug("MergeRemoteState(): paused, not merging")
+		return
+	}
+
 	otherState, err := catalog.Decode(buf)
 	if err != nil {
 		log.Errorf("Failed to MergeRemoteState(): %s", err.Error())
 		return
 	}
 
+	for hostname := range otherState.Servers {
+		if d.ignoring(hostname) {
+			log.Debugf("MergeRemoteState(): ignoring foreign member %s", hostname)
+			delete(otherState.Servers, hostname)
+		}
+	}
+
 	log.Debugf("Merging state: %s", otherState.Format(nil))
 
-	d.state.Merge(otherState)
+	// How much each push/pull changes, to see how far behind we were
+	result := d.state.Merge(otherState)
+	metrics.AddSample([]string{"delegate", "merge", "added"}, float32(result.Added))
+	metrics.AddSample([]string{"delegate", "merge", "updated"}, float32(result.Updated))
+	metrics.AddSample([]string{"delegate", "merge", "removed"}, float32(result.Removed))
+	log.Debugf("MergeRemoteState(): %d added, %d updated, %d removed",
+		result.Added, result.Updated, result.Removed)
+
+	d.Lock()
+	d.synced = true
+	d.Unlock()
+}
+
+func (d *servicesDelegate) paused() bool {
+	return d.Paused != nil && d.Paused()
+}
+
+// Synced is true once we've had the first push/pull from the cluster
+func (d *servicesDelegate) Synced() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.synced
+}
+
+// Tell the cluster we're leaving on purpose, so peers can drop our
+// services right away instead of waiting to see if we come back. Takes
+// effect the next time our metadata goes out.
+func (d *servicesDelegate) SetLeaving() {
+	d.Lock()
+	d.leaving = true
+	d.Unlock()
 }
 
 func (d *servicesDelegate) NotifyJoin(node *memberlist.Node) {
-	log.Debugf("NotifyJoin(): %s %s", node.Name, string(node.Meta))
+	log.WithFields(nodeLogFields(node, "join")).Infof("Member %s joined", node.Name)
+	metrics.IncrCounter([]string{"delegate", "joins"}, 1)
+	d.checkCluster(node)
+
+	d.Lock()
+	d.members[node.Name] = true
+	metrics.SetGauge([]string{"delegate", "members"}, float32(len(d.members)))
+	timer, failed := d.failedMembers[node.Name]
+	delete(d.failedMembers, node.Name)
+	d.Unlock()
+
+	if failed {
+		timer.Stop()
+		metrics.IncrCounter([]string{"delegate", "recoveries"}, 1)
+		log.WithFields(nodeLogFields(node, "recover")).
+			Infof("Member %s came back, keeping its services", node.Name)
+	}
 }
 
+// Memberlist tells us the same way whether a member left or failed. Members
+// that leave cleanly say so in their metadata first, and we expire their
+// services right away. Members that fail might just be on the other side of
+// a network blip, so we give them the failure grace to come back.
 func (d *servicesDelegate) NotifyLeave(node *memberlist.Node) {
-	log.Debugf("NotifyLeave(): %s", node.Name)
-	go d.state.ExpireServer(node.Name)
+	d.Lock()
+	delete(d.foreignMembers, node.Name)
+	delete(d.members, node.Name)
+	metrics.SetGauge([]string{"delegate", "members"}, float32(len(d.members)))
+	d.Unlock()
+
+	var metadata NodeMetadata
+	json.Unmarshal(node.Meta, &metadata)
+
+	if metadata.State == "Leaving" || d.FailureGrace <= 0 {
+		metrics.IncrCounter([]string{"delegate", "leaves"}, 1)
+		log.WithFields(nodeLogFields(node, "leave")).Infof("Member %s left", node.Name)
+		go d.state.ExpireServer(node.Name)
+		return
+	}
+
+	metrics.IncrCounter([]string{"delegate", "failures"}, 1)
+	log.WithFields(nodeLogFields(node, "fail")).Warnf(
+		"Member %s failed, expiring its services in %s unless it comes back",
+		node.Name, d.FailureGrace,
+	)
+
+	d.Lock()
+	defer d.Unlock()
+
+	if timer, ok := d.failedMembers[node.Name]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d.FailureGrace, func() {
+		d.Lock()
+		// It came back, or failed again, since we set this up
+		if d.failedMembers[node.Name] != timer {
+			d.Unlock()
+			return
+		}
+		delete(d.failedMembers, node.Name)
+		d.Unlock()
+
+		d.state.ExpireServer(node.Name)
+	})
+	d.failedMembers[node.Name] = timer
 }
 
 func (d *servicesDelegate) NotifyUpdate(node *memberlist.Node) {
-	log.Debugf("NotifyUpdate(): %s", node.Name)
+	log.WithFields(nodeLogFields(node, "update")).Debugf("NotifyUpdate(): %s", node.Name)
+	d.checkCluster(node)
+}
+
+// Log fields for an event about a member. The cluster is the one the member
+// says it's in, when we can tell.
+func nodeLogFields(node *memberlist.Node, event string) log.Fields {
+	fields := log.Fields{"node": node.Name, "event": event}
+
+	var metadata NodeMetadata
+	if err := json.Unmarshal(node.Meta, &metadata); err == nil && metadata.ClusterName != "" {
+		fields["cluster"] = metadata.ClusterName
+	}
+
+	return fields
+}
+
+// Warn about members that say they're in a different cluster. That's
+// usually a bad seed list, and their services would end up in our catalog.
+// Members whose metadata we can't decode get the benefit of the doubt.
+func (d *servicesDelegate) checkCluster(node *memberlist.Node) {
+	var metadata NodeMetadata
+	if err := json.Unmarshal(node.Meta, &metadata); err != nil || metadata.ClusterName == "" {
+		return
+	}
+
+	foreign := metadata.ClusterName != d.Metadata.ClusterName
+
+	d.Lock()
+	wasForeign := d.foreignMembers[node.Name]
+	if foreign {
+		d.foreignMembers[node.Name] = true
+	} else {
+		delete(d.foreignMembers, node.Name)
+	}
+	d.Unlock()
+
+	if foreign && !wasForeign {
+		metrics.IncrCounter([]string{"delegate", "foreignMembers"}, 1)
+		logger := log.WithFields(nodeLogFields(node, "foreign_member"))
+		if d.IgnoreForeignClusters {
+			logger.Warnf("Member %s is in cluster '%s', not '%s'. Ignoring its services.",
+				node.Name, metadata.ClusterName, d.Metadata.ClusterName)
+		} else {
+			logger.Warnf("Member %s is in cluster '%s', not '%s'",
+				node.Name, metadata.ClusterName, d.Metadata.ClusterName)
+		}
+	}
+}
+
+// Should we drop services from this host?
+func (d *servicesDelegate) ignoring(hostname string) bool {
+	if !d.IgnoreForeignClusters {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	return d.foreignMembers[hostname]
 }
 
 func packPacket(broadcasts [][]byte, limit int, overhead int) (packet [][]byte, leftover [][]byte) {
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/service"
+	"github.com/nitro/memberlist"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -102,3 +106,211 @@ func Test_GetBroadcasts(t *testing.T) {
 		})
 	})
 }
+
+func Test_NodeMeta(t *testing.T) {
+	Convey("NodeMeta()", t, func() {
+		state := catalog.NewServicesState()
+		delegate := NewServicesDelegate(state)
+		delegate.Metadata.State = "Running"
+
+		Convey("Reports the node state", func() {
+			So(string(delegate.NodeMeta(512)), ShouldEqual, `{"ClusterName":"default","State":"Running"}`)
+		})
+
+		Convey("Reports when the node is draining", func() {
+			state.SetDraining(true)
+			So(string(delegate.NodeMeta(512)), ShouldEqual, `{"ClusterName":"default","State":"Draining"}`)
+			So(delegate.Metadata.State, ShouldEqual, "Running")
+		})
+	})
+}
+
+func Test_MergeRemoteState(t *testing.T) {
+	Convey("MergeRemoteState()", t, func() {
+		state := catalog.NewServicesState()
+		delegate := NewServicesDelegate(state)
+
+		Convey("Isn't synced before the first push/pull", func() {
+			So(delegate.Synced(), ShouldBeFalse)
+		})
+
+		Convey("Is synced once it merges remote state", func() {
+			delegate.MergeRemoteState(catalog.NewServicesState().Encode(), true)
+			So(delegate.Synced(), ShouldBeTrue)
+		})
+
+		Convey("Isn't synced when the remote state doesn't decode", func() {
+			delegate.MergeRemoteState([]byte("junk"), true)
+			So(delegate.Synced(), ShouldBeFalse)
+		})
+
+		Convey("Doesn't merge while paused", func() {
+			paused := true
+			delegate.Paused = func() bool { return paused }
+
+			other := catalog.NewServicesState()
+			other.AddServiceEntry(service.Service{
+				ID: "deadbeef123", Name: "web", Image: "web", Hostname: "peer1",
+				Updated: time.Now().UTC(), Status: service.ALIVE,
+			})
+
+			delegate.MergeRemoteState(other.Encode(), false)
+			So(state.HasServer("peer1"), ShouldBeFalse)
+
+			paused = false
+			delegate.MergeRemoteState(other.Encode(), false)
+			So(state.HasServer("peer1"), ShouldBeTrue)
+		})
+	})
+}
+
+func Test_ForeignClusters(t *testing.T) {
+	Convey("Checking the cluster name of members", t, func() {
+		state := catalog.NewServicesState()
+		delegate := NewServicesDelegate(state)
+		delegate.Metadata = NodeMetadata{ClusterName: "ours", State: "Running"}
+
+		node := func(name, cluster string) *memberlist.Node {
+			meta, _ := json.Marshal(NodeMetadata{ClusterName: cluster, State: "Running"})
+			return &memberlist.Node{Name: name, Meta: meta}
+		}
+
+		svc := service.Service{
+			ID: "deadbeef123", Name: "web", Image: "web", Hostname: "foreign1",
+			Updated: time.Now().UTC(), Status: service.ALIVE,
+		}
+
+		Convey("Spots members from another cluster", func() {
+			delegate.NotifyJoin(node("local1", "ours"))
+			delegate.NotifyJoin(node("foreign1", "theirs"))
+
+			So(delegate.foreignMembers, ShouldResemble, map[string]bool{"foreign1": true})
+		})
+
+		Convey("Gives members with metadata we can't read the benefit of the doubt", func() {
+			delegate.NotifyJoin(&memberlist.Node{Name: "old1", Meta: []byte("junk")})
+			So(delegate.foreignMembers, ShouldBeEmpty)
+		})
+
+		Convey("Notices when a member's cluster changes", func() {
+			delegate.NotifyJoin(node("foreign1", "theirs"))
+			delegate.NotifyUpdate(node("foreign1", "ours"))
+			So(delegate.foreignMembers, ShouldBeEmpty)
+		})
+
+		Convey("Forgets members that leave", func() {
+			delegate.NotifyJoin(node("foreign1", "theirs"))
+			delegate.NotifyLeave(node("foreign1", "theirs"))
+			So(delegate.foreignMembers, ShouldBeEmpty)
+		})
+
+		Convey("Only warns by default", func() {
+			delegate.NotifyJoin(node("foreign1", "theirs"))
+			So(delegate.ignoring("foreign1"), ShouldBeFalse)
+		})
+
+		Convey("When ignoring foreign clusters", func() {
+			delegate.IgnoreForeignClusters = true
+			delegate.NotifyJoin(node("foreign1", "theirs"))
+
+			So(delegate.ignoring("foreign1"), ShouldBeTrue)
+			So(delegate.ignoring("local1"), ShouldBeFalse)
+
+			Convey("Drops their services from push/pull", func() {
+				other := catalog.NewServicesState()
+				other.AddServiceEntry(svc)
+				local := svc
+				local.ID = "deadbeef456"
+				local.Hostname = "local1"
+				other.AddServiceEntry(local)
+
+				delegate.MergeRemoteState(other.Encode(), false)
+
+				So(state.HasServer("foreign1"), ShouldBeFalse)
+				So(state.HasServer("local1"), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func Test_LeaveAndFail(t *testing.T) {
+	Convey("When a member goes away", t, func() {
+		state := catalog.NewServicesState()
+		delegate := NewServicesDelegate(state)
+		delegate.FailureGrace = 50 * time.Millisecond
+
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef123", Name: "web", Image: "web", Hostname: "member1",
+			Updated: time.Now().UTC(), Status: service.ALIVE,
+		})
+
+		listener := make(chan catalog.ChangeEvent, 1)
+		state.AddListener(listener)
+
+		node := func(nodeState string) *memberlist.Node {
+			meta, _ := json.Marshal(NodeMetadata{ClusterName: "default", State: nodeState})
+			return &memberlist.Node{Name: "member1", Meta: meta}
+		}
+
+		expiredWithin := func(wait time.Duration) bool {
+			select {
+			case event := <-listener:
+				return event.Hostname == "member1"
+			case <-time.After(wait):
+				return false
+			}
+		}
+
+		Convey("Reports that we're leaving in our metadata", func() {
+			delegate.SetLeaving()
+			So(string(delegate.NodeMeta(512)), ShouldEqual, `{"ClusterName":"default","State":"Leaving"}`)
+		})
+
+		Convey("Expires its services right away when it left cleanly", func() {
+			delegate.NotifyLeave(node("Leaving"))
+			So(expiredWithin(25*time.Millisecond), ShouldBeTrue)
+		})
+
+		Convey("Drains its services for the leave drain grace before they go", func() {
+			state.LeaveDrainGrace = time.Minute
+			delegate.NotifyLeave(node("Leaving"))
+			So(expiredWithin(25*time.Millisecond), ShouldBeTrue)
+
+			svc := state.Servers["member1"].Services["deadbeef123"]
+			So(svc.IsTombstone(), ShouldBeTrue)
+			So(svc.IsDraining(time.Now().UTC()), ShouldBeTrue)
+			So(svc.IsDraining(time.Now().UTC().Add(61*time.Second)), ShouldBeFalse)
+		})
+
+		Convey("Waits for the failure grace when it failed", func() {
+			delegate.NotifyLeave(node("Running"))
+			So(expiredWithin(25*time.Millisecond), ShouldBeFalse)
+			So(expiredWithin(time.Second), ShouldBeTrue)
+			So(delegate.failedMembers, ShouldBeEmpty)
+		})
+
+		Convey("Keeps its services when it comes back in time", func() {
+			delegate.NotifyLeave(node("Running"))
+			delegate.NotifyJoin(node("Running"))
+
+			So(delegate.failedMembers, ShouldBeEmpty)
+			So(expiredWithin(100*time.Millisecond), ShouldBeFalse)
+		})
+
+		Convey("Expires its services right away with no failure grace", func() {
+			delegate.FailureGrace = 0
+			delegate.NotifyLeave(node("Running"))
+			So(expiredWithin(25*time.Millisecond), ShouldBeTrue)
+		})
+
+		Convey("Keeps count of the members", func() {
+			delegate.NotifyJoin(node("Running"))
+			delegate.NotifyJoin(&memberlist.Node{Name: "member2"})
+			delegate.NotifyJoin(node("Running"))
+			So(len(delegate.members), ShouldEqual, 2)
+
+			delegate.NotifyLeave(node("Leaving"))
+			So(delegate.members, ShouldResemble, map[string]bool{"member2": true})
+		})
+	})
+}
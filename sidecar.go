@@ -1,23 +1,41 @@
 package main // import "github.com/newrelic/sidecar"
 
 import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/armon/go-metrics"
 	"github.com/newrelic/sidecar/catalog"
 	"github.com/newrelic/sidecar/discovery"
+	"github.com/newrelic/sidecar/envoy"
 	"github.com/newrelic/sidecar/haproxy"
 	"github.com/newrelic/sidecar/healthy"
 	"github.com/newrelic/sidecar/service"
+	"github.com/newrelic/sidecar/tracing"
 	"github.com/nitro/memberlist"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/relistan/go-director"
 )
 
+const (
+	DRAIN_TIMEOUT    = 10 * time.Second // Longest we'll take to shut down cleanly
+	DRAIN_BROADCASTS = 3                // How many times we send our tombstones on the way out
+	LEAVE_TIMEOUT    = 2 * time.Second  // How long we wait for peers to see us leave
+
+	DEFAULT_LOOPER_JITTER = 0.1 // Vary our timed loops by up to 10% of the interval
+	MAX_LOOPER_JITTER     = 0.5
+)
+
 var (
 	profilerFile os.File
 )
@@ -25,9 +43,12 @@ var (
 func announceMembers(list *memberlist.Memberlist, state *catalog.ServicesState) {
 	for {
 		// Ask for members of the cluster
-		for _, member := range list.Members() {
-			log.Debugf("Member: %s %s", member.Name, member.Addr)
-			log.Debugf("Meta: %s", string(member.Meta))
+		for _, member := range clusterMembers(list) {
+			log.WithFields(log.Fields{
+				"node":    member.Name,
+				"cluster": member.Metadata.ClusterName,
+				"event":   "member",
+			}).Debugf("Member: %s %s %+v", member.Name, member.Address, member.Metadata)
 		}
 
 		log.Debug(state.Format(list))
@@ -36,67 +57,302 @@ func announceMembers(list *memberlist.Memberlist, state *catalog.ServicesState)
 	}
 }
 
-func configureHAproxy(config Config) *haproxy.HAproxy {
-	proxy := haproxy.New(config.HAproxy.ConfigFile, config.HAproxy.PidFile)
+// A Proxy routes traffic to the services in the cluster, and keeps its
+// configuration up to date as the state changes.
+type Proxy interface {
+	Watch(state *catalog.ServicesState)
+	WriteAndReload(state *catalog.ServicesState)
+}
+
+// Set up the proxy backend chosen in the config. Returns nil if the proxy
+// is disabled. Nothing is written or reloaded here.
+func configureProxy(config Config) (Proxy, error) {
+	switch config.Sidecar.ProxyBackend {
+	case "envoy":
+		return configureEnvoy(config), nil
+	case "haproxy":
+		if config.HAproxy.Disable {
+			return nil, nil
+		}
+
+		if len(config.HAproxy.Instances) < 1 {
+			proxy, err := validHAproxy(configureHAproxy(config.HAproxy))
+			if err != nil {
+				return nil, err
+			}
+			return proxy, nil
+		}
+
+		var proxies haproxies
+		for _, instance := range config.HAproxy.Instances {
+			proxy, err := validHAproxy(configureHAproxy(instance))
+			if err != nil {
+				return nil, fmt.Errorf("%s (proxy '%s')", err.Error(), instance.Name)
+			}
+			proxies = append(proxies, proxy)
+		}
+
+		return proxies, nil
+	}
+
+	return nil, fmt.Errorf("Unknown proxy backend '%s'", config.Sidecar.ProxyBackend)
+}
+
+// Check the HAproxy settings that can't be caught when parsing the config
+func validHAproxy(proxy *haproxy.HAproxy) (*haproxy.HAproxy, error) {
+	if !haproxy.ValidBalance(proxy.Balance) {
+		return nil, fmt.Errorf("Invalid HAproxy balance '%s'", proxy.Balance)
+	}
+
+	if len(proxy.CanaryHeader) > 0 && len(proxy.CanaryValue) < 1 {
+		return nil, fmt.Errorf("HAproxy canary_header needs a canary_value to match")
+	}
+
+	if proxy.SocketReload && len(proxy.StatsSocket) < 1 {
+		return nil, fmt.Errorf("HAproxy socket_reload needs the stats_socket to be set")
+	}
+
+	if len(proxy.Resolvers.HostnamePattern) > 0 && !proxy.Resolvers.Enabled() {
+		return nil, fmt.Errorf("HAproxy resolvers need nameservers to look up the hostname_pattern")
+	}
+
+	for _, nameserver := range proxy.Resolvers.Nameservers {
+		if _, _, err := net.SplitHostPort(nameserver); err != nil {
+			return nil, fmt.Errorf("Invalid HAproxy nameserver '%s', it needs to be host:port", nameserver)
+		}
+	}
+
+	for name, address := range proxy.BindAddresses {
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("Invalid HAproxy bind address '%s' for '%s'", address, name)
+		}
+	}
+
+	// Catch template typos before we join the cluster
+	err := proxy.ValidateTemplate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid HAproxy template: %s", err.Error())
+	}
+
+	return proxy, nil
+}
+
+func configureEnvoy(config Config) *envoy.Envoy {
+	proxy := envoy.New(config.Envoy.ConfigDir, config.Envoy.BindIP)
+
+	if config.Envoy.AdminPort > 0 {
+		proxy.AdminPort = config.Envoy.AdminPort
+	}
+
+	if config.Envoy.ReloadDebounce.Duration > 0 {
+		proxy.ReloadDebounce = config.Envoy.ReloadDebounce.Duration
+	}
+
+	return proxy
+}
+
+func configureHAproxy(config HAproxyConfig) *haproxy.HAproxy {
+	proxy := haproxy.New(config.ConfigFile, config.PidFile)
+
+	if len(config.BindIP) > 0 {
+		proxy.BindIP = config.BindIP
+	}
+
+	if len(config.ReloadCmd) > 0 {
+		proxy.ReloadCmd = config.ReloadCmd
+	}
+
+	if len(config.VerifyCmd) > 0 {
+		proxy.VerifyCmd = config.VerifyCmd
+	}
+
+	if len(config.TemplateFile) > 0 {
+		proxy.Template = config.TemplateFile
+	}
+
+	if len(config.User) > 0 {
+		proxy.User = config.User
+	}
+
+	if len(config.Group) > 0 {
+		proxy.Group = config.Group
+	}
+
+	if len(config.StatsSocket) > 0 {
+		proxy.StatsSocket = config.StatsSocket
+	}
+
+	if len(config.RouteTag) > 0 {
+		proxy.RouteTag = config.RouteTag
+		proxy.RouteHeader = config.RouteHeader
+	}
+
+	if len(config.CanaryHeader) > 0 {
+		proxy.CanaryHeader = config.CanaryHeader
+		proxy.CanaryValue = config.CanaryValue
+	}
+
+	if config.ReloadDebounce.Duration > 0 {
+		proxy.ReloadDebounce = config.ReloadDebounce.Duration
+	}
 
-	if len(config.HAproxy.BindIP) > 0 {
-		proxy.BindIP = config.HAproxy.BindIP
+	if len(config.Balance) > 0 {
+		proxy.Balance = config.Balance
 	}
 
-	if len(config.HAproxy.ReloadCmd) > 0 {
-		proxy.ReloadCmd = config.HAproxy.ReloadCmd
+	if config.FailureThreshold > 0 {
+		proxy.FailureThreshold = config.FailureThreshold
 	}
 
-	if len(config.HAproxy.VerifyCmd) > 0 {
-		proxy.VerifyCmd = config.HAproxy.VerifyCmd
+	if config.FailureBackoff.Duration > 0 {
+		proxy.FailureBackoff = config.FailureBackoff.Duration
 	}
 
-	if len(config.HAproxy.TemplateFile) > 0 {
-		proxy.Template = config.HAproxy.TemplateFile
+	if len(config.TLSCerts) > 0 {
+		proxy.TLSCerts = config.TLSCerts
 	}
 
-	if len(config.HAproxy.User) > 0 {
-		proxy.User = config.HAproxy.User
+	if len(config.BindAddresses) > 0 {
+		proxy.BindAddresses = config.BindAddresses
 	}
 
-	if len(config.HAproxy.Group) > 0 {
-		proxy.Group = config.HAproxy.Group
+	proxy.Resolvers = haproxy.Resolvers{
+		Name:            config.Resolvers.Name,
+		Nameservers:     config.Resolvers.Nameservers,
+		HostnamePattern: config.Resolvers.HostnamePattern,
+		HoldValid:       config.Resolvers.HoldValid.Duration,
+		ResolveRetries:  config.Resolvers.ResolveRetries,
+		TimeoutRetry:    config.Resolvers.TimeoutRetry.Duration,
 	}
 
+	proxy.GlobalSettings = config.GlobalSettings
+	proxy.DefaultsSettings = config.DefaultsSettings
+
+	proxy.Name = config.Name
+	proxy.Include = config.Include
+	proxy.Exclude = config.Exclude
+	proxy.PanicMode = config.PanicMode
+	proxy.SocketReload = config.SocketReload
+
 	return proxy
 }
 
-func configureDiscovery(config *Config) discovery.Discoverer {
+func configureDiscovery(config *Config) (*discovery.MultiDiscovery, error) {
 	disco := new(discovery.MultiDiscovery)
+	disco.ShrinkGrace = config.Sidecar.DiscoveryGrace.Duration
 
 	for _, method := range config.Sidecar.Discovery {
 		switch method {
 		case "docker":
+			dockerDisco := discovery.NewDockerDiscovery(config.DockerDiscovery.DockerURL)
+			dockerDisco.MatchLabels = config.DockerDiscovery.MatchLabels
+			dockerDisco.ExcludeLabels = config.DockerDiscovery.ExcludeLabels
+			dockerDisco.EventMode = config.DockerDiscovery.EventMode
+			dockerDisco.TrustDockerHealth = config.DockerDiscovery.TrustDockerHealth
+			dockerDisco.ServicePortEnv = config.DockerDiscovery.ServicePortEnv
+			if config.DockerDiscovery.ResyncInterval.Duration > 0 {
+				dockerDisco.ResyncInterval = config.DockerDiscovery.ResyncInterval.Duration
+			}
+			if config.DockerDiscovery.CertFile != "" || config.DockerDiscovery.KeyFile != "" {
+				err := dockerDisco.ConfigureTLS(
+					config.DockerDiscovery.CertFile,
+					config.DockerDiscovery.KeyFile,
+					config.DockerDiscovery.CAFile,
+				)
+				if err != nil {
+					return nil, fmt.Errorf("Can't load Docker TLS certificates: %s", err.Error())
+				}
+			}
+			disco.Discoverers = append(disco.Discoverers, dockerDisco)
+		case "static":
 			disco.Discoverers = append(
 				disco.Discoverers,
-				discovery.NewDockerDiscovery(config.DockerDiscovery.DockerURL),
+				discovery.NewStaticDiscovery(config.StaticDiscovery.ConfigFile...),
 			)
-		case "static":
+		case "kubernetes":
 			disco.Discoverers = append(
 				disco.Discoverers,
-				discovery.NewStaticDiscovery(config.StaticDiscovery.ConfigFile),
+				discovery.NewKubernetesDiscovery(
+					config.KubernetesDiscovery.KubeConfig,
+					config.KubernetesDiscovery.Namespace,
+				),
+			)
+		case "consul":
+			consulDisco := discovery.NewConsulDiscovery(config.ConsulDiscovery.ConsulURL)
+			consulDisco.Datacenter = config.ConsulDiscovery.Datacenter
+			disco.Discoverers = append(disco.Discoverers, consulDisco)
+		case "nomad":
+			nomadDisco := discovery.NewNomadDiscovery(config.NomadDiscovery.NomadURL)
+			nomadDisco.Region = config.NomadDiscovery.Region
+			nomadDisco.Namespace = config.NomadDiscovery.Namespace
+			disco.Discoverers = append(disco.Discoverers, nomadDisco)
+		case "ecs":
+			disco.Discoverers = append(
+				disco.Discoverers,
+				discovery.NewEcsDiscovery(config.EcsDiscovery.MetadataURL),
 			)
 		default:
 		}
 	}
 
-	return disco
+	return disco, nil
 }
 
-func configureMetrics(config *Config) {
-	if config.Sidecar.StatsAddr != "" {
+// Send metrics to statsd, Prometheus, or both. Returns the Prometheus
+// registry if that's enabled, so it can be served from /metrics.
+func configureMetrics(config *Config, clusterName string, state *catalog.ServicesState) *prometheus.Registry {
+	var sinks metrics.FanoutSink
+	var registry *prometheus.Registry
+
+	metricsConfig := metrics.DefaultConfig("sidecar")
+
+	if config.Sidecar.StatsAddr != "" && config.Sidecar.StatsFormat == "dogstatsd" {
+		sink, err := newDogstatsdSink(config.Sidecar.StatsAddr, metricsConfig.HostName, map[string]string{
+			"cluster": clusterName,
+			"node":    metricsConfig.HostName,
+			"service": metricsConfig.ServiceName,
+		})
+		exitWithError(err, "Can't configure DogStatsD")
+		sinks = append(sinks, sink)
+	} else if config.Sidecar.StatsAddr != "" {
 		sink, err := metrics.NewStatsdSink(config.Sidecar.StatsAddr)
 		exitWithError(err, "Can't configure Statsd")
+		sinks = append(sinks, sink)
+	}
+
+	if config.Sidecar.PrometheusEnabled {
+		registry = prometheus.NewRegistry()
+		registerer := prometheus.WrapRegistererWith(
+			prometheus.Labels{"cluster": clusterName}, registry,
+		)
+		registerer.MustRegister(newServicesCollector(state))
+		sinks = append(sinks, newPrometheusSink(registerer, metricsConfig.HostName))
+	}
 
-		metricsConfig := metrics.DefaultConfig("sidecar")
-		_, err = metrics.NewGlobal(metricsConfig, sink)
+	if len(sinks) > 0 {
+		_, err := metrics.NewGlobal(metricsConfig, sinks)
 		exitWithError(err, "Can't start metrics")
 	}
+
+	return registry
+}
+
+// Export tracing spans if we have somewhere to send them. Otherwise the
+// spans are never created.
+func configureTracing(config *Config, clusterName string, state *catalog.ServicesState) {
+	if config.Sidecar.TracingEndpoint == "" {
+		return
+	}
+
+	exporter := tracing.NewExporter(config.Sidecar.TracingEndpoint, map[string]string{
+		"service.name":    "sidecar",
+		"host.name":       state.Hostname,
+		"sidecar.cluster": clusterName,
+	})
+	go exporter.Run()
+	tracing.Enable(exporter)
+
+	log.Infof("Sending traces to %s", exporter.Endpoint)
 }
 
 func configureDelegate(state *catalog.ServicesState, opts *CliOpts) *servicesDelegate {
@@ -109,24 +365,294 @@ func configureDelegate(state *catalog.ServicesState, opts *CliOpts) *servicesDel
 	return delegate
 }
 
-func configureSignalHandler(opts *CliOpts) {
-	if !*opts.CpuProfile {
-		return
+// Capture SIGTERM and CTRL-C and shut down cleanly: stop the CPU profiler,
+// drain our services from the cluster, and write a final snapshot. The
+// drain can't take longer than the drain timeout.
+func configureSignalHandler(opts *CliOpts, state *catalog.ServicesState, config *Config, drain func()) {
+	snapshotFile := config.Sidecar.SnapshotFile
+
+	timeout := DRAIN_TIMEOUT
+	if config.Sidecar.DrainTimeout.Duration > 0 {
+		timeout = config.Sidecar.DrainTimeout.Duration
 	}
 
-	// Capture CTRL-C and stop the CPU profiler
 	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, os.Interrupt)
+	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for sig := range sigChannel {
-			log.Printf("Captured %v, stopping profiler and exiting..", sig)
+		sig := <-sigChannel
+		log.Printf("Captured %v, shutting down..", sig)
+
+		if *opts.CpuProfile {
 			pprof.StopCPUProfile()
 			profilerFile.Close()
-			os.Exit(1)
 		}
+
+		drained := make(chan struct{})
+		go func() {
+			drain()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+			log.Info("Drained, exiting..")
+		case <-time.After(timeout):
+			log.Warnf("Timed out after %s draining, exiting anyway", timeout)
+		}
+
+		if snapshotFile != "" {
+			err := state.Snapshot(snapshotFile)
+			if err != nil {
+				log.Errorf("Unable to write snapshot %s! (%s)", snapshotFile, err.Error())
+			}
+		}
+
+		// SIGTERM is how we're normally asked to stop
+		if sig == syscall.SIGTERM {
+			os.Exit(0)
+		}
+		os.Exit(1)
 	}()
 }
 
+// Take our services out of the cluster before we go. We stop announcing
+// them, tombstone them, wait for the tombstones to be picked up by gossip,
+// and update the proxy. Then we tell peers we're leaving on purpose, and
+// leave the cluster so they don't have to wait to notice we're gone.
+func drainServices(state *catalog.ServicesState, list *memberlist.Memberlist,
+	delegate *servicesDelegate, proxy Proxy, loopers ...director.Looper) {
+
+	for _, looper := range loopers {
+		looper.Quit()
+	}
+
+	tombstones := state.TombstoneServices(state.Hostname, []service.Service{})
+	if len(tombstones) > 0 {
+		log.Infof("Tombstoned our services, broadcasting %d records", len(tombstones))
+		looper := director.NewTimedLooper(
+			DRAIN_BROADCASTS, catalog.TOMBSTONE_RETRANSMIT, make(chan error),
+		)
+		state.SendServices(tombstones, looper)
+		looper.Wait()
+	}
+
+	if proxy != nil {
+		proxy.WriteAndReload(state)
+	}
+
+	delegate.SetLeaving()
+	err := list.UpdateNode(NODE_UPDATE_TIMEOUT)
+	if err != nil {
+		log.Warnf("Unable to tell the cluster we're leaving: %s", err.Error())
+	}
+
+	err = list.Leave(LEAVE_TIMEOUT)
+	if err != nil {
+		log.Warnf("Unable to leave the cluster cleanly: %s", err.Error())
+	}
+	list.Shutdown()
+}
+
+// The loops that look after the services on this host
+type localLoopers struct {
+	Services    director.Looper
+	Tombstones  director.Looper
+	Tracking    director.Looper
+	Discovery   director.Looper
+	HealthWatch director.Looper
+	Health      director.Looper
+}
+
+// Discover and health check the services on this host, and gossip about
+// them. Observers only follow the cluster, so they skip all of it and never
+// broadcast anything.
+func runLocalServices(config *Config, state *catalog.ServicesState, monitor *healthy.Monitor,
+	serviceFunc func() []service.Service, loopers localLoopers) error {
+
+	if config.Sidecar.Mode == MODE_OBSERVER {
+		log.Info("Running as an observer, not discovering or broadcasting any services")
+		return nil
+	}
+
+	disco, err := configureDiscovery(config)
+	if err != nil {
+		return err
+	}
+	go disco.Run(loopers.Discovery)
+
+	go state.BroadcastServices(serviceFunc, loopers.Services)
+	go state.BroadcastTombstones(serviceFunc, loopers.Tombstones)
+	go state.TrackNewServices(serviceFunc, loopers.Tracking)
+	// Services we don't manage are never checked. Put them in our environment
+	// first, so they're named the same way the catalog will name them.
+	managed := &discovery.FilteredDiscovery{Discoverer: disco, Keep: func(svc *service.Service) bool {
+		named := *svc
+		named.SetEnvironment(config.Sidecar.Environment)
+		return state.Manages(&named)
+	}}
+	go monitor.Watch(managed, loopers.HealthWatch)
+	go monitor.Run(loopers.Health)
+
+	return nil
+}
+
+// Restore the last snapshot, if there is one, and keep writing new ones
+func configureSnapshots(state *catalog.ServicesState, config *Config) {
+	snapshotFile := config.Sidecar.SnapshotFile
+	if snapshotFile == "" {
+		return
+	}
+
+	err := state.LoadSnapshot(snapshotFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Not restoring snapshot: %s", err.Error())
+	}
+
+	interval := catalog.SNAPSHOT_INTERVAL
+	if config.Sidecar.SnapshotInterval.Duration > 0 {
+		interval = config.Sidecar.SnapshotInterval.Duration
+	}
+
+	go state.SaveSnapshots(
+		snapshotFile, director.NewTimedLooper(director.FOREVER, interval, nil),
+	)
+}
+
+// Pick the memberlist defaults that suit the network we're gossiping over
+func memberlistConfig(mode string) (*memberlist.Config, error) {
+	switch mode {
+	case "", "lan":
+		return memberlist.DefaultLANConfig(), nil
+	case "wan":
+		return memberlist.DefaultWANConfig(), nil
+	case "local":
+		return memberlist.DefaultLocalConfig(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown network mode '%s'", mode)
+}
+
+// Wraps a services func so every service also gets this node's tags
+func taggedServices(fn func() []service.Service, tags map[string]string) func() []service.Service {
+	if len(tags) == 0 {
+		return fn
+	}
+
+	return func() []service.Service {
+		services := fn()
+		for i := range services {
+			services[i].AddTags(tags)
+		}
+		return services
+	}
+}
+
+// Wraps a services func so every service is put in this node's environment,
+// which travels with it so every node groups it the same way
+func environmentServices(fn func() []service.Service, env string) func() []service.Service {
+	if env == "" {
+		return fn
+	}
+
+	return func() []service.Service {
+		services := fn()
+		for i := range services {
+			services[i].SetEnvironment(env)
+		}
+		return services
+	}
+}
+
+// Sets the ports we gossip on. GossipPort is the one we advertise, and bind
+// to unless there's a GossipBindPort, e.g. when Docker maps the port for us.
+// Unset ports keep the memberlist defaults.
+func setGossipPorts(mlConfig *memberlist.Config, config *Config) error {
+	for _, port := range []int{config.Sidecar.GossipPort, config.Sidecar.GossipBindPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("Invalid gossip port %d", port)
+		}
+	}
+
+	if config.Sidecar.GossipPort > 0 {
+		mlConfig.BindPort = config.Sidecar.GossipPort
+		mlConfig.AdvertisePort = config.Sidecar.GossipPort
+	}
+
+	if config.Sidecar.GossipBindPort > 0 {
+		mlConfig.BindPort = config.Sidecar.GossipBindPort
+	}
+
+	return nil
+}
+
+// Sets the addresses we gossip on. We always advertise the published IP, but
+// can bind somewhere else, like 0.0.0.0 behind NAT where the published IP
+// isn't one of ours. Without a BindIP, memberlist binds to all interfaces.
+func setGossipAddrs(mlConfig *memberlist.Config, config *Config, publishedIP string) error {
+	mlConfig.AdvertiseAddr = publishedIP
+
+	if config.Sidecar.BindIP == "" {
+		return nil
+	}
+
+	bindIP := strings.Trim(config.Sidecar.BindIP, "[]")
+	if net.ParseIP(bindIP) == nil {
+		return fmt.Errorf("Invalid bind_ip '%s'", config.Sidecar.BindIP)
+	}
+	mlConfig.BindAddr = bindIP
+
+	return nil
+}
+
+// Works out the memberlist push/pull interval. If it's not shorter than the
+// alive lifespan, services will expire between full syncs.
+func pushPullInterval(config *Config) time.Duration {
+	lifespan := config.Sidecar.AliveLifespan.Duration
+	interval := config.Sidecar.PushPullInterval.Duration
+	if interval == 0 {
+		interval = lifespan - 1*time.Second
+	}
+
+	if interval <= 0 || interval >= lifespan {
+		log.Warnf(
+			"Push/pull interval %s should be shorter than the alive lifespan %s, services may expire between syncs!",
+			interval, lifespan,
+		)
+	}
+
+	return interval
+}
+
+// Works out how much to vary the timed loops. Anything outside 0 to
+// MAX_LOOPER_JITTER is clamped so the loops can't run back to back.
+func looperJitter(config *Config) float64 {
+	jitter := config.Sidecar.LooperJitter
+	if jitter < 0 || jitter > MAX_LOOPER_JITTER {
+		clamped := math.Max(0, math.Min(jitter, MAX_LOOPER_JITTER))
+		log.Warnf("Looper jitter %g should be between 0 and %g, using %g",
+			jitter, MAX_LOOPER_JITTER, clamped)
+		jitter = clamped
+	}
+
+	return jitter
+}
+
+// Build a memberlist keyring from base64 encoded keys. The first key is
+// used to encrypt, and all of them are tried when decrypting, so keys can
+// be rotated without a gap.
+func makeKeyring(keys []string) (*memberlist.Keyring, error) {
+	var decoded [][]byte
+	for _, key := range keys {
+		bytes, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode encryption key: %s", err.Error())
+		}
+		decoded = append(decoded, bytes)
+	}
+
+	return memberlist.NewKeyring(decoded[1:], decoded[0])
+}
+
 func configureLoggingLevel(level string) {
 	switch {
 	case len(level) == 0:
@@ -142,9 +668,39 @@ func configureLoggingLevel(level string) {
 	}
 }
 
+// We're ready for traffic once we've synced with the cluster and, if we're
+// running HAproxy, it has loaded its first config
+func isReady(delegate *servicesDelegate, proxy Proxy) bool {
+	if !delegate.Synced() {
+		return false
+	}
+
+	switch p := proxy.(type) {
+	case *haproxy.HAproxy:
+		return p.Loaded()
+	case haproxies:
+		return p.Loaded()
+	}
+
+	return true
+}
+
 func main() {
+	startTime = time.Now()
+
 	opts := parseCommandLine()
-	configureSignalHandler(opts)
+	log.AddHook(&clusterLogHook{cluster: *opts.ClusterName})
+	log.Infof("Sidecar %s (%s)", Version, GitCommit)
+
+	// Only check the config, don't start anything
+	if *opts.Validate {
+		os.Exit(validate(*opts.ConfigFile, *opts.StrictEnv, os.Stdout))
+	}
+
+	// Or just show what the running Sidecar would do to HAproxy
+	if *opts.DiffHAproxy {
+		os.Exit(haproxyDiff(*opts.ConfigFile, *opts.StrictEnv, *opts.HAproxyName, os.Stdout))
+	}
 
 	// Enable CPU profiling support if requested
 	if *opts.CpuProfile {
@@ -156,7 +712,7 @@ func main() {
 	state := catalog.NewServicesState()
 	delegate := configureDelegate(state, opts)
 
-	config := parseConfig(*opts.ConfigFile)
+	config := parseConfig(*opts.ConfigFile, *opts.StrictEnv)
 
 	// We can switch to JSON formatted logs from here on
 	if config.Sidecar.LoggingFormat == "json" {
@@ -169,38 +725,88 @@ func main() {
 	configureLoggingLevel(config.Sidecar.LoggingLevel)
 
 	state.ServiceNameMatch = config.Services.NameRegexp
+	state.ServiceNameRewrite = config.Services.RewriteRegexp
+	state.ServiceNameReplace = config.Services.NameReplacement
+	state.ServiceInclude = config.Services.Include
+	state.ServiceExclude = config.Services.Exclude
+	state.MaxTombstones = config.Sidecar.MaxTombstones
+	state.AliveLifespan = config.Sidecar.AliveLifespan.Duration
+	state.LeaveDrainGrace = config.Sidecar.LeaveDrainGrace.Duration
+
+	delegate.IgnoreForeignClusters = config.Sidecar.IgnoreForeignClusters
+	delegate.Metadata.Environment = config.Sidecar.Environment
+	if config.Sidecar.FailureGrace.Duration > 0 {
+		delegate.FailureGrace = config.Sidecar.FailureGrace.Duration
+	}
 
-	// Use a LAN config but add our delegate
-	mlConfig := memberlist.DefaultLANConfig()
+	// POST /pause stops discovery, health checks and proxy updates, and
+	// gossip from peers too if configured
+	pauser := &pauseSwitch{}
+	if config.Sidecar.PauseGossip {
+		delegate.Paused = pauser.Paused
+	}
+
+	// Restore the last state before we join the cluster
+	configureSnapshots(state, &config)
+
+	// Start from the defaults for our network, then add our delegate
+	mlConfig, err := memberlistConfig(config.Sidecar.NetworkMode)
+	exitWithError(err, "Can't configure memberlist")
 	mlConfig.Delegate = delegate
 	mlConfig.Events = delegate
 
 	mlConfig.LogOutput = &LoggingBridge{}
 
-	// Set up the push pull interval for Memberlist
-	if config.Sidecar.PushPullInterval.Duration == 0 {
-		mlConfig.PushPullInterval = catalog.ALIVE_LIFESPAN - 1*time.Second
-	} else {
-		mlConfig.PushPullInterval = config.Sidecar.PushPullInterval.Duration
-	}
+	mlConfig.PushPullInterval = pushPullInterval(&config)
 	if config.Sidecar.GossipMessages != 0 {
 		mlConfig.GossipMessages = config.Sidecar.GossipMessages
 	}
 
+	// Encrypt gossip if we were given any keys
+	if len(config.Sidecar.EncryptionKey) > 0 {
+		keyring, err := makeKeyring(config.Sidecar.EncryptionKey)
+		exitWithError(err, "Invalid encryption key")
+		mlConfig.Keyring = keyring
+		mlConfig.SecretKey = keyring.GetPrimaryKey()
+	}
+
 	// Figure out our IP address from the CLI or by inspecting
-	publishedIP, err := getPublishedIP(config.Sidecar.ExcludeIPs, opts.AdvertiseIP)
+	if invalid := invalidExclusions(config.Sidecar.ExcludeIPs); len(invalid) > 0 {
+		log.Warnf("Ignoring invalid exclude_ips entries: %s", strings.Join(invalid, ", "))
+	}
+	publishedIP, err := getPublishedIP(config.Sidecar.ExcludeIPs, opts.AdvertiseIP, config.Sidecar.PreferIPv6)
 	exitWithError(err, "Failed to find private IP address")
-	mlConfig.AdvertiseAddr = publishedIP
+
+	err = setGossipAddrs(mlConfig, &config, publishedIP)
+	exitWithError(err, "Can't configure gossip")
+
+	err = setGossipPorts(mlConfig, &config)
+	exitWithError(err, "Can't configure gossip")
+
+	// Make sure we can have the API port before doing anything else
+	apiListener, err := listenHttp(config.Sidecar.BindAddr, config.Sidecar.ApiPort)
+	exitWithError(err, "Can't start HTTP server")
 
 	log.Println("Sidecar starting -------------------")
 	log.Printf("Cluster Name: %s", *opts.ClusterName)
+	log.Printf("Mode: %s", config.Sidecar.Mode)
 	log.Printf("Config File: %s", *opts.ConfigFile)
 	log.Printf("Cluster Seeds: %s", strings.Join(*opts.ClusterIPs, ", "))
-	log.Printf("Advertised address: %s", publishedIP)
+	log.Printf("Advertised address: %s", net.JoinHostPort(publishedIP, strconv.Itoa(mlConfig.AdvertisePort)))
+	log.Printf("Gossip bind address: %s", net.JoinHostPort(mlConfig.BindAddr, strconv.Itoa(mlConfig.BindPort)))
+	log.Printf("HTTP API address: %s", apiListener.Addr())
 	log.Printf("Service Name Match: %s", config.Services.NameMatch)
+	if len(config.Services.NameRewrite) > 0 {
+		log.Printf("Service Name Rewrite: %s -> %s", config.Services.NameRewrite, config.Services.NameReplacement)
+	}
 	log.Printf("Excluded IPs: %v", config.Sidecar.ExcludeIPs)
-	log.Printf("Push/Pull Interval: %s", config.Sidecar.PushPullInterval.Duration.String())
+	log.Printf("Prefer IPv6: %t", config.Sidecar.PreferIPv6)
+	log.Printf("Push/Pull Interval: %s", mlConfig.PushPullInterval.String())
+	log.Printf("Alive Lifespan: %s", config.Sidecar.AliveLifespan.Duration.String())
+	log.Printf("Network Mode: %s", config.Sidecar.NetworkMode)
 	log.Printf("Gossip Messages: %d", config.Sidecar.GossipMessages)
+	log.Printf("Max Tombstones: %d", config.Sidecar.MaxTombstones)
+	log.Printf("Encryption keys: %d", len(config.Sidecar.EncryptionKey))
 	log.Printf("Logging level: %s", config.Sidecar.LoggingLevel)
 	log.Println("----------------------------------")
 
@@ -208,32 +814,48 @@ func main() {
 	exitWithError(err, "Failed to create memberlist")
 
 	// Join an existing cluster by specifying at least one known member.
-	_, err = list.Join(*opts.ClusterIPs)
+	seeds, err := resolveSeeds(*opts.ClusterIPs, lookupSRV, SEED_LOOKUP_ATTEMPTS, SEED_LOOKUP_INTERVAL)
+	exitWithError(err, "Failed to find cluster seeds")
+	seeds = seedsWithPort(seeds, mlConfig.AdvertisePort)
+	log.Printf("Resolved seeds: %s", strings.Join(seeds, ", "))
+
+	_, err = joinCluster(seeds, list.Join, config.Sidecar.JoinRetryTimeout.Duration, JOIN_RETRY_INTERVAL)
 	exitWithError(err, "Failed to join cluster")
 
-	servicesLooper := director.NewTimedLooper(
-		director.FOREVER, catalog.ALIVE_SLEEP_INTERVAL, nil,
-	)
-	tombstoneLooper := director.NewTimedLooper(
-		director.FOREVER, catalog.TOMBSTONE_SLEEP_INTERVAL, nil,
-	)
-	trackingLooper := director.NewTimedLooper(
-		director.FOREVER, catalog.ALIVE_SLEEP_INTERVAL, nil,
-	)
-	discoLooper := director.NewTimedLooper(
+	// The loops that gossip or run checks are jittered, so that nodes
+	// started together don't all hit the network at the same moment
+	jitter := looperJitter(&config)
+
+	// /healthz fails if one of the key loops stops running, or memberlist
+	// gives up on us
+	live := newLiveness(config.Sidecar.StallTimeout.Duration, mlConfig.AwarenessMaxMultiplier-1)
+
+	servicesLooper := live.Track("services", newJitteredLooper(
+		director.FOREVER, config.Sidecar.AliveSleepInterval.Duration, jitter, nil,
+	))
+	tombstoneLooper := live.Track("tombstones", newJitteredLooper(
+		director.FOREVER, config.Sidecar.TombstoneSleepInterval.Duration, jitter, nil,
+	))
+	trackingLooper := live.Track("tracking", newJitteredLooper(
+		director.FOREVER, config.Sidecar.AliveSleepInterval.Duration, jitter, nil,
+	))
+	// Discovery and health checks skip their runs while we're paused, but
+	// still count as running
+	discoLooper := &pausableLooper{director.NewTimedLooper(
 		director.FOREVER, discovery.SLEEP_INTERVAL, make(chan error),
-	)
-	healthWatchLooper := director.NewTimedLooper(
-		director.FOREVER, healthy.WATCH_INTERVAL, make(chan error),
-	)
-	healthLooper := director.NewTimedLooper(
-		director.FOREVER, healthy.HEALTH_INTERVAL, make(chan error),
-	)
-
-	configureMetrics(&config)
-
-	disco := configureDiscovery(&config)
-	go disco.Run(discoLooper)
+	), pauser.Paused}
+	// The monitor polls discovery for the services to check on this one
+	healthWatchLooper := &pausableLooper{live.Track("discovery", newJitteredLooper(
+		director.FOREVER, healthy.WATCH_INTERVAL, jitter, make(chan error),
+	)), pauser.Paused}
+	// Each check runs on its own timer, this just starts them
+	healthLooper := &pausableLooper{live.Track("health_checks", newJitteredLooper(
+		director.FOREVER, healthy.WATCH_INTERVAL, jitter, make(chan error),
+	)), pauser.Paused}
+	go warnWhilePaused(pauser, director.NewTimedLooper(director.FOREVER, PAUSE_WARN_INTERVAL, nil))
+
+	registry := configureMetrics(&config, *opts.ClusterName, state)
+	configureTracing(&config, *opts.ClusterName, state)
 
 	nameFunc := func(svc *service.Service) string {
 		return state.ServiceName(svc)
@@ -243,15 +865,44 @@ func main() {
 	// check address.
 	monitor := healthy.NewMonitor(publishedIP, config.Sidecar.DefaultCheckEndpoint)
 	monitor.ServiceNameFn = nameFunc
+	monitor.MaxConcurrentChecks = config.Sidecar.MaxConcurrentChecks
+	monitor.CheckTimeout = config.Sidecar.HealthCheckTimeout.Duration
+	monitor.ClusterServicesFn = state.ByService
+	if config.Sidecar.HealthyThreshold > 0 {
+		monitor.HealthyThreshold = config.Sidecar.HealthyThreshold
+	}
+	if config.Sidecar.UnhealthyThreshold > 0 {
+		monitor.UnhealthyThreshold = config.Sidecar.UnhealthyThreshold
+	}
 
-	serviceFunc := func() []service.Service { return monitor.Services() }
+	serviceFunc := state.MaintainableServices(
+		state.DrainableServices(taggedServices(
+			environmentServices(monitor.Services, config.Sidecar.Environment), config.Sidecar.NodeTags,
+		)),
+	)
 
-	// Need to call HAproxy first, otherwise won't see first events from
+	// Need to call the proxy first, otherwise won't see first events from
 	// discovered services, and then won't write them out.
-	var proxy *haproxy.HAproxy
+	proxy, err := configureProxy(config)
+	exitWithError(err, "Can't configure proxy")
+
+	// The HAproxies, for /backends
+	var proxies haproxies
+
+	switch p := proxy.(type) {
+	case *haproxy.HAproxy:
+		p.Paused = pauser.Paused
+		proxies = haproxies{p}
+	case haproxies:
+		for _, haProxy := range p {
+			haProxy.Paused = pauser.Paused
+		}
+		proxies = p
+	case *envoy.Envoy:
+		p.Paused = pauser.Paused
+	}
 
-	if !config.HAproxy.Disable {
-		proxy = configureHAproxy(config)
+	if proxy != nil {
 		go proxy.Watch(state)
 	}
 
@@ -259,21 +910,47 @@ func main() {
 	// put them here.
 	for _, url := range config.Listeners.Urls {
 		listener := catalog.NewUrlListener(url)
+		listener.Secret = config.Listeners.Secrets[url]
+		if config.Listeners.Retries > 0 {
+			listener.Retries = config.Listeners.Retries
+		}
+		if config.Listeners.RetryDelay.Duration > 0 {
+			listener.RetryDelay = config.Listeners.RetryDelay.Duration
+		}
 		listener.Watch(state)
 	}
 
+	for _, url := range config.Alerts.Urls {
+		alerter := catalog.NewAlertListener(url)
+		if config.Alerts.DedupWindow.Duration > 0 {
+			alerter.DedupWindow = config.Alerts.DedupWindow.Duration
+		}
+		alerter.Watch(state)
+	}
+
 	go announceMembers(list, state)
-	go state.BroadcastServices(serviceFunc, servicesLooper)
-	go state.BroadcastTombstones(serviceFunc, tombstoneLooper)
-	go state.TrackNewServices(serviceFunc, trackingLooper)
-	go monitor.Watch(disco, healthWatchLooper)
-	go monitor.Run(healthLooper)
 
-	if !config.HAproxy.Disable {
+	err = runLocalServices(&config, state, monitor, serviceFunc, localLoopers{
+		Services:    servicesLooper,
+		Tombstones:  tombstoneLooper,
+		Tracking:    trackingLooper,
+		Discovery:   discoLooper,
+		HealthWatch: healthWatchLooper,
+		Health:      healthLooper,
+	})
+	exitWithError(err, "Can't configure discovery")
+
+	if proxy != nil {
 		proxy.WriteAndReload(state)
 	}
 
-	serveHttp(list, state)
+	configureSignalHandler(opts, state, &config, func() {
+		drainServices(state, list, delegate, proxy, servicesLooper, tombstoneLooper, trackingLooper)
+	})
+
+	serveHttp(apiListener, list, state, registry, proxies, func() bool {
+		return isReady(delegate, proxy)
+	}, pauser, live, config)
 
 	select {}
 }
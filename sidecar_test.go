@@ -0,0 +1,306 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/newrelic/sidecar/haproxy"
+	"github.com/newrelic/sidecar/healthy"
+	"github.com/newrelic/sidecar/service"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_memberlistConfig(t *testing.T) {
+	Convey("memberlistConfig()", t, func() {
+		Convey("Defaults to a LAN config", func() {
+			config, err := memberlistConfig("")
+
+			So(err, ShouldBeNil)
+			So(config.Name, ShouldNotBeEmpty)
+			So(config.ProbeTimeout, ShouldEqual, 500*time.Millisecond)
+		})
+
+		Convey("Uses WAN timings in wan mode", func() {
+			config, err := memberlistConfig("wan")
+
+			So(err, ShouldBeNil)
+			So(config.ProbeTimeout, ShouldEqual, 3*time.Second)
+		})
+
+		Convey("Uses local timings in local mode", func() {
+			config, err := memberlistConfig("local")
+
+			So(err, ShouldBeNil)
+			So(config.ProbeTimeout, ShouldEqual, 200*time.Millisecond)
+		})
+
+		Convey("Returns an error for an unknown mode", func() {
+			_, err := memberlistConfig("interplanetary")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_makeKeyring(t *testing.T) {
+	Convey("makeKeyring()", t, func() {
+		primary := "MDEyMzQ1Njc4OWFiY2RlZg=="           // 0123456789abcdef
+		secondary := "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4" // fedcba9876543210fedcba98
+
+		Convey("Uses the first key as the primary", func() {
+			keyring, err := makeKeyring([]string{primary, secondary})
+
+			So(err, ShouldBeNil)
+			So(string(keyring.GetPrimaryKey()), ShouldEqual, "0123456789abcdef")
+			So(len(keyring.GetKeys()), ShouldEqual, 2)
+		})
+
+		Convey("Returns an error when a key isn't base64", func() {
+			_, err := makeKeyring([]string{primary, "not a key!"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Returns an error when a key is the wrong length", func() {
+			_, err := makeKeyring([]string{"c2hvcnQ="})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_pushPullInterval(t *testing.T) {
+	Convey("pushPullInterval()", t, func() {
+		config := Config{}
+		setDefaults(&config)
+
+		Convey("Defaults to just under the alive lifespan", func() {
+			config.Sidecar.AliveLifespan.Duration = 3 * time.Minute
+			So(pushPullInterval(&config), ShouldEqual, 3*time.Minute-time.Second)
+		})
+
+		Convey("Uses the configured interval", func() {
+			config.Sidecar.PushPullInterval.Duration = 20 * time.Second
+			So(pushPullInterval(&config), ShouldEqual, 20*time.Second)
+		})
+
+		Convey("Keeps the configured interval even when it's too long", func() {
+			config.Sidecar.PushPullInterval.Duration = 2 * time.Minute
+			So(pushPullInterval(&config), ShouldEqual, 2*time.Minute)
+		})
+	})
+}
+
+func Test_setGossipPorts(t *testing.T) {
+	Convey("setGossipPorts()", t, func() {
+		config := Config{}
+		setDefaults(&config)
+		mlConfig, _ := memberlistConfig("lan")
+
+		Convey("Keeps the memberlist defaults when unset", func() {
+			So(setGossipPorts(mlConfig, &config), ShouldBeNil)
+			So(mlConfig.BindPort, ShouldEqual, 7946)
+			So(mlConfig.AdvertisePort, ShouldEqual, 7946)
+		})
+
+		Convey("Binds to and advertises the gossip port", func() {
+			config.Sidecar.GossipPort = 8000
+			So(setGossipPorts(mlConfig, &config), ShouldBeNil)
+			So(mlConfig.BindPort, ShouldEqual, 8000)
+			So(mlConfig.AdvertisePort, ShouldEqual, 8000)
+		})
+
+		Convey("Can bind to a different port than it advertises", func() {
+			config.Sidecar.GossipPort = 8000
+			config.Sidecar.GossipBindPort = 7946
+			So(setGossipPorts(mlConfig, &config), ShouldBeNil)
+			So(mlConfig.BindPort, ShouldEqual, 7946)
+			So(mlConfig.AdvertisePort, ShouldEqual, 8000)
+		})
+
+		Convey("Rejects ports out of range", func() {
+			config.Sidecar.GossipPort = 70000
+			So(setGossipPorts(mlConfig, &config), ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_setGossipAddrs(t *testing.T) {
+	Convey("setGossipAddrs()", t, func() {
+		config := Config{}
+		setDefaults(&config)
+		mlConfig, _ := memberlistConfig("lan")
+
+		Convey("Advertises the published IP and keeps the default bind", func() {
+			So(setGossipAddrs(mlConfig, &config, "10.0.0.5"), ShouldBeNil)
+			So(mlConfig.AdvertiseAddr, ShouldEqual, "10.0.0.5")
+			So(mlConfig.BindAddr, ShouldEqual, "0.0.0.0")
+		})
+
+		Convey("Can bind to a different address than it advertises", func() {
+			config.Sidecar.BindIP = "192.168.1.10"
+			So(setGossipAddrs(mlConfig, &config, "203.0.113.7"), ShouldBeNil)
+			So(mlConfig.AdvertiseAddr, ShouldEqual, "203.0.113.7")
+			So(mlConfig.BindAddr, ShouldEqual, "192.168.1.10")
+		})
+
+		Convey("Takes IPv6 with or without brackets", func() {
+			config.Sidecar.BindIP = "[::]"
+			So(setGossipAddrs(mlConfig, &config, "fc00::1"), ShouldBeNil)
+			So(mlConfig.BindAddr, ShouldEqual, "::")
+		})
+
+		Convey("Rejects anything that isn't an IP", func() {
+			config.Sidecar.BindIP = "eth0"
+			So(setGossipAddrs(mlConfig, &config, "10.0.0.5"), ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_runLocalServices(t *testing.T) {
+	Convey("runLocalServices()", t, func() {
+		config := Config{}
+		setDefaults(&config)
+		config.Sidecar.Discovery = []string{}
+
+		state := catalog.NewServicesState()
+		state.Hostname = "indomitable"
+		monitor := healthy.NewMonitor("127.0.0.1", "/")
+
+		services := func() []service.Service {
+			return []service.Service{{ID: "deadbeef123", Name: "web", Hostname: "indomitable"}}
+		}
+		loopers := localLoopers{
+			Services:    director.NewFreeLooper(director.ONCE, nil),
+			Tombstones:  director.NewFreeLooper(director.ONCE, nil),
+			Tracking:    director.NewFreeLooper(director.ONCE, nil),
+			Discovery:   director.NewFreeLooper(director.ONCE, nil),
+			HealthWatch: director.NewFreeLooper(director.ONCE, nil),
+			Health:      director.NewFreeLooper(director.ONCE, nil),
+		}
+
+		Convey("Broadcasts our services", func() {
+			So(runLocalServices(&config, state, monitor, services, loopers), ShouldBeNil)
+
+			// The tombstones loop sends an empty one when it has nothing, and
+			// the services go out after the first retransmit interval
+			var broadcast [][]byte
+			timeout := time.After(catalog.TOMBSTONE_RETRANSMIT + time.Second)
+			for len(broadcast) == 0 {
+				select {
+				case broadcast = <-state.Broadcasts:
+				case <-timeout:
+					So("no broadcast", ShouldBeNil)
+					return
+				}
+			}
+			So(string(broadcast[0]), ShouldContainSubstring, "deadbeef123")
+		})
+
+		Convey("Never broadcasts anything as an observer", func() {
+			config.Sidecar.Mode = MODE_OBSERVER
+			// Would fail if we tried to discover anything
+			config.Sidecar.Discovery = []string{"docker"}
+			config.DockerDiscovery.CertFile = "/nonexistent/cert.pem"
+
+			So(runLocalServices(&config, state, monitor, services, loopers), ShouldBeNil)
+
+			select {
+			case <-state.Broadcasts:
+				So("a broadcast", ShouldBeNil)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	})
+}
+
+func Test_taggedServices(t *testing.T) {
+	Convey("taggedServices()", t, func() {
+		services := func() []service.Service {
+			return []service.Service{
+				{ID: "deadbeef123"},
+				{ID: "deadbeef101", Tags: map[string]string{"region": "eu-west"}},
+			}
+		}
+
+		Convey("Adds the node's tags to every service", func() {
+			result := taggedServices(services, map[string]string{"region": "us-east"})()
+
+			So(result[0].Tags["region"], ShouldEqual, "us-east")
+			So(result[1].Tags["region"], ShouldEqual, "eu-west")
+		})
+
+		Convey("Leaves services alone without node tags", func() {
+			result := taggedServices(services, nil)()
+			So(result[0].Tags, ShouldBeNil)
+		})
+	})
+}
+
+func Test_environmentServices(t *testing.T) {
+	Convey("environmentServices()", t, func() {
+		services := func() []service.Service {
+			return []service.Service{
+				{ID: "deadbeef123"},
+				{ID: "deadbeef101", Metadata: map[string]string{service.ENVIRONMENT_METADATA: "prod"}},
+			}
+		}
+
+		Convey("Puts every service in the node's environment", func() {
+			result := environmentServices(services, "staging")()
+
+			So(result[0].Environment(), ShouldEqual, "staging")
+			So(result[1].Environment(), ShouldEqual, "prod")
+		})
+
+		Convey("Leaves services alone without an environment", func() {
+			result := environmentServices(services, "")()
+			So(result[0].Metadata, ShouldBeNil)
+		})
+	})
+}
+
+func Test_isReady(t *testing.T) {
+	Convey("isReady()", t, func() {
+		delegate := NewServicesDelegate(catalog.NewServicesState())
+		synced := catalog.NewServicesState().Encode()
+
+		Convey("Isn't ready before the cluster syncs", func() {
+			So(isReady(delegate, nil), ShouldBeFalse)
+		})
+
+		Convey("Is ready after the cluster syncs with no proxy", func() {
+			delegate.MergeRemoteState(synced, true)
+			So(isReady(delegate, nil), ShouldBeTrue)
+		})
+
+		Convey("Waits for HAproxy to load a config", func() {
+			delegate.MergeRemoteState(synced, true)
+			proxy := haproxy.New("/tmp/haproxy.cfg", "/tmp/haproxy.pid")
+			So(isReady(delegate, proxy), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_looperJitter(t *testing.T) {
+	Convey("looperJitter()", t, func() {
+		config := Config{}
+		setDefaults(&config)
+
+		Convey("Defaults to 10%", func() {
+			So(looperJitter(&config), ShouldEqual, 0.1)
+		})
+
+		Convey("Can be turned off", func() {
+			config.Sidecar.LooperJitter = 0
+			So(looperJitter(&config), ShouldEqual, 0)
+		})
+
+		Convey("Clamps values that are out of range", func() {
+			config.Sidecar.LooperJitter = -0.1
+			So(looperJitter(&config), ShouldEqual, 0)
+
+			config.Sidecar.LooperJitter = 2
+			So(looperJitter(&config), ShouldEqual, MAX_LOOPER_JITTER)
+		})
+	})
+}
@@ -0,0 +1,284 @@
+// Package tracing records spans around Sidecar's main cycles and exports
+// them to an OpenTelemetry collector over OTLP/HTTP, using the JSON
+// encoding so that we don't need the whole OpenTelemetry SDK.
+//
+// Until an exporter is enabled, Start returns nil and all the Span methods
+// do nothing, so the tracing calls cost next to nothing when it's off.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	EXPORT_INTERVAL = 5 * time.Second // How often we send spans to the collector
+	EXPORT_BATCH    = 512             // Most spans we send in one request
+	QUEUE_LENGTH    = 2048            // Spans waiting to be sent before we start dropping them
+	CLIENT_TIMEOUT  = 5 * time.Second
+	SPAN_KIND       = 1 // SPAN_KIND_INTERNAL
+	STATUS_ERROR    = 2 // STATUS_CODE_ERROR
+)
+
+var (
+	exporter     *Exporter
+	exporterLock sync.RWMutex
+)
+
+// Enable sends all new spans to this exporter. Passing nil turns tracing
+// back off.
+func Enable(e *Exporter) {
+	exporterLock.Lock()
+	exporter = e
+	exporterLock.Unlock()
+}
+
+type Span struct {
+	Name       string
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+	exporter   *Exporter
+}
+
+// Start a new span. Returns nil when tracing is off.
+func Start(name string) *Span {
+	exporterLock.RLock()
+	e := exporter
+	exporterLock.RUnlock()
+
+	if e == nil {
+		return nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+		exporter:   e,
+	}
+	rand.Read(span.TraceID[:])
+	rand.Read(span.SpanID[:])
+
+	return span
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// Mark the span as failed. Nil errors are ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// Finish the span and queue it for export
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.exporter.enqueue(s)
+}
+
+// An Exporter batches up spans and sends them to an OTLP/HTTP endpoint
+type Exporter struct {
+	Endpoint string            // Where to POST the spans, e.g. http://localhost:4318/v1/traces
+	Resource map[string]string // Describes this Sidecar, e.g. service.name and host.name
+	Interval time.Duration     // How often to send spans
+	Client   *http.Client
+	spans    chan *Span
+}
+
+// NewExporter sends to the collector at this address. The "/v1/traces" path
+// is added when it's not already there.
+func NewExporter(endpoint string, resource map[string]string) *Exporter {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = endpoint + "/v1/traces"
+	}
+
+	return &Exporter{
+		Endpoint: endpoint,
+		Resource: resource,
+		Interval: EXPORT_INTERVAL,
+		Client:   &http.Client{Timeout: CLIENT_TIMEOUT},
+		spans:    make(chan *Span, QUEUE_LENGTH),
+	}
+}
+
+// Never block the caller. If the collector can't keep up, we'd rather lose
+// spans than slow down discovery or reloads.
+func (e *Exporter) enqueue(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		log.Debugf("Tracing queue is full, dropping span %s", span.Name)
+	}
+}
+
+// Run sends the queued spans every Interval, or sooner when a batch fills
+// up. It doesn't return.
+func (e *Exporter) Run() {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, EXPORT_BATCH)
+
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) < EXPORT_BATCH {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := e.export(batch); err != nil {
+			log.Warnf("Unable to export %d spans: %s", len(batch), err)
+		}
+		batch = make([]*Span, 0, EXPORT_BATCH)
+	}
+}
+
+func (e *Exporter) export(spans []*Span) error {
+	data, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Bad status code from collector (%d)", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// The OTLP JSON encoding of a batch of spans. IDs are hex, and 64 bit
+// integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *Exporter) encode(spans []*Span) *otlpRequest {
+	var resourceSpans otlpResourceSpans
+	for key, value := range e.Resource {
+		resourceSpans.Resource.Attributes = append(resourceSpans.Resource.Attributes, attribute(key, value))
+	}
+
+	var scopeSpans otlpScopeSpans
+	scopeSpans.Scope.Name = "sidecar"
+
+	for _, span := range spans {
+		encoded := otlpSpan{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			Name:              span.Name,
+			Kind:              SPAN_KIND,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+
+		for key, value := range span.Attributes {
+			encoded.Attributes = append(encoded.Attributes, attribute(key, value))
+		}
+
+		if span.Error != "" {
+			encoded.Status = &otlpStatus{Code: STATUS_ERROR, Message: span.Error}
+		}
+
+		scopeSpans.Spans = append(scopeSpans.Spans, encoded)
+	}
+
+	resourceSpans.ScopeSpans = []otlpScopeSpans{scopeSpans}
+
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	var encoded map[string]interface{}
+
+	switch v := value.(type) {
+	case string:
+		encoded = map[string]interface{}{"stringValue": v}
+	case bool:
+		encoded = map[string]interface{}{"boolValue": v}
+	case int:
+		encoded = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		encoded = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		encoded = map[string]interface{}{"doubleValue": v}
+	case time.Duration:
+		// Milliseconds are easier to read in most tracing UIs
+		encoded = map[string]interface{}{"doubleValue": float64(v) / float64(time.Millisecond)}
+	default:
+		encoded = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+
+	return otlpAttribute{Key: key, Value: encoded}
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Tracing(t *testing.T) {
+	Convey("When tracing is off", t, func() {
+		Enable(nil)
+
+		Convey("Start() returns nil", func() {
+			So(Start("something"), ShouldBeNil)
+		})
+
+		Convey("Spans can still be used", func() {
+			span := Start("something")
+
+			So(func() {
+				span.SetAttribute("services", 3)
+				span.SetError(errors.New("Oh no!"))
+				span.Finish()
+			}, ShouldNotPanic)
+		})
+	})
+
+	Convey("When tracing is on", t, func() {
+		received := make(chan []byte, 10)
+		var path, contentType string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			contentType = r.Header.Get("Content-Type")
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- body
+		}))
+		defer server.Close()
+
+		exporter := NewExporter(server.URL, map[string]string{"service.name": "sidecar"})
+		Enable(exporter)
+		defer Enable(nil)
+
+		Convey("NewExporter() adds the traces path", func() {
+			So(exporter.Endpoint, ShouldEqual, server.URL+"/v1/traces")
+			So(NewExporter(server.URL+"/v1/traces/", nil).Endpoint, ShouldEqual, server.URL+"/v1/traces")
+		})
+
+		Convey("Start() returns a span with IDs", func() {
+			span := Start("discovery.poll")
+
+			So(span, ShouldNotBeNil)
+			So(span.TraceID, ShouldNotResemble, [16]byte{})
+			So(span.SpanID, ShouldNotResemble, [8]byte{})
+			So(Start("discovery.poll").TraceID, ShouldNotResemble, span.TraceID)
+		})
+
+		Convey("Finish() queues the span", func() {
+			span := Start("discovery.poll")
+			span.Finish()
+
+			So(len(exporter.spans), ShouldEqual, 1)
+			So(span.End.Before(span.Start), ShouldBeFalse)
+		})
+
+		Convey("Finish() drops spans when the queue is full", func() {
+			for i := 0; i < QUEUE_LENGTH+10; i++ {
+				Start("discovery.poll").Finish()
+			}
+
+			So(len(exporter.spans), ShouldEqual, QUEUE_LENGTH)
+		})
+
+		Convey("export() sends the spans in the OTLP JSON encoding", func() {
+			span := Start("haproxy.reload")
+			span.SetAttribute("skipped", false)
+			span.SetAttribute("servers", 3)
+			span.SetAttribute("reload.duration_ms", 1500*time.Microsecond)
+			span.SetError(errors.New("Oh no!"))
+			span.Start = time.Unix(0, 1000)
+			span.End = time.Unix(0, 2000)
+
+			So(exporter.export([]*Span{span}), ShouldBeNil)
+
+			var request map[string]interface{}
+			json.Unmarshal(<-received, &request)
+
+			So(path, ShouldEqual, "/v1/traces")
+			So(contentType, ShouldEqual, "application/json")
+
+			resourceSpans := request["resourceSpans"].([]interface{})[0].(map[string]interface{})
+			resource := resourceSpans["resource"].(map[string]interface{})
+			So(resource["attributes"], ShouldResemble, []interface{}{
+				map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "sidecar"}},
+			})
+
+			scopeSpans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})
+			encoded := scopeSpans["spans"].([]interface{})[0].(map[string]interface{})
+
+			So(encoded["name"], ShouldEqual, "haproxy.reload")
+			So(len(encoded["traceId"].(string)), ShouldEqual, 32)
+			So(len(encoded["spanId"].(string)), ShouldEqual, 16)
+			So(encoded["startTimeUnixNano"], ShouldEqual, "1000")
+			So(encoded["endTimeUnixNano"], ShouldEqual, "2000")
+			So(encoded["status"], ShouldResemble, map[string]interface{}{"code": 2.0, "message": "Oh no!"})
+
+			attributes := make(map[string]interface{})
+			for _, attr := range encoded["attributes"].([]interface{}) {
+				attr := attr.(map[string]interface{})
+				attributes[attr["key"].(string)] = attr["value"]
+			}
+			So(attributes, ShouldResemble, map[string]interface{}{
+				"skipped":            map[string]interface{}{"boolValue": false},
+				"servers":            map[string]interface{}{"intValue": "3"},
+				"reload.duration_ms": map[string]interface{}{"doubleValue": 1.5},
+			})
+		})
+
+		Convey("export() returns an error on a bad status code", func() {
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(500)
+			}))
+			defer failing.Close()
+
+			exporter.Endpoint = failing.URL
+			So(exporter.export([]*Span{Start("discovery.poll")}), ShouldNotBeNil)
+		})
+
+		Convey("Run() sends the queued spans", func() {
+			exporter.Interval = 10 * time.Millisecond
+			go exporter.Run()
+
+			Start("health.checks").Finish()
+
+			select {
+			case body := <-received:
+				So(string(body), ShouldContainSubstring, `"name":"health.checks"`)
+			case <-time.After(time.Second):
+				So("no spans were sent", ShouldBeEmpty)
+			}
+		})
+	})
+}
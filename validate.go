@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/newrelic/sidecar/discovery"
+)
+
+// Run by --validate: check the config file, the proxy setup, and that we
+// can reach each discovery backend, then report. Nothing is written or
+// reloaded, and we don't join the cluster. Returns the exit code.
+func validate(configFile string, strictEnv bool, out io.Writer) int {
+	failed := 0
+	report := func(check string, err error) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL  %s: %s\n", check, err.Error())
+			return
+		}
+		fmt.Fprintf(out, "OK    %s\n", check)
+	}
+
+	config, err := loadConfig(configFile, strictEnv)
+	report("config "+configFile, err)
+	if err != nil {
+		// Nothing else makes sense without a config
+		return 1
+	}
+
+	mlConfig, err := memberlistConfig(config.Sidecar.NetworkMode)
+	report("network mode", err)
+	if err == nil {
+		report("gossip ports", setGossipPorts(mlConfig, &config))
+	}
+
+	if len(config.Sidecar.EncryptionKey) > 0 {
+		_, err = makeKeyring(config.Sidecar.EncryptionKey)
+		report("encryption keys", err)
+	}
+
+	_, err = configureProxy(config)
+	report("proxy "+config.Sidecar.ProxyBackend, err)
+
+	disco, err := configureDiscovery(&config)
+	if err != nil {
+		report("discovery", err)
+	} else {
+		validateDiscovery(config.Sidecar.Discovery, disco, report)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(out, "%d check(s) failed\n", failed)
+		return 1
+	}
+
+	return 0
+}
+
+// Unknown discovery methods are skipped at startup, but we call them out
+// here since they're almost always a typo
+func validateDiscovery(methods []string, disco *discovery.MultiDiscovery, report func(string, error)) {
+	discoverers := make(map[string]discovery.Discoverer, len(disco.Discoverers))
+	for _, d := range disco.Discoverers {
+		discoverers[discovery.Name(d)] = d
+	}
+
+	for _, method := range methods {
+		d, ok := discoverers[method]
+		if !ok {
+			report("discovery "+method, fmt.Errorf("Unknown discovery method"))
+			continue
+		}
+
+		if validator, ok := d.(discovery.Validator); ok {
+			report("discovery "+method, validator.Validate())
+		} else {
+			report("discovery "+method, nil)
+		}
+	}
+}
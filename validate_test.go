@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_validate(t *testing.T) {
+	Convey("validate()", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "sidecar-validate")
+		defer os.RemoveAll(tmpDir)
+
+		staticFile := filepath.Join(tmpDir, "static.json")
+		ioutil.WriteFile(staticFile, []byte(`[{"Service": {"Name": "web", "Ports": [{"Type": "tcp", "Port": 8080}]}}]`), 0644)
+
+		configFile := filepath.Join(tmpDir, "sidecar.toml")
+		writeConfig := func(config string) {
+			ioutil.WriteFile(configFile, []byte(config), 0644)
+		}
+
+		var out bytes.Buffer
+
+		Convey("Passes a good config", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "envoy"
+
+[static_discovery]
+config_file = "` + staticFile + `"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 0)
+			So(out.String(), ShouldContainSubstring, "OK    config")
+			So(out.String(), ShouldContainSubstring, "OK    proxy envoy")
+			So(out.String(), ShouldContainSubstring, "OK    discovery static")
+		})
+
+		Convey("Fails when the config file is missing", func() {
+			So(validate(filepath.Join(tmpDir, "missing.toml"), false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "FAIL  config")
+		})
+
+		Convey("Fails on a bad regexp", func() {
+			writeConfig(`
+[services]
+name_match = "^(broken"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "name_match")
+		})
+
+		Convey("Fails on an unknown mode", func() {
+			writeConfig(`
+[sidecar]
+mode = "follower"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "Unknown mode 'follower'")
+		})
+
+		Convey("Fails on an unknown HAproxy balance", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "haproxy"
+
+[static_discovery]
+config_file = "` + staticFile + `"
+
+[haproxy]
+balance = "fastest"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "FAIL  proxy haproxy: Invalid HAproxy balance 'fastest'")
+		})
+
+		Convey("Fails on a HAproxy socket reload without a stats socket", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "haproxy"
+
+[static_discovery]
+config_file = "` + staticFile + `"
+
+[haproxy]
+socket_reload = true
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "socket_reload needs the stats_socket")
+		})
+
+		Convey("Fails on a HAproxy canary header without a value", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "haproxy"
+
+[static_discovery]
+config_file = "` + staticFile + `"
+
+[haproxy]
+canary_header = "X-Canary"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "canary_header needs a canary_value")
+		})
+
+		Convey("Fails on a HAproxy bind address that isn't an IP", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "haproxy"
+
+[static_discovery]
+config_file = "` + staticFile + `"
+
+[haproxy.bind_addresses]
+internal = "eth1"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "Invalid HAproxy bind address 'eth1'")
+		})
+
+		Convey("Fails on a HAproxy nameserver without a port", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "haproxy"
+
+[static_discovery]
+config_file = "` + staticFile + `"
+
+[haproxy.resolvers]
+nameservers = ["10.0.0.2"]
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "Invalid HAproxy nameserver '10.0.0.2'")
+		})
+
+		Convey("Fails on a HAproxy hostname pattern that doesn't render", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "haproxy"
+
+[static_discovery]
+config_file = "` + staticFile + `"
+
+[haproxy.resolvers]
+nameservers = ["10.0.0.2:53"]
+hostname_pattern = "{{ .Host }}.node.consul"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "Invalid HAproxy template")
+		})
+
+		Convey("Fails on a gossip port out of range", func() {
+			writeConfig(`
+[sidecar]
+discovery = ["static"]
+proxy_backend = "envoy"
+gossip_port = 79460
+
+[static_discovery]
+config_file = "` + staticFile + `"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "FAIL  gossip ports: Invalid gossip port 79460")
+		})
+
+		Convey("Reports every failed check", func() {
+			templateFile := filepath.Join(tmpDir, "haproxy.cfg")
+			ioutil.WriteFile(templateFile, []byte(`{{ .NoSuchField }}`), 0644)
+
+			writeConfig(`
+[sidecar]
+discovery = ["static", "dokcer"]
+proxy_backend = "haproxy"
+network_mode = "interplanetary"
+
+[static_discovery]
+config_file = "` + filepath.Join(tmpDir, "missing.json") + `"
+
+[haproxy]
+template_file = "` + templateFile + `"
+`)
+
+			So(validate(configFile, false, &out), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, "FAIL  network mode")
+			So(out.String(), ShouldContainSubstring, "FAIL  proxy haproxy: Invalid HAproxy template")
+			So(out.String(), ShouldContainSubstring, "FAIL  discovery static")
+			So(out.String(), ShouldContainSubstring, "FAIL  discovery dokcer: Unknown discovery method")
+			So(out.String(), ShouldContainSubstring, "4 check(s) failed")
+		})
+	})
+}
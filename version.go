@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/newrelic/sidecar/catalog"
+	"github.com/nitro/memberlist"
+)
+
+// Set at build time with -ldflags "-X main.Version=1.2.3 -X main.GitCommit=abc1234"
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+)
+
+// When we started, set in main()
+var startTime = time.Now()
+
+// What /version returns. Keep it small, fleet audits scrape it.
+type versionInfo struct {
+	Version       string
+	GitCommit     string
+	GoVersion     string
+	UptimeSeconds int64
+	Paused        bool
+}
+
+// Which build this is, and how long it's been running, so hosts left on an
+// old binary stand out during a rollout
+func versionHandler(started time.Time, paused func() bool) func(http.ResponseWriter, *http.Request, *memberlist.Memberlist, *catalog.ServicesState) {
+	return func(response http.ResponseWriter, req *http.Request, list *memberlist.Memberlist, state *catalog.ServicesState) {
+		defer req.Body.Close()
+
+		response.Header().Set("Content-Type", "application/json")
+		jsonStr, _ := json.Marshal(versionInfo{
+			Version:       Version,
+			GitCommit:     GitCommit,
+			GoVersion:     runtime.Version(),
+			UptimeSeconds: int64(time.Since(started) / time.Second),
+			Paused:        paused(),
+		})
+		response.Write(jsonStr)
+	}
+}